@@ -0,0 +1,207 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package dotprompt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Part type discriminators used in the canonical representation.
+const (
+	PartTypeText         = "text"
+	PartTypeData         = "data"
+	PartTypeMedia        = "media"
+	PartTypeToolRequest  = "toolRequest"
+	PartTypeToolResponse = "toolResponse"
+	PartTypePending      = "pending"
+)
+
+// CanonicalPrompt is the provider-agnostic representation of a rendered
+// prompt. Adapters for specific model providers can be built on top of it
+// without depending on the concrete Part types.
+//
+// The JSON shape is:
+//
+//	{
+//	  "name": "...",
+//	  "model": "...",
+//	  "config": {...},
+//	  "tools": [{"name": "...", "inputSchema": {...}}],
+//	  "output": {"format": "...", "schema": {...}},
+//	  "metadata": {...},
+//	  "messages": [
+//	    {
+//	      "role": "user",
+//	      "content": [
+//	        {"type": "text", "text": "..."},
+//	        {"type": "media", "media": {"url": "...", "contentType": "..."}}
+//	      ],
+//	      "metadata": {...}
+//	    }
+//	  ]
+//	}
+//
+// Empty fields are omitted, except for "messages", "role", "content", and the
+// part "type".
+type CanonicalPrompt struct {
+	Name     string                `json:"name,omitempty"`
+	Model    string                `json:"model,omitempty"`
+	Config   ModelConfig           `json:"config,omitempty"`
+	Tools    []ToolDefinition      `json:"tools,omitempty"`
+	Output   *PromptMetadataOutput `json:"output,omitempty"`
+	Metadata Metadata              `json:"metadata,omitempty"`
+	Messages []CanonicalMessage    `json:"messages"`
+}
+
+// CanonicalMessage is the provider-agnostic representation of a Message.
+type CanonicalMessage struct {
+	Role     Role            `json:"role"`
+	Content  []CanonicalPart `json:"content"`
+	Metadata Metadata        `json:"metadata,omitempty"`
+}
+
+// CanonicalPart is the provider-agnostic representation of a Part. Type is one
+// of the PartType constants and determines which of the other fields is set.
+type CanonicalPart struct {
+	Type         string         `json:"type"`
+	Text         string         `json:"text,omitempty"`
+	Data         map[string]any `json:"data,omitempty"`
+	Media        *Media         `json:"media,omitempty"`
+	ToolRequest  map[string]any `json:"toolRequest,omitempty"`
+	ToolResponse map[string]any `json:"toolResponse,omitempty"`
+	Metadata     Metadata       `json:"metadata,omitempty"`
+}
+
+// PartType returns the type discriminator for a part, or an error if the part
+// is not one of the types defined in this package.
+func PartType(part Part) (string, error) {
+	switch part.(type) {
+	case *TextPart:
+		return PartTypeText, nil
+	case *DataPart:
+		return PartTypeData, nil
+	case *MediaPart:
+		return PartTypeMedia, nil
+	case *ToolRequestPart:
+		return PartTypeToolRequest, nil
+	case *ToolResponsePart:
+		return PartTypeToolResponse, nil
+	case *PendingPart:
+		return PartTypePending, nil
+	default:
+		return "", fmt.Errorf("dotprompt: unsupported part type %T", part)
+	}
+}
+
+// ToCanonicalPart converts a part to its canonical representation.
+func ToCanonicalPart(part Part) (CanonicalPart, error) {
+	partType, err := PartType(part)
+	if err != nil {
+		return CanonicalPart{}, err
+	}
+	out := CanonicalPart{Type: partType, Metadata: part.GetMetadata()}
+	switch p := part.(type) {
+	case *TextPart:
+		out.Text = p.Text
+	case *DataPart:
+		out.Data = p.Data
+	case *MediaPart:
+		media := p.Media
+		out.Media = &media
+	case *ToolRequestPart:
+		out.ToolRequest = p.ToolRequest
+	case *ToolResponsePart:
+		out.ToolResponse = p.ToolResponse
+	}
+	return out, nil
+}
+
+// ToCanonicalMessage converts a message to its canonical representation.
+func ToCanonicalMessage(message Message) (CanonicalMessage, error) {
+	content := make([]CanonicalPart, 0, len(message.Content))
+	for _, part := range message.Content {
+		canonicalPart, err := ToCanonicalPart(part)
+		if err != nil {
+			return CanonicalMessage{}, err
+		}
+		content = append(content, canonicalPart)
+	}
+	return CanonicalMessage{
+		Role:     message.Role,
+		Content:  content,
+		Metadata: message.Metadata,
+	}, nil
+}
+
+// ToCanonical converts the rendered prompt to its canonical representation.
+func (r *RenderedPrompt) ToCanonical() (CanonicalPrompt, error) {
+	messages := make([]CanonicalMessage, 0, len(r.Messages))
+	for _, message := range r.Messages {
+		canonicalMessage, err := ToCanonicalMessage(message)
+		if err != nil {
+			return CanonicalPrompt{}, err
+		}
+		messages = append(messages, canonicalMessage)
+	}
+
+	out := CanonicalPrompt{
+		Name:     r.Name,
+		Model:    r.Model,
+		Config:   r.Config,
+		Tools:    r.ToolDefs,
+		Metadata: r.Metadata,
+		Messages: messages,
+	}
+	if r.Output.Format != "" || r.Output.Schema != nil {
+		output := r.Output
+		out.Output = &output
+	}
+	return out, nil
+}
+
+// ToCanonicalJSON marshals the canonical representation of the rendered prompt
+// to JSON. See CanonicalPrompt for the shape of the output.
+func (r *RenderedPrompt) ToCanonicalJSON() ([]byte, error) {
+	canonical, err := r.ToCanonical()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(canonical)
+}
+
+// WriteSSE writes each message of the rendered prompt to w as a Server-Sent
+// Events frame of the form "event: message\ndata: {json}\n\n", where the data
+// is the canonical JSON representation of the message. It is intended for
+// streaming prompt assembly into debugging tools.
+func (r *RenderedPrompt) WriteSSE(w io.Writer) error {
+	for _, message := range r.Messages {
+		canonical, err := ToCanonicalMessage(message)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(canonical)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: message\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
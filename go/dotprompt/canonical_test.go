@@ -0,0 +1,113 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package dotprompt
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToCanonicalJSON(t *testing.T) {
+	dp := NewDotprompt(nil)
+	rendered, err := dp.Render(`---
+name: describe
+model: test/model
+config:
+  temperature: 0.5
+output:
+  format: text
+---
+{{role "system"}}Describe images.
+{{role "user"}}What is this? {{media url="https://example.com/cat.png" contentType="image/png"}}
+{{section "code"}}`, &DataArgument{}, nil)
+	assert.NoError(t, err)
+
+	out, err := rendered.ToCanonicalJSON()
+	assert.NoError(t, err)
+
+	var decoded map[string]any
+	assert.NoError(t, json.Unmarshal(out, &decoded))
+
+	assert.Equal(t, "describe", decoded["name"])
+	assert.Equal(t, "test/model", decoded["model"])
+	assert.Equal(t, map[string]any{"temperature": 0.5}, decoded["config"])
+	assert.Equal(t, map[string]any{"format": "text"}, decoded["output"])
+
+	messages := decoded["messages"].([]any)
+	assert.Len(t, messages, 2)
+
+	system := messages[0].(map[string]any)
+	assert.Equal(t, "system", system["role"])
+	assert.Equal(t, []any{map[string]any{"type": "text", "text": "Describe images.\n"}}, system["content"])
+
+	user := messages[1].(map[string]any)
+	assert.Equal(t, "user", user["role"])
+	assert.Equal(t, []any{
+		map[string]any{"type": "text", "text": "What is this? "},
+		map[string]any{"type": "media", "media": map[string]any{"url": "https://example.com/cat.png", "contentType": "image/png"}},
+		map[string]any{"type": "pending", "metadata": map[string]any{"pending": true, "purpose": "code"}},
+	}, user["content"])
+}
+
+// unknownPart is a Part not defined by this package.
+type unknownPart struct {
+	HasMetadata
+}
+
+func TestToCanonicalUnsupportedPart(t *testing.T) {
+	rendered := RenderedPrompt{
+		Messages: []Message{{Role: RoleUser, Content: []Part{&unknownPart{}}}},
+	}
+	_, err := rendered.ToCanonicalJSON()
+	assert.Error(t, err)
+}
+
+func TestWriteSSE(t *testing.T) {
+	rendered := RenderedPrompt{
+		Messages: []Message{
+			{Role: RoleSystem, Content: []Part{&TextPart{Text: "Be brief."}}},
+			{Role: RoleUser, Content: []Part{&TextPart{Text: "Hi"}}},
+		},
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, rendered.WriteSSE(&buf))
+
+	frames := strings.Split(strings.TrimSuffix(buf.String(), "\n\n"), "\n\n")
+	assert.Len(t, frames, 2)
+	for i, frame := range frames {
+		event, data, ok := strings.Cut(frame, "\n")
+		assert.True(t, ok)
+		assert.Equal(t, "event: message", event)
+		assert.True(t, strings.HasPrefix(data, "data: "))
+
+		var message CanonicalMessage
+		assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(data, "data: ")), &message))
+		assert.Equal(t, rendered.Messages[i].Role, message.Role)
+	}
+	assert.Equal(t, "event: message\ndata: {\"role\":\"user\",\"content\":[{\"type\":\"text\",\"text\":\"Hi\"}]}", frames[1])
+
+	t.Run("unsupported parts", func(t *testing.T) {
+		rendered := RenderedPrompt{
+			Messages: []Message{{Role: RoleUser, Content: []Part{&unknownPart{}}}},
+		}
+		assert.Error(t, rendered.WriteSSE(&bytes.Buffer{}))
+	})
+}
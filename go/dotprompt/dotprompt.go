@@ -19,9 +19,13 @@ package dotprompt
 import (
 	"errors"
 	"fmt"
+	"math/rand"
 	"reflect"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"maps"
 
@@ -32,6 +36,9 @@ import (
 // PartialResolver is a function to resolve partial names to their content.
 type PartialResolver func(partialName string) (string, error)
 
+// WarningHandler receives warnings about conditions that don't fail a render.
+type WarningHandler func(message string)
+
 // DotpromptOptions defines the options for the Dotprompt instance.
 type DotpromptOptions struct {
 	DefaultModel    string
@@ -43,23 +50,218 @@ type DotpromptOptions struct {
 	Schemas         map[string]*jsonschema.Schema
 	SchemaResolver  SchemaResolver
 	PartialResolver PartialResolver
+	// DescriptionAsSystem prepends a system message containing the prompt's
+	// description when the rendered messages have no system message.
+	DescriptionAsSystem bool
+	// StrictFrontmatter causes Parse to return an error for invalid
+	// frontmatter instead of treating the whole source as the template.
+	StrictFrontmatter bool
+	// FrontmatterDecoder decodes frontmatter in place of the default YAML
+	// decoder, e.g. to support another format or reject unknown fields.
+	FrontmatterDecoder FrontmatterDecoder
+	// DocumentSchema, if set, is the JSON schema each of DataArgument.Docs
+	// must match in its JSON form, e.g. {"metadata": {...}, "content": [...]}.
+	// Rendering fails for the first document that doesn't match. See
+	// ValidateJSONSchema for the supported keywords.
+	DocumentSchema *jsonschema.Schema
+	// AllowAdditionalProperties leaves Picoschema objects open to undeclared
+	// properties. Objects are closed by default; set this to keep the
+	// previous behavior. See PicoschemaOptions.AllowAdditionalProperties.
+	AllowAdditionalProperties bool
+	// TemplateEngine parses and executes templates. Defaults to RaymondEngine.
+	TemplateEngine TemplateEngine
+	// CanonicalizeMetadata converts all message metadata into a canonical
+	// form (string-keyed maps all the way down) so that rendered prompts
+	// serialize deterministically, e.g. for snapshot tests.
+	CanonicalizeMetadata bool
+	// CanonicalizePartMetadata converts the metadata of every part, such as
+	// media parts, into the same canonical form as CanonicalizeMetadata.
+	CanonicalizePartMetadata bool
+	// AllowedMediaHosts restricts the hosts that media URLs may reference.
+	// Data URIs are always allowed and relative URLs are rejected once the list
+	// is set. See ToMessagesOptions.AllowedMediaHosts for the matching rules.
+	AllowedMediaHosts []string
+	// HistoryAnnotator adds metadata to each history message when it is
+	// inserted into the rendered messages.
+	HistoryAnnotator HistoryAnnotator
+	// SectionResolver is invoked during rendering for each pending section
+	// part and the part is replaced by the parts it returns.
+	SectionResolver SectionResolver
+	// CollapseBlankLines reduces runs of blank lines in the rendered template
+	// to a single blank line, outside of fenced code blocks. This tidies the
+	// gaps left behind by conditional sections.
+	CollapseBlankLines bool
+	// TrimMessageWhitespace trims leading and trailing whitespace, including
+	// newlines, from the text at the start and end of each rendered message,
+	// so the line break after a role marker is not part of the message.
+	// Whitespace within a message is preserved.
+	TrimMessageWhitespace bool
+	// MarkerDelimiters replace the `<<<` and `>>>` delimiters of the markers
+	// emitted by the role, history, section, and media helpers and parsed from
+	// the rendered template. See ToMessagesOptions.MarkerDelimiters.
+	MarkerDelimiters MarkerDelimiters
+	// Delimiters replace the Handlebars `{{` and `}}` delimiters in templates
+	// and partials, e.g. with `[[` and `]]`, so that literal double braces in
+	// a template are rendered as written. Both must be set; the default
+	// delimiters are used otherwise.
+	Delimiters Delimiters
+	// RandSource is the source of randomness for the `randomItem` helper.
+	// Defaults to a time-seeded source; set a fixed seed for reproducible
+	// renders in tests.
+	RandSource rand.Source
+	// SchemaIdentifier, if set, gives the resolved input and output schemas of
+	// named prompts an `$id` and title, e.g. with DefaultSchemaIdentifier.
+	SchemaIdentifier SchemaIdentifier
+	// CacheSchemas caches the schemas resolved by name for the lifetime of the
+	// instance, so that the SchemaResolver is called once per name rather than
+	// on every render. DefineSchema evicts the schema it redefines; call
+	// ClearSchemaCache when the schemas behind the resolver change.
+	CacheSchemas bool
+	// OutputFormats registers custom output formats in addition to "json",
+	// "text", "enum", "array", and "media", with validators for their output
+	// schemas.
+	// Rendering fails for any other format. See DefineOutputFormat.
+	OutputFormats map[string]OutputFormatValidator
+	// DefaultMetadata is merged beneath the frontmatter of every prompt, so
+	// prompts inherit e.g. a shared model and config unless they set their
+	// own. Fields set in the frontmatter replace the default's wholesale, as
+	// with other metadata merges.
+	DefaultMetadata *PromptMetadata
+	// MaxTemplateBytes is the maximum size in bytes of a prompt source
+	// accepted by Parse, Compile, and Render. Zero means unlimited.
+	MaxTemplateBytes int
+	// MaxRenderedBytes is the maximum size in bytes of the rendered template,
+	// e.g. after partials and loops are expanded. Zero means unlimited.
+	MaxRenderedBytes int
+	// DropEmptyMedia drops media markers without a URL instead of failing the
+	// render. See ToMessagesOptions.DropEmptyMedia.
+	DropEmptyMedia bool
+	// RoleAliases maps alternative role names, such as "assistant", to the
+	// canonical role they are normalized to. A nil map uses
+	// DefaultRoleAliases and an empty map disables normalization.
+	RoleAliases map[string]Role
+	// StripTrailingWhitespace removes trailing spaces and tabs from each line
+	// of the rendered template. Leading indentation is preserved.
+	StripTrailingWhitespace bool
+	// LenientPartials renders partials that cannot be resolved as empty,
+	// reporting a warning to the WarningHandler, instead of failing.
+	LenientPartials bool
+	// StrictNames causes registering a helper and a partial with the same
+	// name to fail instead of reporting a warning.
+	StrictNames bool
+	// WarningHandler, if set, receives warnings such as names registered as
+	// both a helper and a partial, partials that LenientPartials renders as
+	// empty, or invalid frontmatter ignored outside of StrictFrontmatter.
+	// Warnings are discarded otherwise.
+	WarningHandler WarningHandler
+	// ModelCapabilities describes the capabilities of models by name, for use
+	// by capability-aware helpers such as `ifMultimodal`.
+	ModelCapabilities map[string]ModelCapabilities
+	// EmptyHistoryFallback is inserted as a user message in place of a
+	// history marker when there is no history. See
+	// ToMessagesOptions.EmptyHistoryFallback.
+	EmptyHistoryFallback string
+	// StrictRoles causes rendering to fail when a role marker uses a role
+	// outside AllowedRoles. See ToMessagesOptions.StrictRoles.
+	StrictRoles bool
+	// AllowedRoles are the roles that role markers may use. See
+	// ToMessagesOptions.AllowedRoles.
+	AllowedRoles []Role
+	// InferMediaContentType fills in missing media content types from the URL's
+	// file extension. See ToMessagesOptions.InferMediaContentType.
+	InferMediaContentType bool
+	// StrictHelpers causes built-in helpers to fail the render when they
+	// can't produce their output, e.g. when `json` is given a value that
+	// can't be serialized, instead of rendering an empty string.
+	StrictHelpers bool
+	// HistoryPlacement is where history is inserted when the template doesn't
+	// use the {{history}} helper. See ToMessagesOptions.HistoryPlacement.
+	HistoryPlacement HistoryPlacement
+	// DeduplicateHistory drops repeated history messages. See
+	// ToMessagesOptions.DeduplicateHistory.
+	DeduplicateHistory bool
+	// SplitMediaToMessages moves media parts into messages of their own. See
+	// ToMessagesOptions.SplitMediaToMessages.
+	SplitMediaToMessages bool
+	// MergePartialMetadata parses frontmatter at the start of partials and
+	// merges it into the metadata of prompts that include the partials,
+	// directly or through other partials, e.g. so that a partial can declare
+	// the tools or output schema its template relies on. Without it, a
+	// partial's frontmatter is rendered as part of its template.
+	//
+	// The prompt's own frontmatter takes precedence: partials only fill in
+	// fields and config, input default, and extension keys that it leaves
+	// unset, and add to its tools. Two partials setting the same field or key
+	// to different values is an error. The name, variant, version, and
+	// examples of partials are ignored.
+	MergePartialMetadata bool
+}
+
+// ModelCapabilities describes what a model supports.
+type ModelCapabilities struct {
+	// Multimodal reports whether the model accepts media such as images.
+	Multimodal bool
 }
 
+// SectionResolver resolves the pending section with the given purpose into the
+// parts that replace it. Returning nil parts and a nil error leaves the
+// section pending.
+type SectionResolver func(purpose string, data *DataArgument) ([]Part, error)
+
 // Dotprompt is the main struct for the Dotprompt instance.
 type Dotprompt struct {
-	knownHelpers          map[string]bool
-	defaultModel          string
-	modelConfigs          map[string]any
-	tools                 map[string]ToolDefinition
-	toolResolver          ToolResolver
-	schemaResolver        SchemaResolver
-	partialResolver       PartialResolver
-	knownPartials         map[string]bool
-	Template              *raymond.Template
-	Helpers               map[string]any
-	Partials              map[string]string
-	Schemas               map[string]*jsonschema.Schema
-	ExternalSchemaLookups []func(string) any
+	knownHelpers              map[string]bool
+	defaultModel              string
+	modelConfigs              map[string]any
+	tools                     map[string]ToolDefinition
+	toolResolver              ToolResolver
+	schemaResolver            SchemaResolver
+	partialResolver           PartialResolver
+	descriptionAsSystem       bool
+	strictFrontmatter         bool
+	frontmatterDecoder        FrontmatterDecoder
+	documentSchema            *jsonschema.Schema
+	allowAdditionalProperties bool
+	engine                    TemplateEngine
+	canonicalizeMetadata      bool
+	canonicalizePartMetadata  bool
+	allowedMediaHosts         []string
+	historyAnnotator          HistoryAnnotator
+	sectionResolver           SectionResolver
+	collapseBlankLines        bool
+	trimMessageWhitespace     bool
+	delimiters                Delimiters
+	markerDelimiters          MarkerDelimiters
+	defaultMetadata           *PromptMetadata
+	schemaIdentifier          SchemaIdentifier
+	schemaCache               *SchemaCache
+	outputFormats             map[string]OutputFormatValidator
+	maxTemplateBytes          int
+	maxRenderedBytes          int
+	dropEmptyMedia            bool
+	roleAliases               map[string]Role
+	stripTrailingWhitespace   bool
+	strictNames               bool
+	warningHandler            WarningHandler
+	lenientPartials           bool
+	modelCapabilities         map[string]ModelCapabilities
+	emptyHistoryFallback      string
+	strictRoles               bool
+	allowedRoles              []Role
+	inferMediaContentType     bool
+	strictHelpers             bool
+	historyPlacement          HistoryPlacement
+	deduplicateHistory        bool
+	mergePartialMetadata      bool
+	splitMediaToMessages      bool
+	rand                      *rand.Rand
+	randMu                    sync.Mutex
+	knownPartials             map[string]bool
+	Template                  *raymond.Template
+	Helpers                   map[string]any
+	Partials                  map[string]string
+	Schemas                   map[string]*jsonschema.Schema
+	ExternalSchemaLookups     []func(string) any
 }
 
 // NewDotprompt creates a new Dotprompt instance with the given options.
@@ -81,6 +283,48 @@ func NewDotprompt(options *DotpromptOptions) *Dotprompt {
 		dp.partialResolver = options.PartialResolver
 		dp.Helpers = options.Helpers
 		dp.Partials = options.Partials
+		dp.descriptionAsSystem = options.DescriptionAsSystem
+		dp.strictFrontmatter = options.StrictFrontmatter
+		dp.frontmatterDecoder = options.FrontmatterDecoder
+		dp.documentSchema = options.DocumentSchema
+		dp.allowAdditionalProperties = options.AllowAdditionalProperties
+		dp.engine = options.TemplateEngine
+		dp.canonicalizeMetadata = options.CanonicalizeMetadata
+		dp.canonicalizePartMetadata = options.CanonicalizePartMetadata
+		dp.allowedMediaHosts = options.AllowedMediaHosts
+		dp.historyAnnotator = options.HistoryAnnotator
+		dp.sectionResolver = options.SectionResolver
+		dp.collapseBlankLines = options.CollapseBlankLines
+		dp.trimMessageWhitespace = options.TrimMessageWhitespace
+		dp.delimiters = options.Delimiters
+		dp.markerDelimiters = options.MarkerDelimiters
+		dp.defaultMetadata = options.DefaultMetadata
+		dp.schemaIdentifier = options.SchemaIdentifier
+		dp.outputFormats = maps.Clone(options.OutputFormats)
+		if options.CacheSchemas {
+			dp.schemaCache = NewSchemaCache()
+		}
+		dp.maxTemplateBytes = options.MaxTemplateBytes
+		dp.maxRenderedBytes = options.MaxRenderedBytes
+		dp.dropEmptyMedia = options.DropEmptyMedia
+		dp.roleAliases = options.RoleAliases
+		dp.stripTrailingWhitespace = options.StripTrailingWhitespace
+		dp.strictNames = options.StrictNames
+		dp.warningHandler = options.WarningHandler
+		dp.lenientPartials = options.LenientPartials
+		dp.modelCapabilities = options.ModelCapabilities
+		dp.emptyHistoryFallback = options.EmptyHistoryFallback
+		dp.strictRoles = options.StrictRoles
+		dp.allowedRoles = options.AllowedRoles
+		dp.inferMediaContentType = options.InferMediaContentType
+		dp.strictHelpers = options.StrictHelpers
+		dp.historyPlacement = options.HistoryPlacement
+		dp.deduplicateHistory = options.DeduplicateHistory
+		dp.mergePartialMetadata = options.MergePartialMetadata
+		dp.splitMediaToMessages = options.SplitMediaToMessages
+		if options.RandSource != nil {
+			dp.rand = rand.New(options.RandSource)
+		}
 
 		if dp.tools == nil {
 			dp.tools = make(map[string]ToolDefinition)
@@ -105,15 +349,31 @@ func NewDotprompt(options *DotpromptOptions) *Dotprompt {
 		dp.Partials = make(map[string]string)
 		dp.modelConfigs = make(map[string]any)
 	}
+	if dp.engine == nil {
+		dp.engine = RaymondEngine{}
+	}
+	if dp.rand == nil {
+		dp.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
 
 	return dp
 }
 
 // DefineHelper registers a helper function.
 func (dp *Dotprompt) DefineHelper(name string, helper any, tpl *raymond.Template) error {
+	return dp.defineHelper(name, helper, tpl)
+}
+
+// defineHelper registers a helper function on a template of the engine.
+func (dp *Dotprompt) defineHelper(name string, helper any, tpl Template) error {
 	if dp.knownHelpers[name] {
 		return fmt.Errorf("the helper is already registered: %s", name)
 	}
+	if dp.knownPartials[name] {
+		if err := dp.reportNameCollision(name); err != nil {
+			return err
+		}
+	}
 	tpl.RegisterHelper(name, helper)
 	dp.knownHelpers[name] = true
 	return nil
@@ -121,26 +381,71 @@ func (dp *Dotprompt) DefineHelper(name string, helper any, tpl *raymond.Template
 
 // DefinePartial registers a partial template.
 func (dp *Dotprompt) DefinePartial(name string, source string, tpl *raymond.Template) error {
+	return dp.definePartial(name, source, tpl)
+}
+
+// definePartial registers a partial template on a template of the engine.
+func (dp *Dotprompt) definePartial(name string, source string, tpl Template) error {
 	if dp.knownPartials[name] {
 		return fmt.Errorf("the partial is already registered: %s", name)
 	}
+	if dp.knownHelpers[name] {
+		if err := dp.reportNameCollision(name); err != nil {
+			return err
+		}
+	}
 	tpl.RegisterPartial(name, source)
 	dp.knownPartials[name] = true
 	return nil
 }
 
+// reportNameCollision reports a name registered as both a helper and a
+// partial, returning an error if StrictNames is set and otherwise reporting a
+// warning.
+func (dp *Dotprompt) reportNameCollision(name string) error {
+	if dp.strictNames {
+		return fmt.Errorf("dotprompt: '%s' is registered as both a helper and a partial", name)
+	}
+	dp.warn("dotprompt: '%s' is registered as both a helper and a partial", name)
+	return nil
+}
+
+// warn formats a warning and passes it to the WarningHandler, if any.
+func (dp *Dotprompt) warn(format string, args ...any) {
+	if dp.warningHandler != nil {
+		dp.warningHandler(fmt.Sprintf(format, args...))
+	}
+}
+
 // TODO: Add register helpers
 func (dp *Dotprompt) RegisterHelpers(tpl *raymond.Template) error {
+	return dp.registerHelpers(tpl)
+}
+
+// registerHelpers registers the instance's helpers and the built-in helpers
+// on a template of the engine.
+func (dp *Dotprompt) registerHelpers(tpl Template) error {
 	if dp.Helpers != nil {
 		for key, helper := range dp.Helpers {
-			if err := dp.DefineHelper(key, helper, tpl); err != nil {
+			if err := dp.defineHelper(key, helper, tpl); err != nil {
 				return err
 			}
 		}
 	}
+	instanceHelpers := dp.instanceHelpers()
 	for name, helper := range templateHelpers {
+		if _, ok := instanceHelpers[name]; ok {
+			continue
+		}
 		if !dp.knownHelpers[name] {
-			if err := dp.DefineHelper(name, helper, tpl); err != nil {
+			if err := dp.defineHelper(name, helper, tpl); err != nil {
+				return err
+			}
+		}
+	}
+	for name, helper := range instanceHelpers {
+		if !dp.knownHelpers[name] {
+			if err := dp.defineHelper(name, helper, tpl); err != nil {
 				return err
 			}
 		}
@@ -148,10 +453,76 @@ func (dp *Dotprompt) RegisterHelpers(tpl *raymond.Template) error {
 	return nil
 }
 
+// instanceHelpers returns the built-in helpers that depend on the instance's
+// options, so can't live in templateHelpers. They take precedence over
+// templateHelpers of the same name.
+func (dp *Dotprompt) instanceHelpers() map[string]any {
+	helpers := map[string]any{
+		"randomItem":   dp.randomItem,
+		"ifMultimodal": dp.ifMultimodal,
+	}
+	if dp.strictHelpers {
+		helpers["json"] = strictJSON
+		helpers["jsonBlock"] = strictJSONBlock
+	}
+	if markers := markerSyntaxFor(dp.markerDelimiters); markers != defaultMarkerSyntax {
+		helpers["role"] = func(role string, options *raymond.Options) raymond.SafeString {
+			return raymond.SafeString(markers.marker(string(roleHelper(role, options))))
+		}
+		helpers["history"] = func() raymond.SafeString {
+			return raymond.SafeString(markers.marker(string(History())))
+		}
+		helpers["section"] = func(name string) raymond.SafeString {
+			return raymond.SafeString(markers.marker(string(Section(name))))
+		}
+		helpers["media"] = func(options *raymond.Options) raymond.SafeString {
+			return raymond.SafeString(markers.marker(string(MediaFn(options))))
+		}
+	}
+	return helpers
+}
+
+// ifMultimodal renders its block if the model of the prompt being rendered is
+// multimodal according to DotpromptOptions.ModelCapabilities, and its inverse
+// otherwise. Unknown models are treated as text-only.
+func (dp *Dotprompt) ifMultimodal(options *raymond.Options) string {
+	metadata, _ := options.Data("metadata").(map[string]any)
+	prompt, _ := metadata["prompt"].(PromptMetadata)
+	if dp.modelCapabilities[prompt.Model].Multimodal {
+		return options.Fn()
+	}
+	return options.Inverse()
+}
+
+// randomItem returns a random element of a slice or array using the
+// instance's random source.
+func (dp *Dotprompt) randomItem(items any) any {
+	dp.randMu.Lock()
+	defer dp.randMu.Unlock()
+	return RandomItem(items, dp.rand)
+}
+
 func (dp *Dotprompt) RegisterPartials(tpl *raymond.Template, template string) error {
+	return dp.registerPartials(tpl, template, nil)
+}
+
+// registerPartials registers the partials in the set, the instance's partials
+// that are not in the set, and any further partials the template needs from
+// the partial resolver.
+func (dp *Dotprompt) registerPartials(tpl Template, template string, set *PartialSet) error {
+	if err := dp.registerPartialSet(set, tpl); err != nil {
+		return err
+	}
 	if dp.Partials != nil {
 		for key, partial := range dp.Partials {
-			if err := dp.DefinePartial(key, partial, tpl); err != nil {
+			if set != nil && dp.knownPartials[key] {
+				continue
+			}
+			partial, _, err := dp.splitPartial(partial)
+			if err != nil {
+				return fmt.Errorf("dotprompt: failed to parse partial '%s': %w", key, err)
+			}
+			if err := dp.definePartial(key, partial, tpl); err != nil {
 				return err
 			}
 		}
@@ -162,8 +533,10 @@ func (dp *Dotprompt) RegisterPartials(tpl *raymond.Template, template string) er
 	return nil
 }
 
-func (dp *Dotprompt) initializeTemplate(tpl *raymond.Template) {
-	dp.Template = tpl
+// initializeTemplate resets the registered helpers and partials for a newly
+// parsed template. Template is only set for templates of the raymond engine.
+func (dp *Dotprompt) initializeTemplate(tpl Template) {
+	dp.Template, _ = tpl.(*raymond.Template)
 	dp.knownHelpers = make(map[string]bool)
 	dp.knownPartials = make(map[string]bool)
 }
@@ -176,71 +549,264 @@ func (dp *Dotprompt) DefineTool(def ToolDefinition) *Dotprompt {
 
 // Parse parses the source string into a ParsedPrompt.
 func (dp *Dotprompt) Parse(source string) (ParsedPrompt, error) {
-	return ParseDocument(source)
+	return ParseDocumentWithOptions(source, dp.parseOptions())
+}
+
+// parseOptions returns the ParseOptions configured for the instance.
+func (dp *Dotprompt) parseOptions() *ParseOptions {
+	return &ParseOptions{
+		Strict:             dp.strictFrontmatter,
+		MaxBytes:           dp.maxTemplateBytes,
+		FrontmatterDecoder: dp.frontmatterDecoder,
+		WarningHandler:     dp.warningHandler,
+	}
+}
+
+// toMessagesOptions returns the ToMessagesOptions configured for the instance.
+func (dp *Dotprompt) toMessagesOptions() *ToMessagesOptions {
+	return &ToMessagesOptions{
+		AllowedMediaHosts:     dp.allowedMediaHosts,
+		HistoryAnnotator:      dp.historyAnnotator,
+		DropEmptyMedia:        dp.dropEmptyMedia,
+		RoleAliases:           dp.roleAliases,
+		EmptyHistoryFallback:  dp.emptyHistoryFallback,
+		StrictRoles:           dp.strictRoles,
+		AllowedRoles:          dp.allowedRoles,
+		InferMediaContentType: dp.inferMediaContentType,
+		HistoryPlacement:      dp.historyPlacement,
+		DeduplicateHistory:    dp.deduplicateHistory,
+		SplitMediaToMessages:  dp.splitMediaToMessages,
+		MarkerDelimiters:      dp.markerDelimiters,
+	}
 }
 
 // Render renders the source string with the given data and options.
 func (dp *Dotprompt) Render(source string, data *DataArgument, options *PromptMetadata) (RenderedPrompt, error) {
-	renderer, err := dp.Compile(source, options)
+	return dp.RenderWithPartialSet(source, nil, data, options)
+}
+
+// RenderWithPartialSet renders the source string like Render, using the
+// partials in the set in preference to resolving them again.
+func (dp *Dotprompt) RenderWithPartialSet(source string, partials *PartialSet, data *DataArgument, options *PromptMetadata) (RenderedPrompt, error) {
+	renderer, err := dp.CompileWithPartialSet(source, partials, options)
+	if err != nil {
+		return RenderedPrompt{}, err
+	}
+	return renderer(data, options)
+}
+
+// RenderParsed renders an already parsed prompt, such as one returned by
+// FSPromptStore.LoadParsed, without parsing its source again.
+func (dp *Dotprompt) RenderParsed(parsedPrompt ParsedPrompt, data *DataArgument, options *PromptMetadata) (RenderedPrompt, error) {
+	renderer, err := dp.CompileParsed(parsedPrompt, options)
 	if err != nil {
 		return RenderedPrompt{}, err
 	}
 	return renderer(data, options)
 }
 
+// RenderExamples renders the source string once against each of the example
+// inputs declared in its frontmatter.
+func (dp *Dotprompt) RenderExamples(source string) ([]RenderedPrompt, error) {
+	parsedPrompt, err := dp.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	renderer, err := dp.Compile(source, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]RenderedPrompt, 0, len(parsedPrompt.Examples))
+	for i, example := range parsedPrompt.Examples {
+		rendered, err := renderer(&DataArgument{Input: example}, nil)
+		if err != nil {
+			return nil, fmt.Errorf("dotprompt: failed to render example %d: %w", i, err)
+		}
+		results = append(results, rendered)
+	}
+	return results, nil
+}
+
+// RenderSection renders the full prompt like Render but returns only the
+// messages and content belonging to the named section.
+//
+// A section begins immediately after a `{{section "name"}}` marker and extends
+// up to, but not including, the next section marker or the end of the
+// message, so role and history boundaries also end a section. The marker
+// itself is not included. If the section appears in more than one place, the
+// content of each occurrence is returned in order, in its own message, and
+// messages with no content in the section are dropped. Markers replaced by a
+// SectionResolver no longer delimit sections.
+//
+// An error is returned if the rendered prompt contains no such section.
+func (dp *Dotprompt) RenderSection(source, sectionName string, data *DataArgument, options *PromptMetadata) (RenderedPrompt, error) {
+	rendered, err := dp.Render(source, data, options)
+	if err != nil {
+		return RenderedPrompt{}, err
+	}
+	messages, found := extractSection(rendered.Messages, sectionName)
+	if !found {
+		return RenderedPrompt{}, fmt.Errorf("dotprompt: section '%s' not found", sectionName)
+	}
+	rendered.Messages = messages
+	return rendered, nil
+}
+
+// extractSection returns the messages with their content limited to the parts
+// belonging to the named section, reporting whether the section was found.
+func extractSection(messages []Message, sectionName string) ([]Message, bool) {
+	out := []Message{}
+	found := false
+	for _, msg := range messages {
+		var content []Part
+		inSection := false
+		for _, part := range msg.Content {
+			if pending, ok := part.(*PendingPart); ok && pending.Metadata["purpose"] != nil {
+				inSection = pending.Metadata["purpose"] == sectionName
+				found = found || inSection
+				continue
+			}
+			if inSection {
+				content = append(content, part)
+			}
+		}
+		if len(content) > 0 {
+			msg.Content = content
+			out = append(out, msg)
+		}
+	}
+	return out, found
+}
+
 // Compile compiles the source string into a PromptFunction.
 func (dp *Dotprompt) Compile(source string, additionalMetadata *PromptMetadata) (PromptFunction, error) {
+	return dp.CompileWithPartialSet(source, nil, additionalMetadata)
+}
+
+// CompileWithPartialSet compiles the source string like Compile, registering
+// the partials in the set instead of resolving and parsing them again. The
+// partial resolver is only consulted for partials that are not in the set.
+func (dp *Dotprompt) CompileWithPartialSet(source string, partials *PartialSet, additionalMetadata *PromptMetadata) (PromptFunction, error) {
 	parsedPrompt, err := dp.Parse(source)
 	if err != nil {
 		return nil, err
 	}
+	return dp.compileParsed(parsedPrompt, partials, additionalMetadata)
+}
+
+// CompileParsed compiles an already parsed prompt into a PromptFunction like
+// Compile, without parsing its source again.
+func (dp *Dotprompt) CompileParsed(parsedPrompt ParsedPrompt, additionalMetadata *PromptMetadata) (PromptFunction, error) {
+	return dp.compileParsed(parsedPrompt, nil, additionalMetadata)
+}
+
+// compileParsed compiles a parsed prompt, registering the partials in the set
+// if one is given.
+func (dp *Dotprompt) compileParsed(parsedPrompt ParsedPrompt, partials *PartialSet, additionalMetadata *PromptMetadata) (PromptFunction, error) {
+	var err error
+	if parsedPrompt.Template, err = dp.translateTemplate(parsedPrompt.Template); err != nil {
+		return nil, err
+	}
 	if additionalMetadata != nil {
 		parsedPrompt = mergeMetadata(parsedPrompt, additionalMetadata)
 	}
+	if parsedPrompt, err = dp.withPartialMetadata(parsedPrompt, partials); err != nil {
+		return nil, err
+	}
 
-	renderTpl, err := raymond.Parse(parsedPrompt.Template)
+	renderTpl, err := dp.engine.Parse(parsedPrompt.Template)
 	if err != nil {
 		return nil, err
 	}
 	dp.initializeTemplate(renderTpl)
 
-	// RegisterHelpers()
-	if err = dp.RegisterHelpers(dp.Template); err != nil {
+	if err = dp.registerHelpers(renderTpl); err != nil {
 		return nil, err
 	}
-	if err = dp.RegisterPartials(dp.Template, parsedPrompt.Template); err != nil {
+	if err = dp.registerPartials(renderTpl, parsedPrompt.Template, partials); err != nil {
 		return nil, err
 	}
 
 	renderFunc := func(data *DataArgument, options *PromptMetadata) (RenderedPrompt, error) {
-		mergedMetadata, err := dp.RenderMetadata(parsedPrompt, options)
+		if dp.documentSchema != nil {
+			for i, doc := range data.Docs {
+				if err := ValidateJSONSchema(doc, dp.documentSchema); err != nil {
+					return RenderedPrompt{}, fmt.Errorf("dotprompt: document %d does not match the document schema: %w", i, err)
+				}
+			}
+		}
+
+		mergedMetadata, err := dp.renderMetadata(parsedPrompt, options)
 		if err != nil {
 			return RenderedPrompt{}, err
 		}
 
+		// Defaults declared in the input schema are overridden by the
+		// prompt's input defaults, which are overridden by the input.
 		var inputContext map[string]any
 		defaultInput := make(map[string]any)
+		maps.Copy(defaultInput, schemaDefaults(mergedMetadata.Input.Schema))
 		if mergedMetadata.Input.Default != nil {
 			maps.Copy(defaultInput, mergedMetadata.Input.Default)
 		}
 		inputContext = MergeMaps(defaultInput, data.Input)
-		privDF := raymond.NewDataFrame()
-		for k, v := range data.Context {
-			privDF.Set(k, v)
-		}
 
-		renderedString, err := dp.Template.ExecWith(inputContext, privDF, &raymond.ExecOptions{
-			NoEscape: true,
-		})
+		// As in the JS implementation, the prompt's metadata is exposed as
+		// `@metadata` alongside the context, which may override it.
+		promptMetadata := mergedMetadata
+		promptMetadata.Input = PromptMetadataInput{}
+		privateData := map[string]any{
+			"metadata": map[string]any{
+				"prompt":   promptMetadata,
+				"docs":     data.Docs,
+				"messages": data.Messages,
+			},
+		}
+		maps.Copy(privateData, data.Context)
 
+		renderedString, err := dp.engine.Execute(renderTpl, inputContext, privateData)
 		if err != nil {
 			return RenderedPrompt{}, err
 		}
+		if dp.maxRenderedBytes > 0 && len(renderedString) > dp.maxRenderedBytes {
+			return RenderedPrompt{}, fmt.Errorf(
+				"dotprompt: rendered template is %d bytes, exceeding the limit of %d bytes",
+				len(renderedString), dp.maxRenderedBytes)
+		}
+		if dp.stripTrailingWhitespace {
+			renderedString = stripTrailingWhitespace(renderedString)
+		}
+		if dp.collapseBlankLines {
+			renderedString = collapseBlankLines(renderedString)
+		}
 
-		messages, err := ToMessages(renderedString, data)
+		messages, err := ToMessagesWithOptions(renderedString, data, dp.toMessagesOptions())
 		if err != nil {
 			return RenderedPrompt{}, err
 		}
+		if dp.sectionResolver != nil {
+			messages, err = resolveSections(messages, data, dp.sectionResolver)
+			if err != nil {
+				return RenderedPrompt{}, err
+			}
+		}
+		if dp.trimMessageWhitespace {
+			messages = trimMessageWhitespace(messages)
+		}
+		if dp.descriptionAsSystem {
+			messages = prependDescriptionAsSystem(messages, mergedMetadata.Description)
+		}
+		if dp.canonicalizeMetadata {
+			for i := range messages {
+				messages[i].Metadata = canonicalizeMetadata(messages[i].Metadata)
+			}
+		}
+		if dp.canonicalizePartMetadata {
+			for i := range messages {
+				messages[i].Content = canonicalizePartsMetadata(messages[i].Content)
+			}
+		}
 		return RenderedPrompt{
 			PromptMetadata: mergedMetadata,
 			Messages:       messages,
@@ -250,6 +816,81 @@ func (dp *Dotprompt) Compile(source string, additionalMetadata *PromptMetadata)
 	return renderFunc, nil
 }
 
+// schemaDefaults returns the defaults declared for the top-level properties of
+// a resolved object schema, e.g. with a Picoschema `default=` annotation.
+func schemaDefaults(schema Schema) map[string]any {
+	s, ok := schema.(*jsonschema.Schema)
+	if !ok || s.Properties == nil {
+		return nil
+	}
+	defaults := make(map[string]any)
+	for pair := s.Properties.Oldest(); pair != nil; pair = pair.Next() {
+		if pair.Value.Default != nil {
+			defaults[pair.Key] = pair.Value.Default
+		}
+	}
+	return defaults
+}
+
+// resolveSections replaces each pending section part with the parts returned
+// by the resolver, leaving it pending if the resolver returns no parts.
+func resolveSections(messages []Message, data *DataArgument, resolver SectionResolver) ([]Message, error) {
+	for i, msg := range messages {
+		var content []Part
+		changed := false
+		for _, part := range msg.Content {
+			pending, ok := part.(*PendingPart)
+			if !ok || !pending.IsPending() {
+				content = append(content, part)
+				continue
+			}
+			purpose := stringOrEmpty(pending.Metadata["purpose"])
+			parts, err := resolver(purpose, data)
+			if err != nil {
+				return nil, fmt.Errorf("dotprompt: failed to resolve section '%s': %w", purpose, err)
+			}
+			if parts == nil {
+				content = append(content, part)
+				continue
+			}
+			content = append(content, parts...)
+			changed = true
+		}
+		if changed {
+			messages[i].Content = content
+		}
+	}
+	return messages, nil
+}
+
+// prependDescriptionAsSystem prepends a system message containing the
+// description unless it is empty or a system message is already present.
+func prependDescriptionAsSystem(messages []Message, description string) []Message {
+	if strings.TrimSpace(description) == "" {
+		return messages
+	}
+	for _, msg := range messages {
+		if msg.Role == RoleSystem {
+			return messages
+		}
+	}
+	system := Message{
+		Role:    RoleSystem,
+		Content: []Part{&TextPart{Text: description}},
+	}
+	return append([]Message{system}, messages...)
+}
+
+// translateTemplate rewrites a template or partial written with the configured
+// Delimiters into Handlebars syntax. Templates are returned unchanged when the
+// default delimiters are used.
+func (dp *Dotprompt) translateTemplate(template string) (string, error) {
+	if !dp.delimiters.isCustom() {
+		return template, nil
+	}
+	return translateDelimiters(template, dp.delimiters)
+}
+
 // IdentifyPartials identifies partials in the template.
 func (d *Dotprompt) identifyPartials(template string) []string {
 	// Simplified partial identification logic
@@ -262,29 +903,67 @@ func (d *Dotprompt) identifyPartials(template string) []string {
 
 		for _, match := range matches {
 			if len(match) > 1 {
-				partialName := strings.TrimSpace(match[1])
-				partials = append(partials, partialName)
+				// Only the first field is the name; the rest are arguments.
+				fields := strings.Fields(match[1])
+				if len(fields) > 0 {
+					partials = append(partials, fields[0])
+				}
 			}
 		}
 	}
 	return partials
 }
 
-// resolvePartials resolves and registers partials in the template.
-func (dp *Dotprompt) resolvePartials(template string, tpl *raymond.Template) error {
-	if dp.partialResolver == nil {
+// ExtractPartialNames returns the de-duplicated names of the partials directly
+// referenced by the source's template via `{{> name}}`, in order of first
+// appearance. The partials are not resolved.
+func (dp *Dotprompt) ExtractPartialNames(source string) ([]string, error) {
+	parsedPrompt, err := dp.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	template, err := dp.translateTemplate(parsedPrompt.Template)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, name := range dp.identifyPartials(template) {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// resolvePartials resolves and registers partials in the template. With
+// LenientPartials, partials that cannot be resolved are registered as empty.
+func (dp *Dotprompt) resolvePartials(template string, tpl Template) error {
+	if dp.partialResolver == nil && !dp.lenientPartials {
 		return nil
 	}
 
 	partials := dp.identifyPartials(template)
 	for _, partial := range partials {
 		if _, exists := dp.knownPartials[partial]; !exists {
-			content, err := dp.partialResolver(partial)
-			if err != nil {
+			var content string
+			var err error
+			if dp.lenientPartials {
+				if content, err = dp.lookupPartial(partial); err != nil {
+					dp.warn("dotprompt: partial '%s' could not be resolved and renders as empty: %v", partial, err)
+					if err := dp.definePartial(partial, "", tpl); err != nil {
+						return err
+					}
+					continue
+				}
+			} else if content, err = dp.partialResolver(partial); err != nil {
 				return err
 			}
 			if content != "" {
-				if err = dp.DefinePartial(partial, content, tpl); err != nil {
+				content, _, err = dp.splitPartial(content)
+				if err != nil {
+					return fmt.Errorf("dotprompt: failed to parse partial '%s': %w", partial, err)
+				}
+				if err = dp.definePartial(partial, content, tpl); err != nil {
 					return err
 				}
 				err = dp.resolvePartials(content, tpl)
@@ -310,7 +989,13 @@ func mergeMetadata(parsedPrompt ParsedPrompt, additionalMetadata *PromptMetadata
 	return parsedPrompt
 }
 
-// RenderMetadata renders the metadata for the prompt.
+// RenderMetadata renders the metadata for the prompt: the frontmatter merged
+// with the default metadata, model config, and additionalMetadata, with schema
+// references and Picoschema resolved. The source may be a string or a
+// ParsedPrompt. The template is never executed and no messages are built, so
+// this is much cheaper than Render for callers that only need the metadata,
+// and the result is identical to the PromptMetadata of the RenderedPrompt that
+// Render returns for the same source and options.
 func (dp *Dotprompt) RenderMetadata(source any, additionalMetadata *PromptMetadata) (PromptMetadata, error) {
 	var parsedSource ParsedPrompt
 	var err error
@@ -325,7 +1010,18 @@ func (dp *Dotprompt) RenderMetadata(source any, additionalMetadata *PromptMetada
 	default:
 		return PromptMetadata{}, errors.New("invalid source type")
 	}
+	if parsedSource.Template, err = dp.translateTemplate(parsedSource.Template); err != nil {
+		return PromptMetadata{}, err
+	}
+	if parsedSource, err = dp.withPartialMetadata(parsedSource, nil); err != nil {
+		return PromptMetadata{}, err
+	}
+	return dp.renderMetadata(parsedSource, additionalMetadata)
+}
 
+// renderMetadata renders the metadata for a parsed prompt like RenderMetadata,
+// without merging the metadata of its partials again.
+func (dp *Dotprompt) renderMetadata(parsedSource ParsedPrompt, additionalMetadata *PromptMetadata) (PromptMetadata, error) {
 	if additionalMetadata == nil {
 		additionalMetadata = &PromptMetadata{}
 	}
@@ -333,6 +1029,9 @@ func (dp *Dotprompt) RenderMetadata(source any, additionalMetadata *PromptMetada
 	if selectedModel == "" {
 		selectedModel = parsedSource.Model
 	}
+	if selectedModel == "" && dp.defaultMetadata != nil {
+		selectedModel = dp.defaultMetadata.Model
+	}
 	if selectedModel == "" {
 		selectedModel = dp.defaultModel
 	}
@@ -342,6 +1041,11 @@ func (dp *Dotprompt) RenderMetadata(source any, additionalMetadata *PromptMetada
 		modelConfig = make(map[string]any)
 	}
 	metadata := []*PromptMetadata{}
+	if dp.defaultMetadata != nil {
+		// Copy the default so that rendered metadata never shares its maps.
+		defaultMetadata := copyPromptMetadata(*dp.defaultMetadata)
+		metadata = append(metadata, &defaultMetadata)
+	}
 	metadata = append(metadata, &parsedSource.PromptMetadata)
 	metadata = append(metadata, additionalMetadata)
 
@@ -365,22 +1069,54 @@ func mergeStructs(out, merge PromptMetadata) PromptMetadata {
 	return out
 }
 
-// ResolveMetadata resolves and merges metadata.
+// ResolveVariant returns the variant prompt with the base prompt's metadata
+// inherited beneath it, so that variants of a prompt need only declare the
+// fields they change. Config, Ext, and Metadata are merged recursively, other
+// metadata fields set by the variant replace the base's wholesale, and the
+// template is the variant's unless it is empty. Neither prompt is modified.
+func (dp *Dotprompt) ResolveVariant(base, variant ParsedPrompt) ParsedPrompt {
+	out := variant
+	out.PromptMetadata = mergeStructs(base.PromptMetadata, variant.PromptMetadata)
+	out.Config = deepMergeMaps(base.Config, variant.Config)
+	out.Metadata = deepMergeMaps(base.Metadata, variant.Metadata)
+	if base.Ext != nil || variant.Ext != nil {
+		out.Ext = maps.Clone(base.Ext)
+		if out.Ext == nil {
+			out.Ext = make(map[string]map[string]any)
+		}
+		for ns, fields := range variant.Ext {
+			out.Ext[ns] = deepMergeMaps(base.Ext[ns], fields)
+		}
+	}
+	if out.Template == "" {
+		out.Template = base.Template
+	}
+	return out
+}
+
+// ResolveMetadata resolves and merges metadata. Config is merged recursively
+// into a new map, and other fields set by a later merge replace earlier ones.
 func (dp *Dotprompt) ResolveMetadata(base PromptMetadata, merges []*PromptMetadata) (PromptMetadata, error) {
 	out := base
 	for _, merge := range merges {
 		if merge == nil {
 			continue
 		}
+		config := out.Config
 		out = mergeStructs(out, *merge)
-
-		maps.Copy(out.Config, merge.Config)
+		out.Config = deepMergeMaps(config, merge.Config)
 	}
 	out, err := dp.ResolveTools(out)
 	if err != nil {
 		return PromptMetadata{}, err
 	}
-	return dp.RenderPicoschema(out)
+	if out, err = dp.RenderPicoschema(out); err != nil {
+		return PromptMetadata{}, err
+	}
+	if err := dp.validateOutputFormat(out); err != nil {
+		return PromptMetadata{}, err
+	}
+	return dp.identifySchemas(out), nil
 }
 
 // ResolveTools resolves tools in the metadata.
@@ -416,6 +1152,12 @@ func (dp *Dotprompt) ResolveTools(base PromptMetadata) (PromptMetadata, error) {
 
 // RenderPicoschema renders the picoschema for the metadata.
 func (dp *Dotprompt) RenderPicoschema(meta PromptMetadata) (PromptMetadata, error) {
+	toolDefs, err := dp.resolveToolSchemas(meta.ToolDefs)
+	if err != nil {
+		return PromptMetadata{}, err
+	}
+	meta.ToolDefs = toolDefs
+
 	if meta.Output.Schema == nil && meta.Input.Schema == nil {
 		return meta, nil
 	}
@@ -426,6 +1168,8 @@ func (dp *Dotprompt) RenderPicoschema(meta PromptMetadata) (PromptMetadata, erro
 			SchemaResolver: func(name string) (*jsonschema.Schema, error) {
 				return dp.WrappedSchemaResolver(name)
 			},
+			SchemaCache:               dp.schemaCache,
+			AllowAdditionalProperties: dp.allowAdditionalProperties,
 		})
 		if err != nil {
 			return PromptMetadata{}, err
@@ -437,6 +1181,8 @@ func (dp *Dotprompt) RenderPicoschema(meta PromptMetadata) (PromptMetadata, erro
 			SchemaResolver: func(name string) (*jsonschema.Schema, error) {
 				return dp.WrappedSchemaResolver(name)
 			},
+			SchemaCache:               dp.schemaCache,
+			AllowAdditionalProperties: dp.allowAdditionalProperties,
 		})
 		if err != nil {
 			return PromptMetadata{}, err
@@ -446,6 +1192,44 @@ func (dp *Dotprompt) RenderPicoschema(meta PromptMetadata) (PromptMetadata, erro
 	return newMeta, nil
 }
 
+// resolveToolSchemas returns a copy of the tool definitions with any input or
+// output schemas given by name resolved to the named schema.
+func (dp *Dotprompt) resolveToolSchemas(toolDefs []ToolDefinition) ([]ToolDefinition, error) {
+	if toolDefs == nil {
+		return nil, nil
+	}
+	resolve := func(schema Schema) (Schema, error) {
+		name, ok := schema.(string)
+		if !ok {
+			return schema, nil
+		}
+		resolved, err := Picoschema(name, &PicoschemaOptions{
+			SchemaResolver: dp.WrappedSchemaResolver,
+			SchemaCache:    dp.schemaCache,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return resolved, nil
+	}
+
+	out := make([]ToolDefinition, len(toolDefs))
+	for i, def := range toolDefs {
+		inputSchema, err := resolve(def.InputSchema)
+		if err != nil {
+			return nil, fmt.Errorf("dotprompt: tool '%s' input schema: %w", def.Name, err)
+		}
+		outputSchema, err := resolve(def.OutputSchema)
+		if err != nil {
+			return nil, fmt.Errorf("dotprompt: tool '%s' output schema: %w", def.Name, err)
+		}
+		def.InputSchema = inputSchema
+		def.OutputSchema = outputSchema
+		out[i] = def
+	}
+	return out, nil
+}
+
 // WrappedSchemaResolver resolves Schema.
 func (dp *Dotprompt) WrappedSchemaResolver(name string) (*jsonschema.Schema, error) {
 	if schema, exists := dp.Schemas[name]; exists {
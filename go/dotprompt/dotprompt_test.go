@@ -16,11 +16,17 @@
 package dotprompt
 
 import (
+	"encoding/json"
 	"fmt"
+	"math/rand"
 	"strings"
 	"testing"
 
+	"github.com/goccy/go-yaml"
+	"github.com/invopop/jsonschema"
 	"github.com/mbleigh/raymond"
+	"github.com/stretchr/testify/assert"
+	orderedmap "github.com/wk8/go-ordered-map/v2"
 )
 
 // TestDefineHelper tests the DefineHelper function.
@@ -271,3 +277,1071 @@ func TestRegisterPartialsWithResolver(t *testing.T) {
 		t.Errorf("Expected output '%s', got '%s'", expectedOutput, result)
 	}
 }
+
+// TestLenientPartials tests rendering a template that references a partial the
+// resolver cannot find.
+func TestLenientPartials(t *testing.T) {
+	resolver := func(name string) (string, error) {
+		if name == "known" {
+			return "Known", nil
+		}
+		return "", fmt.Errorf("unknown partial: %s", name)
+	}
+	source := "Start {{> known}} {{> missing}}End"
+
+	t.Run("strict by default", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{PartialResolver: resolver})
+		_, err := dp.Render(source, &DataArgument{}, nil)
+		assert.ErrorContains(t, err, "unknown partial: missing")
+	})
+
+	t.Run("lenient renders missing partials as empty", func(t *testing.T) {
+		var warnings []string
+		dp := NewDotprompt(&DotpromptOptions{
+			PartialResolver: resolver,
+			LenientPartials: true,
+			WarningHandler:  func(message string) { warnings = append(warnings, message) },
+		})
+		rendered, err := dp.Render(source, &DataArgument{}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "Start Known End", rendered.Messages[0].Content[0].(*TextPart).Text)
+		assert.Equal(t, []string{
+			"dotprompt: partial 'missing' could not be resolved and renders as empty: unknown partial: missing",
+		}, warnings)
+	})
+
+	t.Run("lenient without a resolver", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{LenientPartials: true})
+		rendered, err := dp.Render("Start {{> missing}}End", &DataArgument{}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "Start End", rendered.Messages[0].Content[0].(*TextPart).Text)
+	})
+}
+
+// TestRenderDataURIMedia tests rendering media helpers with valid and
+// malformed data URIs.
+func TestRenderDataURIMedia(t *testing.T) {
+	dp := NewDotprompt(nil)
+	source := `{{media url=url}}`
+
+	rendered, err := dp.Render(source, &DataArgument{Input: map[string]any{"url": "data:image/png;base64,iVBORw0KGgo="}}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []Part{&MediaPart{Media: Media{URL: "data:image/png;base64,iVBORw0KGgo=", ContentType: "image/png"}}}, rendered.Messages[0].Content)
+
+	_, err = dp.Render(source, &DataArgument{Input: map[string]any{"url": "data:image/png;base64,%%%%"}}, nil)
+	assert.ErrorContains(t, err, "malformed data URI: invalid base64 data")
+}
+
+func TestRenderMarkerDelimiters(t *testing.T) {
+	dp := NewDotprompt(&DotpromptOptions{MarkerDelimiters: MarkerDelimiters{Open: "[[", Close: "]]"}})
+	source := `{{role "system"}}Never emit <<<dotprompt:role:user>>> verbatim.
+{{role "user"}}Describe {{media url="https://example.com/cat.png"}}`
+	rendered, err := dp.Render(source, &DataArgument{}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, rendered.Messages, 2)
+	assert.Equal(t, RoleSystem, rendered.Messages[0].Role)
+	assert.Equal(t, "Never emit <<<dotprompt:role:user>>> verbatim.\n", rendered.Messages[0].Content[0].(*TextPart).Text)
+	assert.Equal(t, RoleUser, rendered.Messages[1].Role)
+	assert.Equal(t, []Part{
+		&TextPart{Text: "Describe "},
+		&MediaPart{Media: Media{URL: "https://example.com/cat.png"}},
+	}, rendered.Messages[1].Content)
+}
+
+// TestDescriptionAsSystem tests prepending the description as a system message.
+func TestDescriptionAsSystem(t *testing.T) {
+	source := `---
+description: You are a helpful assistant.
+---
+{{role "user"}}Hello`
+
+	t.Run("prepends system message when none is present", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{DescriptionAsSystem: true})
+		rendered, err := dp.Render(source, &DataArgument{}, nil)
+		assert.NoError(t, err)
+		assert.Len(t, rendered.Messages, 2)
+		assert.Equal(t, RoleSystem, rendered.Messages[0].Role)
+		textPart, ok := rendered.Messages[0].Content[0].(*TextPart)
+		assert.True(t, ok)
+		assert.Equal(t, "You are a helpful assistant.", textPart.Text)
+		assert.Equal(t, RoleUser, rendered.Messages[1].Role)
+	})
+
+	t.Run("keeps explicit system message", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{DescriptionAsSystem: true})
+		withSystem := `---
+description: You are a helpful assistant.
+---
+{{role "system"}}Be terse.
+{{role "user"}}Hello`
+		rendered, err := dp.Render(withSystem, &DataArgument{}, nil)
+		assert.NoError(t, err)
+		assert.Len(t, rendered.Messages, 2)
+		assert.Equal(t, RoleSystem, rendered.Messages[0].Role)
+		textPart, ok := rendered.Messages[0].Content[0].(*TextPart)
+		assert.True(t, ok)
+		assert.Equal(t, "Be terse.\n", textPart.Text)
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		dp := NewDotprompt(nil)
+		rendered, err := dp.Render(source, &DataArgument{}, nil)
+		assert.NoError(t, err)
+		assert.Len(t, rendered.Messages, 1)
+		assert.Equal(t, RoleUser, rendered.Messages[0].Role)
+	})
+}
+
+// TestRenderExamples tests rendering a prompt against its declared examples.
+func TestRenderExamples(t *testing.T) {
+	source := `---
+examples:
+  - name: Alice
+  - name: Bob
+---
+Hello {{name}}!`
+
+	parsed, err := ParseDocument(source)
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"name": "Alice"}, {"name": "Bob"}}, parsed.Examples)
+
+	dp := NewDotprompt(nil)
+	results, err := dp.RenderExamples(source)
+	assert.NoError(t, err)
+	assert.Len(t, results, 2)
+	for i, name := range []string{"Alice", "Bob"} {
+		textPart, ok := results[i].Messages[0].Content[0].(*TextPart)
+		assert.True(t, ok)
+		assert.Equal(t, "Hello "+name+"!", textPart.Text)
+	}
+}
+
+// TestCanonicalizeMetadata tests that message metadata serializes
+// deterministically.
+func TestCanonicalizeMetadata(t *testing.T) {
+	history := []Message{
+		{
+			Role:    RoleUser,
+			Content: []Part{&TextPart{Text: "Hi"}},
+			HasMetadata: HasMetadata{Metadata: Metadata{
+				"source": map[any]any{"z": 1, "a": []any{map[any]any{2: "two", 1: "one"}}},
+				"turn":   1,
+			}},
+		},
+	}
+
+	dp := NewDotprompt(&DotpromptOptions{CanonicalizeMetadata: true})
+	expected := `[{"metadata":{"source":{"a":[{"1":"one","2":"two"}],"z":1},"turn":1},"role":"user","content":[{"text":"Hi"}]},` +
+		`{"role":"user","content":[{"text":"Hello"}]}]`
+	for range 5 {
+		rendered, err := dp.Render("Hello", &DataArgument{Messages: history}, nil)
+		assert.NoError(t, err)
+		out, err := json.Marshal(rendered.Messages)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(out))
+	}
+
+	rendered, err := dp.Render("Hello", &DataArgument{Messages: history}, nil)
+	assert.NoError(t, err)
+	source, ok := rendered.Messages[0].Metadata["source"].(map[string]any)
+	assert.True(t, ok)
+	assert.IsType(t, map[string]any{}, source["a"].([]any)[0])
+	// The caller's history is left untouched.
+	assert.IsType(t, map[any]any{}, history[0].Metadata["source"])
+}
+
+// TestCanonicalizePartMetadata tests that part metadata serializes
+// deterministically.
+func TestCanonicalizePartMetadata(t *testing.T) {
+	media := &MediaPart{
+		HasMetadata: HasMetadata{Metadata: Metadata{
+			"dimensions": map[any]any{"width": 640, "height": 480},
+			"tags":       []any{map[any]any{1: "cat", 0: "animal"}},
+		}},
+		Media: Media{URL: "https://example.com/cat.png", ContentType: "image/png"},
+	}
+	history := []Message{{Role: RoleUser, Content: []Part{media, &TextPart{Text: "What is this?"}}}}
+
+	dp := NewDotprompt(&DotpromptOptions{CanonicalizePartMetadata: true})
+	expected := `[{"role":"user","content":[{"metadata":{"dimensions":{"height":480,"width":640},"tags":[{"0":"animal","1":"cat"}]},` +
+		`"media":{"url":"https://example.com/cat.png","contentType":"image/png"}},{"text":"What is this?"}]},` +
+		`{"role":"user","content":[{"text":"Hello"}]}]`
+	for range 5 {
+		rendered, err := dp.Render("Hello", &DataArgument{Messages: history}, nil)
+		assert.NoError(t, err)
+		out, err := json.Marshal(rendered.Messages)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(out))
+	}
+
+	rendered, err := dp.Render("Hello", &DataArgument{Messages: history}, nil)
+	assert.NoError(t, err)
+	metadata := rendered.Messages[0].Content[0].GetMetadata()
+	assert.IsType(t, map[string]any{}, metadata["dimensions"])
+	// The caller's history is left untouched.
+	assert.Same(t, media, history[0].Content[0])
+	assert.IsType(t, map[any]any{}, media.Metadata["dimensions"])
+}
+
+// TestExtractPartialNames tests extracting referenced partial names.
+func TestExtractPartialNames(t *testing.T) {
+	dp := NewDotprompt(&DotpromptOptions{
+		PartialResolver: func(name string) (string, error) {
+			t.Fatalf("resolver should not be called, got %q", name)
+			return "", nil
+		},
+	})
+
+	tests := []struct {
+		name     string
+		source   string
+		expected []string
+	}{
+		{"no partials", "Hello {{name}}", []string{}},
+		{"one partial", "---\nmodel: test\n---\n{{> header}} Hello", []string{"header"}},
+		{"repeated partials", "{{> header}}\n{{>footer}} {{> header }}\n{{> item this}}", []string{"header", "footer", "item"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names, err := dp.ExtractPartialNames(tt.source)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, names)
+		})
+	}
+}
+
+// TestSectionResolver tests resolving pending sections during render.
+func TestSectionResolver(t *testing.T) {
+	source := `Before {{section "code"}} Middle {{section "notes"}}`
+	var calls []string
+	dp := NewDotprompt(&DotpromptOptions{
+		SectionResolver: func(purpose string, data *DataArgument) ([]Part, error) {
+			calls = append(calls, purpose)
+			if purpose == "code" {
+				return []Part{&TextPart{Text: "print(" + data.Input["lang"].(string) + ")"}}, nil
+			}
+			return nil, nil
+		},
+	})
+
+	rendered, err := dp.Render(source, &DataArgument{Input: map[string]any{"lang": "go"}}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"code", "notes"}, calls)
+
+	content := rendered.Messages[0].Content
+	assert.Len(t, content, 4)
+	assert.Equal(t, "Before ", content[0].(*TextPart).Text)
+	assert.Equal(t, "print(go)", content[1].(*TextPart).Text)
+	assert.Equal(t, " Middle ", content[2].(*TextPart).Text)
+	pending, ok := content[3].(*PendingPart)
+	assert.True(t, ok)
+	assert.True(t, pending.IsPending())
+	assert.Equal(t, "notes", pending.Metadata["purpose"])
+
+	t.Run("propagates resolver errors", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{
+			SectionResolver: func(purpose string, data *DataArgument) ([]Part, error) {
+				return nil, fmt.Errorf("boom")
+			},
+		})
+		_, err := dp.Render(source, &DataArgument{}, nil)
+		assert.ErrorContains(t, err, "boom")
+	})
+
+	t.Run("leaves sections pending without a resolver", func(t *testing.T) {
+		rendered, err := NewDotprompt(nil).Render(source, &DataArgument{}, nil)
+		assert.NoError(t, err)
+		_, ok := rendered.Messages[0].Content[1].(*PendingPart)
+		assert.True(t, ok)
+	})
+}
+
+// TestRenderCollapseBlankLines tests collapsing the blank lines left behind by
+// conditional sections.
+func TestRenderCollapseBlankLines(t *testing.T) {
+	source := "Header\n{{#if a}}\nA\n{{/if}}\n\n{{#if b}}\nB\n{{/if}}\n\n{{#if c}}\nC\n{{/if}}\n\nFooter"
+	data := &DataArgument{Input: map[string]any{"c": true}}
+
+	t.Run("preserved by default", func(t *testing.T) {
+		rendered, err := NewDotprompt(nil).Render(source, data, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "Header\n\n\nC\n\nFooter", rendered.Messages[0].Content[0].(*TextPart).Text)
+	})
+
+	t.Run("collapsed when enabled", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{CollapseBlankLines: true})
+		rendered, err := dp.Render(source, data, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "Header\n\nC\n\nFooter", rendered.Messages[0].Content[0].(*TextPart).Text)
+	})
+}
+
+// TestRenderTrimMessageWhitespace tests trimming the whitespace around role
+// markers from the rendered messages.
+func TestRenderTrimMessageWhitespace(t *testing.T) {
+	source := "{{role \"system\"}}\nBe brief.\n\n{{role \"user\"}}\n  Line one\n\nLine two {{media url=\"https://example.com/a.png\"}} done\n"
+	texts := func(dp *Dotprompt) [][]string {
+		rendered, err := dp.Render(source, &DataArgument{}, nil)
+		assert.NoError(t, err)
+		var texts [][]string
+		for _, msg := range rendered.Messages {
+			var parts []string
+			for _, part := range msg.Content {
+				if text, ok := part.(*TextPart); ok {
+					parts = append(parts, text.Text)
+				}
+			}
+			texts = append(texts, parts)
+		}
+		return texts
+	}
+
+	t.Run("preserved by default", func(t *testing.T) {
+		assert.Equal(t, [][]string{
+			{"\nBe brief.\n\n"},
+			{"\n  Line one\n\nLine two ", " done\n"},
+		}, texts(NewDotprompt(nil)))
+	})
+
+	t.Run("trimmed when enabled", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{TrimMessageWhitespace: true})
+		assert.Equal(t, [][]string{
+			{"Be brief."},
+			{"Line one\n\nLine two ", " done"},
+		}, texts(dp))
+	})
+}
+
+// TestRandomItemHelper tests that randomItem is reproducible with a seeded
+// RandSource.
+func TestRandomItemHelper(t *testing.T) {
+	source := `{{#each picks}}{{randomItem ../examples}};{{/each}}`
+	data := &DataArgument{Input: map[string]any{
+		"examples": []any{"one", "two", "three", "four", "five"},
+		"picks":    []int{1, 2, 3, 4, 5, 6},
+	}}
+
+	render := func(seed int64) string {
+		dp := NewDotprompt(&DotpromptOptions{RandSource: rand.NewSource(seed)})
+		rendered, err := dp.Render(source, data, nil)
+		assert.NoError(t, err)
+		return rendered.Messages[0].Content[0].(*TextPart).Text
+	}
+
+	first := render(7)
+	assert.Equal(t, first, render(7))
+	for _, pick := range strings.Split(strings.TrimSuffix(first, ";"), ";") {
+		assert.Contains(t, data.Input["examples"], pick)
+	}
+
+	rendered, err := NewDotprompt(nil).Render(`[{{randomItem missing}}]`, &DataArgument{}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "[]", rendered.Messages[0].Content[0].(*TextPart).Text)
+}
+
+// TestRoleMetadata tests that hash arguments to the role helper are attached to
+// the rendered message.
+func TestRoleMetadata(t *testing.T) {
+	source := `{{role "system"}}Be brief.{{role "model" model=modelName}}Hello`
+	rendered, err := NewDotprompt(nil).Render(source, &DataArgument{
+		Input: map[string]any{"modelName": "gpt-4"},
+	}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, rendered.Messages, 2)
+	assert.Nil(t, rendered.Messages[0].Metadata)
+	assert.Equal(t, RoleModel, rendered.Messages[1].Role)
+	assert.Equal(t, Metadata{"model": "gpt-4"}, rendered.Messages[1].Metadata)
+}
+
+// TestDefaultMetadata tests that DefaultMetadata is merged beneath the prompt
+// frontmatter.
+func TestDefaultMetadata(t *testing.T) {
+	dp := NewDotprompt(&DotpromptOptions{
+		DefaultMetadata: &PromptMetadata{
+			Model:  "default-model",
+			Config: map[string]any{"temperature": 0.2},
+		},
+		ModelConfigs: map[string]any{
+			"default-model": map[string]any{"topK": 10},
+		},
+	})
+
+	t.Run("inherits the default model and config", func(t *testing.T) {
+		rendered, err := dp.Render("Hello", &DataArgument{}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "default-model", rendered.Model)
+		assert.Equal(t, ModelConfig{"topK": 10, "temperature": 0.2}, rendered.Config)
+	})
+
+	t.Run("merges default and frontmatter config", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{
+			DefaultMetadata: &PromptMetadata{
+				Config: map[string]any{"temperature": 0.2, "safety": map[string]any{"level": "high"}},
+			},
+			ModelConfigs: map[string]any{"prompt-model": map[string]any{"topK": 10}},
+		})
+		source := "---\nmodel: prompt-model\nconfig:\n  maxOutputTokens: 100\n  safety:\n    mode: strict\n---\nHello"
+		metadata, err := dp.RenderMetadata(source, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, ModelConfig{
+			"topK":            10,
+			"temperature":     0.2,
+			"maxOutputTokens": uint64(100),
+			"safety":          map[string]any{"level": "high", "mode": "strict"},
+		}, metadata.Config)
+
+		// The rendered config doesn't share maps with the default.
+		metadata.Config["temperature"] = 1.0
+		metadata.Config["safety"].(map[string]any)["level"] = "low"
+		metadata, err = dp.RenderMetadata("Hello", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, ModelConfig{"temperature": 0.2, "safety": map[string]any{"level": "high"}}, metadata.Config)
+	})
+
+	t.Run("frontmatter overrides the default", func(t *testing.T) {
+		source := "---\nmodel: prompt-model\nconfig:\n  temperature: 0.9\n---\nHello"
+		rendered, err := dp.Render(source, &DataArgument{}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "prompt-model", rendered.Model)
+		assert.Equal(t, 0.9, rendered.Config["temperature"])
+
+		metadata, err := dp.RenderMetadata(source, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "prompt-model", metadata.Model)
+	})
+
+	t.Run("render options override the frontmatter", func(t *testing.T) {
+		metadata, err := dp.RenderMetadata("---\nmodel: prompt-model\n---\nHello", &PromptMetadata{Model: "option-model"})
+		assert.NoError(t, err)
+		assert.Equal(t, "option-model", metadata.Model)
+	})
+
+	t.Run("default model config is used without config", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{
+			DefaultMetadata: &PromptMetadata{Model: "default-model"},
+			ModelConfigs: map[string]any{
+				"default-model": map[string]any{"topK": 10},
+			},
+		})
+		metadata, err := dp.RenderMetadata("Hello", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, ModelConfig{"topK": 10}, metadata.Config)
+	})
+}
+
+// TestRenderMetadataMatchesRender tests that RenderMetadata returns the same
+// metadata as a full render without executing the template.
+func TestRenderMetadataMatchesRender(t *testing.T) {
+	dp := NewDotprompt(&DotpromptOptions{
+		DefaultModel: "default-model",
+		ModelConfigs: map[string]any{
+			"default-model": map[string]any{"topK": 10},
+		},
+		Schemas: map[string]*jsonschema.Schema{
+			"Answer": {Type: "string"},
+		},
+	})
+	source := `---
+input:
+  schema:
+    question: string
+    tags?(array): string
+output:
+  format: text
+  schema: Answer
+ext:
+  registry:
+    owner: docs
+---
+{{role "system"}}Answer {{question}}.{{history}}`
+	options := &PromptMetadata{Config: ModelConfig{"temperature": 0.5}}
+	history := make([]Message, 0, 100)
+	for i := range 100 {
+		history = append(history, Message{Role: RoleUser, Content: []Part{&TextPart{Text: fmt.Sprint(i)}}})
+	}
+
+	rendered, err := dp.Render(source, &DataArgument{Input: map[string]any{"question": "why"}, Messages: history}, options)
+	assert.NoError(t, err)
+	metadata, err := dp.RenderMetadata(source, options)
+	assert.NoError(t, err)
+	// Compare as JSON, since the order of Picoschema properties is not stable.
+	renderedJSON, err := json.Marshal(rendered.PromptMetadata)
+	assert.NoError(t, err)
+	metadataJSON, err := json.Marshal(metadata)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(renderedJSON), string(metadataJSON))
+	assert.Equal(t, 0.5, metadata.Config["temperature"])
+	assert.Equal(t, &jsonschema.Schema{Type: "string"}, metadata.Output.Schema)
+
+	t.Run("does not execute the template", func(t *testing.T) {
+		source := "---\nmodel: other\n---\n{{> missing}}"
+		_, err := dp.Render(source, &DataArgument{}, nil)
+		assert.Error(t, err)
+
+		metadata, err := dp.RenderMetadata(source, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "other", metadata.Model)
+	})
+}
+
+// TestRenderSection tests rendering a single named section of a prompt.
+func TestRenderSection(t *testing.T) {
+	source := `---
+model: test-model
+---
+Preamble for {{name}}.
+{{section "context"}}
+Context for {{name}}.
+{{section "instructions"}}
+Do the thing.
+{{role "model"}}Acknowledged.
+{{role "user"}}{{section "instructions"}}
+And then the other thing.
+{{section "examples"}}
+Example.`
+	dp := NewDotprompt(nil)
+	data := &DataArgument{Input: map[string]any{"name": "Alice"}}
+
+	t.Run("middle section", func(t *testing.T) {
+		rendered, err := dp.RenderSection(source, "context", data, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "test-model", rendered.Model)
+		assert.Len(t, rendered.Messages, 1)
+		assert.Equal(t, RoleUser, rendered.Messages[0].Role)
+		assert.Equal(t, []Part{&TextPart{Text: "\nContext for Alice.\n"}}, rendered.Messages[0].Content)
+	})
+
+	t.Run("section ends at role boundary and repeats", func(t *testing.T) {
+		rendered, err := dp.RenderSection(source, "instructions", data, nil)
+		assert.NoError(t, err)
+		assert.Len(t, rendered.Messages, 2)
+		assert.Equal(t, []Part{&TextPart{Text: "\nDo the thing.\n"}}, rendered.Messages[0].Content)
+		assert.Equal(t, RoleUser, rendered.Messages[1].Role)
+		assert.Equal(t, []Part{&TextPart{Text: "\nAnd then the other thing.\n"}}, rendered.Messages[1].Content)
+	})
+
+	t.Run("missing section", func(t *testing.T) {
+		_, err := dp.RenderSection(source, "missing", data, nil)
+		assert.ErrorContains(t, err, "section 'missing' not found")
+	})
+}
+
+// TestMaxTemplateBytes tests the source and rendered size limits.
+func TestMaxTemplateBytes(t *testing.T) {
+	t.Run("under-limit source", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{MaxTemplateBytes: 64, MaxRenderedBytes: 64})
+		rendered, err := dp.Render("Hello {{name}}", &DataArgument{Input: map[string]any{"name": "Bob"}}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "Hello Bob", rendered.Messages[0].Content[0].(*TextPart).Text)
+	})
+
+	t.Run("over-limit source", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{MaxTemplateBytes: 8})
+		_, err := dp.Render("Hello {{name}}", &DataArgument{}, nil)
+		assert.EqualError(t, err, "dotprompt: template source is 14 bytes, exceeding the limit of 8 bytes")
+
+		_, err = dp.Parse("Hello {{name}}")
+		assert.Error(t, err)
+
+		_, err = ParseDocumentWithOptions("Hello {{name}}", &ParseOptions{MaxBytes: 8})
+		assert.Error(t, err)
+	})
+
+	t.Run("over-limit rendered output", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{
+			MaxTemplateBytes: 64,
+			MaxRenderedBytes: 64,
+			Partials: map[string]string{
+				"ten":     "0123456789",
+				"hundred": "{{> ten}}{{> ten}}{{> ten}}{{> ten}}{{> ten}}{{> ten}}{{> ten}}{{> ten}}{{> ten}}{{> ten}}",
+			},
+		})
+		_, err := dp.Render("{{> hundred}}", &DataArgument{}, nil)
+		assert.EqualError(t, err, "dotprompt: rendered template is 100 bytes, exceeding the limit of 64 bytes")
+	})
+}
+
+// TestPromptMetadataInTemplate tests that prompts can refer to their own
+// metadata.
+func TestPromptMetadataInTemplate(t *testing.T) {
+	source := `---
+name: greeter
+variant: formal
+version: "1.2"
+model: test-model
+---
+{{meta "name"}}.{{meta "variant"}}@{{meta "version"}} ({{meta "model"}}) for {{name}} {{@metadata.prompt.name}}{{meta "unknown"}}`
+	dp := NewDotprompt(nil)
+
+	t.Run("renders its own metadata", func(t *testing.T) {
+		rendered, err := dp.Render(source, &DataArgument{
+			// An input field with the same name doesn't collide.
+			Input: map[string]any{"name": "Alice", "version": "input-version"},
+		}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "greeter.formal@1.2 (test-model) for Alice greeter",
+			rendered.Messages[0].Content[0].(*TextPart).Text)
+	})
+
+	t.Run("context can override metadata", func(t *testing.T) {
+		rendered, err := dp.Render(`[{{meta "name"}}]`, &DataArgument{
+			Context: map[string]any{"metadata": "overridden"},
+		}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "[]", rendered.Messages[0].Content[0].(*TextPart).Text)
+	})
+}
+
+// TestRenderStripTrailingWhitespace tests removing trailing whitespace from rendered
+// lines.
+func TestRenderStripTrailingWhitespace(t *testing.T) {
+	source := "config:   \n  name: {{name}}  \n  items:\t\n    - {{item}} \nEnd"
+	data := &DataArgument{Input: map[string]any{"name": "test", "item": "one"}}
+
+	t.Run("preserved by default", func(t *testing.T) {
+		rendered, err := NewDotprompt(nil).Render(source, data, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "config:   \n  name: test  \n  items:\t\n    - one \nEnd",
+			rendered.Messages[0].Content[0].(*TextPart).Text)
+	})
+
+	t.Run("stripped when enabled", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{StripTrailingWhitespace: true})
+		rendered, err := dp.Render(source, data, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "config:\n  name: test\n  items:\n    - one\nEnd",
+			rendered.Messages[0].Content[0].(*TextPart).Text)
+	})
+}
+
+// TestHelperPartialNameCollision tests detecting a name registered as both a
+// helper and a partial.
+func TestHelperPartialNameCollision(t *testing.T) {
+	var warnings []string
+	options := func(strict bool) *DotpromptOptions {
+		return &DotpromptOptions{
+			Helpers:        map[string]any{"greeting": func() string { return "helper" }},
+			Partials:       map[string]string{"greeting": "partial"},
+			StrictNames:    strict,
+			WarningHandler: func(message string) { warnings = append(warnings, message) },
+		}
+	}
+
+	t.Run("warns by default", func(t *testing.T) {
+		rendered, err := NewDotprompt(options(false)).Render("{{greeting}} {{> greeting}}", &DataArgument{}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "helper partial", rendered.Messages[0].Content[0].(*TextPart).Text)
+		assert.Contains(t, warnings, "dotprompt: 'greeting' is registered as both a helper and a partial")
+	})
+
+	t.Run("errors when strict", func(t *testing.T) {
+		_, err := NewDotprompt(options(true)).Render("{{greeting}}", &DataArgument{}, nil)
+		assert.EqualError(t, err, "dotprompt: 'greeting' is registered as both a helper and a partial")
+	})
+
+	t.Run("collides with built-in helpers", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{
+			Partials:    map[string]string{"json": "partial"},
+			StrictNames: true,
+		})
+		_, err := dp.Render("Hello", &DataArgument{}, nil)
+		assert.Error(t, err)
+	})
+}
+
+// TestIfMultimodal tests the ifMultimodal helper with the configured model
+// capabilities.
+func TestIfMultimodal(t *testing.T) {
+	dp := NewDotprompt(&DotpromptOptions{
+		ModelCapabilities: map[string]ModelCapabilities{
+			"vision-model": {Multimodal: true},
+			"text-model":   {Multimodal: false},
+		},
+	})
+	source := `Describe this.{{#ifMultimodal}} {{media url=imageUrl}}{{else}} {{caption}}{{/ifMultimodal}}`
+	data := &DataArgument{Input: map[string]any{
+		"imageUrl": "https://example.com/cat.png",
+		"caption":  "A cat.",
+	}}
+
+	t.Run("multimodal model", func(t *testing.T) {
+		rendered, err := dp.Render(source, data, &PromptMetadata{Model: "vision-model"})
+		assert.NoError(t, err)
+		content := rendered.Messages[0].Content
+		assert.Len(t, content, 2)
+		assert.Equal(t, "https://example.com/cat.png", content[1].(*MediaPart).Media.URL)
+	})
+
+	t.Run("text-only model", func(t *testing.T) {
+		rendered, err := dp.Render(source, data, &PromptMetadata{Model: "text-model"})
+		assert.NoError(t, err)
+		assert.Equal(t, []Part{&TextPart{Text: "Describe this. A cat."}}, rendered.Messages[0].Content)
+	})
+
+	t.Run("unknown model", func(t *testing.T) {
+		rendered, err := dp.Render("---\nmodel: other\n---\n"+source, data, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []Part{&TextPart{Text: "Describe this. A cat."}}, rendered.Messages[0].Content)
+	})
+}
+
+func TestStrictHelpers(t *testing.T) {
+	source := `Data: {{json value}}`
+	data := &DataArgument{Input: map[string]any{"value": map[string]any{"ch": make(chan int)}}}
+
+	t.Run("lenient mode renders an empty string", func(t *testing.T) {
+		rendered, err := NewDotprompt(nil).Render(source, data, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []Part{&TextPart{Text: "Data: "}}, rendered.Messages[0].Content)
+	})
+
+	t.Run("strict mode fails the render", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{StrictHelpers: true})
+		_, err := dp.Render(source, data, nil)
+		assert.ErrorContains(t, err, "json helper: json: unsupported type: chan int")
+
+		_, err = dp.Render(`{{jsonBlock value}}`, data, nil)
+		assert.ErrorContains(t, err, "json helper")
+	})
+
+	t.Run("strict mode renders serializable values", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{StrictHelpers: true})
+		rendered, err := dp.Render(source, &DataArgument{Input: map[string]any{"value": []int{1, 2}}}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []Part{&TextPart{Text: "Data: [1,2]"}}, rendered.Messages[0].Content)
+	})
+}
+
+// TestConversationTurnHelpers tests rendering content only on the first or
+// last turn of a conversation.
+func TestConversationTurnHelpers(t *testing.T) {
+	dp := NewDotprompt(nil)
+	source := `{{#ifFirstTurn}}Welcome! {{else}}Welcome back. {{/ifFirstTurn}}{{question}}{{#ifLastTurn maxTurns=3}} This is your last question.{{/ifLastTurn}}`
+	turn := func(question, answer string) []Message {
+		return []Message{
+			{Role: RoleUser, Content: []Part{&TextPart{Text: question}}},
+			{Role: RoleModel, Content: []Part{&TextPart{Text: answer}}},
+		}
+	}
+	render := func(t *testing.T, history []Message) string {
+		rendered, err := dp.Render(source, &DataArgument{
+			Input:    map[string]any{"question": "Why?"},
+			Messages: history,
+		}, nil)
+		assert.NoError(t, err)
+		last := rendered.Messages[len(rendered.Messages)-1]
+		return last.Content[0].(*TextPart).Text
+	}
+
+	t.Run("first turn", func(t *testing.T) {
+		assert.Equal(t, "Welcome! Why?", render(t, nil))
+	})
+
+	t.Run("system messages are not turns", func(t *testing.T) {
+		history := []Message{{Role: RoleSystem, Content: []Part{&TextPart{Text: "Be brief."}}}}
+		assert.Equal(t, "Welcome! Why?", render(t, history))
+	})
+
+	t.Run("continuing turn", func(t *testing.T) {
+		assert.Equal(t, "Welcome back. Why?", render(t, turn("Hi", "Hello")))
+	})
+
+	t.Run("last turn", func(t *testing.T) {
+		history := append(turn("Hi", "Hello"), turn("How?", "Like this")...)
+		assert.Equal(t, "Welcome back. Why? This is your last question.", render(t, history))
+	})
+}
+
+// TestIfHistoryHelper tests rendering the history marker only when there is
+// history.
+func TestIfHistoryHelper(t *testing.T) {
+	dp := NewDotprompt(nil)
+	source := "{{role \"system\"}}Be brief.{{#ifHistory}}{{history}}{{else}} This is a new conversation.{{/ifHistory}}{{role \"user\"}}Why?"
+	render := func(t *testing.T, history []Message) []Message {
+		rendered, err := dp.Render(source, &DataArgument{Messages: history}, nil)
+		assert.NoError(t, err)
+		return rendered.Messages
+	}
+
+	t.Run("with history", func(t *testing.T) {
+		messages := render(t, []Message{
+			{Role: RoleUser, Content: []Part{&TextPart{Text: "Hi"}}},
+			{Role: RoleModel, Content: []Part{&TextPart{Text: "Hello"}}},
+		})
+		assert.Len(t, messages, 4)
+		assert.Equal(t, "Be brief.", messages[0].Content[0].(*TextPart).Text)
+		assert.Equal(t, "history", messages[1].Metadata["purpose"])
+	})
+
+	t.Run("without history", func(t *testing.T) {
+		messages := render(t, nil)
+		assert.Len(t, messages, 2)
+		assert.Equal(t, "Be brief. This is a new conversation.", messages[0].Content[0].(*TextPart).Text)
+	})
+
+	t.Run("blank history", func(t *testing.T) {
+		messages := render(t, []Message{{Role: RoleUser, Content: []Part{&TextPart{Text: "  "}}}})
+		assert.Equal(t, "Be brief. This is a new conversation.", messages[0].Content[0].(*TextPart).Text)
+	})
+}
+
+// TestInputSchemaDefaults tests that defaults declared in the input schema
+// fill in missing input.
+func TestInputSchemaDefaults(t *testing.T) {
+	dp := NewDotprompt(nil)
+	source := "---\n" +
+		"input:\n" +
+		"  schema:\n" +
+		"    name?(string, default=friend): the user's name\n" +
+		"    tone?(enum, default=warm): [warm, formal]\n" +
+		"    tips?(integer, default=3): how many tips\n" +
+		"  default:\n" +
+		"    tips: 5\n" +
+		"---\n" +
+		"Give {{name}} {{tips}} {{tone}} tips."
+	render := func(t *testing.T, input map[string]any) string {
+		rendered, err := dp.Render(source, &DataArgument{Input: input}, nil)
+		assert.NoError(t, err)
+		return rendered.Messages[0].Content[0].(*TextPart).Text
+	}
+
+	t.Run("schema defaults fill in missing input", func(t *testing.T) {
+		assert.Equal(t, "Give friend 5 warm tips.", render(t, nil))
+	})
+
+	t.Run("input overrides defaults", func(t *testing.T) {
+		assert.Equal(t, "Give Ada 2 formal tips.", render(t, map[string]any{"name": "Ada", "tips": 2, "tone": "formal"}))
+	})
+}
+
+// TestFrontmatterDecoder tests parsing frontmatter with a custom decoder.
+func TestFrontmatterDecoder(t *testing.T) {
+	// The decoder only accepts the fields of promptFields.
+	type promptFields struct {
+		Model  string         `yaml:"model"`
+		Config map[string]any `yaml:"config"`
+	}
+	decoder := func(data []byte, v any) error {
+		if err := yaml.UnmarshalWithOptions(data, &promptFields{}, yaml.DisallowUnknownField()); err != nil {
+			return err
+		}
+		return yaml.Unmarshal(data, v)
+	}
+	dp := NewDotprompt(&DotpromptOptions{
+		FrontmatterDecoder: decoder,
+		StrictFrontmatter:  true,
+	})
+
+	t.Run("known fields", func(t *testing.T) {
+		parsed, err := dp.Parse("---\nmodel: test-model\nconfig:\n  temperature: 0.5\n---\nHello")
+		assert.NoError(t, err)
+		assert.Equal(t, "test-model", parsed.Model)
+		assert.Equal(t, 0.5, parsed.Config["temperature"])
+		assert.Equal(t, "Hello", parsed.Template)
+	})
+
+	t.Run("unknown field", func(t *testing.T) {
+		_, err := dp.Parse("---\nmodel: test-model\ntemprature: 0.5\n---\nHello")
+		assert.ErrorContains(t, err, "dotprompt: invalid frontmatter")
+		assert.ErrorContains(t, err, "temprature")
+
+		_, err = dp.Render("---\nmodel: test-model\ntemprature: 0.5\n---\nHello", &DataArgument{}, nil)
+		assert.Error(t, err)
+	})
+
+	t.Run("default decoder accepts unknown fields", func(t *testing.T) {
+		parsed, err := NewDotprompt(&DotpromptOptions{StrictFrontmatter: true}).
+			Parse("---\nmodel: test-model\ntemprature: 0.5\n---\nHello")
+		assert.NoError(t, err)
+		assert.Equal(t, 0.5, parsed.Raw["temprature"])
+	})
+}
+
+// TestDocumentSchema tests validating documents before rendering.
+func TestDocumentSchema(t *testing.T) {
+	metadataSchema, err := Picoschema(map[string]any{"source": "string", "page?": "integer"}, &PicoschemaOptions{})
+	assert.NoError(t, err)
+	properties := orderedmap.New[string, *jsonschema.Schema]()
+	properties.Set("metadata", metadataSchema)
+	dp := NewDotprompt(&DotpromptOptions{
+		DocumentSchema: &jsonschema.Schema{
+			Type:       "object",
+			Properties: properties,
+			Required:   []string{"metadata"},
+		},
+	})
+	source := "Summarize the documents."
+	doc := func(metadata Metadata) Document {
+		return Document{
+			HasMetadata: HasMetadata{Metadata: metadata},
+			Content:     []Part{&TextPart{Text: "text"}},
+		}
+	}
+
+	t.Run("conforming docs", func(t *testing.T) {
+		_, err := dp.Render(source, &DataArgument{Docs: []Document{
+			doc(Metadata{"source": "a.pdf", "page": 3}),
+			doc(Metadata{"source": "b.pdf"}),
+		}}, nil)
+		assert.NoError(t, err)
+	})
+
+	t.Run("non-conforming doc", func(t *testing.T) {
+		_, err := dp.Render(source, &DataArgument{Docs: []Document{
+			doc(Metadata{"source": "a.pdf"}),
+			doc(Metadata{"source": "b.pdf", "page": "three"}),
+		}}, nil)
+		assert.EqualError(t, err,
+			"dotprompt: document 1 does not match the document schema: metadata.page: expected integer, got string")
+	})
+
+	t.Run("missing metadata", func(t *testing.T) {
+		_, err := dp.Render(source, &DataArgument{Docs: []Document{doc(nil)}}, nil)
+		assert.ErrorContains(t, err, "document 0 does not match the document schema: missing required property 'metadata'")
+	})
+
+	t.Run("tuple metadata", func(t *testing.T) {
+		schema, err := Picoschema(map[string]any{
+			"metadata": map[string]any{"location(tuple)": []any{"number", "number"}},
+			"content":  "any",
+		}, &PicoschemaOptions{})
+		assert.NoError(t, err)
+		dp := NewDotprompt(&DotpromptOptions{DocumentSchema: schema})
+		_, err = dp.Render(source, &DataArgument{Docs: []Document{doc(Metadata{"location": []any{51.5, -0.1}})}}, nil)
+		assert.NoError(t, err)
+		_, err = dp.Render(source, &DataArgument{Docs: []Document{doc(Metadata{"location": []any{51.5, "west"}})}}, nil)
+		assert.EqualError(t, err,
+			"dotprompt: document 0 does not match the document schema: metadata.location[1]: expected number, got string")
+	})
+}
+
+// TestResolveVariant tests that a variant inherits the metadata and template
+// of its base prompt.
+func TestResolveVariant(t *testing.T) {
+	prompts, err := ParseDocuments(`---
+name: greeter
+model: base-model
+config:
+  temperature: 0.2
+  safety:
+    level: high
+    mode: block
+input:
+  schema:
+    name: string
+team.owner: core
+metadata:
+  tags: [greeting]
+---
+Hello {{name}}!
+===
+---
+name: greeter
+variant: fast
+config:
+  maxOutputTokens: 64
+  safety:
+    mode: warn
+team.tier: fast
+---`)
+	assert.NoError(t, err)
+	assert.Len(t, prompts, 2)
+	base, variant := prompts[0], prompts[1]
+	variant.Metadata = Metadata{"fast": true}
+
+	dp := NewDotprompt(nil)
+	resolved := dp.ResolveVariant(base, variant)
+	assert.Equal(t, "fast", resolved.Variant)
+	assert.Equal(t, "base-model", resolved.Model)
+	assert.Equal(t, map[string]any{"name": "string"}, resolved.Input.Schema)
+	assert.Equal(t, ModelConfig{
+		"temperature":     0.2,
+		"maxOutputTokens": uint64(64),
+		"safety":          map[string]any{"level": "high", "mode": "warn"},
+	}, resolved.Config)
+	assert.Equal(t, map[string]any{"owner": "core", "tier": "fast"}, resolved.Ext["team"])
+	assert.Equal(t, Metadata{"fast": true}, resolved.Metadata)
+	assert.Equal(t, "Hello {{name}}!", resolved.Template)
+
+	assert.Equal(t, map[string]any{"level": "high", "mode": "block"}, base.Config["safety"])
+	assert.Equal(t, map[string]any{"owner": "core"}, base.Ext["team"])
+
+	variant.Template = "Hi {{name}}."
+	assert.Equal(t, "Hi {{name}}.", dp.ResolveVariant(base, variant).Template)
+
+	resolved = dp.ResolveVariant(ParsedPrompt{}, ParsedPrompt{Template: "x"})
+	assert.Nil(t, resolved.Config)
+	assert.Nil(t, resolved.Ext)
+}
+
+// TestNestedEachParentReferences tests the ways an inner `each` block can
+// reference the enclosing iteration. Helpers cannot reach enclosing contexts
+// through raymond, so these are the supported forms.
+func TestNestedEachParentReferences(t *testing.T) {
+	data := &DataArgument{Input: map[string]any{
+		"orders": []any{
+			map[string]any{"id": "A", "items": []any{"pen", "ink"}},
+			map[string]any{"id": "B", "items": []any{"pad"}},
+		},
+	}}
+	tests := []struct {
+		name     string
+		template string
+	}{
+		{"parent path", `{{#each orders}}{{#each items}}{{../id}}{{@../index}}:{{this}};{{/each}}{{/each}}`},
+		{"block params", `{{#each orders as |order i|}}{{#each order.items as |item|}}{{order.id}}{{i}}:{{item}};{{/each}}{{/each}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rendered, err := NewDotprompt(nil).Render(tt.template, data, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, "A0:pen;A0:ink;B1:pad;", rendered.Messages[0].Content[0].(*TextPart).Text)
+		})
+	}
+}
+
+// TestIfConfigHelper tests branching on the model config of the prompt.
+func TestIfConfigHelper(t *testing.T) {
+	source := `---
+config:
+  stream: true
+  maxOutputTokens: 64
+  mode: fast
+---
+{{#ifConfig "stream" true}}streaming{{else}}batch{{/ifConfig}}/{{#ifConfig "maxOutputTokens" 64}}short{{else}}long{{/ifConfig}}/{{#ifConfig "mode" "slow"}}slow{{else}}not slow{{/ifConfig}}/{{#ifConfig "missing" true}}set{{else}}unset{{/ifConfig}}`
+	dp := NewDotprompt(nil)
+
+	rendered, err := dp.Render(source, &DataArgument{}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "streaming/short/not slow/unset", rendered.Messages[0].Content[0].(*TextPart).Text)
+
+	// The config passed to Render replaces the frontmatter config.
+	rendered, err = dp.Render(source, &DataArgument{}, &PromptMetadata{
+		Config: ModelConfig{"stream": false, "mode": "slow"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "batch/long/slow/unset", rendered.Messages[0].Content[0].(*TextPart).Text)
+}
+
+// TestRenderToolMarkers tests templating few-shot tool turns with tool request
+// and response markers.
+func TestRenderToolMarkers(t *testing.T) {
+	dp := NewDotprompt(nil)
+	source := `{{role "user"}}Weather in {{example}}?
+{{role "model"}}<<<dotprompt:tool-request>>> {"name": "getWeather", "input": {"city": "{{example}}", "note": ">>>"}}
+{{role "tool"}}<<<dotprompt:tool-response>>> {"name": "getWeather", "output": {"temp": 21}}
+{{role "model"}}It is 21 degrees.
+{{role "user"}}Weather in {{city}}?`
+	rendered, err := dp.Render(source, &DataArgument{Input: map[string]any{"example": "Paris", "city": "Oslo"}}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, rendered.Messages, 5)
+	assert.Equal(t, []Part{
+		&ToolRequestPart{ToolRequest: map[string]any{"name": "getWeather", "input": map[string]any{"city": "Paris", "note": ">>>"}}},
+	}, rendered.Messages[1].Content)
+	assert.Equal(t, RoleTool, rendered.Messages[2].Role)
+	assert.Equal(t, &ToolResponsePart{ToolResponse: map[string]any{"name": "getWeather", "output": map[string]any{"temp": 21.0}}},
+		rendered.Messages[2].Content[0])
+
+	_, err = dp.Render(`{{role "model"}}<<<dotprompt:tool-request>>> {"tool": "getWeather"}`, &DataArgument{}, nil)
+	assert.ErrorContains(t, err, `invalid tool request piece`)
+}
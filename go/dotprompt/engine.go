@@ -0,0 +1,141 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package dotprompt
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mbleigh/raymond"
+)
+
+// Template is a compiled template that helpers and partials can be registered
+// on. *raymond.Template satisfies this interface.
+type Template interface {
+	// RegisterHelper registers a helper function on the template.
+	RegisterHelper(name string, helper any)
+	// RegisterPartial registers a partial template on the template.
+	RegisterPartial(name string, source string)
+}
+
+// TemplateEngine parses and executes templates. It allows the templating
+// language used to render prompts to be swapped out. The built-in helpers are
+// registered on every template and are raymond helpers, which take a
+// *raymond.Options as their last argument; an engine that calls them must
+// adapt them. Dotprompt.Template is only set for raymond templates.
+type TemplateEngine interface {
+	// Parse compiles the template source.
+	Parse(source string) (Template, error)
+	// Execute renders a template previously returned by Parse. The input is the
+	// template's root context and data holds the private `@` variables.
+	Execute(tpl Template, input map[string]any, data map[string]any) (string, error)
+}
+
+// RaymondEngine is the default TemplateEngine, implementing Handlebars
+// semantics using raymond.
+type RaymondEngine struct{}
+
+// Parse compiles the template source with raymond.
+func (RaymondEngine) Parse(source string) (Template, error) {
+	return raymond.Parse(source)
+}
+
+// Execute renders the template without HTML escaping.
+func (RaymondEngine) Execute(tpl Template, input map[string]any, data map[string]any) (string, error) {
+	raymondTpl, ok := tpl.(*raymond.Template)
+	if !ok {
+		return "", fmt.Errorf("dotprompt: RaymondEngine cannot execute template of type %T", tpl)
+	}
+	privDF := raymond.NewDataFrame()
+	for k, v := range data {
+		privDF.Set(k, v)
+	}
+	return raymondTpl.ExecWith(input, privDF, &raymond.ExecOptions{
+		NoEscape: true,
+	})
+}
+
+// Delimiters are the delimiters that open and close template expressions,
+// such as `[[` and `]]`, used in place of the Handlebars `{{` and `}}` so
+// that templates can contain literal double braces. They are unrelated to
+// the `<<<dotprompt:...>>>` markers.
+type Delimiters struct {
+	// Open opens an expression, e.g. `[[` for `[[name]]`.
+	Open string
+	// Close closes an expression, e.g. `]]` for `[[name]]`.
+	Close string
+}
+
+// isCustom reports whether the delimiters replace the Handlebars ones.
+func (d Delimiters) isCustom() bool {
+	return d.Open != "" && d.Close != "" && (d.Open != "{{" || d.Close != "}}")
+}
+
+// translateDelimiters rewrites a template written with the delimiters into
+// Handlebars syntax: expressions are rewritten to use `{{` and `}}`, and the
+// text outside of them is escaped with escapeText so it renders as written.
+func translateDelimiters(template string, d Delimiters) (string, error) {
+	var b strings.Builder
+	for {
+		start := strings.Index(template, d.Open)
+		if start < 0 {
+			b.WriteString(escapeText(template, false))
+			return b.String(), nil
+		}
+		b.WriteString(escapeText(template[:start], true))
+		template = template[start+len(d.Open):]
+		end := strings.Index(template, d.Close)
+		if end < 0 {
+			return "", fmt.Errorf("dotprompt: unclosed template delimiter '%s'", d.Open)
+		}
+		b.WriteString("{{")
+		b.WriteString(template[:end])
+		b.WriteString("}}")
+		template = template[end+len(d.Close):]
+	}
+}
+
+// escapeText escapes literal text for Handlebars. Each `{{` is escaped as
+// `\{{`. A backslash right before a `{{`, or before the expression that
+// follows the text, would escape the braces, so it is written as `\\{{!}}`:
+// an escaped backslash followed by an empty comment.
+func escapeText(text string, beforeExpression bool) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(text, "{{")
+		if i < 0 {
+			break
+		}
+		b.WriteString(escapeTrailingBackslash(text[:i]))
+		b.WriteString("\\{{")
+		text = text[i+len("{{"):]
+	}
+	if beforeExpression {
+		text = escapeTrailingBackslash(text)
+	}
+	b.WriteString(text)
+	return b.String()
+}
+
+// escapeTrailingBackslash rewrites a backslash at the end of the text as
+// `\\{{!}}`. See escapeText.
+func escapeTrailingBackslash(text string) string {
+	if rest, ok := strings.CutSuffix(text, "\\"); ok {
+		return rest + "\\\\{{!}}"
+	}
+	return text
+}
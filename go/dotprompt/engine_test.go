@@ -0,0 +1,191 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package dotprompt
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// stubTemplate is a Template that substitutes `${key}` placeholders.
+type stubTemplate struct {
+	source   string
+	helpers  map[string]any
+	partials map[string]string
+}
+
+func (t *stubTemplate) RegisterHelper(name string, helper any) {
+	t.helpers[name] = helper
+}
+
+func (t *stubTemplate) RegisterPartial(name string, source string) {
+	t.partials[name] = source
+}
+
+// stubEngine is a trivial TemplateEngine used to exercise the engine seam.
+type stubEngine struct {
+	parsed []*stubTemplate
+}
+
+func (e *stubEngine) Parse(source string) (Template, error) {
+	tpl := &stubTemplate{
+		source:   source,
+		helpers:  make(map[string]any),
+		partials: make(map[string]string),
+	}
+	e.parsed = append(e.parsed, tpl)
+	return tpl, nil
+}
+
+func (e *stubEngine) Execute(tpl Template, input map[string]any, data map[string]any) (string, error) {
+	out := tpl.(*stubTemplate).source
+	for k, v := range input {
+		out = strings.ReplaceAll(out, "${"+k+"}", fmt.Sprint(v))
+	}
+	for k, v := range data {
+		out = strings.ReplaceAll(out, "${@"+k+"}", fmt.Sprint(v))
+	}
+	return out, nil
+}
+
+func TestTemplateEngine(t *testing.T) {
+	t.Run("renders with a custom engine", func(t *testing.T) {
+		engine := &stubEngine{}
+		dp := NewDotprompt(&DotpromptOptions{
+			TemplateEngine: engine,
+			Helpers:        map[string]any{"shout": strings.ToUpper},
+			Partials:       map[string]string{"greeting": "Hi"},
+		})
+
+		rendered, err := dp.Render("Hello ${name} from ${@team}!", &DataArgument{
+			Input:   map[string]any{"name": "World"},
+			Context: map[string]any{"team": "dotprompt"},
+		}, nil)
+		assert.NoError(t, err)
+		assert.Len(t, rendered.Messages, 1)
+		textPart, ok := rendered.Messages[0].Content[0].(*TextPart)
+		assert.True(t, ok)
+		assert.Equal(t, "Hello World from dotprompt!", textPart.Text)
+
+		assert.Len(t, engine.parsed, 1)
+		assert.Contains(t, engine.parsed[0].helpers, "shout")
+		assert.Contains(t, engine.parsed[0].helpers, "json")
+		assert.Equal(t, "Hi", engine.parsed[0].partials["greeting"])
+		assert.Nil(t, dp.Template)
+	})
+
+	t.Run("defaults to the raymond engine", func(t *testing.T) {
+		dp := NewDotprompt(nil)
+		assert.IsType(t, RaymondEngine{}, dp.engine)
+
+		rendered, err := dp.Render("Hello {{name}}!", &DataArgument{
+			Input: map[string]any{"name": "World"},
+		}, nil)
+		assert.NoError(t, err)
+		textPart, ok := rendered.Messages[0].Content[0].(*TextPart)
+		assert.True(t, ok)
+		assert.Equal(t, "Hello World!", textPart.Text)
+		assert.NotNil(t, dp.Template)
+	})
+
+	t.Run("raymond engine rejects foreign templates", func(t *testing.T) {
+		_, err := RaymondEngine{}.Execute(&stubTemplate{}, nil, nil)
+		assert.Error(t, err)
+	})
+}
+
+func TestTranslateDelimiters(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		want     string
+		wantErr  bool
+	}{
+		{"expressions", "Hi [[name]]![[#if x]] [[> p]][[/if]]", "Hi {{name}}!{{#if x}} {{> p}}{{/if}}", false},
+		{"literal braces", "Use {{name}} for [[name]].", "Use \\{{name}} for {{name}}.", false},
+		{"no expressions", "plain }} text", "plain }} text", false},
+		{"escaped literal braces", `Use \{{name}} for [[name]].`, `Use \\{{!}}\{{name}} for {{name}}.`, false},
+		{"backslash before expression", `C:\[[dir]]`, `C:\\{{!}}{{dir}}`, false},
+		{"other backslashes", `a\b \\{{`, `a\b \\\{{!}}\{{`, false},
+		{"unclosed", "Hi [[name", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := translateDelimiters(tt.template, Delimiters{Open: "[[", Close: "]]"})
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestRenderDelimiters(t *testing.T) {
+	source := "---\ninput:\n  schema:\n    name: string\n---\n" +
+		"Write a Handlebars greeting like {{greeting name}} for [[name]].[[> footer]]"
+	data := &DataArgument{Input: map[string]any{"name": "Ada"}}
+	render := func(dp *Dotprompt) string {
+		rendered, err := dp.Render(source, data, nil)
+		assert.NoError(t, err)
+		return rendered.Messages[0].Content[0].(*TextPart).Text
+	}
+
+	t.Run("custom delimiters", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{
+			Delimiters: Delimiters{Open: "[[", Close: "]]"},
+			Partials:   map[string]string{"footer": " {{json}} is [[#if name]]literal[[/if]]."},
+		})
+		assert.Equal(t, "Write a Handlebars greeting like {{greeting name}} for Ada. {{json}} is literal.", render(dp))
+		assert.Empty(t, dp.Lint(source, nil))
+
+		names, err := dp.ExtractPartialNames(source)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"footer"}, names)
+	})
+
+	t.Run("default delimiters", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{
+			Partials: map[string]string{"footer": ""},
+		})
+		assert.NotContains(t, render(dp), "{{greeting name}}")
+	})
+
+	t.Run("literal backslashes", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{Delimiters: Delimiters{Open: "[[", Close: "]]"}})
+		for template, want := range map[string]string{
+			`Escape with \{{name}}.`:    `Escape with \{{name}}.`,
+			`Escape with \\{{name}}.`:   `Escape with \\{{name}}.`,
+			`Path C:\[[name]]\[[name]]`: `Path C:\Ada\Ada`,
+			`Trailing \`:                `Trailing \`,
+		} {
+			rendered, err := dp.Render(template, data, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, want, rendered.Messages[0].Content[0].(*TextPart).Text)
+		}
+	})
+
+	t.Run("unclosed delimiter", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{Delimiters: Delimiters{Open: "[[", Close: "]]"}})
+		_, err := dp.Render("Hi [[name", data, nil)
+		assert.ErrorContains(t, err, "unclosed template delimiter")
+	})
+}
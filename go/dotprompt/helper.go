@@ -17,49 +17,134 @@
 package dotprompt
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"maps"
+	"math"
+	"math/rand"
+	"path"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/mbleigh/raymond"
 )
 
 var templateHelpers = map[string]any{
 	"json":         JSON,
-	"role":         RoleFn,
+	"jsonBlock":    JSONBlock,
+	"role":         roleHelper,
 	"history":      History,
 	"section":      Section,
 	"media":        MediaFn,
 	"ifEquals":     IfEquals,
 	"unlessEquals": UnlessEquals,
+	"matches":      Matches,
+	"ifMatches":    IfMatches,
+	"ensureSuffix": EnsureSuffix,
+	"ensurePrefix": EnsurePrefix,
+	"snakeCase":    SnakeCase,
+	"camelCase":    CamelCase,
+	"kebabCase":    KebabCase,
+	"count":        Count,
+	"length":       Count,
+	"wrap":         Wrap,
+	"looseEquals":  LooseEquals,
+	"lookup":       Lookup,
+	"slice":        Slice,
+	"first":        First,
+	"last":         Last,
+	"meta":         Meta,
+	"hashId":       HashID,
+	"ifFirstTurn":  IfFirstTurn,
+	"ifLastTurn":   IfLastTurn,
+	"eachLimit":    EachLimit,
+	"let":          Let,
+	"assign":       Let,
+	"isString":     IsString,
+	"isArray":      IsArray,
+	"isObject":     IsObject,
+	"isNumber":     IsNumber,
+	"ifString":     IfString,
+	"ifArray":      IfArray,
+	"ifObject":     IfObject,
+	"ifNumber":     IfNumber,
+	"ifHistory":    IfHistory,
+	"itemsCount":   ItemsCount,
+	"pluralize":    Pluralize,
+	"ifConfig":     IfConfig,
 }
 
 // TODO: Add pending: true for section helper
 // JSON serializes the given data to a JSON string with optional indentation.
 func JSON(serializable any, options *raymond.Options) raymond.SafeString {
-	var jsonData []byte
-	var err error
-	if options.HashProp("indent") == nil {
-		jsonData, err = json.Marshal(serializable)
-	} else {
-		indent := options.HashProp("indent").(int)
-		indentStr := ""
-		for range indent {
-			indentStr += " "
-		}
-		jsonData, err = json.MarshalIndent(serializable, "", indentStr)
+	jsonData, err := marshalJSON(serializable, options)
+	if err != nil {
+		return ""
 	}
+	return raymond.SafeString(string(jsonData))
+}
 
+// JSONBlock serializes the given data like JSON and wraps it in a ```json
+// fenced code block. It accepts the same `indent` option as JSON.
+func JSONBlock(serializable any, options *raymond.Options) raymond.SafeString {
+	return raymond.SafeString("```json\n" + string(JSON(serializable, options)) + "\n```")
+}
+
+// strictJSON is JSON for DotpromptOptions.StrictHelpers: a value that can't
+// be serialized fails the render instead of producing empty output.
+func strictJSON(serializable any, options *raymond.Options) raymond.SafeString {
+	jsonData, err := marshalJSON(serializable, options)
 	if err != nil {
-		return ""
+		// Raymond reports helper panics with an error value as render errors.
+		panic(fmt.Errorf("dotprompt: json helper: %w", err))
 	}
 	return raymond.SafeString(string(jsonData))
 }
 
+// strictJSONBlock is JSONBlock for DotpromptOptions.StrictHelpers.
+func strictJSONBlock(serializable any, options *raymond.Options) raymond.SafeString {
+	return raymond.SafeString("```json\n" + string(strictJSON(serializable, options)) + "\n```")
+}
+
+// marshalJSON serializes the given data, indented by the number of spaces in
+// the `indent` option if set.
+func marshalJSON(serializable any, options *raymond.Options) ([]byte, error) {
+	if options.HashProp("indent") == nil {
+		return json.Marshal(serializable)
+	}
+	indent := options.HashProp("indent").(int)
+	indentStr := ""
+	for range indent {
+		indentStr += " "
+	}
+	return json.MarshalIndent(serializable, "", indentStr)
+}
+
 // Role returns a formatted role string.
 func RoleFn(role string) raymond.SafeString {
 	return raymond.SafeString(fmt.Sprintf("<<<dotprompt:role:%s>>>", role))
 }
 
+// roleHelper is the role helper. Hash arguments are attached to the resulting
+// message as metadata, e.g. {{role "model" model="gpt-4"}}.
+func roleHelper(role string, options *raymond.Options) raymond.SafeString {
+	if options != nil && len(options.Hash()) > 0 {
+		// json.Marshal escapes '<' and '>', so the metadata can't terminate the
+		// marker early.
+		metadata, err := json.Marshal(options.Hash())
+		if err == nil {
+			return raymond.SafeString(fmt.Sprintf("<<<dotprompt:role:%s %s>>>", role, metadata))
+		}
+	}
+	return RoleFn(role)
+}
+
 // History returns a formatted history string.
 func History() raymond.SafeString {
 	return raymond.SafeString("<<<dotprompt:history>>>")
@@ -70,6 +155,114 @@ func Section(name string) raymond.SafeString {
 	return raymond.SafeString(fmt.Sprintf("<<<dotprompt:section %s>>>", name))
 }
 
+// Meta returns a field of the metadata of the prompt being rendered, so that
+// prompts can refer to themselves, e.g. {{meta "version"}}. The supported keys
+// are "name", "variant", "version", "description", and "model". The metadata
+// is read from the `@metadata` data variable rather than the input, so it
+// can't collide with input fields.
+func Meta(key string, options *raymond.Options) string {
+	metadata, _ := options.Data("metadata").(map[string]any)
+	prompt, ok := metadata["prompt"].(PromptMetadata)
+	if !ok {
+		return ""
+	}
+	switch key {
+	case "name":
+		return prompt.Name
+	case "variant":
+		return prompt.Variant
+	case "version":
+		return prompt.Version
+	case "description":
+		return prompt.Description
+	case "model":
+		return prompt.Model
+	default:
+		return ""
+	}
+}
+
+// conversationTurn returns the number of the conversation turn being rendered.
+// A turn begins with a user message, so this is one more than the number of
+// user messages in the history passed as DataArgument.Messages; the first
+// turn is the one rendered without any user messages in the history.
+func conversationTurn(options *raymond.Options) int {
+	metadata, _ := options.Data("metadata").(map[string]any)
+	messages, _ := metadata["messages"].([]Message)
+	turn := 1
+	for _, msg := range messages {
+		if msg.Role == RoleUser {
+			turn++
+		}
+	}
+	return turn
+}
+
+// IfFirstTurn renders its block on the first turn of a conversation, i.e.
+// when the history contains no user messages, and its inverse otherwise.
+func IfFirstTurn(options *raymond.Options) string {
+	if conversationTurn(options) == 1 {
+		return options.Fn()
+	}
+	return options.Inverse()
+}
+
+// IfLastTurn renders its block when the turn being rendered is the last turn
+// of a conversation limited to the number of turns given by the maxTurns hash
+// argument, e.g. {{#ifLastTurn maxTurns=5}}, and its inverse otherwise. Turns
+// past the limit also count as the last turn. Without a positive maxTurns no
+// turn is the last.
+func IfLastTurn(options *raymond.Options) string {
+	maxTurns, ok := toFloat(options.HashProp("maxTurns"))
+	if ok && maxTurns > 0 && float64(conversationTurn(options)) >= maxTurns {
+		return options.Fn()
+	}
+	return options.Inverse()
+}
+
+// IfHistory renders its block when the history passed as DataArgument.Messages
+// has a message with content other than blank text, and its inverse otherwise,
+// e.g. to only place {{history}} in a turn of its own when there is history to
+// insert.
+func IfHistory(options *raymond.Options) string {
+	metadata, _ := options.Data("metadata").(map[string]any)
+	messages, _ := metadata["messages"].([]Message)
+	return fnIf(slices.ContainsFunc(messages, hasContent), options)
+}
+
+// IfConfig renders its block when the model config of the prompt being
+// rendered has the key set to the expected value, and its inverse otherwise,
+// including when the key is not set, e.g. {{#ifConfig "stream" true}}.
+// Numbers are compared by value, so an integer in the template matches the
+// same number decoded from the frontmatter.
+func IfConfig(key string, expected any, options *raymond.Options) string {
+	metadata, _ := options.Data("metadata").(map[string]any)
+	prompt, _ := metadata["prompt"].(PromptMetadata)
+	value, ok := prompt.Config[key]
+	return fnIf(ok && configValueEqual(value, expected), options)
+}
+
+// configValueEqual reports whether a config value equals the expected value,
+// comparing numbers of any type by value.
+func configValueEqual(value, expected any) bool {
+	if IsNumber(value) && IsNumber(expected) {
+		a, okA := toFloat(value)
+		b, okB := toFloat(expected)
+		return okA && okB && a == b
+	}
+	return reflect.DeepEqual(value, expected)
+}
+
+// hasContent reports whether the message has a part other than blank text.
+func hasContent(msg Message) bool {
+	for _, part := range msg.Content {
+		if text, ok := part.(*TextPart); !ok || strings.TrimSpace(text.Text) != "" {
+			return true
+		}
+	}
+	return false
+}
+
 // Media returns a formatted media string.
 func MediaFn(options *raymond.Options) raymond.SafeString {
 	url := options.HashStr("url")
@@ -95,3 +288,505 @@ func UnlessEquals(arg1, arg2 any, options *raymond.Options) string {
 	}
 	return options.Inverse()
 }
+
+// LooseEquals compares two values after coercion and returns the appropriate
+// template content. Unlike IfEquals, which uses strict Go equality, values
+// that can both be interpreted as numbers (any numeric type, or a string that
+// parses as a number) are compared numerically, so 1, 1.0 and "1" are equal.
+// Likewise, bools equal the strings "true" and "false". All other values,
+// including nil, are compared strictly.
+func LooseEquals(arg1, arg2 any, options *raymond.Options) string {
+	if looselyEqual(arg1, arg2) {
+		return options.Fn()
+	}
+	return options.Inverse()
+}
+
+// looselyEqual reports whether two values are equal under the coercion rules
+// of LooseEquals.
+func looselyEqual(a, b any) bool {
+	if numA, ok := toFloat(a); ok {
+		numB, ok := toFloat(b)
+		return ok && numA == numB
+	}
+	if boolA, ok := toBool(a); ok {
+		boolB, ok := toBool(b)
+		return ok && boolA == boolB
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// toBool converts bools and the strings "true" and "false" to bool.
+func toBool(value any) (bool, bool) {
+	switch v := value.(type) {
+	case bool:
+		return v, true
+	case string:
+		switch v {
+		case "true":
+			return true, true
+		case "false":
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// toFloat converts numeric values and numeric strings to float64.
+func toFloat(value any) (float64, bool) {
+	switch v := value.(type) {
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	case nil:
+		return 0, false
+	}
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	default:
+		return 0, false
+	}
+}
+
+// Matches reports whether the string matches the glob pattern. Patterns use
+// path.Match semantics: '*' matches any sequence of characters other than '/',
+// '?' matches a single character other than '/', and malformed patterns never
+// match. It is intended for use as a subexpression, e.g.
+// {{#if (matches path "/api/*/users")}}.
+func Matches(str, pattern string) bool {
+	matched, err := path.Match(pattern, str)
+	if err != nil {
+		return false
+	}
+	return matched
+}
+
+// IfMatches renders the block when the string matches the glob pattern and the
+// inverse block otherwise. See Matches for the pattern semantics.
+func IfMatches(str, pattern string, options *raymond.Options) string {
+	if Matches(str, pattern) {
+		return options.Fn()
+	}
+	return options.Inverse()
+}
+
+// EnsureSuffix appends the suffix to the text unless it already ends with it.
+func EnsureSuffix(text, suffix any) raymond.SafeString {
+	str, sfx := stringOrEmpty(text), stringOrEmpty(suffix)
+	if strings.HasSuffix(str, sfx) {
+		return raymond.SafeString(str)
+	}
+	return raymond.SafeString(str + sfx)
+}
+
+// EnsurePrefix prepends the prefix to the text unless it already starts with it.
+func EnsurePrefix(text, prefix any) raymond.SafeString {
+	str, pfx := stringOrEmpty(text), stringOrEmpty(prefix)
+	if strings.HasPrefix(str, pfx) {
+		return raymond.SafeString(str)
+	}
+	return raymond.SafeString(pfx + str)
+}
+
+// SnakeCase converts the text to snake_case.
+func SnakeCase(text any) raymond.SafeString {
+	words := splitWords(stringOrEmpty(text))
+	for i, word := range words {
+		words[i] = strings.ToLower(word)
+	}
+	return raymond.SafeString(strings.Join(words, "_"))
+}
+
+// KebabCase converts the text to kebab-case.
+func KebabCase(text any) raymond.SafeString {
+	words := splitWords(stringOrEmpty(text))
+	for i, word := range words {
+		words[i] = strings.ToLower(word)
+	}
+	return raymond.SafeString(strings.Join(words, "-"))
+}
+
+// CamelCase converts the text to camelCase.
+func CamelCase(text any) raymond.SafeString {
+	words := splitWords(stringOrEmpty(text))
+	for i, word := range words {
+		word = strings.ToLower(word)
+		if i > 0 {
+			runes := []rune(word)
+			runes[0] = unicode.ToUpper(runes[0])
+			word = string(runes)
+		}
+		words[i] = word
+	}
+	return raymond.SafeString(strings.Join(words, ""))
+}
+
+// splitWords splits text into words on any non-alphanumeric delimiter and on
+// case boundaries. Runs of uppercase letters are treated as acronyms, so
+// "parseHTTPRequest" splits into "parse", "HTTP" and "Request".
+func splitWords(text string) []string {
+	var words []string
+	var current []rune
+	runes := []rune(text)
+	flush := func() {
+		if len(current) > 0 {
+			words = append(words, string(current))
+			current = nil
+		}
+	}
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			flush()
+			continue
+		}
+		if len(current) > 0 && unicode.IsUpper(r) {
+			prev := current[len(current)-1]
+			nextIsLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if !unicode.IsUpper(prev) || nextIsLower {
+				flush()
+			}
+		}
+		current = append(current, r)
+	}
+	flush()
+	return words
+}
+
+// Count returns the length of a slice, array, or map, or the number of runes in
+// a string, following pointers, e.g. to struct fields. It returns 0 for nil
+// and any other type. It is registered as both `count` and `length`.
+func Count(value any) int {
+	v, ok := indirectValue(value)
+	if !ok {
+		return 0
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return utf8.RuneCountInString(v.String())
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return v.Len()
+	default:
+		return 0
+	}
+}
+
+// ItemsCount renders a count with the singular or plural noun, e.g.
+// {{itemsCount count "item" "items" "no items"}} renders "no items", "1 item",
+// or "3 items". A count of zero renders the zero phrase, or "0 items" if it is
+// empty. Integer and float counts are supported; anything else counts as 0.
+func ItemsCount(count any, singular, plural, zero string) raymond.SafeString {
+	n, _ := toFloat(count)
+	switch {
+	case n == 0 && zero != "":
+		return raymond.SafeString(zero)
+	case n == 1:
+		return raymond.SafeString("1 " + singular)
+	default:
+		return raymond.SafeString(strconv.FormatFloat(n, 'f', -1, 64) + " " + plural)
+	}
+}
+
+// Pluralize returns the singular form when the count is exactly 1 and the
+// plural form otherwise, including for zero, e.g.
+// {{pluralize count "item" "items"}}. Integer, float, and numeric string
+// counts are supported; anything else takes the plural form.
+func Pluralize(count any, singular, plural string) raymond.SafeString {
+	if n, ok := toFloat(count); ok && n == 1 {
+		return raymond.SafeString(singular)
+	}
+	return raymond.SafeString(plural)
+}
+
+// Lookup returns the element at the index of a slice or array, or otherwise
+// falls back to the built-in lookup of a field by name. Negative indices count
+// from the end, so {{lookup messages -1}} is the last message, and fractional
+// indices are truncated toward zero. Out-of-range indices return nil.
+func Lookup(obj any, field any, options *raymond.Options) any {
+	if list, ok := listValue(obj); ok {
+		if index, ok := toFloat(field); ok {
+			i, ok := resolveIndex(list.Len(), index)
+			if !ok {
+				return nil
+			}
+			return list.Index(i).Interface()
+		}
+	}
+	return raymond.Str(options.Eval(obj, raymond.Str(field)))
+}
+
+// Slice returns the elements of a slice or array from the start index up to,
+// but excluding, the optional `end` hash argument, e.g.
+// {{#each (slice docs -3)}} or {{#each (slice docs 1 end=-1)}}. Negative
+// indices count from the end and out-of-range indices are clamped, following
+// JavaScript's Array.prototype.slice. Other values return nil.
+func Slice(value any, start any, options *raymond.Options) any {
+	list, ok := listValue(value)
+	if !ok {
+		return nil
+	}
+	n := list.Len()
+	from := clampIndex(n, start, 0)
+	to := clampIndex(n, options.HashProp("end"), n)
+	if to < from {
+		to = from
+	}
+	return list.Slice(from, to).Interface()
+}
+
+// First returns the first element of a slice or array, or nil if it is empty.
+func First(value any) any {
+	list, ok := listValue(value)
+	if !ok || list.Len() == 0 {
+		return nil
+	}
+	return list.Index(0).Interface()
+}
+
+// Last returns the last element of a slice or array, or nil if it is empty.
+func Last(value any) any {
+	list, ok := listValue(value)
+	if !ok || list.Len() == 0 {
+		return nil
+	}
+	return list.Index(list.Len() - 1).Interface()
+}
+
+// RandomItem returns a random element of a slice or array chosen with r, or
+// nil if it is nil or empty. It is registered as the `randomItem` helper using
+// the random source from DotpromptOptions.RandSource.
+func RandomItem(items any, r *rand.Rand) any {
+	list, ok := listValue(items)
+	if !ok || list.Len() == 0 {
+		return nil
+	}
+	return list.Index(r.Intn(list.Len())).Interface()
+}
+
+// HashID returns a short, stable identifier for the content: the first 8 hex
+// characters of its SHA-256 hash. Non-string values are hashed by their
+// rendered string form.
+func HashID(content any) raymond.SafeString {
+	sum := sha256.Sum256([]byte(raymond.Str(content)))
+	return raymond.SafeString(hex.EncodeToString(sum[:])[:8])
+}
+
+// EachLimit iterates over at most limit items of a list like the built-in
+// each helper, e.g. {{#eachLimit items 3}}...{{/eachLimit}}. In addition to
+// @index, @first, and @last, the block can use @remaining, the number of items
+// left out, and @truncated, whether any items were left out. The inverse block
+// is rendered for an empty list or a value that is not a list. A limit that is
+// not a number is treated as zero.
+func EachLimit(items any, limit any, options *raymond.Options) string {
+	list, ok := listValue(items)
+	if !ok || list.Len() == 0 {
+		return options.Inverse()
+	}
+	n := list.Len()
+	shown := 0
+	if l, ok := toFloat(limit); ok && l > 0 {
+		shown = min(n, int(l))
+	}
+
+	var sb strings.Builder
+	for i := range shown {
+		data := options.NewDataFrame()
+		data.Set("index", i)
+		data.Set("first", i == 0)
+		data.Set("last", i == shown-1)
+		data.Set("remaining", n-shown)
+		data.Set("truncated", shown < n)
+		sb.WriteString(options.FnCtxData(list.Index(i).Interface(), data))
+	}
+	return sb.String()
+}
+
+// Let renders its block with the hash arguments bound as names in the block
+// context, so that a value can be computed once and referenced several times,
+// e.g. {{#let total=(add a b)}}Total is {{total}}{{/let}}. It is also
+// registered as `assign`. The bindings are only visible inside the block and
+// shadow fields of the same name. When the current context is not a map, the
+// block context holds only the bindings and the outer context remains
+// reachable as `../`.
+func Let(options *raymond.Options) string {
+	ctx := map[string]any{}
+	if outer, ok := options.Ctx().(map[string]any); ok {
+		maps.Copy(ctx, outer)
+	}
+	maps.Copy(ctx, options.Hash())
+	return options.FnWith(ctx)
+}
+
+// IsString reports whether the value is a string. Like the other type tests,
+// it is intended for use as a subexpression, e.g.
+// {{#if (isString input)}}, and has a block form, here `ifString`, that
+// renders its block when the test passes and the inverse block otherwise.
+// Pointers are followed and nil is none of the types.
+func IsString(value any) bool {
+	if _, ok := value.(json.Number); ok {
+		return false
+	}
+	v, ok := indirectValue(value)
+	return ok && v.Kind() == reflect.String
+}
+
+// IsArray reports whether the value is a list, such as a []any decoded from
+// JSON or YAML input. See IsString.
+func IsArray(value any) bool {
+	v, ok := indirectValue(value)
+	return ok && (v.Kind() == reflect.Slice || v.Kind() == reflect.Array)
+}
+
+// IsObject reports whether the value is a map, such as a map[string]any
+// decoded from JSON or YAML input, or a struct. See IsString.
+func IsObject(value any) bool {
+	v, ok := indirectValue(value)
+	return ok && (v.Kind() == reflect.Map || v.Kind() == reflect.Struct)
+}
+
+// IsNumber reports whether the value is of a numeric type, including
+// json.Number. Numeric strings are not numbers. See IsString.
+func IsNumber(value any) bool {
+	if _, ok := value.(json.Number); ok {
+		return true
+	}
+	v, ok := indirectValue(value)
+	if !ok {
+		return false
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	default:
+		return false
+	}
+}
+
+// IfString renders the block if the value is a string. See IsString.
+func IfString(value any, options *raymond.Options) string {
+	return fnIf(IsString(value), options)
+}
+
+// IfArray renders the block if the value is a list. See IsArray.
+func IfArray(value any, options *raymond.Options) string {
+	return fnIf(IsArray(value), options)
+}
+
+// IfObject renders the block if the value is a map or struct. See IsObject.
+func IfObject(value any, options *raymond.Options) string {
+	return fnIf(IsObject(value), options)
+}
+
+// IfNumber renders the block if the value is a number. See IsNumber.
+func IfNumber(value any, options *raymond.Options) string {
+	return fnIf(IsNumber(value), options)
+}
+
+// fnIf renders the block if the condition holds and the inverse block
+// otherwise.
+func fnIf(condition bool, options *raymond.Options) string {
+	if condition {
+		return options.Fn()
+	}
+	return options.Inverse()
+}
+
+// indirectValue returns the reflected value, following pointers, or false for
+// nil.
+func indirectValue(value any) (reflect.Value, bool) {
+	v := reflect.ValueOf(value)
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}, false
+		}
+		v = v.Elem()
+	}
+	return v, v.IsValid()
+}
+
+// listValue returns the reflected value if it is a slice or array.
+func listValue(value any) (reflect.Value, bool) {
+	if value == nil {
+		return reflect.Value{}, false
+	}
+	v := reflect.ValueOf(value)
+	if v.Kind() == reflect.Array && !v.CanAddr() {
+		// Arrays must be addressable to be sliced.
+		ptr := reflect.New(v.Type())
+		ptr.Elem().Set(v)
+		v = ptr.Elem()
+	}
+	return v, v.Kind() == reflect.Slice || v.Kind() == reflect.Array
+}
+
+// resolveIndex converts a possibly negative or fractional index into an offset
+// into a list of length n, reporting false if it is out of range.
+func resolveIndex(n int, index float64) (int, bool) {
+	i := int(math.Trunc(index))
+	if i < 0 {
+		i += n
+	}
+	if i < 0 || i >= n {
+		return 0, false
+	}
+	return i, true
+}
+
+// clampIndex converts a possibly negative or fractional index into an offset
+// clamped to [0, n], returning def if the index is missing or not a number.
+func clampIndex(n int, index any, def int) int {
+	f, ok := toFloat(index)
+	if !ok {
+		return def
+	}
+	i := int(math.Trunc(f))
+	if i < 0 {
+		i += n
+	}
+	return max(0, min(i, n))
+}
+
+// Wrap hard-wraps the text at the column width on word boundaries. Existing
+// newlines (and so paragraph breaks) are preserved, widths are counted in
+// runes, and words longer than the width are placed on a line of their own
+// rather than being broken. Lines are split only at single spaces, and each
+// line's leading indentation is kept and repeated on its continuation lines.
+// A non-positive width returns the text unchanged.
+func Wrap(text any, width int) raymond.SafeString {
+	str := stringOrEmpty(text)
+	if width <= 0 {
+		return raymond.SafeString(str)
+	}
+
+	lines := strings.Split(str, "\n")
+	for i, line := range lines {
+		rest := strings.TrimLeft(line, " \t")
+		indent := line[:len(line)-len(rest)]
+		indentLen := utf8.RuneCountInString(indent)
+
+		var b strings.Builder
+		b.WriteString(indent)
+		lineLen := indentLen
+		for j, word := range strings.Split(rest, " ") {
+			wordLen := utf8.RuneCountInString(word)
+			if j > 0 && lineLen > indentLen && lineLen+1+wordLen > width {
+				b.WriteString("\n" + indent)
+				lineLen = indentLen
+			} else if j > 0 {
+				b.WriteString(" ")
+				lineLen++
+			}
+			b.WriteString(word)
+			lineLen += wordLen
+		}
+		lines[i] = b.String()
+	}
+	return raymond.SafeString(strings.Join(lines, "\n"))
+}
@@ -17,6 +17,9 @@
 package dotprompt
 
 import (
+	"encoding/json"
+	"math/rand"
+	"strings"
 	"testing"
 
 	"github.com/mbleigh/raymond"
@@ -32,6 +35,16 @@ func TestRoleFn(t *testing.T) {
 	assert.Equal(t, raymond.SafeString(expected), result)
 }
 
+func TestRoleHelperMetadata(t *testing.T) {
+	tpl, err := raymond.Parse(`{{role "model" model="gpt-4" temperature=0.5 note="a>b"}}`)
+	assert.NoError(t, err)
+	tpl.RegisterHelper("role", roleHelper)
+
+	result, err := tpl.Exec(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `<<<dotprompt:role:model {"model":"gpt-4","note":"a\u003eb","temperature":0.5}>>>`, result)
+}
+
 func TestHistory(t *testing.T) {
 	expected := "<<<dotprompt:history>>>"
 	result := History()
@@ -44,3 +57,482 @@ func TestSection(t *testing.T) {
 	result := Section(name)
 	assert.Equal(t, raymond.SafeString(expected), result)
 }
+
+func TestMatches(t *testing.T) {
+	assert.True(t, Matches("/api/v1/users", "/api/*/users"))
+	assert.True(t, Matches("file.txt", "file.???"))
+	assert.False(t, Matches("/api/v1/groups", "/api/*/users"))
+	// '*' does not span path segments.
+	assert.False(t, Matches("/api/v1/beta/users", "/api/*/users"))
+	// Malformed patterns never match.
+	assert.False(t, Matches("abc", "[a"))
+}
+
+func TestIfMatches(t *testing.T) {
+	tpl, err := raymond.Parse(`{{#ifMatches path "/api/*/users"}}yes{{else}}no{{/ifMatches}}` +
+		`{{#if (matches path "/api/*")}}!{{/if}}`)
+	assert.NoError(t, err)
+	tpl.RegisterHelper("matches", Matches)
+	tpl.RegisterHelper("ifMatches", IfMatches)
+
+	result, err := tpl.Exec(map[string]any{"path": "/api/v1/users"})
+	assert.NoError(t, err)
+	assert.Equal(t, "yes", result)
+
+	result, err = tpl.Exec(map[string]any{"path": "/api/v1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "no!", result)
+}
+
+func TestEnsureSuffix(t *testing.T) {
+	assert.Equal(t, raymond.SafeString("Done."), EnsureSuffix("Done", "."))
+	assert.Equal(t, raymond.SafeString("Done."), EnsureSuffix("Done.", "."))
+	assert.Equal(t, raymond.SafeString("."), EnsureSuffix(nil, "."))
+}
+
+func TestEnsurePrefix(t *testing.T) {
+	assert.Equal(t, raymond.SafeString("- item"), EnsurePrefix("item", "- "))
+	assert.Equal(t, raymond.SafeString("- item"), EnsurePrefix("- item", "- "))
+	assert.Equal(t, raymond.SafeString("item"), EnsurePrefix("item", nil))
+}
+
+func TestCaseConversion(t *testing.T) {
+	tests := []struct {
+		input string
+		snake string
+		camel string
+		kebab string
+	}{
+		{"Hello World", "hello_world", "helloWorld", "hello-world"},
+		{"helloWorld", "hello_world", "helloWorld", "hello-world"},
+		{"parse_HTTP-request", "parse_http_request", "parseHttpRequest", "parse-http-request"},
+		{"parseHTTPRequest", "parse_http_request", "parseHttpRequest", "parse-http-request"},
+		{"", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			assert.Equal(t, raymond.SafeString(tt.snake), SnakeCase(tt.input))
+			assert.Equal(t, raymond.SafeString(tt.camel), CamelCase(tt.input))
+			assert.Equal(t, raymond.SafeString(tt.kebab), KebabCase(tt.input))
+		})
+	}
+}
+
+func TestCount(t *testing.T) {
+	assert.Equal(t, 3, Count([]any{1, "two", 3.0}))
+	assert.Equal(t, 2, Count([]string{"a", "b"}))
+	assert.Equal(t, 2, Count(map[string]any{"a": 1, "b": 2}))
+	assert.Equal(t, 5, Count("héllo"))
+	assert.Equal(t, 0, Count(nil))
+	assert.Equal(t, 0, Count(42))
+	assert.Equal(t, 2, Count(&[]string{"a", "b"}))
+	assert.Equal(t, 0, Count((*[]string)(nil)))
+
+	tpl, err := raymond.Parse(`{{#if (count items)}}{{count items}} items{{else}}No items{{/if}}`)
+	assert.NoError(t, err)
+	tpl.RegisterHelper("count", Count)
+
+	result, err := tpl.Exec(map[string]any{"items": []any{"a", "b"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "2 items", result)
+
+	result, err = tpl.Exec(map[string]any{})
+	assert.NoError(t, err)
+	assert.Equal(t, "No items", result)
+}
+
+func TestItemsCount(t *testing.T) {
+	assert.Equal(t, raymond.SafeString("nothing to do"), ItemsCount(0, "task", "tasks", "nothing to do"))
+	assert.Equal(t, raymond.SafeString("0 tasks"), ItemsCount(0, "task", "tasks", ""))
+	assert.Equal(t, raymond.SafeString("1 task"), ItemsCount(1, "task", "tasks", "nothing to do"))
+	assert.Equal(t, raymond.SafeString("1 task"), ItemsCount(1.0, "task", "tasks", "nothing to do"))
+	assert.Equal(t, raymond.SafeString("3 tasks"), ItemsCount(3, "task", "tasks", "nothing to do"))
+	assert.Equal(t, raymond.SafeString("2.5 tasks"), ItemsCount(2.5, "task", "tasks", "nothing to do"))
+	assert.Equal(t, raymond.SafeString("nothing to do"), ItemsCount(nil, "task", "tasks", "nothing to do"))
+
+	tpl, err := raymond.Parse(`You have {{itemsCount (count items) "item" "items" "no items"}}.`)
+	assert.NoError(t, err)
+	tpl.RegisterHelper("count", Count)
+	tpl.RegisterHelper("itemsCount", ItemsCount)
+	for _, tc := range []struct {
+		items    []any
+		expected string
+	}{
+		{nil, "You have no items."},
+		{[]any{"a"}, "You have 1 item."},
+		{[]any{"a", "b", "c"}, "You have 3 items."},
+	} {
+		result, err := tpl.Exec(map[string]any{"items": tc.items})
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, result)
+	}
+}
+
+func TestPluralize(t *testing.T) {
+	for _, tc := range []struct {
+		count    any
+		expected raymond.SafeString
+	}{
+		{1, "item"},
+		{1.0, "item"},
+		{"1", "item"},
+		{uint64(1), "item"},
+		{0, "items"},
+		{0.0, "items"},
+		{2, "items"},
+		{1.5, "items"},
+		{"3", "items"},
+		{nil, "items"},
+		{"one", "items"},
+	} {
+		assert.Equal(t, tc.expected, Pluralize(tc.count, "item", "items"), "count %v", tc.count)
+	}
+
+	tpl, err := raymond.Parse(`{{n}} {{pluralize n "item" "items"}}`)
+	assert.NoError(t, err)
+	tpl.RegisterHelper("pluralize", Pluralize)
+	for n, expected := range map[float64]string{0: "0 items", 1: "1 item", 2: "2 items"} {
+		result, err := tpl.Exec(map[string]any{"n": n})
+		assert.NoError(t, err)
+		assert.Equal(t, expected, result)
+	}
+
+	// pluralize is registered as a built-in helper.
+	dp := NewDotprompt(nil)
+	for n, expected := range map[any]string{1: "1 file", "1": "1 file", 1.5: "1.5 files"} {
+		rendered, err := dp.Render(`{{n}} {{pluralize n "file" "files"}}`, &DataArgument{Input: map[string]any{"n": n}}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, rendered.Messages[0].Content[0].(*TextPart).Text)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	t.Run("wraps a long line on word boundaries", func(t *testing.T) {
+		result := Wrap("the quick brown fox jumps over the lazy dog", 15)
+		assert.Equal(t, raymond.SafeString("the quick brown\nfox jumps over\nthe lazy dog"), result)
+	})
+
+	t.Run("preserves existing newlines and paragraphs", func(t *testing.T) {
+		result := Wrap("first line here\n\nsecond paragraph is longer", 12)
+		assert.Equal(t, raymond.SafeString("first line\nhere\n\nsecond\nparagraph is\nlonger"), result)
+	})
+
+	t.Run("counts multibyte runes", func(t *testing.T) {
+		result := Wrap("héllo wörld ñandú", 11)
+		assert.Equal(t, raymond.SafeString("héllo wörld\nñandú"), result)
+	})
+
+	t.Run("keeps words longer than the width intact", func(t *testing.T) {
+		result := Wrap("a supercalifragilistic word", 5)
+		assert.Equal(t, raymond.SafeString("a\nsupercalifragilistic\nword"), result)
+	})
+
+	t.Run("keeps the indentation of each line", func(t *testing.T) {
+		result := Wrap("Steps:\n  - mix the flour and water\n\t- bake", 14)
+		assert.Equal(t, raymond.SafeString("Steps:\n  - mix the\n  flour and\n  water\n\t- bake"), result)
+	})
+
+	t.Run("splits only on single spaces", func(t *testing.T) {
+		result := Wrap("a\tb  c d", 6)
+		assert.Equal(t, raymond.SafeString("a\tb  c\nd"), result)
+	})
+
+	t.Run("works in a template", func(t *testing.T) {
+		tpl, err := raymond.Parse(`{{wrap text 10}}`)
+		assert.NoError(t, err)
+		tpl.RegisterHelper("wrap", Wrap)
+		result, err := tpl.Exec(map[string]any{"text": "one two three four"})
+		assert.NoError(t, err)
+		assert.Equal(t, "one two\nthree four", result)
+	})
+}
+
+func TestLooseEquals(t *testing.T) {
+	tpl, err := raymond.Parse(`{{#looseEquals a b}}equal{{else}}different{{/looseEquals}}`)
+	assert.NoError(t, err)
+	tpl.RegisterHelper("looseEquals", LooseEquals)
+
+	tests := []struct {
+		name     string
+		a, b     any
+		expected string
+	}{
+		{"int vs float", 1, 1.0, "equal"},
+		{"string vs int", "1", 1, "equal"},
+		{"string vs float", "2.50", 2.5, "equal"},
+		{"equal strings", "abc", "abc", "equal"},
+		{"different numbers", 1, 2, "different"},
+		{"different strings", "abc", "abd", "different"},
+		{"non-numeric string vs number", "one", 1, "different"},
+		{"bool vs string", true, "true", "equal"},
+		{"bool vs different string", false, "true", "different"},
+		{"bool vs number", true, 1, "different"},
+		{"nil vs nil", nil, nil, "equal"},
+		{"nil vs string", nil, "<nil>", "different"},
+		{"nil vs empty string", nil, "", "different"},
+		{"equal lists", []any{"a"}, []any{"a"}, "equal"},
+		{"list vs string", []any{"a"}, "[a]", "different"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := tpl.Exec(map[string]any{"a": tt.a, "b": tt.b})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
+func TestListHelpers(t *testing.T) {
+	items := []string{"a", "b", "c"}
+	tests := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{"lookup positive", `{{lookup items 1}}`, "b"},
+		{"lookup -1", `{{lookup items -1}}`, "c"},
+		{"lookup -n", `{{lookup items -3}}`, "a"},
+		{"lookup -(n+1)", `{{lookup items -4}}`, ""},
+		{"lookup past end", `{{lookup items 3}}`, ""},
+		{"lookup fractional", `{{lookup items 1.7}}`, "b"},
+		{"lookup fractional negative", `{{lookup items -1.5}}`, "c"},
+		{"lookup key", `{{lookup obj "key"}}`, "value"},
+		{"slice start", `{{#each (slice items 1)}}{{this}}{{/each}}`, "bc"},
+		{"slice -1", `{{#each (slice items -1)}}{{this}}{{/each}}`, "c"},
+		{"slice -n", `{{#each (slice items -3)}}{{this}}{{/each}}`, "abc"},
+		{"slice -(n+1)", `{{#each (slice items -4)}}{{this}}{{/each}}`, "abc"},
+		{"slice negative end", `{{#each (slice items 0 end=-1)}}{{this}}{{/each}}`, "ab"},
+		{"slice end -(n+1)", `{{#each (slice items 0 end=-4)}}{{this}}{{/each}}`, ""},
+		{"slice start after end", `{{#each (slice items 2 end=1)}}{{this}}{{/each}}`, ""},
+		{"first", `{{first items}}`, "a"},
+		{"last", `{{last items}}`, "c"},
+		{"first empty", `{{first empty}}`, ""},
+		{"last empty", `{{last empty}}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := raymond.Parse(tt.template)
+			assert.NoError(t, err)
+			tpl.RegisterHelpers(map[string]any{
+				"lookup": Lookup,
+				"slice":  Slice,
+				"first":  First,
+				"last":   Last,
+			})
+			result, err := tpl.Exec(map[string]any{
+				"items": items,
+				"empty": []string{},
+				"obj":   map[string]any{"key": "value"},
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
+func TestRandomItem(t *testing.T) {
+	items := []string{"a", "b", "c", "d"}
+
+	t.Run("same seed gives same selection", func(t *testing.T) {
+		r1 := rand.New(rand.NewSource(42))
+		r2 := rand.New(rand.NewSource(42))
+		for range 10 {
+			assert.Equal(t, RandomItem(items, r1), RandomItem(items, r2))
+		}
+	})
+
+	t.Run("returns an element of the slice", func(t *testing.T) {
+		r := rand.New(rand.NewSource(1))
+		for range 10 {
+			assert.Contains(t, items, RandomItem(items, r))
+		}
+	})
+
+	t.Run("nil and empty input", func(t *testing.T) {
+		r := rand.New(rand.NewSource(1))
+		assert.Nil(t, RandomItem(nil, r))
+		assert.Nil(t, RandomItem([]string{}, r))
+		assert.Nil(t, RandomItem("not a slice", r))
+	})
+}
+
+func TestJSONBlock(t *testing.T) {
+	data := map[string]any{"name": "Alice", "tags": []any{"a", "b"}}
+
+	t.Run("indented", func(t *testing.T) {
+		tpl, err := raymond.Parse(`{{jsonBlock data indent=2}}`)
+		assert.NoError(t, err)
+		tpl.RegisterHelper("jsonBlock", JSONBlock)
+
+		result, err := tpl.Exec(map[string]any{"data": data})
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(result, "```json\n"))
+		assert.True(t, strings.HasSuffix(result, "\n```"))
+
+		body := strings.TrimSuffix(strings.TrimPrefix(result, "```json\n"), "\n```")
+		assert.Equal(t, "{\n  \"name\": \"Alice\",\n  \"tags\": [\n    \"a\",\n    \"b\"\n  ]\n}", body)
+		var decoded map[string]any
+		assert.NoError(t, json.Unmarshal([]byte(body), &decoded))
+		assert.Equal(t, data, decoded)
+	})
+
+	t.Run("compact", func(t *testing.T) {
+		tpl, err := raymond.Parse(`{{jsonBlock data}}`)
+		assert.NoError(t, err)
+		tpl.RegisterHelper("jsonBlock", JSONBlock)
+
+		result, err := tpl.Exec(map[string]any{"data": data})
+		assert.NoError(t, err)
+		assert.Equal(t, "```json\n{\"name\":\"Alice\",\"tags\":[\"a\",\"b\"]}\n```", result)
+	})
+}
+
+func TestHashID(t *testing.T) {
+	t.Run("deterministic", func(t *testing.T) {
+		assert.Equal(t, HashID("hello world"), HashID("hello world"))
+		assert.Equal(t, raymond.SafeString("b94d27b9"), HashID("hello world"))
+		assert.Len(t, string(HashID("")), 8)
+	})
+
+	t.Run("different inputs give different ids", func(t *testing.T) {
+		assert.NotEqual(t, HashID("doc one"), HashID("doc two"))
+		assert.NotEqual(t, HashID(1), HashID(2))
+	})
+
+	t.Run("in a template", func(t *testing.T) {
+		tpl, err := raymond.Parse(`{{#each docs}}[{{hashId this}}]{{/each}}`)
+		assert.NoError(t, err)
+		tpl.RegisterHelper("hashId", HashID)
+		result, err := tpl.Exec(map[string]any{"docs": []string{"hello world", "hello world"}})
+		assert.NoError(t, err)
+		assert.Equal(t, "[b94d27b9][b94d27b9]", result)
+	})
+}
+
+func TestEachLimit(t *testing.T) {
+	block := `{{#eachLimit items 3}}{{@index}}:{{this}}{{#if @last}}{{#if @truncated}} (+{{@remaining}} more){{/if}}{{else}}, {{/if}}{{else}}none{{/eachLimit}}`
+	tests := []struct {
+		name     string
+		items    any
+		expected string
+	}{
+		{"shorter than the limit", []string{"a", "b"}, "0:a, 1:b"},
+		{"equal to the limit", []string{"a", "b", "c"}, "0:a, 1:b, 2:c"},
+		{"longer than the limit", []string{"a", "b", "c", "d", "e"}, "0:a, 1:b, 2:c (+2 more)"},
+		{"empty", []string{}, "none"},
+		{"not a list", "abc", "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := raymond.Parse(block)
+			assert.NoError(t, err)
+			tpl.RegisterHelper("eachLimit", EachLimit)
+			result, err := tpl.Exec(map[string]any{"items": tt.items})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+
+	t.Run("block variables", func(t *testing.T) {
+		tpl, err := raymond.Parse(`{{#eachLimit items 1}}{{@remaining}}/{{@truncated}}{{/eachLimit}}`)
+		assert.NoError(t, err)
+		tpl.RegisterHelper("eachLimit", EachLimit)
+
+		result, err := tpl.Exec(map[string]any{"items": []int{1, 2, 3}})
+		assert.NoError(t, err)
+		assert.Equal(t, "2/true", result)
+
+		result, err = tpl.Exec(map[string]any{"items": []int{1}})
+		assert.NoError(t, err)
+		assert.Equal(t, "0/false", result)
+	})
+}
+
+func TestLet(t *testing.T) {
+	computed := 0
+	add := func(a, b int) int {
+		computed++
+		return a + b
+	}
+	render := func(source string, ctx any) string {
+		tpl, err := raymond.Parse(source)
+		assert.NoError(t, err)
+		tpl.RegisterHelper("let", Let)
+		tpl.RegisterHelper("assign", Let)
+		tpl.RegisterHelper("add", add)
+		result, err := tpl.Exec(ctx)
+		assert.NoError(t, err)
+		return result
+	}
+
+	t.Run("binds a computed value", func(t *testing.T) {
+		computed = 0
+		result := render(`{{#let total=(add a b)}}Total is {{total}}; twice {{total}}{{/let}}`, map[string]any{"a": 2, "b": 3})
+		assert.Equal(t, "Total is 5; twice 5", result)
+		assert.Equal(t, 1, computed)
+	})
+
+	t.Run("keeps outer fields and shadows them", func(t *testing.T) {
+		result := render(`{{#assign name="Bob" greeting="Hi"}}{{greeting}} {{name}} from {{city}}{{/assign}} {{name}}`,
+			map[string]any{"name": "Alice", "city": "Paris"})
+		assert.Equal(t, "Hi Bob from Paris Alice", result)
+	})
+
+	t.Run("scopes the binding to the block", func(t *testing.T) {
+		result := render(`{{#let x=1}}{{x}}{{/let}}[{{x}}]`, map[string]any{})
+		assert.Equal(t, "1[]", result)
+	})
+
+	t.Run("non-map context", func(t *testing.T) {
+		result := render(`{{#each items}}{{#let upper=this}}{{upper}}-{{../this}}{{/let}} {{/each}}`,
+			map[string]any{"items": []string{"a", "b"}})
+		assert.Equal(t, "a-a b-b ", result)
+	})
+}
+
+func TestTypeHelpers(t *testing.T) {
+	values := map[string]any{
+		"string": "hello",
+		"array":  []any{"a", 1},
+		"object": map[string]any{"a": 1},
+		"number": 42.0,
+	}
+	tests := []struct {
+		name   string
+		test   func(any) bool
+		passes string
+	}{
+		{"isString", IsString, "string"},
+		{"isArray", IsArray, "array"},
+		{"isObject", IsObject, "object"},
+		{"isNumber", IsNumber, "number"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for kind, value := range values {
+				assert.Equal(t, kind == tt.passes, tt.test(value), kind)
+			}
+			assert.False(t, tt.test(nil))
+		})
+	}
+
+	t.Run("other representations", func(t *testing.T) {
+		assert.True(t, IsNumber(7))
+		assert.True(t, IsNumber(json.Number("1.5")))
+		assert.False(t, IsString(json.Number("1.5")))
+		assert.False(t, IsNumber("1.5"))
+		assert.True(t, IsArray([2]int{1, 2}))
+		assert.True(t, IsObject(&struct{ A int }{1}))
+		assert.False(t, IsObject((*struct{})(nil)))
+	})
+
+	t.Run("in templates", func(t *testing.T) {
+		source := `{{#each items}}{{#ifString this}}s{{else}}{{#ifArray this}}a{{else}}{{#ifObject this}}o{{/ifObject}}{{#ifNumber this}}n{{/ifNumber}}{{/ifArray}}{{/ifString}}{{#if (isNumber this)}}!{{/if}} {{/each}}`
+		tpl, err := raymond.Parse(source)
+		assert.NoError(t, err)
+		tpl.RegisterHelpers(templateHelpers)
+		result, err := tpl.Exec(map[string]any{"items": []any{"hello", []any{1}, map[string]any{"a": 1}, 3}})
+		assert.NoError(t, err)
+		assert.Equal(t, "s a o n! ", result)
+	})
+}
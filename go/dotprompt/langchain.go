@@ -0,0 +1,100 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package dotprompt
+
+import (
+	"fmt"
+	"strings"
+)
+
+// langChainMessageTypes maps roles to LangChain message types.
+var langChainMessageTypes = map[Role]string{
+	RoleUser:   "human",
+	RoleModel:  "ai",
+	RoleSystem: "system",
+	RoleTool:   "tool",
+}
+
+// ToLangChainMessages converts messages to the LangChain message format,
+// `{"type": "human", "content": ...}`. The content of a message with a single
+// text part is the text; otherwise it is a list of LangChain standard content
+// blocks, with `{"type": "text", "text": ...}` for text and e.g.
+// `{"type": "image", "source_type": "url", "url": ..., "mime_type": ...}` for
+// media. Media in base64 data URLs use the "base64" source type. Only text and
+// media parts can be converted.
+func ToLangChainMessages(messages []Message) ([]map[string]any, error) {
+	out := make([]map[string]any, 0, len(messages))
+	for i, msg := range messages {
+		messageType, ok := langChainMessageTypes[msg.Role]
+		if !ok {
+			return nil, fmt.Errorf("dotprompt: message %d: role '%s' has no LangChain message type", i, msg.Role)
+		}
+		if len(msg.Content) == 1 {
+			if text, ok := msg.Content[0].(*TextPart); ok {
+				out = append(out, map[string]any{"type": messageType, "content": text.Text})
+				continue
+			}
+		}
+		content := make([]map[string]any, 0, len(msg.Content))
+		for _, part := range msg.Content {
+			switch p := part.(type) {
+			case *TextPart:
+				content = append(content, map[string]any{"type": "text", "text": p.Text})
+			case *MediaPart:
+				content = append(content, langChainMediaBlock(p.Media))
+			default:
+				return nil, fmt.Errorf("dotprompt: message %d: %T cannot be converted to LangChain content", i, part)
+			}
+		}
+		out = append(out, map[string]any{"type": messageType, "content": content})
+	}
+	return out, nil
+}
+
+// langChainMediaBlock returns the LangChain standard content block for media.
+// The block type is derived from the content type, or from the URL's file
+// extension if it has none, and defaults to "file".
+func langChainMediaBlock(media Media) map[string]any {
+	block := map[string]any{}
+	contentType := media.ContentType
+	dataURL, isDataURL := strings.CutPrefix(media.URL, "data:")
+	header, data, isBase64 := strings.Cut(dataURL, ";base64,")
+	if isDataURL && isBase64 {
+		if contentType == "" {
+			contentType = header
+		}
+		block["source_type"] = "base64"
+		block["data"] = data
+	} else {
+		if contentType == "" {
+			contentType = inferMediaContentType(media.URL)
+		}
+		block["source_type"] = "url"
+		block["url"] = media.URL
+	}
+
+	block["type"] = "file"
+	for _, kind := range []string{"image", "audio", "video"} {
+		if strings.HasPrefix(contentType, kind+"/") {
+			block["type"] = kind
+		}
+	}
+	if contentType != "" {
+		block["mime_type"] = contentType
+	}
+	return block
+}
@@ -0,0 +1,70 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package dotprompt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToLangChainMessages(t *testing.T) {
+	t.Run("maps each role", func(t *testing.T) {
+		messages := []Message{
+			{Role: RoleSystem, Content: []Part{&TextPart{Text: "Be brief."}}},
+			{Role: RoleUser, Content: []Part{&TextPart{Text: "Hi"}}},
+			{Role: RoleModel, Content: []Part{&TextPart{Text: "Hello!"}}},
+			{Role: RoleTool, Content: []Part{&TextPart{Text: "42"}}},
+		}
+		out, err := ToLangChainMessages(messages)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]any{
+			{"type": "system", "content": "Be brief."},
+			{"type": "human", "content": "Hi"},
+			{"type": "ai", "content": "Hello!"},
+			{"type": "tool", "content": "42"},
+		}, out)
+	})
+
+	t.Run("emits content blocks for media", func(t *testing.T) {
+		messages := []Message{{Role: RoleUser, Content: []Part{
+			&TextPart{Text: "Describe these."},
+			&MediaPart{Media: Media{URL: "https://example.com/cat.png"}},
+			&MediaPart{Media: Media{URL: "https://example.com/talk", ContentType: "audio/mpeg"}},
+			&MediaPart{Media: Media{URL: "data:application/pdf;base64,JVBERi0="}},
+		}}}
+		out, err := ToLangChainMessages(messages)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]any{{
+			"type": "human",
+			"content": []map[string]any{
+				{"type": "text", "text": "Describe these."},
+				{"type": "image", "source_type": "url", "url": "https://example.com/cat.png", "mime_type": "image/png"},
+				{"type": "audio", "source_type": "url", "url": "https://example.com/talk", "mime_type": "audio/mpeg"},
+				{"type": "file", "source_type": "base64", "data": "JVBERi0=", "mime_type": "application/pdf"},
+			},
+		}}, out)
+	})
+
+	t.Run("rejects unsupported messages", func(t *testing.T) {
+		_, err := ToLangChainMessages([]Message{{Role: "critic", Content: []Part{&TextPart{Text: "Hmm"}}}})
+		assert.ErrorContains(t, err, "role 'critic' has no LangChain message type")
+
+		_, err = ToLangChainMessages([]Message{{Role: RoleUser, Content: []Part{&DataPart{}}}})
+		assert.ErrorContains(t, err, "*dotprompt.DataPart cannot be converted")
+	})
+}
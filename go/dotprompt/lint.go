@@ -0,0 +1,210 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package dotprompt
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/mbleigh/raymond/ast"
+	"github.com/mbleigh/raymond/parser"
+)
+
+// LintIssueKind classifies a LintIssue.
+type LintIssueKind string
+
+const (
+	// LintIssueParse is reported when the frontmatter can't be parsed.
+	LintIssueParse LintIssueKind = "parse"
+	// LintIssueMetadata is reported when the metadata can't be resolved, e.g.
+	// because of an unknown schema or tool.
+	LintIssueMetadata LintIssueKind = "metadata"
+	// LintIssueTemplate is reported when the template has a syntax error.
+	LintIssueTemplate LintIssueKind = "template"
+	// LintIssuePartial is reported when a partial can't be resolved.
+	LintIssuePartial LintIssueKind = "partial"
+	// LintIssueHelper is reported when the template calls an unknown helper.
+	LintIssueHelper LintIssueKind = "helper"
+)
+
+// LintIssue is a problem found by Lint.
+type LintIssue struct {
+	Kind    LintIssueKind `json:"kind"`
+	Message string        `json:"message"`
+}
+
+// builtinHelpers are the helpers built into raymond.
+var builtinHelpers = []string{"if", "unless", "with", "each", "log", "lookup", "equal"}
+
+// Lint checks a prompt end-to-end without rendering it, so it needs no input
+// data. It parses the source, resolves its metadata (including schemas and
+// tools), compiles its template, and resolves its partials, collecting every
+// issue found rather than stopping at the first. Templates and partials are
+// also checked for calls to unknown helpers when using the default
+// RaymondEngine.
+//
+// If dpOptions is non-nil, the prompt is checked against a new instance
+// configured with them instead of dp, e.g. to lint with the schemas, partials,
+// and resolvers a CI job provides. Lint does not register anything on the
+// Dotprompt instance.
+func (dp *Dotprompt) Lint(source string, dpOptions *DotpromptOptions) []LintIssue {
+	if dpOptions != nil {
+		dp = NewDotprompt(dpOptions)
+	}
+	issues := []LintIssue{}
+
+	parsedPrompt, err := ParseDocumentWithOptions(source, dp.parseOptions())
+	if err != nil {
+		return append(issues, LintIssue{Kind: LintIssueParse, Message: err.Error()})
+	}
+
+	if _, err := dp.RenderMetadata(parsedPrompt, nil); err != nil {
+		issues = append(issues, LintIssue{Kind: LintIssueMetadata, Message: err.Error()})
+	}
+
+	visited := map[string]bool{}
+	return append(issues, dp.lintTemplate("template", parsedPrompt.Template, visited)...)
+}
+
+// lintTemplate checks that the template compiles, calls only known helpers,
+// and that its partials resolve, recursing into the partials.
+func (dp *Dotprompt) lintTemplate(name, template string, visited map[string]bool) []LintIssue {
+	var issues []LintIssue
+	template, err := dp.translateTemplate(template)
+	if err != nil {
+		return append(issues, LintIssue{Kind: LintIssueTemplate, Message: fmt.Sprintf("%s: %v", name, err)})
+	}
+	if _, err := dp.engine.Parse(template); err != nil {
+		return append(issues, LintIssue{Kind: LintIssueTemplate, Message: fmt.Sprintf("%s: %v", name, err)})
+	}
+
+	if _, ok := dp.engine.(RaymondEngine); ok {
+		program, err := parser.Parse(template)
+		if err == nil {
+			for _, helper := range dp.unknownHelpers(program) {
+				issues = append(issues, LintIssue{
+					Kind:    LintIssueHelper,
+					Message: fmt.Sprintf("%s: unknown helper '%s'", name, helper),
+				})
+			}
+		}
+	}
+
+	for _, partial := range dp.identifyPartials(template) {
+		if visited[partial] {
+			continue
+		}
+		visited[partial] = true
+
+		content, err := dp.lookupPartial(partial)
+		if err != nil {
+			issues = append(issues, LintIssue{
+				Kind:    LintIssuePartial,
+				Message: fmt.Sprintf("%s: partial '%s' could not be resolved: %v", name, partial, err),
+			})
+			continue
+		}
+		issues = append(issues, dp.lintTemplate("partial '"+partial+"'", content, visited)...)
+	}
+	return issues
+}
+
+// lookupPartial returns the source of a registered or resolvable partial.
+func (dp *Dotprompt) lookupPartial(name string) (string, error) {
+	if content, ok := dp.Partials[name]; ok {
+		return content, nil
+	}
+	if dp.partialResolver == nil {
+		return "", fmt.Errorf("not registered and no partial resolver is configured")
+	}
+	content, err := dp.partialResolver(name)
+	if err != nil {
+		return "", err
+	}
+	if content == "" {
+		return "", fmt.Errorf("partial resolver returned no content")
+	}
+	return content, nil
+}
+
+// unknownHelpers returns the names of helpers called in the program that are
+// not registered, in order of first use. An expression is a helper call if it
+// has parameters or hash arguments; bare names are treated as field lookups.
+func (dp *Dotprompt) unknownHelpers(program *ast.Program) []string {
+	var unknown []string
+	var walk func(node ast.Node)
+	walkExpression := func(expr *ast.Expression) {
+		if expr == nil {
+			return
+		}
+		name := expr.HelperName()
+		if name != "" && (len(expr.Params) > 0 || expr.Hash != nil) && !dp.isKnownHelper(name) &&
+			!slices.Contains(unknown, name) {
+			unknown = append(unknown, name)
+		}
+		for _, param := range expr.Params {
+			walk(param)
+		}
+		if expr.Hash != nil {
+			for _, pair := range expr.Hash.Pairs {
+				walk(pair.Val)
+			}
+		}
+	}
+	walk = func(node ast.Node) {
+		switch n := node.(type) {
+		case *ast.Program:
+			if n == nil {
+				return
+			}
+			for _, statement := range n.Body {
+				walk(statement)
+			}
+		case *ast.MustacheStatement:
+			walkExpression(n.Expression)
+		case *ast.BlockStatement:
+			walkExpression(n.Expression)
+			walk(n.Program)
+			walk(n.Inverse)
+		case *ast.PartialStatement:
+			for _, param := range n.Params {
+				walk(param)
+			}
+		case *ast.SubExpression:
+			walkExpression(n.Expression)
+		case *ast.Expression:
+			walkExpression(n)
+		}
+	}
+	walk(program)
+	return unknown
+}
+
+// isKnownHelper reports whether a helper with the name is available to
+// templates.
+func (dp *Dotprompt) isKnownHelper(name string) bool {
+	if _, ok := dp.Helpers[name]; ok {
+		return true
+	}
+	if _, ok := templateHelpers[name]; ok {
+		return true
+	}
+	if _, ok := dp.instanceHelpers()[name]; ok {
+		return true
+	}
+	return slices.Contains(builtinHelpers, name)
+}
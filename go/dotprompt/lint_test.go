@@ -0,0 +1,164 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package dotprompt
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/invopop/jsonschema"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLint(t *testing.T) {
+	newDotprompt := func() *Dotprompt {
+		return NewDotprompt(&DotpromptOptions{
+			Schemas: map[string]*jsonschema.Schema{
+				"Person": {Type: "object"},
+			},
+			Helpers: map[string]any{
+				"shout": func(s string) string { return s + "!" },
+			},
+			Partials: map[string]string{
+				"header": "Hello {{shout name}}",
+			},
+			PartialResolver: func(name string) (string, error) {
+				if name == "footer" {
+					return "{{> signature}}", nil
+				}
+				if name == "signature" {
+					return "Bye {{#if polite}}kindly{{/if}}", nil
+				}
+				return "", fmt.Errorf("no partial named %s", name)
+			},
+		})
+	}
+
+	t.Run("clean prompt", func(t *testing.T) {
+		source := `---
+input:
+  schema: Person
+output:
+  schema:
+    answer: string
+---
+{{> header}}
+{{#each items}}{{json this}}{{/each}}
+{{role "model"}}{{ifEquals a b}}{{lookup items 0}}
+{{> footer}}`
+		assert.Empty(t, newDotprompt().Lint(source, nil))
+	})
+
+	tests := []struct {
+		name     string
+		source   string
+		expected []LintIssue
+	}{
+		{
+			name:   "invalid frontmatter",
+			source: "---\ninput: [\n---\nHello",
+			// Frontmatter errors are only reported in strict mode, so this
+			// falls back to treating the whole source as the template.
+			expected: []LintIssue{},
+		},
+		{
+			name:   "unknown schema",
+			source: "---\ninput:\n  schema: Missing\n---\nHello",
+			expected: []LintIssue{{
+				Kind:    LintIssueMetadata,
+				Message: "Picoschema: could not find schema with name 'Missing'",
+			}},
+		},
+		{
+			name:   "template syntax error",
+			source: "Hello {{#if name}}",
+			expected: []LintIssue{{
+				Kind: LintIssueTemplate,
+			}},
+		},
+		{
+			name:   "unresolved partial",
+			source: "{{> header}} {{> missing}}",
+			expected: []LintIssue{{
+				Kind:    LintIssuePartial,
+				Message: "template: partial 'missing' could not be resolved: no partial named missing",
+			}},
+		},
+		{
+			name:   "unknown helper",
+			source: "{{whisper name}} {{#if (shout name)}}{{frobnicate a b=1}}{{/if}} {{whisper x}}",
+			expected: []LintIssue{
+				{Kind: LintIssueHelper, Message: "template: unknown helper 'whisper'"},
+				{Kind: LintIssueHelper, Message: "template: unknown helper 'frobnicate'"},
+			},
+		},
+		{
+			name:   "multiple issues",
+			source: "---\noutput:\n  schema: Missing\n---\n{{> missing}}{{nope 1}}",
+			expected: []LintIssue{
+				{Kind: LintIssueMetadata, Message: "Picoschema: could not find schema with name 'Missing'"},
+				{Kind: LintIssueHelper, Message: "template: unknown helper 'nope'"},
+				{Kind: LintIssuePartial, Message: "template: partial 'missing' could not be resolved: no partial named missing"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issues := newDotprompt().Lint(tt.source, nil)
+			if len(tt.expected) == 1 && tt.expected[0].Message == "" {
+				assert.Len(t, issues, 1)
+				assert.Equal(t, tt.expected[0].Kind, issues[0].Kind)
+				return
+			}
+			assert.Equal(t, tt.expected, issues)
+		})
+	}
+
+	t.Run("strict frontmatter", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{StrictFrontmatter: true})
+		issues := dp.Lint("---\ninput: [\n---\nHello", nil)
+		assert.Len(t, issues, 1)
+		assert.Equal(t, LintIssueParse, issues[0].Kind)
+	})
+
+	t.Run("options", func(t *testing.T) {
+		dp := newDotprompt()
+		source := "---\ninput:\n  schema: Greeting\n---\n{{> closing}}"
+		assert.Len(t, dp.Lint(source, nil), 2)
+
+		issues := dp.Lint(source, &DotpromptOptions{
+			Schemas:  map[string]*jsonschema.Schema{"Greeting": {Type: "object"}},
+			Partials: map[string]string{"closing": "Cheers"},
+		})
+		assert.Empty(t, issues)
+		assert.NotContains(t, dp.Partials, "closing")
+
+		issues = dp.Lint("---\ninput: [\n---\nHello", &DotpromptOptions{StrictFrontmatter: true})
+		assert.Len(t, issues, 1)
+		assert.Equal(t, LintIssueParse, issues[0].Kind)
+	})
+
+	t.Run("issues inside resolved partials", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{
+			Partials: map[string]string{"outer": "{{> inner}}", "inner": "{{mystery 1}}{{#if}}"},
+		})
+		issues := dp.Lint("{{> outer}}", nil)
+		assert.Len(t, issues, 1)
+		assert.Equal(t, LintIssueTemplate, issues[0].Kind)
+		assert.Contains(t, issues[0].Message, "partial 'inner'")
+	})
+}
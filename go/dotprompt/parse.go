@@ -17,10 +17,18 @@
 package dotprompt
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"iter"
+	"maps"
+	"net/url"
+	"path"
+	"reflect"
 	"regexp"
 	"slices"
 	"strings"
+	"sync"
 
 	"github.com/goccy/go-yaml"
 )
@@ -46,42 +54,287 @@ const (
 
 	// Prefixes for the section markers in the template.
 	SectionMarkerPrefix = "<<<dotprompt:section"
+
+	// Prefixes for the data markers in the template.
+	DataMarkerPrefix = "<<<dotprompt:data"
+
+	// Prefixes for the tool request markers in the template.
+	ToolRequestMarkerPrefix = "<<<dotprompt:tool-request"
+
+	// Prefixes for the tool response markers in the template.
+	ToolResponseMarkerPrefix = "<<<dotprompt:tool-response"
 )
 
 var (
 	// FrontmatterAndBodyRegex is a regular expression to match YAML frontmatter
-	// delineated by `---` markers at the start of a .prompt content block.
+	// delineated by `---` markers at the start of a .prompt content block. The
+	// body may be empty, in which case the closing marker may end the content.
 	FrontmatterAndBodyRegex = regexp.MustCompile(
-		`^---\s*(?:\r\n|\r|\n)([\s\S]*?)(?:\r\n|\r|\n)---\s*(?:\r\n|\r|\n)([\s\S]*)$`)
+		`^---\s*(?:\r\n|\r|\n)([\s\S]*?)(?:\r\n|\r|\n)---\s*(?:(?:\r\n|\r|\n)([\s\S]*))?$`)
+
+	// JSONFrontmatterAndBodyRegex is a regular expression to match JSON
+	// frontmatter delineated by `---json` and `---` markers at the start of a
+	// .prompt content block.
+	JSONFrontmatterAndBodyRegex = regexp.MustCompile(
+		`^---json[ \t]*(?:\r\n|\r|\n)(?:([\s\S]*?)(?:\r\n|\r|\n))?---\s*(?:(?:\r\n|\r|\n)([\s\S]*))?$`)
+
+	// TOMLFrontmatterAndBodyRegex is a regular expression to match TOML
+	// frontmatter delineated by `+++` markers at the start of a .prompt content
+	// block.
+	TOMLFrontmatterAndBodyRegex = regexp.MustCompile(
+		`^\+\+\+[ \t]*(?:\r\n|\r|\n)(?:([\s\S]*?)(?:\r\n|\r|\n))?\+\+\+\s*(?:(?:\r\n|\r|\n)([\s\S]*))?$`)
 
 	// EmptyFrontmatterRegex is a regular expression to match empty YAML
 	// frontmatter (where there's no content between the frontmatter markers).
 	EmptyFrontmatterRegex = regexp.MustCompile(`^---\s*\n---\s*\n([\s\S]*)$`)
 
+	// TabIndentationRegex is a regular expression to match lines indented with
+	// tabs, which YAML does not allow.
+	TabIndentationRegex = regexp.MustCompile(`(?m)^ *\t`)
+
 	// RoleAndHistoryMarkerRegex is a regular expression to match
 	// <<<dotprompt:role:xxx>>> and <<<dotprompt:history>>> markers in the
 	// template.
 	//
-	// Note: Only lowercase letters are allowed after 'role:'.
+	// Note: Only lowercase letters are allowed after 'role:'. The role may be
+	// followed by a space and a JSON object of message metadata before the
+	// closing `>>>`. Only the opening brace of the object is part of the
+	// match; the object is decoded with a json.Decoder, so it may contain
+	// `>>>`.
 	//
 	// Examples of matching patterns:
 	// - <<<dotprompt:role:user>>>
 	// - <<<dotprompt:role:system>>>
+	// - <<<dotprompt:role:model {"model":"gpt-4"}>>>
 	// - <<<dotprompt:history>>>
-	RoleAndHistoryMarkerRegex = regexp.MustCompile(
-		`(<<<dotprompt:(?:role:[a-z]+|history))>>>`)
+	RoleAndHistoryMarkerRegex = roleAndHistoryMarkerRegex(DefaultMarkerDelimiters)
 
 	// MediaAndSectionMarkerRegex is a regular expression to match
-	// <<<dotprompt:media:url>>> and <<<dotprompt:section>>> markers in the
-	// template.
+	// <<<dotprompt:media:url>>>, <<<dotprompt:section>>>,
+	// <<<dotprompt:data>>>, <<<dotprompt:tool-request>>>, and
+	// <<<dotprompt:tool-response>>> markers in the template.
+	//
+	// Note: Data and tool markers are followed by a JSON object, which is not
+	// part of the match, e.g. `<<<dotprompt:data>>> {"city":"Paris"}`. The
+	// object is decoded with a json.Decoder, so it may span multiple lines and
+	// contain `>>>`.
 	//
 	// Examples of matching patterns:
 	// - <<<dotprompt:media:url>>>
 	// - <<<dotprompt:section>>>
+	// - <<<dotprompt:data>>>
+	// - <<<dotprompt:tool-request>>>
 	MediaAndSectionMarkerRegex = regexp.MustCompile(
-		`(<<<dotprompt:(?:media:url|section).*?)>>>`)
+		`(<<<dotprompt:(?:media:url|section).*?|<<<dotprompt:(?:data|tool-request|tool-response))>>>`)
 )
 
+// MarkerDelimiters are the delimiters that open and close the dotprompt
+// markers in a rendered template, e.g. `<<<` and `>>>` in
+// `<<<dotprompt:role:user>>>`. Other delimiters let prompts contain the
+// default markers as literal text.
+type MarkerDelimiters struct {
+	// Open opens a marker, e.g. `<<<`.
+	Open string
+	// Close closes a marker, e.g. `>>>`.
+	Close string
+}
+
+// DefaultMarkerDelimiters are the delimiters of the markers unless others are
+// configured.
+var DefaultMarkerDelimiters = MarkerDelimiters{Open: "<<<", Close: ">>>"}
+
+// isDefault reports whether the delimiters are the defaults. Delimiters with
+// either side unset are treated as the defaults.
+func (d MarkerDelimiters) isDefault() bool {
+	return d.Open == "" || d.Close == "" || d == DefaultMarkerDelimiters
+}
+
+// markerSyntax is the form of the markers for a pair of delimiters, with the
+// regexes matching them in place of RoleAndHistoryMarkerRegex and
+// MediaAndSectionMarkerRegex.
+type markerSyntax struct {
+	delimiters      MarkerDelimiters
+	roleAndHistory  *regexp.Regexp
+	mediaAndSection *regexp.Regexp
+}
+
+// defaultMarkerSyntax is the marker syntax of DefaultMarkerDelimiters.
+var defaultMarkerSyntax = &markerSyntax{
+	delimiters:      DefaultMarkerDelimiters,
+	roleAndHistory:  RoleAndHistoryMarkerRegex,
+	mediaAndSection: MediaAndSectionMarkerRegex,
+}
+
+// markerSyntaxes caches the marker syntaxes of custom delimiters.
+var markerSyntaxes sync.Map
+
+// markerSyntaxFor returns the marker syntax for the delimiters.
+func markerSyntaxFor(d MarkerDelimiters) *markerSyntax {
+	if d.isDefault() {
+		return defaultMarkerSyntax
+	}
+	if m, ok := markerSyntaxes.Load(d); ok {
+		return m.(*markerSyntax)
+	}
+	open, close := regexp.QuoteMeta(d.Open), regexp.QuoteMeta(d.Close)
+	m := &markerSyntax{
+		delimiters:     d,
+		roleAndHistory: roleAndHistoryMarkerRegex(d),
+		mediaAndSection: regexp.MustCompile(
+			`(` + open + `dotprompt:(?:media:url|section).*?|` + open + `dotprompt:(?:data|tool-request|tool-response))` + close),
+	}
+	markerSyntaxes.Store(d, m)
+	return m
+}
+
+// roleAndHistoryMarkerRegex returns a regex matching the role and history
+// markers written with the delimiters, up to the closing delimiter or the
+// opening brace of a metadata object. The first group is the marker without
+// its closing delimiter and the second is what follows it.
+func roleAndHistoryMarkerRegex(d MarkerDelimiters) *regexp.Regexp {
+	open, close := regexp.QuoteMeta(d.Open), regexp.QuoteMeta(d.Close)
+	return regexp.MustCompile(`(` + open + `dotprompt:(?:role:[a-z]+|history))( \{|` + close + `)`)
+}
+
+// splitByRoleAndHistoryMarkers lazily splits a string by the role and history
+// markers of the syntax like splitByRegexSeq. The JSON metadata object
+// following a role is read with a json.Decoder and joined to the marker's
+// piece after a space, e.g. `<<<dotprompt:role:user {"a":1}`, so that it may
+// contain anything, including the closing delimiter.
+func (m *markerSyntax) splitByRoleAndHistoryMarkers(source string) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		lastEnd, searchFrom := 0, 0
+		for {
+			match := m.roleAndHistory.FindStringSubmatchIndex(source[searchFrom:])
+			if match == nil {
+				break
+			}
+			start, end := searchFrom+match[0], searchFrom+match[1]
+			marker := source[searchFrom+match[2] : searchFrom+match[3]]
+			if source[searchFrom+match[4]:end] != m.delimiters.Close {
+				roleStr, ok := strings.CutPrefix(marker, m.prefix(RoleMarkerPrefix))
+				if !ok {
+					// Only role markers carry metadata.
+					searchFrom = end
+					continue
+				}
+				decoder := json.NewDecoder(strings.NewReader(source[end-1:]))
+				var metadata json.RawMessage
+				if err := decoder.Decode(&metadata); err != nil {
+					yield("", fmt.Errorf("dotprompt: invalid metadata for role '%s': %w", roleStr, err))
+					return
+				}
+				end += int(decoder.InputOffset()) - 1
+				if !strings.HasPrefix(source[end:], m.delimiters.Close) {
+					yield("", fmt.Errorf("dotprompt: invalid metadata for role '%s': expected %s after the JSON object",
+						roleStr, m.delimiters.Close))
+					return
+				}
+				end += len(m.delimiters.Close)
+				marker += " " + string(metadata)
+			}
+
+			if textBefore := source[lastEnd:start]; strings.TrimSpace(textBefore) != "" {
+				if !yield(textBefore, nil) {
+					return
+				}
+			}
+			if !yield(marker, nil) {
+				return
+			}
+			lastEnd, searchFrom = end, end
+		}
+
+		if textAfter := source[lastEnd:]; strings.TrimSpace(textAfter) != "" {
+			yield(textAfter, nil)
+		}
+	}
+}
+
+// prefix returns a marker prefix, such as RoleMarkerPrefix, with the opening
+// delimiter of the syntax.
+func (m *markerSyntax) prefix(prefix string) string {
+	return m.delimiters.Open + strings.TrimPrefix(prefix, DefaultMarkerDelimiters.Open)
+}
+
+// marker rewrites a marker written with the default delimiters to use the
+// delimiters of the syntax.
+func (m *markerSyntax) marker(marker string) string {
+	marker = strings.TrimPrefix(marker, DefaultMarkerDelimiters.Open)
+	marker = strings.TrimSuffix(marker, DefaultMarkerDelimiters.Close)
+	return m.delimiters.Open + marker + m.delimiters.Close
+}
+
+// partMarkerPrefixes are the prefixes of the markers that become parts of a
+// message.
+var partMarkerPrefixes = []string{
+	MediaMarkerPrefix, SectionMarkerPrefix, DataMarkerPrefix, ToolRequestMarkerPrefix, ToolResponseMarkerPrefix,
+}
+
+// jsonMarkerPrefixes are the prefixes of the markers that are followed by a
+// JSON value.
+var jsonMarkerPrefixes = []string{DataMarkerPrefix, ToolRequestMarkerPrefix, ToolResponseMarkerPrefix}
+
+// splitByPartMarkers splits a string by the media, section, data, and tool
+// markers of the syntax like splitByRegex. The JSON value following a marker
+// in jsonMarkerPrefixes is read with a json.Decoder and joined to the marker's
+// piece after a space, e.g. `<<<dotprompt:data {"a":1}`, so that the value
+// may contain anything, including the closing delimiter.
+func (m *markerSyntax) splitByPartMarkers(source string) ([]string, error) {
+	var pieces []string
+	lastEnd := 0
+	for {
+		match := m.mediaAndSection.FindStringSubmatchIndex(source[lastEnd:])
+		if match == nil {
+			break
+		}
+		start, end := lastEnd+match[0], lastEnd+match[1]
+		if textBefore := source[lastEnd:start]; strings.TrimSpace(textBefore) != "" {
+			pieces = append(pieces, textBefore)
+		}
+		marker := source[lastEnd+match[2] : lastEnd+match[3]]
+		lastEnd = end
+
+		if m.takesJSON(marker) && strings.TrimSpace(source[end:]) != "" {
+			decoder := json.NewDecoder(strings.NewReader(source[end:]))
+			var value json.RawMessage
+			if err := decoder.Decode(&value); err != nil {
+				return nil, fmt.Errorf("invalid marker %s%s: expected a JSON value after it: %w", marker, m.delimiters.Close, err)
+			}
+			marker += " " + string(value)
+			lastEnd += int(decoder.InputOffset())
+		}
+		pieces = append(pieces, marker)
+	}
+	if textAfter := source[lastEnd:]; strings.TrimSpace(textAfter) != "" {
+		pieces = append(pieces, textAfter)
+	}
+	return pieces, nil
+}
+
+// takesJSON reports whether a marker of the syntax, without its closing
+// delimiter, is followed by a JSON value.
+func (m *markerSyntax) takesJSON(marker string) bool {
+	return slices.ContainsFunc(jsonMarkerPrefixes, func(prefix string) bool { return marker == m.prefix(prefix) })
+}
+
+// canonicalPartMarker returns a media, section, data, or tool marker piece split
+// from a rendered template, without its closing delimiter, rewritten to use
+// the default opening delimiter, and reports whether the piece is such a
+// marker. Pieces are returned unchanged for the default syntax, since
+// parsePart recognizes the markers itself.
+func (m *markerSyntax) canonicalPartMarker(piece string) (string, bool) {
+	if m == defaultMarkerSyntax {
+		return piece, true
+	}
+	for _, prefix := range partMarkerPrefixes {
+		if strings.HasPrefix(piece, m.prefix(prefix)) {
+			return DefaultMarkerDelimiters.Open + strings.TrimPrefix(piece, m.delimiters.Open), true
+		}
+	}
+	return piece, false
+}
+
 // ReservedMetadataKeywords is a list of keywords that are reserved for metadata
 // in the frontmatter of a .prompt file. These keys are processed differently
 // from extension metadata.
@@ -89,6 +342,7 @@ var ReservedMetadataKeywords = []string{
 	// NOTE: KEEP SORTED
 	"config",
 	"description",
+	"examples",
 	"ext",
 	"input",
 	"model",
@@ -131,63 +385,72 @@ func splitByRegex(source string, regex *regexp.Regexp) []string {
 	}
 
 	// For marker regexes with capturing groups, include the matched portions.
-	matches := regex.FindAllStringSubmatchIndex(source, -1)
-	if len(matches) == 0 {
-		if strings.TrimSpace(source) != "" {
-			return []string{source}
-		}
+	var result []string
+	for piece := range splitByRegexSeq(source, regex) {
+		result = append(result, piece)
+	}
+	if result == nil && !regex.MatchString(source) {
 		return []string{}
 	}
+	return result
+}
 
-	var result []string
-	lastEnd := 0
-
-	// Process each match and the text before it
-	for _, match := range matches {
-		start := match[0] // Start of the full match.
-		end := match[1]   // End of the full match.
-
-		// If there's text before the match that isn't empty...
-		if start > lastEnd {
-			textBefore := source[lastEnd:start]
-			if strings.TrimSpace(textBefore) != "" {
-				result = append(result, textBefore)
+// splitByRegexSeq lazily splits a string by a marker regex with a capturing
+// group, yielding the non-blank text between matches and the non-blank
+// capturing groups of the matches in order.
+func splitByRegexSeq(source string, regex *regexp.Regexp) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		lastEnd := 0
+		for {
+			match := regex.FindStringSubmatchIndex(source[lastEnd:])
+			if match == nil {
+				break
 			}
-		}
+			start, end := lastEnd+match[0], lastEnd+match[1]
 
-		// Add the capturing group (not the full match).
-		groupStart := match[2] // Start of first capturing group.
-		groupEnd := match[3]   // End of first capturing group.
+			// If there's text before the match that isn't empty...
+			if textBefore := source[lastEnd:start]; strings.TrimSpace(textBefore) != "" {
+				if !yield(textBefore) {
+					return
+				}
+			}
 
-		if groupStart >= 0 && groupEnd >= 0 {
-			matchText := source[groupStart:groupEnd]
-			if strings.TrimSpace(matchText) != "" {
-				result = append(result, matchText)
+			// Add the capturing group (not the full match).
+			if match[2] >= 0 && match[3] >= 0 {
+				matchText := source[lastEnd+match[2] : lastEnd+match[3]]
+				if strings.TrimSpace(matchText) != "" && !yield(matchText) {
+					return
+				}
 			}
-		}
 
-		lastEnd = end
-	}
+			lastEnd = end
+		}
 
-	// If there's text after the last match that isn't empty...
-	if lastEnd < len(source) {
-		textAfter := source[lastEnd:]
-		if strings.TrimSpace(textAfter) != "" {
-			result = append(result, textAfter)
+		// If there's text after the last match that isn't empty...
+		if lastEnd < len(source) {
+			if textAfter := source[lastEnd:]; strings.TrimSpace(textAfter) != "" {
+				yield(textAfter)
+			}
 		}
 	}
-
-	return result
 }
 
 // splitByRoleAndHistoryMarkers splits a string by role and history markers.
-func splitByRoleAndHistoryMarkers(source string) []string {
-	return splitByRegex(source, RoleAndHistoryMarkerRegex)
+func splitByRoleAndHistoryMarkers(source string) ([]string, error) {
+	pieces := []string{}
+	for piece, err := range defaultMarkerSyntax.splitByRoleAndHistoryMarkers(source) {
+		if err != nil {
+			return nil, err
+		}
+		pieces = append(pieces, piece)
+	}
+	return pieces, nil
 }
 
-// splitByMediaAndSectionMarkers splits a string by media and section markers.
-func splitByMediaAndSectionMarkers(source string) []string {
-	return splitByRegex(source, MediaAndSectionMarkerRegex)
+// splitByMediaAndSectionMarkers splits a string by media, section, data, and
+// tool markers.
+func splitByMediaAndSectionMarkers(source string) ([]string, error) {
+	return defaultMarkerSyntax.splitByPartMarkers(source)
 }
 
 // convertNamespacedEntryToNestedObject converts a namespaced entry to a nested
@@ -216,47 +479,133 @@ func convertNamespacedEntryToNestedObject(
 	return obj
 }
 
+// ExtractFrontmatterAndBody returns the raw frontmatter and body of a .prompt
+// source without parsing the frontmatter. The frontmatter excludes its
+// markers and may be YAML, JSON, or TOML.
+//
+// A source without frontmatter markers returns two empty strings, not the
+// source as the body; callers that want the whole source as the body in that
+// case must check for it themselves.
+func ExtractFrontmatterAndBody(source string) (frontmatter, body string) {
+	return extractFrontmatterAndBody(source)
+}
+
 // extractFrontmatterAndBody extracts the frontmatter and body from a .prompt
 // file.
 func extractFrontmatterAndBody(source string) (string, string) {
+	_, frontmatter, body := extractFrontmatterFormatAndBody(source)
+	return frontmatter, body
+}
+
+// FrontmatterFormat is the format of a document's frontmatter, determined by
+// its opening marker.
+type FrontmatterFormat string
+
+// Supported frontmatter formats.
+const (
+	// FrontmatterFormatYAML is frontmatter delineated by `---` markers.
+	FrontmatterFormatYAML FrontmatterFormat = "yaml"
+	// FrontmatterFormatJSON is frontmatter delineated by `---json` and `---`
+	// markers.
+	FrontmatterFormatJSON FrontmatterFormat = "json"
+	// FrontmatterFormatTOML is frontmatter delineated by `+++` markers.
+	FrontmatterFormatTOML FrontmatterFormat = "toml"
+)
+
+// extractFrontmatterFormatAndBody extracts the frontmatter, its format, and
+// the body from a document. Documents without frontmatter are reported as
+// YAML.
+func extractFrontmatterFormatAndBody(source string) (FrontmatterFormat, string, string) {
+	if match := JSONFrontmatterAndBodyRegex.FindStringSubmatch(source); match != nil {
+		return FrontmatterFormatJSON, match[1], match[2]
+	}
+	if match := TOMLFrontmatterAndBodyRegex.FindStringSubmatch(source); match != nil {
+		return FrontmatterFormatTOML, match[1], match[2]
+	}
+	// Check for empty frontmatter first, since FrontmatterAndBodyRegex requires
+	// a line between the markers and would otherwise treat the closing marker
+	// as frontmatter and end at the next `---` line in the body.
+	if match := EmptyFrontmatterRegex.FindStringSubmatch(source); match != nil {
+		return FrontmatterFormatYAML, "", match[1]
+	}
 	match := FrontmatterAndBodyRegex.FindStringSubmatch(source)
 	if match == nil {
-		// Try the empty frontmatter pattern
-		match = EmptyFrontmatterRegex.FindStringSubmatch(source)
-		if match == nil {
-			return "", ""
-		}
-		return "", match[1]
+		return FrontmatterFormatYAML, "", ""
 	}
-	frontmatter, body := match[1], match[2]
-	return frontmatter, body
+	return FrontmatterFormatYAML, match[1], match[2]
+}
+
+// frontmatterDecoder returns the decoder for the frontmatter format. The
+// custom YAML decoder, if any, replaces the default YAML decoder.
+func frontmatterDecoder(format FrontmatterFormat, yamlDecoder FrontmatterDecoder) FrontmatterDecoder {
+	switch format {
+	case FrontmatterFormatJSON:
+		return json.Unmarshal
+	case FrontmatterFormatTOML:
+		return decodeTOML
+	}
+	if yamlDecoder != nil {
+		return yamlDecoder
+	}
+	return yaml.Unmarshal
+}
+
+// ParseOptions configures how a document is parsed.
+type ParseOptions struct {
+	// Strict causes invalid frontmatter to be reported as an error instead of
+	// falling back to treating the whole source as the template.
+	Strict bool
+	// MaxBytes is the maximum size of the source in bytes. Zero means
+	// unlimited.
+	MaxBytes int
+	// FrontmatterDecoder decodes YAML (`---` delimited) frontmatter in place
+	// of the default YAML decoder when set. JSON and TOML frontmatter always
+	// use their own decoders.
+	FrontmatterDecoder FrontmatterDecoder
+	// WarningHandler, if set, receives a warning when invalid frontmatter is
+	// ignored outside of strict mode. Warnings are discarded otherwise.
+	WarningHandler WarningHandler
 }
 
+// FrontmatterDecoder decodes raw frontmatter into v, which is a pointer to a
+// map[string]any, in the manner of yaml.Unmarshal or json.Unmarshal. Custom
+// decoders can support other formats or reject frontmatter the default YAML
+// decoder accepts.
+type FrontmatterDecoder func(data []byte, v any) error
+
 // ParseDocument parses a document containing YAML frontmatter and a template
 // content section.  The frontmatter contains metadata and configuration for the
-// prompt.
+// prompt. JSON frontmatter delineated by `---json` and `---` markers and TOML
+// frontmatter delineated by `+++` markers are also supported.
 func ParseDocument(source string) (ParsedPrompt, error) {
-	frontmatter, body := extractFrontmatterAndBody(source)
+	return ParseDocumentWithOptions(source, nil)
+}
+
+// ParseDocumentWithOptions parses a document like ParseDocument using the given
+// options. A nil options value is equivalent to the zero ParseOptions.
+func ParseDocumentWithOptions(source string, options *ParseOptions) (ParsedPrompt, error) {
+	if options == nil {
+		options = &ParseOptions{}
+	}
+	if options.MaxBytes > 0 && len(source) > options.MaxBytes {
+		return ParsedPrompt{}, fmt.Errorf(
+			"dotprompt: template source is %d bytes, exceeding the limit of %d bytes", len(source), options.MaxBytes)
+	}
+	format, frontmatter, body := extractFrontmatterFormatAndBody(source)
 	promptMetadata := PromptMetadata{
 		Ext: make(map[string]map[string]any),
 	}
 
 	if frontmatter != "" {
-		var parsedMetadata map[string]any
-		// The github.com/goccy/go-yaml library can panic on certain malformed YAML
-		// so we need to use a custom error handler to recover from panics
-		var err error
-		func() {
-			defer func() {
-				if r := recover(); r != nil {
-					err = fmt.Errorf("panic while parsing YAML: %v", r)
-				}
-			}()
-			err = yaml.Unmarshal([]byte(frontmatter), &parsedMetadata)
-		}()
-
+		pruned, err := decodeFrontmatterAs(format, frontmatter, options.FrontmatterDecoder)
 		if err != nil {
-			fmt.Printf("Dotprompt: Error parsing YAML frontmatter: %v\n", err)
+			if options.Strict {
+				return ParsedPrompt{}, fmt.Errorf("dotprompt: invalid frontmatter: %w", err)
+			}
+			if options.WarningHandler != nil {
+				options.WarningHandler(fmt.Sprintf(
+					"dotprompt: ignoring invalid %s frontmatter: %v", strings.ToUpper(string(format)), err))
+			}
 			// Return a basic ParsedPrompt with just the template
 			return ParsedPrompt{
 				PromptMetadata: promptMetadata,
@@ -264,94 +613,6 @@ func ParseDocument(source string) (ParsedPrompt, error) {
 			}, nil
 		}
 
-		raw := copyMapping(parsedMetadata)
-		pruned := PromptMetadata{
-			Ext: make(map[string]map[string]any),
-		}
-		ext := make(map[string]map[string]any)
-
-		for key, value := range raw {
-			if slices.Contains(ReservedMetadataKeywords, key) {
-				// Add to pruned metadata.
-				switch key {
-				case "name":
-					pruned.Name = stringOrEmpty(value)
-				case "description":
-					pruned.Description = stringOrEmpty(value)
-				case "variant":
-					pruned.Variant = stringOrEmpty(value)
-				case "version":
-					pruned.Version = stringOrEmpty(value)
-				case "model":
-					pruned.Model = stringOrEmpty(value)
-				case "config":
-					if configMap, ok := value.(map[string]any); ok {
-						pruned.Config = configMap
-					}
-				case "tools":
-					if toolsSlice, ok := value.([]any); ok {
-						tools := make([]string, 0, len(toolsSlice))
-						for _, t := range toolsSlice {
-							if toolStr, ok := t.(string); ok {
-								tools = append(tools, toolStr)
-							}
-						}
-						pruned.Tools = tools
-					}
-				case "toolDefs":
-					if toolDefsSlice, ok := value.([]any); ok {
-						toolDefs := make([]ToolDefinition, 0, len(toolDefsSlice))
-						for _, td := range toolDefsSlice {
-							if tdMap, ok := td.(map[string]any); ok {
-								toolDef := ToolDefinition{
-									Name:        stringOrEmpty(tdMap["name"]),
-									Description: stringOrEmpty(tdMap["description"]),
-								}
-								if inputSchema, ok := tdMap["inputSchema"].(map[string]any); ok {
-									toolDef.InputSchema = inputSchema
-								}
-								if outputSchema, ok := tdMap["outputSchema"].(map[string]any); ok {
-									toolDef.OutputSchema = outputSchema
-								}
-								toolDefs = append(toolDefs, toolDef)
-							}
-						}
-						pruned.ToolDefs = toolDefs
-					}
-				case "input":
-					if inputMap, ok := value.(map[string]any); ok {
-						if defaultMap, ok := inputMap["default"].(map[string]any); ok {
-							pruned.Input.Default = defaultMap
-						}
-						if schemaMap, ok := inputMap["schema"].(map[string]any); ok {
-							pruned.Input.Schema = schemaMap
-						}
-						if schemaMap, ok := inputMap["schema"].(string); ok {
-							pruned.Input.Schema = schemaMap
-						}
-					}
-				case "output":
-					if outputMap, ok := value.(map[string]any); ok {
-						if formatMap, ok := outputMap["format"].(string); ok {
-							pruned.Output.Format = formatMap
-						}
-						if schemaMap, ok := outputMap["schema"].(map[string]any); ok {
-							pruned.Output.Schema = schemaMap
-						}
-						if schemaMap, ok := outputMap["schema"].(string); ok {
-							pruned.Output.Schema = schemaMap
-						}
-					}
-				}
-			} else if strings.Contains(key, ".") {
-				convertNamespacedEntryToNestedObject(key, value, ext)
-			}
-		}
-
-		// Set the raw and ext fields
-		pruned.Raw = raw
-		pruned.Ext = ext
-
 		return ParsedPrompt{
 			PromptMetadata: pruned,
 			Template:       strings.TrimSpace(body),
@@ -373,112 +634,881 @@ func ParseDocument(source string) (ParsedPrompt, error) {
 	}, nil
 }
 
+// DocumentDelimiter separates the documents of a multi-document .prompt file
+// when it appears on a line of its own.
+const DocumentDelimiter = "==="
+
+// ParseDocuments parses a source containing several documents, e.g. a prompt
+// and its variants, separated by DocumentDelimiter lines. Each document is
+// parsed independently with its own frontmatter and the documents are returned
+// in order. Delimiters inside fenced code blocks are ignored, and a source
+// without delimiters yields a single document equivalent to ParseDocument.
+func ParseDocuments(source string) ([]ParsedPrompt, error) {
+	return ParseDocumentsWithOptions(source, nil)
+}
+
+// ParseDocumentsWithOptions parses documents like ParseDocuments using the
+// given options, which apply to each document. MaxBytes limits the size of
+// the whole source.
+func ParseDocumentsWithOptions(source string, options *ParseOptions) ([]ParsedPrompt, error) {
+	if options != nil && options.MaxBytes > 0 && len(source) > options.MaxBytes {
+		return nil, fmt.Errorf(
+			"dotprompt: template source is %d bytes, exceeding the limit of %d bytes", len(source), options.MaxBytes)
+	}
+	var prompts []ParsedPrompt
+	for i, document := range splitDocuments(source) {
+		prompt, err := ParseDocumentWithOptions(document, options)
+		if err != nil {
+			return nil, fmt.Errorf("dotprompt: document %d: %w", i+1, err)
+		}
+		prompts = append(prompts, prompt)
+	}
+	return prompts, nil
+}
+
+// splitDocuments splits a source on DocumentDelimiter lines outside of fenced
+// code blocks (delimited by ``` or ~~~).
+func splitDocuments(source string) []string {
+	var documents []string
+	var lines []string
+	inFence := false
+	for _, line := range strings.Split(source, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			inFence = !inFence
+		}
+		if trimmed == DocumentDelimiter && !inFence {
+			documents = append(documents, strings.Join(lines, "\n"))
+			lines = nil
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return append(documents, strings.Join(lines, "\n"))
+}
+
+// ParseFrontmatterOnly decodes only the frontmatter of a document into
+// prompt metadata, without processing the template body or resolving schemas.
+// It is cheaper than ParseDocument when only metadata such as the name and
+// description is needed, e.g. for listing prompts. Unlike ParseDocument,
+// invalid frontmatter is always reported as an error. A document without
+// frontmatter yields empty metadata.
+func ParseFrontmatterOnly(source string) (PromptMetadata, error) {
+	format, frontmatter, _ := extractFrontmatterFormatAndBody(source)
+	if frontmatter == "" {
+		return PromptMetadata{Ext: make(map[string]map[string]any)}, nil
+	}
+	metadata, err := decodeFrontmatterAs(format, frontmatter, nil)
+	if err != nil {
+		return PromptMetadata{}, fmt.Errorf("dotprompt: invalid frontmatter: %w", err)
+	}
+	return metadata, nil
+}
+
+// decodeFrontmatter decodes YAML frontmatter into prompt metadata. Reserved
+// keywords populate the corresponding fields, namespaced keys (containing a
+// '.') populate Ext, and all keys are kept in Raw.
+func decodeFrontmatter(frontmatter string) (PromptMetadata, error) {
+	return decodeFrontmatterAs(FrontmatterFormatYAML, frontmatter, nil)
+}
+
+// decodeFrontmatterAs decodes frontmatter of the given format like
+// decodeFrontmatter, using yamlDecoder in place of the default YAML decoder if
+// it is not nil.
+func decodeFrontmatterAs(format FrontmatterFormat, frontmatter string, yamlDecoder FrontmatterDecoder) (PromptMetadata, error) {
+	decoder := frontmatterDecoder(format, yamlDecoder)
+	var parsedMetadata map[string]any
+	// The github.com/goccy/go-yaml library can panic on certain malformed YAML
+	// so we need to use a custom error handler to recover from panics
+	var err error
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic while parsing frontmatter: %v", r)
+			}
+		}()
+		err = decoder([]byte(frontmatter), &parsedMetadata)
+	}()
+
+	if err != nil && format == FrontmatterFormatYAML && TabIndentationRegex.MatchString(frontmatter) {
+		err = fmt.Errorf("YAML frontmatter uses tabs for indentation: %w", err)
+	}
+	if err != nil {
+		return PromptMetadata{}, err
+	}
+
+	raw := copyMapping(parsedMetadata)
+	pruned := PromptMetadata{
+		Ext: make(map[string]map[string]any),
+	}
+	ext := make(map[string]map[string]any)
+
+	for key, value := range raw {
+		if slices.Contains(ReservedMetadataKeywords, key) {
+			// Add to pruned metadata.
+			switch key {
+			case "name":
+				pruned.Name = stringOrEmpty(value)
+			case "description":
+				pruned.Description = stringOrEmpty(value)
+			case "variant":
+				pruned.Variant = stringOrEmpty(value)
+			case "version":
+				pruned.Version = stringOrEmpty(value)
+			case "model":
+				pruned.Model = stringOrEmpty(value)
+			case "examples":
+				if examplesSlice, ok := value.([]any); ok {
+					examples := make([]map[string]any, 0, len(examplesSlice))
+					for _, ex := range examplesSlice {
+						if exMap, ok := ex.(map[string]any); ok {
+							examples = append(examples, exMap)
+						}
+					}
+					pruned.Examples = examples
+				}
+			case "config":
+				if configMap, ok := value.(map[string]any); ok {
+					pruned.Config = configMap
+				}
+			case "tools":
+				if toolsSlice, ok := value.([]any); ok {
+					tools := make([]string, 0, len(toolsSlice))
+					for _, t := range toolsSlice {
+						if toolStr, ok := t.(string); ok {
+							tools = append(tools, toolStr)
+						}
+					}
+					pruned.Tools = tools
+				}
+			case "toolDefs":
+				if toolDefsSlice, ok := value.([]any); ok {
+					toolDefs := make([]ToolDefinition, 0, len(toolDefsSlice))
+					for _, td := range toolDefsSlice {
+						if tdMap, ok := td.(map[string]any); ok {
+							toolDef := ToolDefinition{
+								Name:        stringOrEmpty(tdMap["name"]),
+								Description: stringOrEmpty(tdMap["description"]),
+							}
+							switch inputSchema := tdMap["inputSchema"].(type) {
+							case map[string]any, string:
+								toolDef.InputSchema = inputSchema
+							}
+							switch outputSchema := tdMap["outputSchema"].(type) {
+							case map[string]any, string:
+								toolDef.OutputSchema = outputSchema
+							}
+							toolDefs = append(toolDefs, toolDef)
+						}
+					}
+					pruned.ToolDefs = toolDefs
+				}
+			case "input":
+				if inputMap, ok := value.(map[string]any); ok {
+					if defaultMap, ok := inputMap["default"].(map[string]any); ok {
+						pruned.Input.Default = defaultMap
+					}
+					if schemaMap, ok := inputMap["schema"].(map[string]any); ok {
+						pruned.Input.Schema = schemaMap
+					}
+					if schemaMap, ok := inputMap["schema"].(string); ok {
+						pruned.Input.Schema = schemaMap
+					}
+				}
+			case "output":
+				if outputMap, ok := value.(map[string]any); ok {
+					if formatMap, ok := outputMap["format"].(string); ok {
+						pruned.Output.Format = formatMap
+					}
+					if schemaMap, ok := outputMap["schema"].(map[string]any); ok {
+						pruned.Output.Schema = schemaMap
+					}
+					if schemaMap, ok := outputMap["schema"].(string); ok {
+						pruned.Output.Schema = schemaMap
+					}
+				}
+			}
+		} else if strings.Contains(key, ".") {
+			convertNamespacedEntryToNestedObject(key, value, ext)
+		}
+	}
+
+	// Set the raw and ext fields
+	pruned.Raw = raw
+	pruned.Ext = ext
+	return pruned, nil
+}
+
+// ToMessagesOptions configures how a rendered template string is converted
+// into messages.
+type ToMessagesOptions struct {
+	// AllowedMediaHosts restricts the hosts media URLs may reference. An entry
+	// matches a URL host exactly, except for entries of the form
+	// "*.example.com", which match any subdomain of example.com (but not
+	// example.com itself). Data URIs embed their content and are always
+	// allowed, while relative URLs have no host and are rejected. An empty list
+	// allows all URLs.
+	AllowedMediaHosts []string
+	// HistoryAnnotator, if set, is called for each message in
+	// DataArgument.Messages and its result is merged into that message's
+	// metadata when the history is inserted.
+	HistoryAnnotator HistoryAnnotator
+	// DropEmptyMedia drops media markers without a URL, e.g. from
+	// {{media url=""}}, from the message content. By default such markers are
+	// reported as an error.
+	DropEmptyMedia bool
+	// RoleAliases maps alternative role names to the canonical role they are
+	// normalized to, for both template roles and history messages. A nil map
+	// uses DefaultRoleAliases and an empty map disables normalization.
+	RoleAliases map[string]Role
+	// EmptyHistoryFallback, if set, is inserted as a user message in place of
+	// a history marker when there are no history messages, e.g. "No prior
+	// conversation.". By default an empty history inserts nothing.
+	EmptyHistoryFallback string
+	// StrictRoles causes role markers whose role is not in AllowedRoles to be
+	// reported as an error, e.g. a mistyped <<<dotprompt:role:usr>>>. By
+	// default any role is accepted.
+	StrictRoles bool
+	// AllowedRoles are the roles that role markers may use, checked after
+	// RoleAliases are applied. Setting it enables the check even without
+	// StrictRoles. When StrictRoles is set and AllowedRoles is empty,
+	// DefaultAllowedRoles is used.
+	AllowedRoles []Role
+	// InferMediaContentType fills in the content type of media parts that
+	// have none from the file extension of the URL, e.g. image/png for
+	// ".png". URLs with an unknown extension are left without a content type.
+	InferMediaContentType bool
+	// HistoryPlacement is where history is inserted when the template doesn't
+	// place it with the {{history}} helper. With either placement, system
+	// messages always precede the inserted history. The zero value is
+	// HistoryPlacementBeforeLastUser.
+	HistoryPlacement HistoryPlacement
+	// DeduplicateHistory drops history messages that repeat an earlier
+	// history message with the same role and content, adjacent or not,
+	// keeping the first occurrence. This is useful when a client resends
+	// turns that are already part of the stored conversation.
+	DeduplicateHistory bool
+	// MarkerDelimiters replace the `<<<` and `>>>` delimiters of the markers
+	// in the rendered template, e.g. to parse `[[dotprompt:role:user]]` so
+	// that `<<<dotprompt:...>>>` is left as literal text. Both must be set;
+	// the default delimiters are used otherwise.
+	MarkerDelimiters MarkerDelimiters
+	// SplitMediaToMessages moves each media part into a message of its own
+	// with the role and metadata of the message it came from, placed between
+	// messages holding the parts before and after it, for providers that
+	// expect media outside of mixed content. By default media parts stay in
+	// the content of their message.
+	SplitMediaToMessages bool
+}
+
+// HistoryPlacement is a strategy for inserting history into rendered messages.
+type HistoryPlacement string
+
+const (
+	// HistoryPlacementBeforeLastUser inserts the history before the final
+	// message if it is a user message, and at the end otherwise.
+	HistoryPlacementBeforeLastUser HistoryPlacement = "beforeLastUser"
+	// HistoryPlacementAfterSystem inserts the history directly after the
+	// last system message, ahead of the user and model turns that follow it,
+	// as some providers require.
+	HistoryPlacementAfterSystem HistoryPlacement = "afterSystem"
+)
+
+// DefaultAllowedRoles are the roles accepted when
+// ToMessagesOptions.StrictRoles is set without AllowedRoles.
+var DefaultAllowedRoles = []Role{RoleUser, RoleModel, RoleSystem, RoleTool}
+
+// DefaultRoleAliases are the role aliases applied when
+// ToMessagesOptions.RoleAliases is nil.
+var DefaultRoleAliases = map[string]Role{
+	"assistant": RoleModel,
+	"ai":        RoleModel,
+	"human":     RoleUser,
+}
+
+// roleAliases returns the role aliases configured in the options.
+func (o *ToMessagesOptions) roleAliases() map[string]Role {
+	if o == nil || o.RoleAliases == nil {
+		return DefaultRoleAliases
+	}
+	return o.RoleAliases
+}
+
+// markers returns the marker syntax configured in the options.
+func (o *ToMessagesOptions) markers() *markerSyntax {
+	if o == nil {
+		return defaultMarkerSyntax
+	}
+	return markerSyntaxFor(o.MarkerDelimiters)
+}
+
+// allowedRoles returns the roles that role markers may use, or nil if any role
+// is accepted.
+func (o *ToMessagesOptions) allowedRoles() []Role {
+	if o == nil {
+		return nil
+	}
+	if len(o.AllowedRoles) > 0 {
+		return o.AllowedRoles
+	}
+	if o.StrictRoles {
+		return DefaultAllowedRoles
+	}
+	return nil
+}
+
+// validateRoles checks that every role marker in the rendered string uses one
+// of the allowed roles, reporting the first offending role and the byte offset
+// of its marker.
+func validateRoles(renderedString string, allowed []Role, aliases map[string]Role, markers *markerSyntax) error {
+	for _, match := range markers.roleAndHistory.FindAllStringSubmatchIndex(renderedString, -1) {
+		marker := renderedString[match[2]:match[3]]
+		rest, ok := strings.CutPrefix(marker, markers.prefix(RoleMarkerPrefix))
+		if !ok {
+			continue
+		}
+		roleStr, _, _ := strings.Cut(rest, " ")
+		if !slices.Contains(allowed, canonicalRole(Role(roleStr), aliases)) {
+			return fmt.Errorf("dotprompt: unknown role '%s' at byte offset %d", roleStr, match[0])
+		}
+	}
+	return nil
+}
+
+// canonicalRole returns the role the given role is an alias of, or the role
+// itself.
+func canonicalRole(role Role, aliases map[string]Role) Role {
+	if canonical, ok := aliases[string(role)]; ok {
+		return canonical
+	}
+	return role
+}
+
+// HistoryAnnotator returns additional metadata for the history message at the
+// given index.
+type HistoryAnnotator func(index int, message Message) Metadata
+
 // ToMessages converts a rendered template string into an array of messages.
 func ToMessages(renderedString string, data *DataArgument) ([]Message, error) {
-	// Create the initial message source with empty content.
-	ms := &MessageSource{
-		Role:   RoleUser,
-		Source: "",
-	}
-	messageSources := []*MessageSource{ms}
-
-	for _, piece := range splitByRoleAndHistoryMarkers(renderedString) {
-		if strings.HasPrefix(piece, RoleMarkerPrefix) {
-			roleStr := piece[len(RoleMarkerPrefix):]
-			role := Role(roleStr)
-
-			if messageSources[len(messageSources)-1].Source != "" &&
-				trimUnicodeSpacesExceptNewlines(messageSources[len(messageSources)-1].Source) != "" {
-				// If the current message has content, create a new message.
-				newMs := &MessageSource{
-					Role:   role,
-					Source: "",
+	return ToMessagesWithOptions(renderedString, data, nil)
+}
+
+// ToMessagesWithOptions converts a rendered template string into an array of
+// messages like ToMessages using the given options. A nil options value is
+// equivalent to the zero ToMessagesOptions.
+func ToMessagesWithOptions(renderedString string, data *DataArgument, options *ToMessagesOptions) ([]Message, error) {
+	messages := []Message{}
+	for msg, err := range ToMessagesSeqWithOptions(renderedString, data, options) {
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+// ToMessagesSeq returns an iterator over the messages of a rendered template
+// string, yielding the same messages in the same order as ToMessages. The
+// rendered string is split lazily and each message is yielded once it is
+// complete, so that callers can process the first messages of a large prompt
+// before the rest is parsed. Iteration stops after the first error.
+//
+// When the history is inserted without the {{history}} helper, it goes before
+// the final user message, so the latest message is only yielded once the
+// next one is complete.
+func ToMessagesSeq(renderedString string, data *DataArgument) iter.Seq2[Message, error] {
+	return ToMessagesSeqWithOptions(renderedString, data, nil)
+}
+
+// ToMessagesSeqWithOptions returns an iterator over the messages of a
+// rendered template string like ToMessagesSeq using the given options. A nil
+// options value is equivalent to the zero ToMessagesOptions.
+func ToMessagesSeqWithOptions(renderedString string, data *DataArgument, options *ToMessagesOptions) iter.Seq2[Message, error] {
+	if options == nil {
+		options = &ToMessagesOptions{}
+	}
+	return func(yield func(Message, error) bool) {
+		if options.SplitMediaToMessages {
+			yield = splitMediaYield(yield)
+		}
+		if allowed := options.allowedRoles(); allowed != nil {
+			if err := validateRoles(renderedString, allowed, options.roleAliases(), options.markers()); err != nil {
+				yield(Message{}, err)
+				return
+			}
+		}
+
+		history := []Message{}
+		if data != nil && data.Messages != nil {
+			history = annotateHistory(data.Messages, options.HistoryAnnotator)
+		}
+		history = canonicalHistoryRoles(history, options.roleAliases())
+		if options.DeduplicateHistory {
+			history = deduplicateHistory(history)
+		}
+
+		emitter := &messageEmitter{yield: yield, history: history, options: options}
+		// Create the initial message source with empty content.
+		current := &MessageSource{
+			Role:   RoleUser,
+			Source: "",
+		}
+		// next completes the current message source and starts the given one,
+		// reporting whether iteration should continue.
+		next := func(ms *MessageSource) bool {
+			completed := current
+			current = ms
+			return emitter.emit(completed)
+		}
+
+		markers := options.markers()
+		rolePrefix, historyPrefix := markers.prefix(RoleMarkerPrefix), markers.prefix(HistoryMarkerPrefix)
+		for piece, err := range markers.splitByRoleAndHistoryMarkers(renderedString) {
+			if err != nil {
+				yield(Message{}, err)
+				return
+			}
+			if strings.HasPrefix(piece, rolePrefix) {
+				roleStr, metadataStr, _ := strings.Cut(piece[len(rolePrefix):], " ")
+				role := Role(roleStr)
+				var metadata map[string]any
+				if metadataStr != "" {
+					if err := json.Unmarshal([]byte(metadataStr), &metadata); err != nil {
+						yield(Message{}, fmt.Errorf("dotprompt: invalid metadata for role '%s': %w", roleStr, err))
+						return
+					}
+				}
+
+				if current.Source != "" && trimUnicodeSpacesExceptNewlines(current.Source) != "" {
+					// If the current message has content, create a new message.
+					if !next(&MessageSource{Role: role, Source: "", Metadata: metadata}) {
+						return
+					}
+				} else {
+					// Otherwise, update the role of the current message.
+					current.Role = role
+					if metadata != nil {
+						if current.Metadata == nil {
+							current.Metadata = make(map[string]any)
+						}
+						maps.Copy(current.Metadata, metadata)
+					}
+				}
+			} else if strings.HasPrefix(piece, historyPrefix) {
+				// Add the history messages to the message sources.
+				historyMessages, err := transformMessagesToHistory(history)
+				if err != nil {
+					yield(Message{}, err)
+					return
+				}
+
+				if len(historyMessages) > 0 {
+					for _, msg := range historyMessages {
+						if !next(&MessageSource{Role: msg.Role, Content: msg.Content, Metadata: msg.Metadata}) {
+							return
+						}
+					}
+				} else if options.EmptyHistoryFallback != "" {
+					if !next(&MessageSource{Role: RoleUser, Source: options.EmptyHistoryFallback}) {
+						return
+					}
+				}
+
+				if !next(&MessageSource{Role: RoleModel, Source: ""}) {
+					return
 				}
-				messageSources = append(messageSources, newMs)
 			} else {
-				// Otherwise, update the role of the current message.
-				messageSources[len(messageSources)-1].Role = role
+				// Otherwise, add the piece to the current message source.
+				current.Source += piece
 			}
-		} else if strings.HasPrefix(piece, HistoryMarkerPrefix) {
-			// Add the history messages to the message sources.
-			var msgs []Message
-			if data != nil && data.Messages != nil {
-				msgs = data.Messages
+		}
+
+		if emitter.emit(current) {
+			emitter.finish()
+		}
+	}
+}
+
+// roleNameRegex matches the role names that RoleAndHistoryMarkerRegex accepts
+// in a role marker.
+var roleNameRegex = regexp.MustCompile(`^[a-z]+$`)
+
+// MessagesToString converts messages back into a rendered template string
+// using role, media, and section markers, the inverse of ToMessages. Each
+// message starts with a role marker carrying its metadata, and contiguous
+// history messages, i.e. those whose "purpose" metadata is "history", are
+// collapsed into a single <<<dotprompt:history>>> marker, so converting the
+// result with ToMessages and the same history yields equivalent messages.
+// Adjacent text parts are merged by that conversion.
+//
+// Messages that markers can't express are errors: roles other than lowercase
+// letters, text containing a dotprompt marker, media URLs or section names
+// containing spaces, part metadata, and tool parts.
+func MessagesToString(messages []Message) (string, error) {
+	var sb strings.Builder
+	inHistory := false
+	for i, message := range messages {
+		if message.Metadata["purpose"] == "history" {
+			if !inHistory {
+				sb.WriteString(HistoryMarkerPrefix + ">>>")
+				inHistory = true
 			}
+			continue
+		}
+		inHistory = false
 
-			historyMessages, err := transformMessagesToHistory(msgs)
+		if !roleNameRegex.MatchString(string(message.Role)) {
+			return "", fmt.Errorf("dotprompt: message %d: role '%s' can't be written as a role marker", i, message.Role)
+		}
+		sb.WriteString(RoleMarkerPrefix + string(message.Role))
+		if len(message.Metadata) > 0 {
+			// json.Marshal escapes '<' and '>', so the metadata can't terminate
+			// the marker early.
+			metadata, err := json.Marshal(message.Metadata)
 			if err != nil {
-				return nil, err
+				return "", fmt.Errorf("dotprompt: message %d: %w", i, err)
 			}
+			sb.WriteString(" " + string(metadata))
+		}
+		sb.WriteString(">>>")
 
-			if len(historyMessages) > 0 {
-				for _, msg := range historyMessages {
-					messageSources = append(messageSources, &MessageSource{
-						Role:     msg.Role,
-						Content:  msg.Content,
-						Metadata: msg.Metadata,
-					})
-				}
+		for _, part := range message.Content {
+			if err := writePartMarkup(&sb, part); err != nil {
+				return "", fmt.Errorf("dotprompt: message %d: %w", i, err)
 			}
+		}
+	}
+	return sb.String(), nil
+}
 
-			newMs := &MessageSource{
-				Role:   RoleModel,
-				Source: "",
-			}
-			messageSources = append(messageSources, newMs)
-		} else {
-			// Otherwise, add the piece to the current message source.
-			messageSources[len(messageSources)-1].Source += piece
+// writePartMarkup writes a part as it appears in a rendered template string.
+func writePartMarkup(sb *strings.Builder, part Part) error {
+	switch p := part.(type) {
+	case *TextPart:
+		if len(p.Metadata) > 0 {
+			return fmt.Errorf("text part metadata can't be written as markers")
+		}
+		if strings.Contains(p.Text, "<<<dotprompt:") {
+			return fmt.Errorf("text part contains a dotprompt marker")
+		}
+		sb.WriteString(p.Text)
+	case *MediaPart:
+		if len(p.Metadata) > 0 {
+			return fmt.Errorf("media part metadata can't be written as markers")
+		}
+		if p.Media.URL == "" || strings.ContainsAny(p.Media.URL, " >") {
+			return fmt.Errorf("media URL %q can't be written as a media marker", p.Media.URL)
+		}
+		if strings.ContainsAny(p.Media.ContentType, " >") {
+			return fmt.Errorf("media content type %q can't be written as a media marker", p.Media.ContentType)
 		}
+		sb.WriteString(MediaMarkerPrefix + "url " + p.Media.URL)
+		if p.Media.ContentType != "" {
+			sb.WriteString(" " + p.Media.ContentType)
+		}
+		sb.WriteString(">>>")
+	case *PendingPart:
+		name, _ := p.Metadata["purpose"].(string)
+		if name == "" || strings.ContainsAny(name, " >") || p.Metadata["pending"] != true || len(p.Metadata) != 2 {
+			return fmt.Errorf("pending part can't be written as a section marker")
+		}
+		sb.WriteString(SectionMarkerPrefix + " " + name + ">>>")
+	case *DataPart:
+		if len(p.Metadata) > 0 {
+			return fmt.Errorf("data part metadata can't be written as markers")
+		}
+		data, err := json.Marshal(p.Data)
+		if err != nil {
+			return err
+		}
+		if p.Data == nil {
+			data = []byte("{}")
+		}
+		sb.WriteString(DataMarkerPrefix + ">>>" + string(data))
+	case *ToolRequestPart:
+		return writeToolMarker(sb, ToolRequestMarkerPrefix, "tool request", p.Metadata, p.ToolRequest)
+	case *ToolResponsePart:
+		return writeToolMarker(sb, ToolResponseMarkerPrefix, "tool response", p.Metadata, p.ToolResponse)
+	default:
+		return fmt.Errorf("%T can't be written as markers", part)
 	}
+	return nil
+}
 
-	messages, err := messageSourcesToMessages(messageSources)
+// writeToolMarker writes a tool request or response part as a tool marker.
+func writeToolMarker(sb *strings.Builder, prefix, kind string, metadata Metadata, object map[string]any) error {
+	if len(metadata) > 0 {
+		return fmt.Errorf("%s part metadata can't be written as markers", kind)
+	}
+	data, err := json.Marshal(object)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	// Check that the marker parses back into the part.
+	if _, err := parsePart(prefix+" "+string(data), nil); err != nil {
+		return err
+	}
+	sb.WriteString(prefix + ">>>" + string(data))
+	return nil
+}
 
-	if data != nil {
-		return insertHistory(messages, data.Messages)
+// messageEmitter yields the messages converted from completed message
+// sources. Messages are held back for as long as history that was not placed
+// with the {{history}} helper could still be inserted before them: the latest
+// message, since history is inserted before a final user message by default,
+// or every message since the last system message with
+// HistoryPlacementAfterSystem.
+type messageEmitter struct {
+	yield      func(Message, error) bool
+	history    []Message
+	options    *ToMessagesOptions
+	pending    []Message
+	hasHistory bool
+}
+
+// emit converts a completed message source, yielding the held messages that
+// history can no longer be inserted before. It reports whether iteration
+// should continue.
+func (e *messageEmitter) emit(ms *MessageSource) bool {
+	msg, ok, err := messageSourceToMessage(ms, e.options)
+	if err != nil {
+		e.yield(Message{}, err)
+		return false
+	}
+	if !ok {
+		return true
 	}
-	return insertHistory(messages, []Message{})
+	if msg.Metadata["purpose"] == "history" {
+		e.hasHistory = true
+	}
+	e.pending = append(e.pending, msg)
+
+	ready := len(e.pending) - 1
+	if e.options.HistoryPlacement == HistoryPlacementAfterSystem {
+		ready = 0
+		if msg.Role == RoleSystem {
+			ready = len(e.pending)
+		}
+	}
+	for _, held := range e.pending[:ready] {
+		if !e.yield(held, nil) {
+			return false
+		}
+	}
+	e.pending = e.pending[ready:]
+	return true
 }
 
-// messageSourcesToMessages converts an array of message sources to an array of
+// finish yields the held messages along with the history if it still needs to
+// be inserted.
+func (e *messageEmitter) finish() {
+	tail := e.pending
+	if !e.hasHistory {
+		if e.options.HistoryPlacement == HistoryPlacementAfterSystem {
+			tail = insertHistoryAfterSystem(tail, e.history)
+		} else {
+			tail, _ = insertHistory(tail, e.history)
+		}
+	}
+	for _, msg := range tail {
+		if !e.yield(msg, nil) {
+			return
+		}
+	}
+}
+
+// annotateHistory returns a copy of the history messages with the metadata
+// returned by the annotator merged into each message's metadata. The history
+// is returned unchanged if the annotator is nil.
+func annotateHistory(history []Message, annotator HistoryAnnotator) []Message {
+	if annotator == nil {
+		return history
+	}
+	result := make([]Message, len(history))
+	for i, message := range history {
+		result[i] = message
+		extra := annotator(i, message)
+		if len(extra) > 0 {
+			newMetadata := copyMapping(message.Metadata)
+			maps.Copy(newMetadata, extra)
+			result[i].Metadata = newMetadata
+		}
+	}
+	return result
+}
+
+// canonicalHistoryRoles returns the history with aliased roles replaced by
+// their canonical role, copying it rather than modifying the caller's
 // messages.
-func messageSourcesToMessages(
-	messageSources []*MessageSource) ([]Message, error) {
-	messages := []Message{}
+func canonicalHistoryRoles(history []Message, aliases map[string]Role) []Message {
+	var result []Message
+	for i, message := range history {
+		role := canonicalRole(message.Role, aliases)
+		if role == message.Role {
+			continue
+		}
+		if result == nil {
+			result = slices.Clone(history)
+		}
+		result[i].Role = role
+	}
+	if result == nil {
+		return history
+	}
+	return result
+}
 
-	for _, m := range messageSources {
-		// Only skip messages that have both empty Content and empty Source.
-		if m.Content == nil && strings.TrimSpace(m.Source) == "" {
+// splitMediaYield wraps yield so that each message is yielded as the messages
+// returned by splitMediaParts.
+func splitMediaYield(yield func(Message, error) bool) func(Message, error) bool {
+	return func(msg Message, err error) bool {
+		if err != nil {
+			return yield(msg, err)
+		}
+		for _, part := range splitMediaParts(msg) {
+			if !yield(part, nil) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// splitMediaParts splits a message into messages with the same role and
+// metadata, one for each media part and one for each run of other parts, in
+// the original order.
+func splitMediaParts(msg Message) []Message {
+	if !slices.ContainsFunc(msg.Content, isMediaPart) {
+		return []Message{msg}
+	}
+	var result []Message
+	var run []Part
+	add := func(content []Part) {
+		result = append(result, Message{
+			Role:        msg.Role,
+			Content:     content,
+			HasMetadata: HasMetadata{Metadata: maps.Clone(msg.Metadata)},
+		})
+	}
+	flush := func() {
+		if len(run) > 0 {
+			add(run)
+			run = nil
+		}
+	}
+	for _, part := range msg.Content {
+		if isMediaPart(part) {
+			flush()
+			add([]Part{part})
 			continue
 		}
+		run = append(run, part)
+	}
+	flush()
+	return result
+}
+
+// isMediaPart reports whether the part is a media part.
+func isMediaPart(part Part) bool {
+	_, ok := part.(*MediaPart)
+	return ok
+}
 
-		out := Message{
-			Role: m.Role,
+// deduplicateHistory returns the history without messages that have the same
+// role and content as an earlier message. Metadata is ignored, so a resent
+// turn is dropped even if it was annotated differently.
+func deduplicateHistory(history []Message) []Message {
+	var result []Message
+	for _, message := range history {
+		duplicate := slices.ContainsFunc(result, func(kept Message) bool {
+			return sameMessage(kept, message)
+		})
+		if !duplicate {
+			result = append(result, message)
 		}
+	}
+	return result
+}
 
-		if m.Content != nil {
-			out.Content = m.Content
-		} else {
-			parts, err := toParts(m.Source)
-			if err != nil {
-				return nil, err
+// MessagesDifference returns the messages in a that are absent from b, in
+// their order in a, e.g. the history messages that a render dropped. Messages
+// are equal if they have the same role and parts, ignoring message metadata
+// such as the "purpose" added to inserted history. Each message in b accounts
+// for at most one equal message in a, so a message that appears twice in a
+// and once in b is returned once.
+func MessagesDifference(a, b []Message) []Message {
+	matched := make([]bool, len(b))
+	result := []Message{}
+	for _, message := range a {
+		found := false
+		for i, other := range b {
+			if !matched[i] && sameMessage(message, other) {
+				matched[i] = true
+				found = true
+				break
 			}
-			out.Content = parts
 		}
-
-		if m.Metadata != nil {
-			out.Metadata = m.Metadata
+		if !found {
+			result = append(result, message)
 		}
+	}
+	return result
+}
 
-		messages = append(messages, out)
+// sameMessage reports whether the messages have the same role and parts,
+// ignoring message metadata.
+func sameMessage(a, b Message) bool {
+	return a.Role == b.Role && reflect.DeepEqual(a.Content, b.Content)
+}
+
+// messageSourcesToMessages converts an array of message sources to an array of
+// messages.
+func messageSourcesToMessages(
+	messageSources []*MessageSource, options *ToMessagesOptions) ([]Message, error) {
+	messages := []Message{}
+
+	for _, m := range messageSources {
+		out, ok, err := messageSourceToMessage(m, options)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			messages = append(messages, out)
+		}
 	}
 
 	return messages, nil
 }
 
+// messageSourceToMessage converts a message source to a message, reporting
+// false for a message source without content.
+func messageSourceToMessage(m *MessageSource, options *ToMessagesOptions) (Message, bool, error) {
+	// Only skip messages that have both empty Content and empty Source.
+	if m.Content == nil && strings.TrimSpace(m.Source) == "" {
+		return Message{}, false, nil
+	}
+
+	out := Message{
+		Role: canonicalRole(m.Role, options.roleAliases()),
+	}
+
+	if m.Content != nil {
+		out.Content = m.Content
+	} else {
+		parts, err := toParts(m.Source, options)
+		if err != nil {
+			return Message{}, false, err
+		}
+		out.Content = parts
+	}
+
+	if m.Metadata != nil {
+		out.Metadata = m.Metadata
+	}
+
+	return out, true, nil
+}
+
 // transformMessagesToHistory adds history metadata to an array of messages.
 func transformMessagesToHistory(messages []Message) ([]Message, error) {
 	result := make([]Message, len(messages))
@@ -552,37 +1582,159 @@ func insertHistory(messages []Message, history []Message) ([]Message, error) {
 	return append(messages, history...), nil
 }
 
+// insertHistoryAfterSystem inserts historical messages directly after the last
+// system message, or before all other messages if there is none, so that
+// system messages always precede the history.
+func insertHistoryAfterSystem(messages []Message, history []Message) []Message {
+	if len(history) == 0 || messagesHaveHistory(messages) {
+		return messages
+	}
+	at := 0
+	for i, msg := range messages {
+		if msg.Role == RoleSystem {
+			at = i + 1
+		}
+	}
+	result := make([]Message, 0, len(messages)+len(history))
+	result = append(result, messages[:at]...)
+	result = append(result, history...)
+	return append(result, messages[at:]...)
+}
+
+// NewMessages returns the rendered messages that were generated by the
+// template, leaving out those carried over from the history passed as
+// DataArgument.Messages, e.g. so that a UI can append only the new messages to
+// an existing conversation.
+//
+// Messages placed with the {{history}} helper are identified by their
+// `purpose: history` metadata. Otherwise the history was inserted as a single
+// run of messages, which is identified by comparing content with the history.
+func NewMessages(history []Message, rendered []Message) []Message {
+	out := []Message{}
+	if messagesHaveHistory(rendered) {
+		for _, msg := range rendered {
+			if msg.Metadata["purpose"] != "history" {
+				out = append(out, msg)
+			}
+		}
+		return out
+	}
+
+	h := len(history)
+	if h > 0 {
+		for i := 0; i+h <= len(rendered); i++ {
+			if sameContent(rendered[i:i+h], history) {
+				out = append(out, rendered[:i]...)
+				return append(out, rendered[i+h:]...)
+			}
+		}
+	}
+	return append(out, rendered...)
+}
+
+// sameContent reports whether the messages have the same content, ignoring
+// roles and metadata, which may have been rewritten while rendering.
+func sameContent(a, b []Message) bool {
+	for i := range a {
+		if !reflect.DeepEqual(a[i].Content, b[i].Content) {
+			return false
+		}
+	}
+	return true
+}
+
 // toParts converts a source string into an array of parts (text, media, or
 // metadata).
 //
-// Also processes media and section markers.
-func toParts(source string) ([]Part, error) {
+// Also processes media and section markers. The parts are in the order of the
+// text and markers in the source; blank text between markers is dropped.
+func toParts(source string, options *ToMessagesOptions) ([]Part, error) {
 	parts := []Part{}
 
-	for _, piece := range splitByMediaAndSectionMarkers(source) {
-		part, err := parsePart(piece)
+	markers := options.markers()
+	pieces, err := markers.splitByPartMarkers(source)
+	if err != nil {
+		return nil, err
+	}
+	for _, piece := range pieces {
+		var part Part
+		var err error
+		if marker, ok := markers.canonicalPartMarker(piece); ok {
+			part, err = parsePart(marker, options)
+		} else {
+			part, err = parseTextPart(piece)
+		}
 		if err != nil {
 			return nil, err
 		}
+		if part == nil {
+			// Dropped, e.g. a media marker without a URL.
+			continue
+		}
 		parts = append(parts, part)
 	}
 
 	return parts, nil
 }
 
+// ParsePart parses a single piece of a rendered template into a part. A
+// piece is either plain text or one marker, with or without its closing
+// `>>>`, and followed by its JSON object for a data or tool marker. The
+// concrete type of the returned part is:
+//
+//   - *MediaPart for `<<<dotprompt:media:url <url> [<contentType>]>>>`
+//   - *PendingPart for `<<<dotprompt:section <name>>>>`, with "pending" set to
+//     true and "purpose" set to the section name in its metadata
+//   - *DataPart for `<<<dotprompt:data>>> <json object>`
+//   - *ToolRequestPart for `<<<dotprompt:tool-request>>> <json object>`,
+//     where the object has a "name" and optionally "input" (or "args") and
+//     "ref"
+//   - *ToolResponsePart for `<<<dotprompt:tool-response>>> <json object>`,
+//     where the object has a "name" and "output" and optionally "ref"
+//   - *TextPart for anything else
+//
+// Malformed markers, including media markers without a URL, are errors.
+func ParsePart(piece string) (Part, error) {
+	for _, prefix := range jsonMarkerPrefixes {
+		if value, ok := strings.CutPrefix(piece, prefix+">>>"); ok {
+			piece = prefix + " " + value
+		}
+	}
+	if slices.ContainsFunc(partMarkerPrefixes, func(prefix string) bool { return strings.HasPrefix(piece, prefix) }) {
+		piece = strings.TrimSuffix(piece, ">>>")
+	}
+	part, err := parsePart(piece, nil)
+	if err != nil {
+		// Avoid returning a non-nil Part holding a nil pointer.
+		return nil, err
+	}
+	return part, nil
+}
+
 // parsePart parses a part from piece of rendered template.
-func parsePart(piece string) (Part, error) {
+func parsePart(piece string, options *ToMessagesOptions) (Part, error) {
 	if strings.HasPrefix(piece, MediaMarkerPrefix) {
-		return parseMediaPart(piece)
+		mediaPart, err := parseMediaPart(piece, options)
+		if mediaPart == nil {
+			// Avoid returning a non-nil Part holding a nil *MediaPart.
+			return nil, err
+		}
+		return mediaPart, err
 	} else if strings.HasPrefix(piece, SectionMarkerPrefix) {
 		return parseSectionPart(piece)
+	} else if strings.HasPrefix(piece, DataMarkerPrefix) {
+		return parseDataPart(piece)
+	} else if strings.HasPrefix(piece, ToolRequestMarkerPrefix) {
+		return parseToolRequestPart(piece)
+	} else if strings.HasPrefix(piece, ToolResponseMarkerPrefix) {
+		return parseToolResponsePart(piece)
 	} else {
 		return parseTextPart(piece)
 	}
 }
 
 // parseMediaPart parses a media part from a piece of rendered template.
-func parseMediaPart(piece string) (*MediaPart, error) {
+func parseMediaPart(piece string, options *ToMessagesOptions) (*MediaPart, error) {
 	if !strings.HasPrefix(piece, MediaMarkerPrefix) {
 		return nil, fmt.Errorf(
 			"invalid media piece: %s; expected prefix %s",
@@ -598,12 +1750,36 @@ func parseMediaPart(piece string) (*MediaPart, error) {
 		url, contentType = fields[1], fields[2]
 	case 2:
 		url = fields[1]
+	case 1:
+		// The marker has no URL; handled below.
 	default:
 		return nil, fmt.Errorf(
 			"invalid media piece: %s; expected 2 or 3 fields, found %d",
 			piece, n)
 	}
 
+	if strings.TrimSpace(url) == "" {
+		if options != nil && options.DropEmptyMedia {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("invalid media piece: %s; missing URL", piece)
+	}
+
+	if options != nil && len(options.AllowedMediaHosts) > 0 {
+		if err := checkMediaHost(url, options.AllowedMediaHosts); err != nil {
+			return nil, err
+		}
+	}
+
+	var dataContentType string
+	if isDataURI(url) {
+		declared, err := parseDataURI(url)
+		if err != nil {
+			return nil, fmt.Errorf("invalid media piece: %w", err)
+		}
+		dataContentType = declared
+	}
+
 	mediaPart := &MediaPart{
 		Media: Media{
 			URL:         url,
@@ -614,11 +1790,116 @@ func parseMediaPart(piece string) (*MediaPart, error) {
 
 	if contentType != "" && strings.TrimSpace(contentType) != "" {
 		mediaPart.Media.ContentType = contentType
+	} else if dataContentType != "" {
+		mediaPart.Media.ContentType = dataContentType
+	} else if options != nil && options.InferMediaContentType {
+		mediaPart.Media.ContentType = inferMediaContentType(url)
 	}
 
 	return mediaPart, nil
 }
 
+// isDataURI reports whether the media URL uses the `data:` scheme.
+func isDataURI(mediaURL string) bool {
+	return len(mediaURL) >= 5 && strings.EqualFold(mediaURL[:5], "data:")
+}
+
+// parseDataURI validates a data URI of the form
+// `data:[<media type>][;<parameter>]*[;base64],<data>` and returns its
+// declared media type without parameters, which may be empty. Base64 payloads
+// must decode with one of base64Encodings. The payload is left out of errors
+// since it may be large.
+func parseDataURI(uri string) (string, error) {
+	header, payload, ok := strings.Cut(uri[len("data:"):], ",")
+	if !ok {
+		return "", fmt.Errorf("malformed data URI: missing ','")
+	}
+	params := strings.Split(header, ";")
+	mediaType := strings.TrimSpace(params[0])
+	if mediaType != "" && !strings.Contains(mediaType, "/") {
+		return "", fmt.Errorf("malformed data URI: invalid media type %q", mediaType)
+	}
+	if strings.EqualFold(params[len(params)-1], "base64") && len(params) > 1 {
+		decodes := slices.ContainsFunc(base64Encodings, func(encoding *base64.Encoding) bool {
+			_, err := encoding.DecodeString(payload)
+			return err == nil
+		})
+		if !decodes {
+			_, err := base64.StdEncoding.DecodeString(payload)
+			return "", fmt.Errorf("malformed data URI: invalid base64 data: %w", err)
+		}
+	}
+	return mediaType, nil
+}
+
+// base64Encodings are the encodings tried in order when decoding the base64
+// payload of a data URI, since unpadded and URL-safe payloads are common.
+var base64Encodings = []*base64.Encoding{
+	base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding,
+}
+
+// mediaContentTypes maps lowercase file extensions to the content type used
+// when inferring the content type of a media URL.
+var mediaContentTypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".svg":  "image/svg+xml",
+	".heic": "image/heic",
+	".mp4":  "video/mp4",
+	".mov":  "video/quicktime",
+	".webm": "video/webm",
+	".mpeg": "video/mpeg",
+	".mp3":  "audio/mpeg",
+	".wav":  "audio/wav",
+	".ogg":  "audio/ogg",
+	".flac": "audio/flac",
+	".aac":  "audio/aac",
+	".pdf":  "application/pdf",
+	".txt":  "text/plain",
+	".html": "text/html",
+	".csv":  "text/csv",
+	".json": "application/json",
+}
+
+// inferMediaContentType returns the content type for the file extension of
+// the media URL's path, or an empty string if the extension is unknown.
+func inferMediaContentType(mediaURL string) string {
+	parsed, err := url.Parse(mediaURL)
+	if err != nil {
+		return ""
+	}
+	return mediaContentTypes[strings.ToLower(path.Ext(parsed.Path))]
+}
+
+// checkMediaHost returns an error unless the host of the media URL is in the
+// allow-list. See ToMessagesOptions.AllowedMediaHosts for the matching rules.
+func checkMediaHost(mediaURL string, allowedHosts []string) error {
+	if isDataURI(mediaURL) {
+		return nil
+	}
+	parsed, err := url.Parse(mediaURL)
+	if err != nil {
+		return fmt.Errorf("invalid media URL %q: %w", mediaURL, err)
+	}
+	host := strings.ToLower(parsed.Hostname())
+	if host != "" {
+		for _, allowed := range allowedHosts {
+			allowed = strings.ToLower(allowed)
+			if suffix, ok := strings.CutPrefix(allowed, "*."); ok {
+				if strings.HasSuffix(host, "."+suffix) {
+					return nil
+				}
+			} else if host == allowed {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("media URL %q has a host that is not allowed", mediaURL)
+}
+
 // parseSectionPart parses a section part from a piece of rendered template.
 func parseSectionPart(piece string) (*PendingPart, error) {
 	if !strings.HasPrefix(piece, SectionMarkerPrefix) {
@@ -641,6 +1922,105 @@ func parseSectionPart(piece string) (*PendingPart, error) {
 	return pendingPart, nil
 }
 
+// parseDataPart parses a data part from a piece of rendered template. The
+// marker keyword is followed by whitespace and a JSON object, as joined by
+// splitByPartMarkers.
+func parseDataPart(piece string) (*DataPart, error) {
+	data, err := parseMarkerObject(piece, DataMarkerPrefix, "data")
+	if err != nil {
+		return nil, err
+	}
+	return &DataPart{Data: data}, nil
+}
+
+// parseToolRequestPart parses a tool request part from a piece of rendered
+// template. The marker keyword is followed by whitespace and a JSON object, as
+// joined by splitByPartMarkers, with the tool's "name" and optionally its "input" and a "ref". The input may
+// be given as "args" instead.
+func parseToolRequestPart(piece string) (*ToolRequestPart, error) {
+	request, err := parseMarkerObject(piece, ToolRequestMarkerPrefix, "tool request")
+	if err != nil {
+		return nil, err
+	}
+	if err := validateToolMarkerObject(piece, "tool request", request, []string{"name"}, []string{"input", "args", "ref"}); err != nil {
+		return nil, err
+	}
+	if args, ok := request["args"]; ok {
+		if _, ok := request["input"]; ok {
+			return nil, fmt.Errorf("invalid tool request piece: %s; expected \"input\" or \"args\", not both", piece)
+		}
+		request["input"] = args
+		delete(request, "args")
+	}
+	return &ToolRequestPart{ToolRequest: request}, nil
+}
+
+// parseToolResponsePart parses a tool response part from a piece of rendered
+// template. The marker keyword is followed by whitespace and a JSON object, as
+// joined by splitByPartMarkers, with the tool's "name" and "output" and optionally a "ref".
+func parseToolResponsePart(piece string) (*ToolResponsePart, error) {
+	response, err := parseMarkerObject(piece, ToolResponseMarkerPrefix, "tool response")
+	if err != nil {
+		return nil, err
+	}
+	if err := validateToolMarkerObject(piece, "tool response", response, []string{"name", "output"}, []string{"ref"}); err != nil {
+		return nil, err
+	}
+	return &ToolResponsePart{ToolResponse: response}, nil
+}
+
+// parseMarkerObject parses the JSON object following the keyword of a data
+// or tool marker, where kind names the marker in errors.
+func parseMarkerObject(piece, prefix, kind string) (map[string]any, error) {
+	if !strings.HasPrefix(piece, prefix) {
+		return nil, fmt.Errorf(
+			"invalid %s piece: %s; expected prefix %s",
+			kind, piece, prefix)
+	}
+
+	rest := piece[len(prefix):]
+	trimmed := strings.TrimSpace(rest)
+	if trimmed == "" {
+		return nil, fmt.Errorf("invalid %s piece: %s; missing JSON object", kind, piece)
+	}
+	if trimmed == rest {
+		return nil, fmt.Errorf(
+			"invalid %s piece: %s; expected whitespace before the JSON object", kind, piece)
+	}
+
+	var object map[string]any
+	if err := json.Unmarshal([]byte(trimmed), &object); err != nil {
+		return nil, fmt.Errorf("invalid %s piece: %w", kind, err)
+	}
+	if object == nil {
+		return nil, fmt.Errorf("invalid %s piece: %s; expected a JSON object", kind, piece)
+	}
+	return object, nil
+}
+
+// validateToolMarkerObject checks that the JSON object of a tool marker has
+// the required keys and no keys other than the required and optional ones,
+// and that its "name" and "ref", if any, are strings.
+func validateToolMarkerObject(piece, kind string, object map[string]any, required, optional []string) error {
+	for _, key := range required {
+		if _, ok := object[key]; !ok {
+			return fmt.Errorf("invalid %s piece: %s; missing %q", kind, piece, key)
+		}
+	}
+	for key, value := range object {
+		if !slices.Contains(required, key) && !slices.Contains(optional, key) {
+			return fmt.Errorf("invalid %s piece: %s; unexpected key %q, expected %s",
+				kind, piece, key, strings.Join(slices.Concat(required, optional), ", "))
+		}
+		if key == "name" || key == "ref" {
+			if s, ok := value.(string); !ok || s == "" {
+				return fmt.Errorf("invalid %s piece: %s; %q must be a non-empty string", kind, piece, key)
+			}
+		}
+	}
+	return nil
+}
+
 // parseTextPart parses a text part from a piece of rendered template.
 func parseTextPart(piece string) (*TextPart, error) {
 	return &TextPart{
@@ -74,6 +74,13 @@ func TestFrontmatterAndBodyRegex(t *testing.T) {
 			expectedBody:        "",
 			shouldMatch:         true,
 		},
+		{
+			name:                "Document ending at the closing marker",
+			source:              "---\nfoo: bar\n---",
+			expectedFrontmatter: "foo: bar",
+			expectedBody:        "",
+			shouldMatch:         true,
+		},
 		{
 			name:                "Document with multiline frontmatter",
 			source:              "---\nfoo: bar\nbaz: qux\n---\nThis is the body.",
@@ -102,6 +109,13 @@ func TestFrontmatterAndBodyRegex(t *testing.T) {
 			expectedBody:        "This is the body.\n---\nExtra section.",
 			shouldMatch:         true,
 		},
+		{
+			name:                "Document with fenced YAML containing markers in the body",
+			source:              "---\nfoo: bar\n---\nExample:\n```yaml\n---\nkey: value\n---\n```\nDone.",
+			expectedFrontmatter: "foo: bar",
+			expectedBody:        "Example:\n```yaml\n---\nkey: value\n---\n```\nDone.",
+			shouldMatch:         true,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -133,6 +147,7 @@ func TestRoleAndHistoryMarkerRegex(t *testing.T) {
 			"<<<dotprompt:role:bot>>>",
 			"<<<dotprompt:role:human>>>",
 			"<<<dotprompt:role:customer>>>",
+			`<<<dotprompt:role:model {"model":"gpt-4"}>>>`,
 		}
 
 		for _, pattern := range validPatterns {
@@ -143,15 +158,16 @@ func TestRoleAndHistoryMarkerRegex(t *testing.T) {
 
 	t.Run("test invalid patterns", func(t *testing.T) {
 		invalidPatterns := []string{
-			"<<<dotprompt:role:USER>>>",   // uppercase not allowed
-			"<<<dotprompt:role:model1>>>", // numbers not allowed
-			"<<<dotprompt:role:>>>",       // needs at least one letter
-			"<<<dotprompt:role>>>",        // missing role value
-			"<<<dotprompt:history123>>>",  // history should be exact
-			"<<<dotprompt:HISTORY>>>",     // history must be lowercase
-			"dotprompt:role:user",         // missing brackets
-			"<<<dotprompt:role:user",      // incomplete closing
-			"dotprompt:role:user>>>",      // incomplete opening
+			"<<<dotprompt:role:USER>>>",     // uppercase not allowed
+			"<<<dotprompt:role:model1>>>",   // numbers not allowed
+			"<<<dotprompt:role:>>>",         // needs at least one letter
+			"<<<dotprompt:role>>>",          // missing role value
+			"<<<dotprompt:history123>>>",    // history should be exact
+			"<<<dotprompt:HISTORY>>>",       // history must be lowercase
+			"dotprompt:role:user",           // missing brackets
+			"<<<dotprompt:role:user",        // incomplete closing
+			"dotprompt:role:user>>>",        // incomplete opening
+			"<<<dotprompt:role:user foo>>>", // metadata must be a JSON object
 		}
 
 		for _, pattern := range invalidPatterns {
@@ -178,6 +194,7 @@ func TestMediaAndSectionMarkerRegex(t *testing.T) {
 		validPatterns := []string{
 			"<<<dotprompt:media:url>>>",
 			"<<<dotprompt:section>>>",
+			"<<<dotprompt:data>>>",
 		}
 
 		for _, pattern := range validPatterns {
@@ -208,7 +225,8 @@ func TestSplitByRegex(t *testing.T) {
 func TestSplitByMediaAndSectionMarkers(t *testing.T) {
 	t.Run("BasicMarker", func(t *testing.T) {
 		inputStr := "<<<dotprompt:media:url>>> https://example.com/image.jpg"
-		output := splitByMediaAndSectionMarkers(inputStr)
+		output, err := splitByMediaAndSectionMarkers(inputStr)
+		assert.NoError(t, err)
 		expected := []string{
 			"<<<dotprompt:media:url",
 			" https://example.com/image.jpg",
@@ -219,7 +237,8 @@ func TestSplitByMediaAndSectionMarkers(t *testing.T) {
 
 	t.Run("MultipleMarkers", func(t *testing.T) {
 		inputStr := "Start <<<dotprompt:media:url>>> https://example.com/image.jpg End <<<dotprompt:section>>> Code"
-		output := splitByMediaAndSectionMarkers(inputStr)
+		output, err := splitByMediaAndSectionMarkers(inputStr)
+		assert.NoError(t, err)
 		expected := []string{
 			"Start ",
 			"<<<dotprompt:media:url",
@@ -231,9 +250,23 @@ func TestSplitByMediaAndSectionMarkers(t *testing.T) {
 		assert.Equal(t, expected, output, "Split result should match expected output")
 	})
 
+	t.Run("DataMarker", func(t *testing.T) {
+		inputStr := "Use <<<dotprompt:data>>>\n{\"a\": \">>>\"} now"
+		output, err := splitByMediaAndSectionMarkers(inputStr)
+		assert.NoError(t, err)
+		expected := []string{
+			"Use ",
+			"<<<dotprompt:data {\"a\": \">>>\"}",
+			" now",
+		}
+
+		assert.Equal(t, expected, output, "Split result should match expected output")
+	})
+
 	t.Run("NoMarkers", func(t *testing.T) {
 		inputStr := "Hello World"
-		output := splitByMediaAndSectionMarkers(inputStr)
+		output, err := splitByMediaAndSectionMarkers(inputStr)
+		assert.NoError(t, err)
 		expected := []string{"Hello World"}
 
 		assert.Equal(t, expected, output, "Split result should match expected output")
@@ -243,7 +276,8 @@ func TestSplitByMediaAndSectionMarkers(t *testing.T) {
 func TestSplitByRoleAndHistoryMarkers(t *testing.T) {
 	t.Run("NoMarkers", func(t *testing.T) {
 		inputStr := "Hello World"
-		output := splitByRoleAndHistoryMarkers(inputStr)
+		output, err := splitByRoleAndHistoryMarkers(inputStr)
+		assert.NoError(t, err)
 		expected := []string{"Hello World"}
 
 		assert.Equal(t, expected, output, "Split result should match expected output")
@@ -251,7 +285,8 @@ func TestSplitByRoleAndHistoryMarkers(t *testing.T) {
 
 	t.Run("SingleMarker", func(t *testing.T) {
 		inputStr := "Hello <<<dotprompt:role:model>>> world"
-		output := splitByRoleAndHistoryMarkers(inputStr)
+		output, err := splitByRoleAndHistoryMarkers(inputStr)
+		assert.NoError(t, err)
 		expected := []string{
 			"Hello ",
 			"<<<dotprompt:role:model",
@@ -263,7 +298,8 @@ func TestSplitByRoleAndHistoryMarkers(t *testing.T) {
 
 	t.Run("FilterEmpty", func(t *testing.T) {
 		inputStr := "  <<<dotprompt:role:system>>>   "
-		output := splitByRoleAndHistoryMarkers(inputStr)
+		output, err := splitByRoleAndHistoryMarkers(inputStr)
+		assert.NoError(t, err)
 		expected := []string{"<<<dotprompt:role:system"}
 
 		assert.Equal(t, expected, output, "Split result should match expected output")
@@ -271,7 +307,8 @@ func TestSplitByRoleAndHistoryMarkers(t *testing.T) {
 
 	t.Run("AdjacentMarkers", func(t *testing.T) {
 		inputStr := "<<<dotprompt:role:user>>><<<dotprompt:history>>>"
-		output := splitByRoleAndHistoryMarkers(inputStr)
+		output, err := splitByRoleAndHistoryMarkers(inputStr)
+		assert.NoError(t, err)
 		expected := []string{
 			"<<<dotprompt:role:user",
 			"<<<dotprompt:history",
@@ -282,7 +319,8 @@ func TestSplitByRoleAndHistoryMarkers(t *testing.T) {
 
 	t.Run("InvalidFormat", func(t *testing.T) {
 		inputStr := "<<<dotprompt:ROLE:user>>>"
-		output := splitByRoleAndHistoryMarkers(inputStr)
+		output, err := splitByRoleAndHistoryMarkers(inputStr)
+		assert.NoError(t, err)
 		expected := []string{"<<<dotprompt:ROLE:user>>>"}
 
 		assert.Equal(t, expected, output, "Split result should match expected output")
@@ -290,7 +328,8 @@ func TestSplitByRoleAndHistoryMarkers(t *testing.T) {
 
 	t.Run("MultipleMarkers", func(t *testing.T) {
 		inputStr := "Start <<<dotprompt:role:user>>> middle <<<dotprompt:history>>> end"
-		output := splitByRoleAndHistoryMarkers(inputStr)
+		output, err := splitByRoleAndHistoryMarkers(inputStr)
+		assert.NoError(t, err)
 		expected := []string{
 			"Start ",
 			"<<<dotprompt:role:user",
@@ -301,6 +340,29 @@ func TestSplitByRoleAndHistoryMarkers(t *testing.T) {
 
 		assert.Equal(t, expected, output, "Split result should match expected output")
 	})
+
+	t.Run("RoleMetadata", func(t *testing.T) {
+		inputStr := "<<<dotprompt:role:model {\"note\": \"a}>>>b\"}>>> Hi <<<dotprompt:history {}>>>"
+		output, err := splitByRoleAndHistoryMarkers(inputStr)
+		assert.NoError(t, err)
+		expected := []string{
+			`<<<dotprompt:role:model {"note": "a}>>>b"}`,
+			" Hi <<<dotprompt:history {}>>>",
+		}
+
+		assert.Equal(t, expected, output, "Split result should match expected output")
+	})
+
+	t.Run("InvalidRoleMetadata", func(t *testing.T) {
+		for _, inputStr := range []string{
+			"<<<dotprompt:role:model {bad}>>>",
+			`<<<dotprompt:role:model {"a": 1} >>>`,
+			`<<<dotprompt:role:model {"a": 1`,
+		} {
+			_, err := splitByRoleAndHistoryMarkers(inputStr)
+			assert.ErrorContains(t, err, "invalid metadata for role 'model'", inputStr)
+		}
+	})
 }
 
 func TestConvertNamespacedEntryToNestedObject(t *testing.T) {
@@ -367,6 +429,20 @@ func TestExtractFrontmatterAndBody(t *testing.T) {
 		assert.Equal(t, "This is the body.", body)
 	})
 
+	t.Run("should leave markers inside fenced code blocks in the body", func(t *testing.T) {
+		inputStr := "---\nfoo: bar\n---\n```yaml\n---\nbaz: qux\n---\n```"
+		frontmatter, body := extractFrontmatterAndBody(inputStr)
+		assert.Equal(t, "foo: bar", frontmatter)
+		assert.Equal(t, "```yaml\n---\nbaz: qux\n---\n```", body)
+	})
+
+	t.Run("should leave fenced markers in the body with empty frontmatter", func(t *testing.T) {
+		inputStr := "---\n---\n```yaml\n---\nbaz: qux\n```"
+		frontmatter, body := extractFrontmatterAndBody(inputStr)
+		assert.Equal(t, "", frontmatter)
+		assert.Equal(t, "```yaml\n---\nbaz: qux\n```", body)
+	})
+
 	t.Run("should return empty strings when there is no frontmatter marker", func(t *testing.T) {
 		// TODO: May be change this behavior to return a matching body when
 		// there is no frontmatter marker and we have a body. This may need to
@@ -378,6 +454,16 @@ func TestExtractFrontmatterAndBody(t *testing.T) {
 	})
 }
 
+func TestExtractFrontmatterAndBodyExported(t *testing.T) {
+	frontmatter, body := ExtractFrontmatterAndBody("---\nfoo: bar\n---\nThis is the body.")
+	assert.Equal(t, "foo: bar", frontmatter)
+	assert.Equal(t, "This is the body.", body)
+
+	frontmatter, body = ExtractFrontmatterAndBody("Hello World")
+	assert.Equal(t, "", frontmatter)
+	assert.Equal(t, "", body)
+}
+
 func TestTransformMessagesToHistory(t *testing.T) {
 	t.Run("add history metadata to messages", func(t *testing.T) {
 		messages := []Message{
@@ -441,7 +527,7 @@ func TestTransformMessagesToHistory(t *testing.T) {
 func TestMessageSourcesToMessages(t *testing.T) {
 	t.Run("should handle empty array", func(t *testing.T) {
 		messageSources := []*MessageSource{}
-		messages, err := messageSourcesToMessages(messageSources)
+		messages, err := messageSourcesToMessages(messageSources, nil)
 		assert.NoError(t, err)
 		assert.Equal(t, 0, len(messages))
 	})
@@ -454,7 +540,7 @@ func TestMessageSourcesToMessages(t *testing.T) {
 			},
 		}
 
-		messages, err := messageSourcesToMessages(messageSources)
+		messages, err := messageSourcesToMessages(messageSources, nil)
 		assert.NoError(t, err)
 		assert.Equal(t, 1, len(messages))
 		assert.Equal(t, []Message{
@@ -478,7 +564,7 @@ func TestMessageSourcesToMessages(t *testing.T) {
 			},
 		}
 
-		messages, err := messageSourcesToMessages(messageSources)
+		messages, err := messageSourcesToMessages(messageSources, nil)
 		assert.NoError(t, err)
 		assert.Equal(t, 1, len(messages))
 		assert.Equal(t, []Message{
@@ -505,7 +591,7 @@ func TestMessageSourcesToMessages(t *testing.T) {
 			},
 		}
 
-		messages, err := messageSourcesToMessages(messageSources)
+		messages, err := messageSourcesToMessages(messageSources, nil)
 		assert.NoError(t, err)
 		assert.Equal(t, 1, len(messages))
 		assert.Equal(t, []Message{
@@ -540,7 +626,7 @@ func TestMessageSourcesToMessages(t *testing.T) {
 			},
 		}
 
-		messages, err := messageSourcesToMessages(messageSources)
+		messages, err := messageSourcesToMessages(messageSources, nil)
 		assert.NoError(t, err)
 		assert.Equal(t, 2, len(messages))
 
@@ -1088,6 +1174,288 @@ func TestInsertHistory(t *testing.T) {
 	})
 }
 
+func TestHistoryPlacement(t *testing.T) {
+	text := func(role Role, s string) Message {
+		return Message{Role: role, Content: []Part{&TextPart{Text: s}}}
+	}
+	history := []Message{
+		text(RoleUser, "Earlier question"),
+		text(RoleModel, "Earlier answer"),
+	}
+	data := &DataArgument{Messages: history}
+	rendered := "<<<dotprompt:role:system>>>Be helpful." +
+		"<<<dotprompt:role:user>>>Example question" +
+		"<<<dotprompt:role:model>>>Example answer" +
+		"<<<dotprompt:role:user>>>Question"
+	roles := func(messages []Message) []Role {
+		var out []Role
+		for _, msg := range messages {
+			out = append(out, msg.Role)
+		}
+		return out
+	}
+
+	t.Run("before the last user message by default", func(t *testing.T) {
+		result, err := ToMessages(rendered, data)
+		assert.NoError(t, err)
+		assert.Equal(t, []Role{RoleSystem, RoleUser, RoleModel, RoleUser, RoleModel, RoleUser}, roles(result))
+		assert.Equal(t, RoleSystem, result[0].Role)
+		assert.Equal(t, "Earlier question", result[3].Content[0].(*TextPart).Text)
+	})
+
+	t.Run("after the system message", func(t *testing.T) {
+		result, err := ToMessagesWithOptions(rendered, data, &ToMessagesOptions{HistoryPlacement: HistoryPlacementAfterSystem})
+		assert.NoError(t, err)
+		assert.Len(t, result, 6)
+		assert.Equal(t, "Be helpful.", result[0].Content[0].(*TextPart).Text)
+		assert.Equal(t, "Earlier question", result[1].Content[0].(*TextPart).Text)
+		assert.Equal(t, "Earlier answer", result[2].Content[0].(*TextPart).Text)
+		assert.Equal(t, "Example question", result[3].Content[0].(*TextPart).Text)
+		assert.Equal(t, "Question", result[5].Content[0].(*TextPart).Text)
+	})
+
+	t.Run("after a later system message", func(t *testing.T) {
+		source := "<<<dotprompt:role:system>>>A<<<dotprompt:role:user>>>B<<<dotprompt:role:system>>>C<<<dotprompt:role:user>>>D"
+		result, err := ToMessagesWithOptions(source, data, &ToMessagesOptions{HistoryPlacement: HistoryPlacementAfterSystem})
+		assert.NoError(t, err)
+		assert.Equal(t, []Role{RoleSystem, RoleUser, RoleSystem, RoleUser, RoleModel, RoleUser}, roles(result))
+		assert.Equal(t, "Earlier question", result[3].Content[0].(*TextPart).Text)
+	})
+
+	t.Run("first without a system message", func(t *testing.T) {
+		result, err := ToMessagesWithOptions("Question", data, &ToMessagesOptions{HistoryPlacement: HistoryPlacementAfterSystem})
+		assert.NoError(t, err)
+		assert.Equal(t, []Role{RoleUser, RoleModel, RoleUser}, roles(result))
+		assert.Equal(t, "Question", result[2].Content[0].(*TextPart).Text)
+	})
+
+	t.Run("history helper takes precedence", func(t *testing.T) {
+		source := "<<<dotprompt:role:system>>>A<<<dotprompt:role:user>>>B<<<dotprompt:history>>><<<dotprompt:role:user>>>C"
+		result, err := ToMessagesWithOptions(source, data, &ToMessagesOptions{HistoryPlacement: HistoryPlacementAfterSystem})
+		assert.NoError(t, err)
+		assert.Equal(t, []Role{RoleSystem, RoleUser, RoleUser, RoleModel, RoleUser}, roles(result))
+	})
+}
+
+func TestDeduplicateHistory(t *testing.T) {
+	text := func(role Role, s string) Message {
+		return Message{Role: role, Content: []Part{&TextPart{Text: s}}}
+	}
+	texts := func(messages []Message) []string {
+		var out []string
+		for _, msg := range messages {
+			out = append(out, string(msg.Role)+":"+msg.Content[0].(*TextPart).Text)
+		}
+		return out
+	}
+	options := &ToMessagesOptions{DeduplicateHistory: true}
+
+	t.Run("adjacent duplicates", func(t *testing.T) {
+		data := &DataArgument{Messages: []Message{
+			text(RoleUser, "Hi"),
+			text(RoleUser, "Hi"),
+			text(RoleModel, "Hello"),
+		}}
+		result, err := ToMessagesWithOptions("Question", data, options)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"user:Hi", "model:Hello", "user:Question"}, texts(result))
+	})
+
+	t.Run("non-adjacent duplicates", func(t *testing.T) {
+		data := &DataArgument{Messages: []Message{
+			text(RoleUser, "Hi"),
+			text(RoleModel, "Hello"),
+			text(RoleUser, "Hi"),
+			text(RoleModel, "Hello again"),
+		}}
+		result, err := ToMessagesWithOptions("<<<dotprompt:history>>><<<dotprompt:role:user>>>Question", data, options)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"user:Hi", "model:Hello", "model:Hello again", "user:Question"}, texts(result))
+	})
+
+	t.Run("same text with a different role is kept", func(t *testing.T) {
+		data := &DataArgument{Messages: []Message{
+			text(RoleUser, "OK"),
+			text(RoleModel, "OK"),
+		}}
+		result, err := ToMessagesWithOptions("Question", data, options)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"user:OK", "model:OK", "user:Question"}, texts(result))
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		data := &DataArgument{Messages: []Message{
+			text(RoleUser, "Hi"),
+			text(RoleUser, "Hi"),
+		}}
+		result, err := ToMessages("Question", data)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"user:Hi", "user:Hi", "user:Question"}, texts(result))
+	})
+}
+
+func TestSplitMediaToMessages(t *testing.T) {
+	image := &MediaPart{Media: Media{URL: "https://example.com/cat.png", ContentType: "image/png"}}
+	options := &ToMessagesOptions{SplitMediaToMessages: true}
+
+	t.Run("text and image", func(t *testing.T) {
+		rendered := `<<<dotprompt:role:user {"turn":1}>>>Describe this image.<<<dotprompt:media:url https://example.com/cat.png image/png>>>`
+		result, err := ToMessagesWithOptions(rendered, nil, options)
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{
+			{Role: RoleUser, Content: []Part{&TextPart{Text: "Describe this image."}}, HasMetadata: HasMetadata{Metadata: Metadata{"turn": float64(1)}}},
+			{Role: RoleUser, Content: []Part{image}, HasMetadata: HasMetadata{Metadata: Metadata{"turn": float64(1)}}},
+		}, result)
+	})
+
+	t.Run("preserves order and roles", func(t *testing.T) {
+		rendered := "<<<dotprompt:role:system>>>Be brief." +
+			"<<<dotprompt:role:user>>>Before <<<dotprompt:media:url https://example.com/cat.png image/png>>>" +
+			"<<<dotprompt:media:url https://example.com/dog.png>>> after"
+		result, err := ToMessagesWithOptions(rendered, nil, options)
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{
+			{Role: RoleSystem, Content: []Part{&TextPart{Text: "Be brief."}}},
+			{Role: RoleUser, Content: []Part{&TextPart{Text: "Before "}}},
+			{Role: RoleUser, Content: []Part{image}},
+			{Role: RoleUser, Content: []Part{&MediaPart{Media: Media{URL: "https://example.com/dog.png"}}}},
+			{Role: RoleUser, Content: []Part{&TextPart{Text: " after"}}},
+		}, result)
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		result, err := ToMessages("Describe this image.<<<dotprompt:media:url https://example.com/cat.png image/png>>>", nil)
+		assert.NoError(t, err)
+		assert.Len(t, result, 1)
+		assert.Len(t, result[0].Content, 2)
+	})
+}
+
+func TestMessagesDifference(t *testing.T) {
+	text := func(role Role, s string) Message {
+		return Message{Role: role, Content: []Part{&TextPart{Text: s}}}
+	}
+	hi, hello, why, because := text(RoleUser, "Hi"), text(RoleModel, "Hello"), text(RoleUser, "Why?"), text(RoleModel, "Because.")
+
+	t.Run("disjoint", func(t *testing.T) {
+		assert.Equal(t, []Message{hi, hello}, MessagesDifference([]Message{hi, hello}, []Message{why, because}))
+	})
+
+	t.Run("overlapping", func(t *testing.T) {
+		assert.Equal(t, []Message{hi, hello}, MessagesDifference([]Message{hi, hello, why, because}, []Message{why, because}))
+	})
+
+	t.Run("identical", func(t *testing.T) {
+		assert.Empty(t, MessagesDifference([]Message{hi, hello}, []Message{hi, hello}))
+	})
+
+	t.Run("role and parts are compared", func(t *testing.T) {
+		modelHi := text(RoleModel, "Hi")
+		media := Message{Role: RoleUser, Content: []Part{&MediaPart{Media: Media{URL: "https://example.com/cat.png"}}}}
+		assert.Equal(t, []Message{hi, media}, MessagesDifference([]Message{hi, media}, []Message{modelHi}))
+	})
+
+	t.Run("metadata is ignored", func(t *testing.T) {
+		history := hi
+		history.Metadata = Metadata{"purpose": "history"}
+		assert.Empty(t, MessagesDifference([]Message{hi}, []Message{history}))
+	})
+
+	t.Run("duplicates are matched once", func(t *testing.T) {
+		assert.Equal(t, []Message{hi}, MessagesDifference([]Message{hi, hello, hi}, []Message{hi, hello}))
+	})
+
+	t.Run("history dropped by a render", func(t *testing.T) {
+		history := []Message{hi, hello, why, because}
+		messages, err := ToMessages("<<<dotprompt:history>>><<<dotprompt:role:user>>>And then?", &DataArgument{Messages: history[2:]})
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{hi, hello}, MessagesDifference(history, messages))
+	})
+}
+
+// TestToMessagesPartOrder tests that the parts of a message are in the order
+// of their pieces in the rendered template.
+func TestToMessagesPartOrder(t *testing.T) {
+	text := func(s string) Part { return &TextPart{Text: s} }
+	media := func(url string) Part { return &MediaPart{Media: Media{URL: url}} }
+	section := func(name string) Part {
+		part := NewPendingPart()
+		part.SetMetadata("purpose", name)
+		return part
+	}
+
+	testCases := []struct {
+		name     string
+		source   string
+		expected []Message
+	}{
+		{
+			name:   "text media text section text",
+			source: "one <<<dotprompt:media:url https://example.com/a.png>>> two <<<dotprompt:section notes>>> three",
+			expected: []Message{{Role: RoleUser, Content: []Part{
+				text("one "), media("https://example.com/a.png"), text(" two "), section("notes"), text(" three"),
+			}}},
+		},
+		{
+			name: "adjacent markers",
+			source: "<<<dotprompt:section first>>><<<dotprompt:media:url https://example.com/a.png>>>" +
+				"<<<dotprompt:media:url https://example.com/b.png>>><<<dotprompt:section second>>>",
+			expected: []Message{{Role: RoleUser, Content: []Part{
+				section("first"), media("https://example.com/a.png"), media("https://example.com/b.png"), section("second"),
+			}}},
+		},
+		{
+			name:   "data between media",
+			source: "<<<dotprompt:media:url https://example.com/a.png>>>one<<<dotprompt:data>>>{\"n\":1}two<<<dotprompt:media:url https://example.com/b.png>>>",
+			expected: []Message{{Role: RoleUser, Content: []Part{
+				media("https://example.com/a.png"), text("one"), &DataPart{Data: map[string]any{"n": 1.0}}, text("two"), media("https://example.com/b.png"),
+			}}},
+		},
+		{
+			name: "each role segment keeps its own order",
+			source: "<<<dotprompt:role:user>>>one<<<dotprompt:media:url https://example.com/a.png>>>two" +
+				"<<<dotprompt:role:model>>><<<dotprompt:section notes>>>three" +
+				"<<<dotprompt:role:user>>>four<<<dotprompt:media:url https://example.com/b.png>>>",
+			expected: []Message{
+				{Role: RoleUser, Content: []Part{text("one"), media("https://example.com/a.png"), text("two")}},
+				{Role: RoleModel, Content: []Part{section("notes"), text("three")}},
+				{Role: RoleUser, Content: []Part{text("four"), media("https://example.com/b.png")}},
+			},
+		},
+		{
+			name:   "blank text between markers is dropped in place",
+			source: "one\n<<<dotprompt:media:url https://example.com/a.png>>>\n \n<<<dotprompt:section notes>>>\ntwo",
+			expected: []Message{{Role: RoleUser, Content: []Part{
+				text("one\n"), media("https://example.com/a.png"), section("notes"), text("\ntwo"),
+			}}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := ToMessages(tc.source, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, result)
+		})
+	}
+
+	t.Run("resolved sections and split media stay in place", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{
+			SectionResolver: func(purpose string, data *DataArgument) ([]Part, error) {
+				return []Part{text("[" + purpose + " 1]"), text("[" + purpose + " 2]")}, nil
+			},
+			SplitMediaToMessages: true,
+		})
+		rendered, err := dp.Render(`one {{media url="https://example.com/a.png"}} two {{section "notes"}} three`, &DataArgument{}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{
+			{Role: RoleUser, Content: []Part{text("one ")}},
+			{Role: RoleUser, Content: []Part{media("https://example.com/a.png")}},
+			{Role: RoleUser, Content: []Part{text(" two "), text("[notes 1]"), text("[notes 2]"), text(" three")}},
+		}, rendered.Messages)
+	})
+}
+
 func TestParsePart(t *testing.T) {
 	testCases := []struct {
 		name     string
@@ -1145,7 +1513,7 @@ func TestParsePart(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			result, err := parsePart(tc.piece)
+			result, err := parsePart(tc.piece, nil)
 
 			if tc.hasError {
 				assert.Error(t, err)
@@ -1173,13 +1541,239 @@ func TestParsePart(t *testing.T) {
 	}
 }
 
+func TestDataMarker(t *testing.T) {
+	t.Run("inline JSON", func(t *testing.T) {
+		rendered := "Call the tool with <<<dotprompt:data>>> {\"city\": \"Paris\",\n  \"units\": [\"C\"]} please."
+		messages, err := ToMessages(rendered, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{{
+			Role: RoleUser,
+			Content: []Part{
+				&TextPart{Text: "Call the tool with "},
+				&DataPart{Data: map[string]any{"city": "Paris", "units": []any{"C"}}},
+				&TextPart{Text: " please."},
+			},
+		}}, messages)
+	})
+
+	t.Run("payload containing the closing delimiter", func(t *testing.T) {
+		rendered := `<<<dotprompt:data>>>{"arrow": ">>>", "marker": "<<<dotprompt:section x>>>"} after`
+		messages, err := ToMessages(rendered, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []Part{
+			&DataPart{Data: map[string]any{"arrow": ">>>", "marker": "<<<dotprompt:section x>>>"}},
+			&TextPart{Text: " after"},
+		}, messages[0].Content)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			rendered string
+			wantErr  string
+		}{
+			{"missing JSON", "<<<dotprompt:data>>>", "missing JSON object"},
+			{"invalid JSON", "<<<dotprompt:data>>> {city: Paris}", "expected a JSON value after it"},
+			{"not an object", "<<<dotprompt:data>>> [1, 2]", "invalid data piece"},
+			{"null", "<<<dotprompt:data>>> null", "expected a JSON object"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				_, err := ToMessages(tt.rendered, nil)
+				assert.ErrorContains(t, err, tt.wantErr)
+			})
+		}
+	})
+}
+
 func TestParseMediaPiece(t *testing.T) {
 	t.Run("parse media piece", func(t *testing.T) {
 		piece := "<<<dotprompt:media:url>>> https://example.com/image.jpg"
-		result, err := parseMediaPart(piece)
+		result, err := parseMediaPart(piece, nil)
 		assert.NoError(t, err)
 		assert.Equal(t, "https://example.com/image.jpg", result.Media.URL)
 	})
+
+	t.Run("error on media piece without URL by default", func(t *testing.T) {
+		for _, piece := range []string{"<<<dotprompt:media:url", "<<<dotprompt:media:url "} {
+			_, err := parseMediaPart(piece, nil)
+			assert.ErrorContains(t, err, "missing URL")
+		}
+	})
+
+	t.Run("drop media piece without URL when enabled", func(t *testing.T) {
+		for _, piece := range []string{"<<<dotprompt:media:url", "<<<dotprompt:media:url "} {
+			result, err := parseMediaPart(piece, &ToMessagesOptions{DropEmptyMedia: true})
+			assert.NoError(t, err)
+			assert.Nil(t, result)
+		}
+	})
+}
+
+func TestToMessagesMissingMediaURL(t *testing.T) {
+	source := "Look at <<<dotprompt:media:url>>> this <<<dotprompt:media:url  image/png>>>"
+
+	t.Run("errors by default", func(t *testing.T) {
+		_, err := ToMessages(source, nil)
+		assert.ErrorContains(t, err, "missing URL")
+	})
+
+	t.Run("errors by default when rendering", func(t *testing.T) {
+		_, err := NewDotprompt(nil).Render(`{{media url=imageUrl}}`, &DataArgument{}, nil)
+		assert.ErrorContains(t, err, "missing URL")
+	})
+
+	t.Run("drops the media part when enabled", func(t *testing.T) {
+		messages, err := ToMessagesWithOptions(source, nil, &ToMessagesOptions{DropEmptyMedia: true})
+		assert.NoError(t, err)
+		assert.Len(t, messages, 1)
+		assert.Equal(t, []Part{&TextPart{Text: "Look at "}, &TextPart{Text: " this "}}, messages[0].Content)
+	})
+
+	t.Run("drops the media part when rendering", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{DropEmptyMedia: true})
+		rendered, err := dp.Render(`Hi {{media url=imageUrl}}`, &DataArgument{}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []Part{&TextPart{Text: "Hi "}}, rendered.Messages[0].Content)
+	})
+}
+
+func TestInferMediaContentType(t *testing.T) {
+	options := &ToMessagesOptions{InferMediaContentType: true}
+
+	t.Run("infers the content type from the extension", func(t *testing.T) {
+		tests := map[string]string{
+			"https://example.com/y.png":             "image/png",
+			"https://example.com/clip.MP4":          "video/mp4",
+			"https://example.com/a/b.jpeg?size=big": "image/jpeg",
+			"https://example.com/doc.pdf#page=2":    "application/pdf",
+			"https://example.com/file.unknown":      "",
+			"https://example.com/noextension":       "",
+		}
+		for url, want := range tests {
+			result, err := parseMediaPart("<<<dotprompt:media:url "+url, options)
+			assert.NoError(t, err)
+			assert.Equal(t, want, result.Media.ContentType, url)
+		}
+	})
+
+	t.Run("keeps an explicit content type", func(t *testing.T) {
+		result, err := parseMediaPart("<<<dotprompt:media:url https://example.com/y.png image/webp", options)
+		assert.NoError(t, err)
+		assert.Equal(t, "image/webp", result.Media.ContentType)
+	})
+
+	t.Run("leaves the content type empty by default", func(t *testing.T) {
+		result, err := parseMediaPart("<<<dotprompt:media:url https://example.com/y.png", nil)
+		assert.NoError(t, err)
+		assert.Empty(t, result.Media.ContentType)
+	})
+
+	t.Run("infers when rendering", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{InferMediaContentType: true})
+		rendered, err := dp.Render(`{{media url=imageUrl}}`, &DataArgument{
+			Input: map[string]any{"imageUrl": "https://example.com/y.png"},
+		}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []Part{&MediaPart{Media: Media{URL: "https://example.com/y.png", ContentType: "image/png"}}},
+			rendered.Messages[0].Content)
+	})
+}
+
+func TestDataURIMedia(t *testing.T) {
+	tests := []struct {
+		name        string
+		source      string
+		want        *MediaPart
+		errContains string
+	}{
+		{
+			name:   "declared content type",
+			source: "<<<dotprompt:media:url data:image/png;base64,iVBORw0KGgo=>>>",
+			want:   &MediaPart{Media: Media{URL: "data:image/png;base64,iVBORw0KGgo=", ContentType: "image/png"}},
+		},
+		{
+			name:   "explicit content type wins",
+			source: "<<<dotprompt:media:url data:image/png;base64,iVBORw0KGgo= image/x-png>>>",
+			want:   &MediaPart{Media: Media{URL: "data:image/png;base64,iVBORw0KGgo=", ContentType: "image/x-png"}},
+		},
+		{
+			name:   "parameters and plain payload",
+			source: "<<<dotprompt:media:url data:text/plain;charset=utf-8,hello>>>",
+			want:   &MediaPart{Media: Media{URL: "data:text/plain;charset=utf-8,hello", ContentType: "text/plain"}},
+		},
+		{
+			name:   "no media type",
+			source: "<<<dotprompt:media:url data:;base64,aGk=>>>",
+			want:   &MediaPart{Media: Media{URL: "data:;base64,aGk="}},
+		},
+		{
+			name:   "unpadded base64",
+			source: "<<<dotprompt:media:url data:image/png;base64,iVBORw0KGgo>>>",
+			want:   &MediaPart{Media: Media{URL: "data:image/png;base64,iVBORw0KGgo", ContentType: "image/png"}},
+		},
+		{
+			name:   "URL-safe base64",
+			source: "<<<dotprompt:media:url data:application/octet-stream;base64,-_8=>>>",
+			want:   &MediaPart{Media: Media{URL: "data:application/octet-stream;base64,-_8=", ContentType: "application/octet-stream"}},
+		},
+		{
+			name:   "unpadded URL-safe base64",
+			source: "<<<dotprompt:media:url data:application/octet-stream;base64,-_8>>>",
+			want:   &MediaPart{Media: Media{URL: "data:application/octet-stream;base64,-_8", ContentType: "application/octet-stream"}},
+		},
+		{
+			name:        "invalid base64",
+			source:      "<<<dotprompt:media:url data:image/png;base64,not*base64>>>",
+			errContains: "invalid base64 data",
+		},
+		{
+			name:        "missing comma",
+			source:      "<<<dotprompt:media:url data:image/png;base64>>>",
+			errContains: "missing ','",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages, err := ToMessages(tt.source, nil)
+			if tt.errContains != "" {
+				assert.ErrorContains(t, err, tt.errContains)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, []Part{tt.want}, messages[0].Content)
+		})
+	}
+}
+
+func TestParseMetadataOnlyDocument(t *testing.T) {
+	for name, source := range map[string]string{
+		"trailing newline":    "---\nmodel: test/model\nconfig:\n  temperature: 0.2\n---\n",
+		"no trailing newline": "---\nmodel: test/model\nconfig:\n  temperature: 0.2\n---",
+		"blank body":          "---\nmodel: test/model\nconfig:\n  temperature: 0.2\n---\n\n  \n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			parsed, err := ParseDocument(source)
+			assert.NoError(t, err)
+			assert.Empty(t, parsed.Template)
+			assert.Equal(t, "test/model", parsed.Model)
+
+			rendered, err := NewDotprompt(nil).Render(source, &DataArgument{}, nil)
+			assert.NoError(t, err)
+			assert.Empty(t, rendered.Messages)
+			assert.Equal(t, "test/model", rendered.Model)
+			assert.Equal(t, 0.2, rendered.Config["temperature"])
+		})
+	}
+
+	t.Run("other frontmatter formats", func(t *testing.T) {
+		for _, source := range []string{"---json\n{\"model\": \"test/model\"}\n---", "+++\nmodel = \"test/model\"\n+++"} {
+			parsed, err := ParseDocument(source)
+			assert.NoError(t, err)
+			assert.Empty(t, parsed.Template)
+			assert.Equal(t, "test/model", parsed.Model)
+		}
+	})
 }
 
 func TestParseDocument(t *testing.T) {
@@ -1225,6 +1819,15 @@ Template content`
 		assert.NotNil(t, result.Ext)
 		// When YAML is invalid, return source as template
 		assert.Equal(t, source, result.Template)
+
+		var warnings []string
+		result, err = ParseDocumentWithOptions(source, &ParseOptions{
+			WarningHandler: func(message string) { warnings = append(warnings, message) },
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, source, result.Template)
+		assert.Len(t, warnings, 1)
+		assert.Contains(t, warnings[0], "dotprompt: ignoring invalid YAML frontmatter: ")
 	})
 
 	t.Run("handle empty frontmatter", func(t *testing.T) {
@@ -1238,6 +1841,19 @@ Template content`
 		assert.Equal(t, "Template content", result.Template)
 	})
 
+	t.Run("handle fenced YAML with markers in the body", func(t *testing.T) {
+		source := "---\nname: example\nconfig:\n  temperature: 0.5\n---\n" +
+			"Here is an example config:\n```yaml\n---\nname: other\nconfig:\n  temperature: 1\n---\n```\nExplain it."
+
+		result, err := ParseDocument(source)
+		assert.NoError(t, err)
+		assert.Equal(t, "example", result.Name)
+		assert.Equal(t, 0.5, result.Config["temperature"])
+		assert.Equal(t,
+			"Here is an example config:\n```yaml\n---\nname: other\nconfig:\n  temperature: 1\n---\n```\nExplain it.",
+			result.Template)
+	})
+
 	t.Run("handle multiple namespaced entries", func(t *testing.T) {
 		source := `---
 foo.bar: value1
@@ -1293,3 +1909,717 @@ Template content`
 		}
 	})
 }
+
+func TestParseDocumentWithOptions(t *testing.T) {
+	tabIndented := "---\nconfig:\n\ttemperature: 0.5\n---\nTemplate content"
+
+	t.Run("strict mode reports tab-indented frontmatter", func(t *testing.T) {
+		_, err := ParseDocumentWithOptions(tabIndented, &ParseOptions{Strict: true})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "YAML frontmatter uses tabs for indentation")
+	})
+
+	t.Run("strict mode reports other invalid frontmatter", func(t *testing.T) {
+		_, err := ParseDocumentWithOptions("---\ninvalid: : yaml\n---\nTemplate content", &ParseOptions{Strict: true})
+		assert.Error(t, err)
+		assert.NotContains(t, err.Error(), "tabs")
+	})
+
+	t.Run("lenient mode falls back to the whole source", func(t *testing.T) {
+		result, err := ParseDocumentWithOptions(tabIndented, nil)
+		assert.NoError(t, err)
+		assert.Empty(t, result.Config)
+		assert.True(t, strings.HasPrefix(result.Template, "---\nconfig:"))
+	})
+
+	t.Run("tabs inside values are allowed", func(t *testing.T) {
+		result, err := ParseDocumentWithOptions("---\nname: \"a\\tb\"\n---\nTemplate content", &ParseOptions{Strict: true})
+		assert.NoError(t, err)
+		assert.Equal(t, "a\tb", result.Name)
+	})
+}
+
+func TestToMessagesAllowedMediaHosts(t *testing.T) {
+	options := &ToMessagesOptions{AllowedMediaHosts: []string{"cdn.example.com", "*.assets.example.com"}}
+	render := func(url string) ([]Message, error) {
+		return ToMessagesWithOptions("Look <<<dotprompt:media:url "+url+">>>", nil, options)
+	}
+
+	t.Run("allows an exact host", func(t *testing.T) {
+		messages, err := render("https://cdn.example.com/cat.png")
+		assert.NoError(t, err)
+		mediaPart, ok := messages[0].Content[1].(*MediaPart)
+		assert.True(t, ok)
+		assert.Equal(t, "https://cdn.example.com/cat.png", mediaPart.Media.URL)
+	})
+
+	t.Run("rejects a disallowed host", func(t *testing.T) {
+		_, err := render("https://evil.example.org/cat.png")
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "not allowed")
+	})
+
+	t.Run("matches subdomains only for wildcard entries", func(t *testing.T) {
+		_, err := render("https://img.assets.example.com/cat.png")
+		assert.NoError(t, err)
+
+		_, err = render("https://assets.example.com/cat.png")
+		assert.Error(t, err)
+
+		_, err = render("https://img.cdn.example.com/cat.png")
+		assert.Error(t, err)
+	})
+
+	t.Run("allows data URIs", func(t *testing.T) {
+		messages, err := render("data:image/png;base64,iVBORw0KGgo=")
+		assert.NoError(t, err)
+		mediaPart, ok := messages[0].Content[1].(*MediaPart)
+		assert.True(t, ok)
+		assert.Equal(t, "image/png", mediaPart.Media.ContentType)
+	})
+
+	t.Run("rejects relative URLs", func(t *testing.T) {
+		_, err := render("images/cat.png")
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "not allowed")
+	})
+
+	t.Run("allows all hosts when empty", func(t *testing.T) {
+		_, err := ToMessagesWithOptions("<<<dotprompt:media:url https://anything.test/a.png>>>", nil, nil)
+		assert.NoError(t, err)
+	})
+}
+
+func TestToMessagesHistoryAnnotator(t *testing.T) {
+	history := []Message{
+		{
+			Role:        RoleUser,
+			Content:     []Part{&TextPart{Text: "Hi"}},
+			HasMetadata: HasMetadata{Metadata: Metadata{"timestamp": "2025-01-01T00:00:00Z"}},
+		},
+		{
+			Role:    RoleModel,
+			Content: []Part{&TextPart{Text: "Hello!"}},
+		},
+	}
+	annotator := func(index int, message Message) Metadata {
+		return Metadata{"turn": index, "source": "chat"}
+	}
+	options := &ToMessagesOptions{HistoryAnnotator: annotator}
+
+	t.Run("annotates history inserted at a history marker", func(t *testing.T) {
+		result, err := ToMessagesWithOptions("Before<<<dotprompt:history>>>", &DataArgument{Messages: history}, options)
+		assert.NoError(t, err)
+		assert.Len(t, result, 3)
+
+		assert.Equal(t, Metadata{
+			"timestamp": "2025-01-01T00:00:00Z",
+			"turn":      0,
+			"source":    "chat",
+			"purpose":   "history",
+		}, result[1].Metadata)
+		assert.Equal(t, Metadata{"turn": 1, "source": "chat", "purpose": "history"}, result[2].Metadata)
+	})
+
+	t.Run("annotates history inserted without a marker", func(t *testing.T) {
+		result, err := ToMessagesWithOptions("Follow-up", &DataArgument{Messages: history}, options)
+		assert.NoError(t, err)
+		assert.Len(t, result, 3)
+		assert.Equal(t, "2025-01-01T00:00:00Z", result[0].Metadata["timestamp"])
+		assert.Equal(t, 0, result[0].Metadata["turn"])
+		assert.Equal(t, 1, result[1].Metadata["turn"])
+		assert.Nil(t, result[2].Metadata)
+	})
+
+	t.Run("preserves custom metadata without an annotator", func(t *testing.T) {
+		result, err := ToMessages("<<<dotprompt:history>>>", &DataArgument{Messages: history})
+		assert.NoError(t, err)
+		assert.Equal(t, Metadata{"timestamp": "2025-01-01T00:00:00Z", "purpose": "history"}, result[0].Metadata)
+	})
+
+	// The caller's messages are not modified.
+	assert.Equal(t, Metadata{"timestamp": "2025-01-01T00:00:00Z"}, history[0].Metadata)
+	assert.Nil(t, history[1].Metadata)
+}
+
+func TestToMessagesRoleMetadata(t *testing.T) {
+	t.Run("attaches metadata to new messages", func(t *testing.T) {
+		messages, err := ToMessages(
+			"<<<dotprompt:role:system>>>Be brief."+
+				`<<<dotprompt:role:model {"model":"gpt-4","temperature":0.5}>>>Hi`, nil)
+		assert.NoError(t, err)
+		assert.Len(t, messages, 2)
+		assert.Nil(t, messages[0].Metadata)
+		assert.Equal(t, RoleModel, messages[1].Role)
+		assert.Equal(t, Metadata{"model": "gpt-4", "temperature": 0.5}, messages[1].Metadata)
+	})
+
+	t.Run("attaches metadata when updating the current role", func(t *testing.T) {
+		messages, err := ToMessages(`<<<dotprompt:role:model {"model":"gpt-4"}>>>Hi`, nil)
+		assert.NoError(t, err)
+		assert.Len(t, messages, 1)
+		assert.Equal(t, RoleModel, messages[0].Role)
+		assert.Equal(t, Metadata{"model": "gpt-4"}, messages[0].Metadata)
+	})
+}
+
+func TestToMessagesRoleAliases(t *testing.T) {
+	source := "<<<dotprompt:role:human>>>Hi<<<dotprompt:role:assistant>>>Hello<<<dotprompt:role:ai>>>Hey<<<dotprompt:role:system>>>Be kind"
+
+	t.Run("default aliases", func(t *testing.T) {
+		messages, err := ToMessages(source, nil)
+		assert.NoError(t, err)
+		roles := []Role{}
+		for _, msg := range messages {
+			roles = append(roles, msg.Role)
+		}
+		assert.Equal(t, []Role{RoleUser, RoleModel, RoleModel, RoleSystem}, roles)
+	})
+
+	t.Run("custom aliases", func(t *testing.T) {
+		messages, err := ToMessagesWithOptions(source, nil, &ToMessagesOptions{
+			RoleAliases: map[string]Role{"human": "customer"},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, Role("customer"), messages[0].Role)
+		assert.Equal(t, Role("assistant"), messages[1].Role)
+	})
+
+	t.Run("disabled aliases", func(t *testing.T) {
+		messages, err := ToMessagesWithOptions(source, nil, &ToMessagesOptions{RoleAliases: map[string]Role{}})
+		assert.NoError(t, err)
+		assert.Equal(t, Role("human"), messages[0].Role)
+		assert.Equal(t, Role("ai"), messages[2].Role)
+	})
+
+	t.Run("history messages", func(t *testing.T) {
+		history := []Message{
+			{Role: "human", Content: []Part{&TextPart{Text: "Hi"}}},
+			{Role: "assistant", Content: []Part{&TextPart{Text: "Hello"}}},
+		}
+		messages, err := ToMessages("<<<dotprompt:history>>>", &DataArgument{Messages: history})
+		assert.NoError(t, err)
+		assert.Equal(t, RoleUser, messages[0].Role)
+		assert.Equal(t, RoleModel, messages[1].Role)
+		// The caller's history is not modified.
+		assert.Equal(t, Role("human"), history[0].Role)
+	})
+}
+
+func TestParseDocuments(t *testing.T) {
+	t.Run("parses each document in order", func(t *testing.T) {
+		source := "---\nname: greeter\n---\nHello {{name}}!\n===\n---\nname: greeter\nvariant: formal\n---\nGood day, {{name}}.\n===\nNo frontmatter.\n"
+		prompts, err := ParseDocuments(source)
+		assert.NoError(t, err)
+		assert.Len(t, prompts, 3)
+		assert.Equal(t, "greeter", prompts[0].Name)
+		assert.Equal(t, "Hello {{name}}!", prompts[0].Template)
+		assert.Equal(t, "formal", prompts[1].Variant)
+		assert.Equal(t, "Good day, {{name}}.", prompts[1].Template)
+		assert.Equal(t, "No frontmatter.\n", prompts[2].Template)
+	})
+
+	t.Run("matches ParseDocument without delimiters", func(t *testing.T) {
+		source := "---\nname: greeter\n---\nHello\n---\nWorld"
+		prompts, err := ParseDocuments(source)
+		assert.NoError(t, err)
+		parsed, err := ParseDocument(source)
+		assert.NoError(t, err)
+		assert.Equal(t, []ParsedPrompt{parsed}, prompts)
+	})
+
+	t.Run("ignores delimiters in fenced code blocks", func(t *testing.T) {
+		prompts, err := ParseDocuments("Example:\n```\n===\n```\n=== \nSecond")
+		assert.NoError(t, err)
+		assert.Len(t, prompts, 2)
+		assert.Equal(t, "Example:\n```\n===\n```", prompts[0].Template)
+		assert.Equal(t, "Second", prompts[1].Template)
+	})
+
+	t.Run("reports the failing document", func(t *testing.T) {
+		_, err := ParseDocumentsWithOptions("Hello\n===\n---\n: bad\n---\nWorld", &ParseOptions{Strict: true})
+		assert.ErrorContains(t, err, "document 2")
+	})
+}
+
+func TestParseFrontmatterOnly(t *testing.T) {
+	t.Run("returns metadata fields", func(t *testing.T) {
+		source := `---
+name: greeter
+description: Greets the user
+variant: formal
+version: "2"
+model: test-model
+input:
+  schema:
+    name: string
+foo.bar: baz
+---
+Hello {{name}}! {{#if unclosed}}`
+
+		metadata, err := ParseFrontmatterOnly(source)
+		assert.NoError(t, err)
+		assert.Equal(t, "greeter", metadata.Name)
+		assert.Equal(t, "Greets the user", metadata.Description)
+		assert.Equal(t, "formal", metadata.Variant)
+		assert.Equal(t, "2", metadata.Version)
+		assert.Equal(t, "test-model", metadata.Model)
+		assert.Equal(t, map[string]any{"name": "string"}, metadata.Input.Schema)
+		assert.Equal(t, "baz", metadata.Ext["foo"]["bar"])
+
+		parsed, err := ParseDocument(source)
+		assert.NoError(t, err)
+		assert.Equal(t, parsed.PromptMetadata, metadata)
+	})
+
+	t.Run("ignores the body", func(t *testing.T) {
+		metadata, err := ParseFrontmatterOnly("---\nname: a\n---\n---\nname: b\n---\n")
+		assert.NoError(t, err)
+		assert.Equal(t, "a", metadata.Name)
+	})
+
+	t.Run("document without frontmatter", func(t *testing.T) {
+		metadata, err := ParseFrontmatterOnly("Just a template")
+		assert.NoError(t, err)
+		assert.Equal(t, "", metadata.Name)
+		assert.NotNil(t, metadata.Ext)
+	})
+
+	t.Run("invalid frontmatter", func(t *testing.T) {
+		_, err := ParseFrontmatterOnly("---\nname: [\n---\nHello")
+		assert.ErrorContains(t, err, "dotprompt: invalid frontmatter")
+	})
+}
+
+func TestToMessagesStrictRoles(t *testing.T) {
+	renderedString := "<<<dotprompt:role:system>>>Be helpful.<<<dotprompt:role:usr>>>Question"
+
+	t.Run("accepts any role by default", func(t *testing.T) {
+		result, err := ToMessages(renderedString, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, Role("usr"), result[1].Role)
+	})
+
+	t.Run("reports unknown roles with their offset", func(t *testing.T) {
+		_, err := ToMessagesWithOptions(renderedString, nil, &ToMessagesOptions{StrictRoles: true})
+		assert.EqualError(t, err, "dotprompt: unknown role 'usr' at byte offset 38")
+	})
+
+	t.Run("accepts default roles and aliases", func(t *testing.T) {
+		result, err := ToMessagesWithOptions(
+			"<<<dotprompt:role:system>>>Hi<<<dotprompt:role:assistant>>>Hello<<<dotprompt:history>>>",
+			nil, &ToMessagesOptions{StrictRoles: true})
+		assert.NoError(t, err)
+		assert.Equal(t, RoleModel, result[1].Role)
+	})
+
+	t.Run("uses a custom allow-list", func(t *testing.T) {
+		options := &ToMessagesOptions{AllowedRoles: []Role{RoleSystem, "usr"}}
+		_, err := ToMessagesWithOptions(renderedString, nil, options)
+		assert.NoError(t, err)
+
+		_, err = ToMessagesWithOptions("<<<dotprompt:role:user>>>Hi", nil, options)
+		assert.ErrorContains(t, err, "unknown role 'user' at byte offset 0")
+	})
+}
+
+func TestToMessagesMarkerDelimiters(t *testing.T) {
+	options := &ToMessagesOptions{MarkerDelimiters: MarkerDelimiters{Open: "<|", Close: "|>"}}
+	renderedString := "<|dotprompt:role:system {\"cache\":true,\"note\":\"}|>\"}|>Start turns with <<<dotprompt:role:user>>>." +
+		"<|dotprompt:history|>" +
+		"<|dotprompt:role:user|>Look at <|dotprompt:media:url https://example.com/a.png image/png|>" +
+		" and <<<dotprompt:media:url https://example.com/b.png>>><|dotprompt:section notes|><|dotprompt:data|>{\"k\":1}"
+	history := []Message{{Role: RoleModel, Content: []Part{&TextPart{Text: "Earlier"}}}}
+
+	result, err := ToMessagesWithOptions(renderedString, &DataArgument{Messages: history}, options)
+	assert.NoError(t, err)
+	assert.Len(t, result, 3)
+	assert.Equal(t, Message{
+		Role:    RoleSystem,
+		Content: []Part{&TextPart{Text: "Start turns with <<<dotprompt:role:user>>>."}},
+		HasMetadata: HasMetadata{
+			Metadata: map[string]any{"cache": true, "note": "}|>"},
+		},
+	}, result[0])
+	assert.Equal(t, "history", result[1].Metadata["purpose"])
+	assert.Equal(t, RoleUser, result[2].Role)
+
+	pending := NewPendingPart()
+	pending.SetMetadata("purpose", "notes")
+	assert.Equal(t, []Part{
+		&TextPart{Text: "Look at "},
+		&MediaPart{Media: Media{URL: "https://example.com/a.png", ContentType: "image/png"}},
+		&TextPart{Text: " and <<<dotprompt:media:url https://example.com/b.png>>>"},
+		pending,
+		&DataPart{Data: map[string]any{"k": 1.0}},
+	}, result[2].Content)
+
+	t.Run("validates roles of custom markers", func(t *testing.T) {
+		strict := *options
+		strict.StrictRoles = true
+		_, err := ToMessagesWithOptions("<<<dotprompt:role:usr>>><|dotprompt:role:usr|>Hi", nil, &strict)
+		assert.EqualError(t, err, "dotprompt: unknown role 'usr' at byte offset 24")
+	})
+
+	t.Run("default markers are text", func(t *testing.T) {
+		result, err := ToMessagesWithOptions("<<<dotprompt:role:model>>>Hi", nil, options)
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{{Role: RoleUser, Content: []Part{&TextPart{Text: "<<<dotprompt:role:model>>>Hi"}}}}, result)
+	})
+}
+
+func TestToMessagesEmptyHistoryFallback(t *testing.T) {
+	renderedString := "<<<dotprompt:role:system>>>Be helpful.<<<dotprompt:history>>><<<dotprompt:role:user>>>Question"
+	options := &ToMessagesOptions{EmptyHistoryFallback: "No prior conversation."}
+
+	t.Run("inserts the fallback for empty history", func(t *testing.T) {
+		result, err := ToMessagesWithOptions(renderedString, &DataArgument{}, options)
+		assert.NoError(t, err)
+		assert.Equal(t, []Message{
+			{Role: RoleSystem, Content: []Part{&TextPart{Text: "Be helpful."}}},
+			{Role: RoleUser, Content: []Part{&TextPart{Text: "No prior conversation."}}},
+			{Role: RoleUser, Content: []Part{&TextPart{Text: "Question"}}},
+		}, result)
+	})
+
+	t.Run("no fallback by default", func(t *testing.T) {
+		result, err := ToMessages(renderedString, &DataArgument{})
+		assert.NoError(t, err)
+		assert.Len(t, result, 2)
+	})
+
+	t.Run("populated history is unchanged", func(t *testing.T) {
+		data := &DataArgument{Messages: []Message{
+			{Role: RoleUser, Content: []Part{&TextPart{Text: "Hi"}}},
+			{Role: RoleModel, Content: []Part{&TextPart{Text: "Hello"}}},
+		}}
+		result, err := ToMessagesWithOptions(renderedString, data, options)
+		assert.NoError(t, err)
+		assert.Len(t, result, 4)
+		assert.Equal(t, "Hi", result[1].Content[0].(*TextPart).Text)
+		assert.Equal(t, "Hello", result[2].Content[0].(*TextPart).Text)
+		for _, msg := range result {
+			assert.NotEqual(t, "No prior conversation.", msg.Content[0].(*TextPart).Text)
+		}
+	})
+}
+
+func TestNewMessages(t *testing.T) {
+	history := []Message{
+		{Role: RoleUser, Content: []Part{&TextPart{Text: "Hi"}}},
+		{Role: RoleModel, Content: []Part{&TextPart{Text: "Hello!"}}},
+	}
+	data := &DataArgument{Messages: history}
+
+	t.Run("history helper", func(t *testing.T) {
+		rendered, err := ToMessages(
+			"<<<dotprompt:role:system>>>Be brief.<<<dotprompt:history>>><<<dotprompt:role:user>>>Why?", data)
+		assert.NoError(t, err)
+		assert.Len(t, rendered, 4)
+
+		assert.Equal(t, []Message{
+			{Role: RoleSystem, Content: []Part{&TextPart{Text: "Be brief."}}},
+			{Role: RoleUser, Content: []Part{&TextPart{Text: "Why?"}}},
+		}, NewMessages(history, rendered))
+	})
+
+	t.Run("inserted history", func(t *testing.T) {
+		rendered, err := ToMessages("Why?", data)
+		assert.NoError(t, err)
+		assert.Len(t, rendered, 3)
+
+		assert.Equal(t, []Message{
+			{Role: RoleUser, Content: []Part{&TextPart{Text: "Why?"}}},
+		}, NewMessages(history, rendered))
+	})
+
+	t.Run("new message repeating history", func(t *testing.T) {
+		rendered, err := ToMessages("Hi", data)
+		assert.NoError(t, err)
+
+		assert.Equal(t, []Message{
+			{Role: RoleUser, Content: []Part{&TextPart{Text: "Hi"}}},
+		}, NewMessages(history, rendered))
+	})
+
+	t.Run("no history", func(t *testing.T) {
+		rendered, err := ToMessages("Why?", &DataArgument{})
+		assert.NoError(t, err)
+
+		assert.Equal(t, rendered, NewMessages(nil, rendered))
+	})
+}
+
+func TestParseDocumentFrontmatterFormats(t *testing.T) {
+	yamlSource := "---\nname: greeter\nmodel: test-model\nconfig:\n  temperature: 0.5\nfoo.bar: value1\nfoo.released: 2025-01-02\n---\nHello {{name}}!"
+	expected, err := ParseDocument(yamlSource)
+	assert.NoError(t, err)
+
+	sources := map[string]string{
+		"json": "---json\n" +
+			`{"name": "greeter", "model": "test-model", "config": {"temperature": 0.5}, "foo.bar": "value1", "foo.released": "2025-01-02"}` +
+			"\n---\nHello {{name}}!",
+		"toml": "+++\nname = \"greeter\"\nmodel = \"test-model\"\n\"foo.bar\" = \"value1\"\n\"foo.released\" = 2025-01-02\n\n" +
+			"[config]\ntemperature = 0.5\n+++\nHello {{name}}!",
+	}
+	for format, source := range sources {
+		t.Run(format, func(t *testing.T) {
+			result, err := ParseDocument(source)
+			assert.NoError(t, err)
+			assert.Equal(t, "greeter", result.Name)
+			assert.Equal(t, "test-model", result.Model)
+			assert.Equal(t, 0.5, result.Config["temperature"])
+			assert.Equal(t, expected.Ext, result.Ext)
+			assert.Equal(t, expected.Raw, result.Raw)
+			assert.Equal(t, expected.Template, result.Template)
+
+			metadata, err := ParseFrontmatterOnly(source)
+			assert.NoError(t, err)
+			assert.Equal(t, "greeter", metadata.Name)
+		})
+	}
+
+	t.Run("empty frontmatter", func(t *testing.T) {
+		for _, source := range []string{"---json\n---\nHello", "+++\n+++\nHello"} {
+			result, err := ParseDocument(source)
+			assert.NoError(t, err)
+			assert.Equal(t, "Hello", result.Template)
+		}
+	})
+
+	t.Run("invalid frontmatter", func(t *testing.T) {
+		for _, source := range []string{"---json\n{\"name\": \n---\nHello", "+++\nname = \n+++\nHello"} {
+			result, err := ParseDocument(source)
+			assert.NoError(t, err)
+			// As with YAML, the whole source is used as the template.
+			assert.Equal(t, source, result.Template)
+
+			_, err = ParseDocumentWithOptions(source, &ParseOptions{Strict: true})
+			assert.ErrorContains(t, err, "dotprompt: invalid frontmatter")
+		}
+	})
+}
+
+func TestToMessagesSeq(t *testing.T) {
+	history := []Message{
+		{Role: RoleUser, Content: []Part{&TextPart{Text: "Hi"}}},
+		{Role: RoleModel, Content: []Part{&TextPart{Text: "Hello!"}}},
+	}
+	tests := []struct {
+		name     string
+		rendered string
+		data     *DataArgument
+	}{
+		{"single message", "Hello", nil},
+		{"empty", "", nil},
+		{"roles", "<<<dotprompt:role:system>>>Be brief.<<<dotprompt:role:user>>>Why?<<<dotprompt:role:model>>>Because.", nil},
+		{"role metadata", `<<<dotprompt:role:user {"cache":true}>>>Why?`, nil},
+		{"inserted history before user", "<<<dotprompt:role:system>>>Be brief.<<<dotprompt:role:user>>>Why?", &DataArgument{Messages: history}},
+		{"inserted history after model", "<<<dotprompt:role:model>>>Why?", &DataArgument{Messages: history}},
+		{"history only", "", &DataArgument{Messages: history}},
+		{"history marker", "Be brief.<<<dotprompt:history>>><<<dotprompt:role:user>>>Why?", &DataArgument{Messages: history}},
+		{"empty history marker", "Be brief.<<<dotprompt:history>>>Why?", &DataArgument{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expected, err := ToMessages(tt.rendered, tt.data)
+			assert.NoError(t, err)
+
+			actual := []Message{}
+			for msg, err := range ToMessagesSeq(tt.rendered, tt.data) {
+				assert.NoError(t, err)
+				actual = append(actual, msg)
+			}
+			assert.Equal(t, expected, actual)
+		})
+	}
+
+	t.Run("stops early", func(t *testing.T) {
+		// The invalid metadata at the end is never parsed.
+		rendered := "<<<dotprompt:role:system>>>One<<<dotprompt:role:user>>>Two<<<dotprompt:role:model>>>Three" +
+			"<<<dotprompt:role:user {bad}>>>Four"
+		var first []Message
+		for msg, err := range ToMessagesSeq(rendered, nil) {
+			assert.NoError(t, err)
+			first = append(first, msg)
+			break
+		}
+		assert.Equal(t, []Message{{Role: RoleSystem, Content: []Part{&TextPart{Text: "One"}}}}, first)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		var errs []error
+		for _, err := range ToMessagesSeq("One<<<dotprompt:role:model {bad}>>>Two", nil) {
+			errs = append(errs, err)
+		}
+		assert.Len(t, errs, 1)
+		assert.ErrorContains(t, errs[0], "invalid metadata for role 'model'")
+	})
+}
+
+func TestMessagesToString(t *testing.T) {
+	history := []Message{
+		{Role: RoleUser, Content: []Part{&TextPart{Text: "Hi"}}},
+		{Role: RoleModel, Content: []Part{&TextPart{Text: "Hello!"}}},
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		messages := []Message{
+			{Role: RoleSystem, Content: []Part{&TextPart{Text: "Be brief."}}},
+			{
+				Role:        RoleUser,
+				Content:     []Part{&TextPart{Text: "Describe "}, &MediaPart{Media: Media{URL: "https://example.com/cat.png", ContentType: "image/png"}}},
+				HasMetadata: HasMetadata{Metadata: Metadata{"cache": true}},
+			},
+			{Role: RoleModel, Content: []Part{&TextPart{Text: "A cat."}, NewPendingPart()}},
+			{Role: RoleUser, Content: []Part{&DataPart{Data: map[string]any{"tag": "<b>"}}}},
+			{Role: RoleModel, Content: []Part{&ToolRequestPart{ToolRequest: map[string]any{"name": "lookup", "input": map[string]any{"q": "cat"}}}}},
+			{Role: RoleTool, Content: []Part{&ToolResponsePart{ToolResponse: map[string]any{"name": "lookup", "output": "meow"}}}},
+		}
+		messages[2].Content[1].(*PendingPart).SetMetadata("purpose", "output")
+
+		rendered, err := MessagesToString(messages)
+		assert.NoError(t, err)
+		assert.Equal(t, "<<<dotprompt:role:system>>>Be brief."+
+			`<<<dotprompt:role:user {"cache":true}>>>Describe <<<dotprompt:media:url https://example.com/cat.png image/png>>>`+
+			"<<<dotprompt:role:model>>>A cat.<<<dotprompt:section output>>>"+
+			`<<<dotprompt:role:user>>><<<dotprompt:data>>>{"tag":"\u003cb\u003e"}`+
+			`<<<dotprompt:role:model>>><<<dotprompt:tool-request>>>{"input":{"q":"cat"},"name":"lookup"}`+
+			`<<<dotprompt:role:tool>>><<<dotprompt:tool-response>>>{"name":"lookup","output":"meow"}`, rendered)
+
+		parsed, err := ToMessages(rendered, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, messages, parsed)
+	})
+
+	t.Run("history collapses to a marker", func(t *testing.T) {
+		rendered := "<<<dotprompt:role:system>>>Be brief.<<<dotprompt:history>>><<<dotprompt:role:user>>>Why?"
+		data := &DataArgument{Messages: history}
+		messages, err := ToMessages(rendered, data)
+		assert.NoError(t, err)
+		assert.Len(t, messages, 4)
+
+		out, err := MessagesToString(messages)
+		assert.NoError(t, err)
+		assert.Equal(t, rendered, out)
+
+		parsed, err := ToMessages(out, data)
+		assert.NoError(t, err)
+		assert.Equal(t, messages, parsed)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			message Message
+			wantErr string
+		}{
+			{"role", Message{Role: "User"}, "role 'User'"},
+			{"marker in text", Message{Role: RoleUser, Content: []Part{&TextPart{Text: "<<<dotprompt:history>>>"}}}, "contains a dotprompt marker"},
+			{"media URL", Message{Role: RoleUser, Content: []Part{&MediaPart{Media: Media{URL: "a b"}}}}, "media URL"},
+			{"tool request part", Message{Role: RoleModel, Content: []Part{&ToolRequestPart{ToolRequest: map[string]any{"args": "a"}}}}, "missing \"name\""},
+			{"pending part", Message{Role: RoleModel, Content: []Part{&PendingPart{}}}, "section marker"},
+			{"part metadata", Message{Role: RoleUser, Content: []Part{&TextPart{Text: "a", HasMetadata: HasMetadata{Metadata: Metadata{"a": 1}}}}}, "metadata"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				_, err := MessagesToString([]Message{tt.message})
+				assert.ErrorContains(t, err, tt.wantErr)
+			})
+		}
+	})
+}
+
+func TestExportedParsePart(t *testing.T) {
+	t.Run("text", func(t *testing.T) {
+		part, err := ParsePart("Hello World")
+		assert.NoError(t, err)
+		assert.Equal(t, &TextPart{Text: "Hello World"}, part)
+	})
+
+	t.Run("media", func(t *testing.T) {
+		for _, piece := range []string{
+			"<<<dotprompt:media:url https://example.com/cat.png image/png>>>",
+			"<<<dotprompt:media:url https://example.com/cat.png image/png",
+		} {
+			part, err := ParsePart(piece)
+			assert.NoError(t, err)
+			media, ok := part.(*MediaPart)
+			assert.True(t, ok)
+			assert.Equal(t, Media{URL: "https://example.com/cat.png", ContentType: "image/png"}, media.Media)
+		}
+	})
+
+	t.Run("section", func(t *testing.T) {
+		part, err := ParsePart("<<<dotprompt:section code>>>")
+		assert.NoError(t, err)
+		pending, ok := part.(*PendingPart)
+		assert.True(t, ok)
+		assert.True(t, pending.IsPending())
+		assert.Equal(t, "code", pending.Metadata["purpose"])
+	})
+
+	t.Run("data", func(t *testing.T) {
+		part, err := ParsePart(`<<<dotprompt:data>>> {"city":"Paris"}`)
+		assert.NoError(t, err)
+		assert.Equal(t, &DataPart{Data: map[string]any{"city": "Paris"}}, part)
+	})
+
+	t.Run("tool request", func(t *testing.T) {
+		part, err := ParsePart(`<<<dotprompt:tool-request>>> {"name":"getWeather","input":{"city":"Paris"},"ref":"1"}`)
+		assert.NoError(t, err)
+		assert.Equal(t, &ToolRequestPart{ToolRequest: map[string]any{
+			"name": "getWeather", "input": map[string]any{"city": "Paris"}, "ref": "1",
+		}}, part)
+	})
+
+	t.Run("tool request with args", func(t *testing.T) {
+		part, err := ParsePart(`<<<dotprompt:tool-request>>> {"name":"getWeather","args":{"city":"Paris"}}`)
+		assert.NoError(t, err)
+		assert.Equal(t, &ToolRequestPart{ToolRequest: map[string]any{
+			"name": "getWeather", "input": map[string]any{"city": "Paris"},
+		}}, part)
+	})
+
+	t.Run("tool response", func(t *testing.T) {
+		part, err := ParsePart(`<<<dotprompt:tool-response>>> {"name":"getWeather","output":{"temp":21}}`)
+		assert.NoError(t, err)
+		assert.Equal(t, &ToolResponsePart{ToolResponse: map[string]any{
+			"name": "getWeather", "output": map[string]any{"temp": 21.0},
+		}}, part)
+	})
+
+	t.Run("malformed tool markers", func(t *testing.T) {
+		tests := []struct {
+			piece   string
+			wantErr string
+		}{
+			{`<<<dotprompt:tool-request>>>`, "missing JSON object"},
+			{`<<<dotprompt:tool-request>>> {"input":{}}`, `missing "name"`},
+			{`<<<dotprompt:tool-request>>> {"name":""}`, `"name" must be a non-empty string`},
+			{`<<<dotprompt:tool-request>>> {"name":"a","arguments":{}}`, `unexpected key "arguments", expected name, input, args, ref`},
+			{`<<<dotprompt:tool-request>>> {"name":"a","args":{},"input":{}}`, `expected "input" or "args", not both`},
+			{`<<<dotprompt:tool-response>>> {"name":"a"}`, `missing "output"`},
+			{`<<<dotprompt:tool-response>>> {"name":"a","output":1,"ref":2}`, `"ref" must be a non-empty string`},
+			{`<<<dotprompt:tool-response>>> ["a"]`, "invalid tool response piece"},
+		}
+		for _, tt := range tests {
+			part, err := ParsePart(tt.piece)
+			assert.ErrorContains(t, err, tt.wantErr, tt.piece)
+			assert.True(t, part == nil, tt.piece)
+		}
+	})
+
+	t.Run("malformed markers", func(t *testing.T) {
+		for _, piece := range []string{
+			"<<<dotprompt:data>>>",
+			"<<<dotprompt:media:url>>>",
+			"<<<dotprompt:media:url a b c>>>",
+			"<<<dotprompt:section>>>",
+		} {
+			part, err := ParsePart(piece)
+			assert.Error(t, err, piece)
+			assert.True(t, part == nil, piece)
+		}
+	})
+}
@@ -0,0 +1,373 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package dotprompt
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+
+	"github.com/mbleigh/raymond"
+)
+
+// PartialSet is a set of partials that have been resolved and parsed once so
+// that they can be shared by many Compile and Render calls without invoking
+// the partial resolver or re-parsing the partials for every prompt.
+type PartialSet struct {
+	partials map[string]setPartial
+}
+
+// setPartial is a resolved partial along with its parsed template.
+type setPartial struct {
+	source   string
+	template Template
+	// metadata is the partial's frontmatter, if it has any and
+	// DotpromptOptions.MergePartialMetadata is set.
+	metadata *PromptMetadata
+}
+
+// NewPartialSet resolves the named partials, along with every partial they
+// include, from the instance's Partials and PartialResolver and parses each
+// of them once.
+func (dp *Dotprompt) NewPartialSet(names ...string) (*PartialSet, error) {
+	set := &PartialSet{partials: make(map[string]setPartial)}
+	var add func(name string) error
+	add = func(name string) error {
+		if _, ok := set.partials[name]; ok {
+			return nil
+		}
+		source, err := dp.lookupPartial(name)
+		if err != nil {
+			return fmt.Errorf("dotprompt: failed to resolve partial '%s': %w", name, err)
+		}
+		source, metadata, err := dp.splitPartial(source)
+		if err != nil {
+			return fmt.Errorf("dotprompt: failed to parse partial '%s': %w", name, err)
+		}
+		tpl, err := dp.engine.Parse(source)
+		if err != nil {
+			return fmt.Errorf("dotprompt: failed to parse partial '%s': %w", name, err)
+		}
+		set.partials[name] = setPartial{source: source, template: tpl, metadata: metadata}
+		for _, included := range dp.identifyPartials(source) {
+			if err := add(included); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, name := range names {
+		if err := add(name); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// Names returns the names of the partials in the set.
+func (s *PartialSet) Names() []string {
+	names := make([]string, 0, len(s.partials))
+	for name := range s.partials {
+		names = append(names, name)
+	}
+	return names
+}
+
+// registerPartialSet registers every partial in the set on the template,
+// reusing the parsed partial templates where the engine supports it.
+func (dp *Dotprompt) registerPartialSet(set *PartialSet, tpl Template) error {
+	if set == nil {
+		return nil
+	}
+	for name, partial := range set.partials {
+		if dp.knownPartials[name] {
+			return fmt.Errorf("the partial is already registered: %s", name)
+		}
+		if dp.knownHelpers[name] {
+			if err := dp.reportNameCollision(name); err != nil {
+				return err
+			}
+		}
+		raymondTpl, isRaymond := tpl.(*raymond.Template)
+		parsed, isParsed := partial.template.(*raymond.Template)
+		if isRaymond && isParsed {
+			raymondTpl.RegisterPartialTemplate(name, parsed)
+		} else {
+			tpl.RegisterPartial(name, partial.source)
+		}
+		dp.knownPartials[name] = true
+	}
+	return nil
+}
+
+// splitPartial returns the template of a partial source, translated from the
+// configured Delimiters, and the metadata declared in its frontmatter. Unless
+// DotpromptOptions.MergePartialMetadata is set, or if the source has no
+// frontmatter, the whole source is the template and the metadata is nil.
+func (dp *Dotprompt) splitPartial(source string) (string, *PromptMetadata, error) {
+	template, metadata := source, (*PromptMetadata)(nil)
+	if _, frontmatter, body := extractFrontmatterFormatAndBody(source); dp.mergePartialMetadata && (frontmatter != "" || body != "") {
+		parsed, err := dp.Parse(source)
+		if err != nil {
+			return "", nil, err
+		}
+		template, metadata = parsed.Template, &parsed.PromptMetadata
+	}
+	template, err := dp.translateTemplate(template)
+	if err != nil {
+		return "", nil, err
+	}
+	return template, metadata, nil
+}
+
+// partialMetadata is the metadata declared in the frontmatter of a partial.
+type partialMetadata struct {
+	name     string
+	metadata *PromptMetadata
+}
+
+// withPartialMetadata returns the prompt with the metadata of the partials it
+// includes merged into its metadata if DotpromptOptions.MergePartialMetadata
+// is set. Partials in the set are used in preference to resolving them again.
+func (dp *Dotprompt) withPartialMetadata(prompt ParsedPrompt, set *PartialSet) (ParsedPrompt, error) {
+	if !dp.mergePartialMetadata {
+		return prompt, nil
+	}
+	partials, err := dp.collectPartialMetadata(prompt.Template, set)
+	if err != nil {
+		return ParsedPrompt{}, err
+	}
+	if len(partials) == 0 {
+		return prompt, nil
+	}
+	prompt.PromptMetadata, err = mergePartialMetadata(prompt.PromptMetadata, partials)
+	if err != nil {
+		return ParsedPrompt{}, err
+	}
+	return prompt, nil
+}
+
+// collectPartialMetadata returns the metadata declared by the partials that
+// the template includes, directly or through other partials, in order of
+// first inclusion. Partials that can't be resolved are skipped, as when they
+// are registered.
+func (dp *Dotprompt) collectPartialMetadata(template string, set *PartialSet) ([]partialMetadata, error) {
+	var partials []partialMetadata
+	visited := make(map[string]bool)
+	var visit func(template string) error
+	visit = func(template string) error {
+		for _, name := range dp.identifyPartials(template) {
+			if visited[name] {
+				continue
+			}
+			visited[name] = true
+
+			var body string
+			var metadata *PromptMetadata
+			if partial, ok := set.lookup(name); ok {
+				body, metadata = partial.source, partial.metadata
+			} else {
+				source, ok := dp.Partials[name]
+				if !ok && dp.partialResolver != nil {
+					var err error
+					if source, err = dp.partialResolver(name); err != nil {
+						return err
+					}
+				}
+				if source == "" {
+					continue
+				}
+				var err error
+				if body, metadata, err = dp.splitPartial(source); err != nil {
+					return fmt.Errorf("dotprompt: failed to parse partial '%s': %w", name, err)
+				}
+			}
+			if metadata != nil {
+				partials = append(partials, partialMetadata{name: name, metadata: metadata})
+			}
+			if err := visit(body); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := visit(template); err != nil {
+		return nil, err
+	}
+	return partials, nil
+}
+
+// lookup returns the named partial if the set is non-nil and contains it.
+func (s *PartialSet) lookup(name string) (setPartial, bool) {
+	if s == nil {
+		return setPartial{}, false
+	}
+	partial, ok := s.partials[name]
+	return partial, ok
+}
+
+// mergePartialMetadata merges the metadata declared by partials into the
+// metadata of the prompt that includes them. The prompt's own metadata takes
+// precedence: a partial only sets the description, model, input schema, and
+// output format and schema if the prompt leaves them unset, and only adds
+// config, input default, and extension keys the prompt doesn't set. Tools and
+// tool definitions are added to the prompt's unless it already lists them.
+//
+// Partials have no order of precedence among themselves, so two partials
+// setting the same field or key to different values is an error, unless the
+// prompt sets it. The name, variant, version, examples, raw frontmatter, and
+// metadata of partials are ignored.
+func mergePartialMetadata(prompt PromptMetadata, partials []partialMetadata) (PromptMetadata, error) {
+	// setBy records the partial that set each field, to report conflicts.
+	setBy := make(map[string]string)
+	// claim reports whether the partial should set the field: it isn't set
+	// yet, by the prompt or by another partial. It returns an error if
+	// another partial set it to a different value.
+	claim := func(field, partial string, isSet bool, current, value any) (bool, error) {
+		if other, ok := setBy[field]; ok {
+			if !reflect.DeepEqual(current, value) {
+				return false, fmt.Errorf(
+					"dotprompt: partials '%s' and '%s' set different values for '%s'", other, partial, field)
+			}
+			return false, nil
+		}
+		if isSet {
+			return false, nil
+		}
+		setBy[field] = partial
+		return true, nil
+	}
+	// mergeKeys adds the keys of the partial's map to a copy of the prompt's,
+	// returning the copy. The prompt's map is returned if nothing is added.
+	mergeKeys := func(field, partial string, out, values map[string]any) (map[string]any, error) {
+		copied := false
+		for _, key := range slices.Sorted(maps.Keys(values)) {
+			current, isSet := out[key]
+			ok, err := claim(field+"."+key, partial, isSet, current, values[key])
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			if !copied {
+				out = maps.Clone(out)
+				if out == nil {
+					out = make(map[string]any)
+				}
+				copied = true
+			}
+			out[key] = values[key]
+		}
+		return out, nil
+	}
+
+	out := prompt
+	for _, p := range partials {
+		name, meta := p.name, p.metadata
+
+		if meta.Description != "" {
+			ok, err := claim("description", name, out.Description != "", out.Description, meta.Description)
+			if err != nil {
+				return PromptMetadata{}, err
+			}
+			if ok {
+				out.Description = meta.Description
+			}
+		}
+		if meta.Model != "" {
+			ok, err := claim("model", name, out.Model != "", out.Model, meta.Model)
+			if err != nil {
+				return PromptMetadata{}, err
+			}
+			if ok {
+				out.Model = meta.Model
+			}
+		}
+		if meta.Input.Schema != nil {
+			ok, err := claim("input.schema", name, out.Input.Schema != nil, out.Input.Schema, meta.Input.Schema)
+			if err != nil {
+				return PromptMetadata{}, err
+			}
+			if ok {
+				out.Input.Schema = meta.Input.Schema
+			}
+		}
+		if meta.Output.Format != "" {
+			ok, err := claim("output.format", name, out.Output.Format != "", out.Output.Format, meta.Output.Format)
+			if err != nil {
+				return PromptMetadata{}, err
+			}
+			if ok {
+				out.Output.Format = meta.Output.Format
+			}
+		}
+		if meta.Output.Schema != nil {
+			ok, err := claim("output.schema", name, out.Output.Schema != nil, out.Output.Schema, meta.Output.Schema)
+			if err != nil {
+				return PromptMetadata{}, err
+			}
+			if ok {
+				out.Output.Schema = meta.Output.Schema
+			}
+		}
+
+		config, err := mergeKeys("config", name, out.Config, meta.Config)
+		if err != nil {
+			return PromptMetadata{}, err
+		}
+		out.Config = config
+		if out.Input.Default, err = mergeKeys("input.default", name, out.Input.Default, meta.Input.Default); err != nil {
+			return PromptMetadata{}, err
+		}
+		for _, namespace := range slices.Sorted(maps.Keys(meta.Ext)) {
+			ext, err := mergeKeys("ext."+namespace, name, out.Ext[namespace], meta.Ext[namespace])
+			if err != nil {
+				return PromptMetadata{}, err
+			}
+			if len(ext) > 0 {
+				out.Ext = maps.Clone(out.Ext)
+				if out.Ext == nil {
+					out.Ext = make(map[string]map[string]any)
+				}
+				out.Ext[namespace] = ext
+			}
+		}
+
+		for _, tool := range meta.Tools {
+			if !slices.Contains(out.Tools, tool) {
+				out.Tools = append(slices.Clip(out.Tools), tool)
+			}
+		}
+		for _, def := range meta.ToolDefs {
+			i := slices.IndexFunc(out.ToolDefs, func(d ToolDefinition) bool { return d.Name == def.Name })
+			var current any
+			if i >= 0 {
+				current = out.ToolDefs[i]
+			}
+			ok, err := claim("toolDefs."+def.Name, name, i >= 0, current, def)
+			if err != nil {
+				return PromptMetadata{}, err
+			}
+			if ok {
+				out.ToolDefs = append(slices.Clip(out.ToolDefs), def)
+			}
+		}
+	}
+	return out, nil
+}
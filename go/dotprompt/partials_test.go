@@ -0,0 +1,176 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package dotprompt
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartialSet(t *testing.T) {
+	calls := map[string]int{}
+	dp := NewDotprompt(&DotpromptOptions{
+		Partials: map[string]string{"footer": "-- {{signature}}"},
+		PartialResolver: func(name string) (string, error) {
+			calls[name]++
+			switch name {
+			case "header":
+				return "Dear {{name}},", nil
+			case "signoff":
+				return "Thanks,\n{{> footer}}", nil
+			default:
+				return "", fmt.Errorf("unknown partial: %s", name)
+			}
+		},
+	})
+
+	set, err := dp.NewPartialSet("header", "signoff")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"header", "signoff", "footer"}, set.Names())
+	assert.Equal(t, map[string]int{"header": 1, "signoff": 1}, calls)
+
+	data := &DataArgument{Input: map[string]any{"name": "Ada", "signature": "Bob"}}
+
+	t.Run("renders prompts against a shared set", func(t *testing.T) {
+		welcome, err := dp.RenderWithPartialSet("{{> header}} Welcome! {{> signoff}}", set, data, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "Dear Ada, Welcome! Thanks,\n-- Bob", welcome.Messages[0].Content[0].(*TextPart).Text)
+
+		renderer, err := dp.CompileWithPartialSet("{{> header}} Goodbye.", set, nil)
+		assert.NoError(t, err)
+		goodbye, err := renderer(data, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "Dear Ada, Goodbye.", goodbye.Messages[0].Content[0].(*TextPart).Text)
+
+		assert.Equal(t, map[string]int{"header": 1, "signoff": 1}, calls)
+	})
+
+	t.Run("resolves partials missing from the set", func(t *testing.T) {
+		headerOnly, err := dp.NewPartialSet("header")
+		assert.NoError(t, err)
+		rendered, err := dp.RenderWithPartialSet("{{> header}} / {{> signoff}}", headerOnly, data, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "Dear Ada, / Thanks,\n-- Bob", rendered.Messages[0].Content[0].(*TextPart).Text)
+		assert.Equal(t, 2, calls["signoff"])
+	})
+
+	t.Run("unresolvable partial", func(t *testing.T) {
+		_, err := dp.NewPartialSet("missing")
+		assert.ErrorContains(t, err, "failed to resolve partial 'missing'")
+	})
+
+	t.Run("invalid partial", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{Partials: map[string]string{"broken": "{{#if}}"}})
+		_, err := dp.NewPartialSet("broken")
+		assert.ErrorContains(t, err, "failed to parse partial 'broken'")
+	})
+}
+
+func TestMergePartialMetadata(t *testing.T) {
+	partials := map[string]string{
+		"forecast": "---\n" +
+			"tools: [getWeather]\n" +
+			"config:\n  temperature: 0.2\n  topK: 5\n" +
+			"input:\n  schema:\n    city: string\n  default:\n    city: Paris\n" +
+			"output:\n  format: json\n  schema:\n    summary: string\n" +
+			"---\n" +
+			"Use getWeather for {{city}}.",
+		"units":    "---\nconfig:\n  topK: 5\n---\nReport temperatures in {{> scale}}.",
+		"scale":    "---\ntools: [convert]\n---\nCelsius",
+		"hot":      "---\nconfig:\n  temperature: 0.9\n---\nBe bold.",
+		"plain":    "No frontmatter here.",
+		"template": "{{> forecast}} / {{> units}}",
+	}
+	dp := NewDotprompt(&DotpromptOptions{Partials: partials, MergePartialMetadata: true})
+	source := "---\nmodel: test-model\nconfig:\n  temperature: 0.7\n---\n{{> forecast}} / {{> units}} / {{> plain}}"
+
+	t.Run("parent uses the partial's schema", func(t *testing.T) {
+		rendered, err := dp.Render(source, &DataArgument{}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "Use getWeather for Paris. / Report temperatures in Celsius. / No frontmatter here.",
+			rendered.Messages[0].Content[0].(*TextPart).Text)
+
+		assert.Equal(t, "test-model", rendered.Model)
+		assert.Equal(t, []string{"getWeather", "convert"}, rendered.Tools)
+		assert.Equal(t, ModelConfig{"temperature": 0.7, "topK": uint64(5)}, rendered.Config)
+		assert.Equal(t, "json", rendered.Output.Format)
+		schemaJSON, err := json.Marshal(rendered.Output.Schema)
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{
+			"type": "object",
+			"properties": {"summary": {"type": "string"}},
+			"required": ["summary"],
+			"additionalProperties": false
+		}`, string(schemaJSON))
+	})
+
+	t.Run("render metadata", func(t *testing.T) {
+		rendered, err := dp.Render(source, &DataArgument{}, nil)
+		assert.NoError(t, err)
+		metadata, err := dp.RenderMetadata(source, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, rendered.Tools, metadata.Tools)
+		assert.Equal(t, rendered.Config, metadata.Config)
+		assert.Equal(t, rendered.Input.Default, metadata.Input.Default)
+	})
+
+	t.Run("partial set", func(t *testing.T) {
+		set, err := dp.NewPartialSet("forecast", "units", "plain")
+		assert.NoError(t, err)
+		rendered, err := dp.RenderWithPartialSet(source, set, &DataArgument{}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "Use getWeather for Paris. / Report temperatures in Celsius. / No frontmatter here.",
+			rendered.Messages[0].Content[0].(*TextPart).Text)
+		assert.Equal(t, []string{"getWeather", "convert"}, rendered.Tools)
+	})
+
+	t.Run("resolved partials", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{
+			MergePartialMetadata: true,
+			PartialResolver: func(name string) (string, error) {
+				return partials[name], nil
+			},
+		})
+		rendered, err := dp.Render("{{> template}}", &DataArgument{Input: map[string]any{"city": "Oslo"}}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "Use getWeather for Oslo. / Report temperatures in Celsius.",
+			rendered.Messages[0].Content[0].(*TextPart).Text)
+		assert.Equal(t, []string{"getWeather", "convert"}, rendered.Tools)
+		assert.Equal(t, ModelConfig{"temperature": 0.2, "topK": uint64(5)}, rendered.Config)
+	})
+
+	t.Run("conflicting partials", func(t *testing.T) {
+		_, err := dp.Render("{{> forecast}} {{> hot}}", &DataArgument{}, nil)
+		assert.ErrorContains(t, err, "partials 'forecast' and 'hot' set different values for 'config.temperature'")
+
+		// The prompt's own value takes precedence, so there is no conflict.
+		rendered, err := dp.Render("---\nconfig:\n  temperature: 0.5\n---\n{{> forecast}} {{> hot}}", &DataArgument{}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 0.5, rendered.Config["temperature"])
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{Partials: partials})
+		rendered, err := dp.Render("{{> scale}}", &DataArgument{}, nil)
+		assert.NoError(t, err)
+		assert.Contains(t, rendered.Messages[0].Content[0].(*TextPart).Text, "tools: [convert]")
+		assert.Empty(t, rendered.Tools)
+	})
+}
@@ -19,9 +19,14 @@ package dotprompt
 import (
 	"encoding/json"
 	"fmt"
+	"math"
+	"reflect"
+	"regexp"
 	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/invopop/jsonschema"
 	orderedmap "github.com/wk8/go-ordered-map/v2"
@@ -40,9 +45,26 @@ var JSONSchemaScalarTypes = []string{
 // WildcardPropertyName is the name used for wildcard properties.
 const WildcardPropertyName = "(*)"
 
+// OpenObjectPropertyName is the name of the reserved property that opens an
+// object to properties it does not declare, e.g. `(...): true` sets
+// `additionalProperties: true`. Unlike a wildcard property, the values of the
+// additional properties are not constrained. `(...): false` closes the object
+// even when AllowAdditionalProperties is set.
+const OpenObjectPropertyName = "(...)"
+
 // PicoschemaOptions defines options for the Picoschema parser.
 type PicoschemaOptions struct {
 	SchemaResolver SchemaResolver
+	// SchemaCache, if set, caches the schemas resolved by name through the
+	// SchemaResolver so that they are resolved once across parses.
+	SchemaCache *SchemaCache
+	// AllowAdditionalProperties leaves additionalProperties unset on objects
+	// without a wildcard property, so that they accept properties that are
+	// not declared, as they did before objects were closed by default. Such
+	// objects are now closed with `additionalProperties: false` by default,
+	// as in the JS and Python implementations. A wildcard property always
+	// sets additionalProperties to its schema.
+	AllowAdditionalProperties bool
 }
 
 // Picoschema parses a schema with the given options.
@@ -53,22 +75,75 @@ func Picoschema(schema any, options *PicoschemaOptions) (*jsonschema.Schema, err
 
 // PicoschemaParser is a parser for Picoschema.
 type PicoschemaParser struct {
-	SchemaResolver SchemaResolver
+	SchemaResolver            SchemaResolver
+	SchemaCache               *SchemaCache
+	AllowAdditionalProperties bool
 }
 
 // NewPicoschemaParser creates a new PicoschemaParser with the given options.
 func NewPicoschemaParser(options *PicoschemaOptions) *PicoschemaParser {
 	return &PicoschemaParser{
-		SchemaResolver: options.SchemaResolver,
+		SchemaResolver:            options.SchemaResolver,
+		SchemaCache:               options.SchemaCache,
+		AllowAdditionalProperties: options.AllowAdditionalProperties,
 	}
 }
 
+// SchemaCache caches schemas resolved by name. It is safe for concurrent use.
+// Cached schemas are copies of the resolved schemas, and the parser copies
+// them again before use, so neither resolvers nor callers can modify them.
+type SchemaCache struct {
+	mu      sync.RWMutex
+	schemas map[string]*jsonschema.Schema
+}
+
+// NewSchemaCache creates an empty SchemaCache.
+func NewSchemaCache() *SchemaCache {
+	return &SchemaCache{schemas: map[string]*jsonschema.Schema{}}
+}
+
+// load returns the cached schema with the given name.
+func (c *SchemaCache) load(name string) (*jsonschema.Schema, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	schema, ok := c.schemas[name]
+	return schema, ok
+}
+
+// store caches a copy of the schema with the given name.
+func (c *SchemaCache) store(name string, schema *jsonschema.Schema) {
+	schema = createCopy(schema)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.schemas[name] = schema
+}
+
+// Delete removes the schema with the given name from the cache.
+func (c *SchemaCache) Delete(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.schemas, name)
+}
+
+// Clear removes all schemas from the cache.
+func (c *SchemaCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.schemas)
+}
+
 // mustResolveSchema resolves a schema name to a JSON schema using the SchemaResolver.
 func (p *PicoschemaParser) mustResolveSchema(schemaName string) (*jsonschema.Schema, error) {
 	if p.SchemaResolver == nil {
 		return nil, fmt.Errorf("Picoschema: unsupported scalar type '%s'", schemaName)
 	}
 
+	if p.SchemaCache != nil {
+		if val, ok := p.SchemaCache.load(schemaName); ok {
+			return val, nil
+		}
+	}
+
 	val, err := p.SchemaResolver(schemaName)
 	if err != nil {
 		return nil, err
@@ -76,6 +151,9 @@ func (p *PicoschemaParser) mustResolveSchema(schemaName string) (*jsonschema.Sch
 	if val == nil {
 		return nil, fmt.Errorf("Picoschema: could not find schema with name '%s'", schemaName)
 	}
+	if p.SchemaCache != nil {
+		p.SchemaCache.store(schemaName, val)
+	}
 	return val, nil
 }
 
@@ -204,7 +282,24 @@ func (p *PicoschemaParser) parsePico(obj any, path ...string) (*jsonschema.Schem
 
 	// Handle wildcard properties
 	objMap := obj.(map[string]any)
+	_, hasWildcard := objMap[WildcardPropertyName]
+	_, hasOpen := objMap[OpenObjectPropertyName]
+	if hasWildcard && hasOpen {
+		return nil, fmt.Errorf("Picoschema: an object cannot have both '%s' and '%s' properties", WildcardPropertyName, OpenObjectPropertyName)
+	}
 	for key, value := range objMap {
+		if key == OpenObjectPropertyName {
+			open, ok := value.(bool)
+			if !ok {
+				return nil, fmt.Errorf("Picoschema: '%s' must be true or false, got: %v", OpenObjectPropertyName, value)
+			}
+			schema.AdditionalProperties = jsonschema.FalseSchema
+			if open {
+				schema.AdditionalProperties = jsonschema.TrueSchema
+			}
+			continue
+		}
+
 		// wildcard property
 		if key == WildcardPropertyName {
 			parsedValue, err := p.parsePico(value, append(path, key)...)
@@ -245,6 +340,14 @@ func (p *PicoschemaParser) parsePico(obj any, path ...string) (*jsonschema.Schem
 		// Handle properties with type description
 		typeDesc := extractDescription(strings.TrimSuffix(nameType[1], ")"))
 		newProp := &jsonschema.Schema{}
+		if slices.Contains(JSONSchemaScalarTypes, typeDesc[0]) {
+			prop, err := p.parseScalarProperty(typeDesc, value, isOptional)
+			if err != nil {
+				return nil, fmt.Errorf("Picoschema: property '%s': %w", propertyName, err)
+			}
+			schema.Properties.Set(propertyName, prop)
+			continue
+		}
 		switch typeDesc[0] {
 		case "array":
 			items, err := p.parsePico(value, append(path, key)...)
@@ -269,13 +372,37 @@ func (p *PicoschemaParser) parsePico(obj any, path ...string) (*jsonschema.Schem
 			}
 			newProp = updatedProp
 		case "enum":
-			enumValues := value.([]any)
-			if isOptional && !slices.ContainsFunc(enumValues, func(s any) bool { return s == nil }) {
-				enumValues = append(enumValues, nil)
+			enumValues, err := enumValuesOf(value)
+			if err != nil {
+				return nil, fmt.Errorf("Picoschema: enum property '%s' %w", propertyName, err)
+			}
+			prop, description, err := parseEnumProperty(enumValues, typeDesc[1], isOptional)
+			if err != nil {
+				return nil, fmt.Errorf("Picoschema: enum property '%s': %w", propertyName, err)
+			}
+			newProp = prop
+			typeDesc[1] = description
+		case "tuple":
+			members, err := enumValuesOf(value)
+			if err != nil {
+				return nil, fmt.Errorf("Picoschema: tuple property '%s' %w", propertyName, err)
+			}
+			newProp.PrefixItems = make([]*jsonschema.Schema, len(members))
+			for i, member := range members {
+				item, err := p.parsePico(member, append(path, key, strconv.Itoa(i))...)
+				if err != nil {
+					return nil, err
+				}
+				newProp.PrefixItems[i] = item
+			}
+			newProp.Items = jsonschema.FalseSchema
+			if isOptional {
+				newProp.AnyOf = []*jsonschema.Schema{{Type: "array"}, {Type: "null"}}
+			} else {
+				newProp.Type = "array"
 			}
-			newProp.Enum = enumValues
 		default:
-			return nil, fmt.Errorf("Picoschema: parenthetical types must be 'object' or 'array', got: %s", typeDesc[0])
+			return nil, fmt.Errorf("Picoschema: parenthetical types must be 'object', 'array', 'tuple', 'enum', or a scalar type, got: %s", typeDesc[0])
 		}
 		if typeDesc[1] != "" {
 			newProp.Description = typeDesc[1]
@@ -287,9 +414,320 @@ func (p *PicoschemaParser) parsePico(obj any, path ...string) (*jsonschema.Schem
 	if len(schema.Required) != 0 {
 		sort.Strings(schema.Required)
 	}
+	if schema.AdditionalProperties == nil && !p.AllowAdditionalProperties {
+		schema.AdditionalProperties = jsonschema.FalseSchema
+	}
 	return schema, nil
 }
 
+// scalarAnnotations are the `key=value` annotations recognized in the
+// parenthetical of a scalar property.
+var scalarAnnotations = []string{"default", "format", "pattern"}
+
+// enumAnnotations are the `key=value` annotations recognized in the
+// parenthetical of an enum property.
+var enumAnnotations = []string{"default", "type"}
+
+// enumTypes are the types an enum may declare for its values.
+var enumTypes = []string{"string", "number", "integer", "boolean"}
+
+// extractAnnotations splits the `key=value` annotations for the given keys
+// out of a comma-separated annotation list, returning the remaining text,
+// which is the description. The values of `default` and `pattern` may contain
+// commas, so they run until the next recognized annotation; any other text
+// after them is part of the value.
+func extractAnnotations(description string, keys []string) (string, map[string]string, error) {
+	annotations := make(map[string]string)
+	var rest []string
+	extending := ""
+	for _, segment := range strings.Split(description, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(segment), "=")
+		if ok && slices.Contains(keys, key) {
+			if _, dup := annotations[key]; dup {
+				return "", nil, fmt.Errorf("duplicate '%s' annotation", key)
+			}
+			annotations[key] = value
+			extending = ""
+			if key == "default" || key == "pattern" {
+				extending = key
+			}
+			continue
+		}
+		if extending != "" {
+			annotations[extending] += "," + segment
+			continue
+		}
+		rest = append(rest, segment)
+	}
+	for key, value := range annotations {
+		annotations[key] = strings.TrimSpace(value)
+	}
+	return strings.TrimSpace(strings.Join(rest, ",")), annotations, nil
+}
+
+// rangeAnnotationRegex matches an annotation that is written as a numeric
+// range, e.g. `0..120`, `1..`, or `..0.5`, whether or not its bounds are
+// valid numbers.
+var rangeAnnotationRegex = regexp.MustCompile(`^[-+0-9.eE]*\.\.[-+0-9.eE]*$`)
+
+// parseScalarProperty parses a property declared with a scalar type in
+// parentheses, e.g. `name?(string, the name, default=Anonymous)`. The
+// description may be given in the annotation or as the property's value.
+//
+// String properties may carry `format=` and `pattern=` annotations, e.g.
+// `email(string, format=email)` or `code(string, pattern=^[A-Z]{3}$)`, which
+// are emitted as the `format` and `pattern` keywords.
+//
+// Integer and number properties may give an inclusive range as the first
+// annotation, e.g. `age(integer, 0..120)` or `score(number, 0..1, normalized
+// value)`, which is emitted as `minimum` and `maximum`. Either bound may be
+// left out.
+//
+// A `default=` annotation is coerced to the property's type and emitted as
+// the `default` keyword. Nullability and the default are independent: an
+// optional property still accepts null and is left out of `required`, while
+// the default is the value consumers should use when the property is omitted.
+func (p *PicoschemaParser) parseScalarProperty(typeDesc [2]string, value any, isOptional bool) (*jsonschema.Schema, error) {
+	description, annotations, err := extractAnnotations(typeDesc[1], scalarAnnotations)
+	if err != nil {
+		return nil, err
+	}
+	var defaultValue any
+	literal, hasDefault := annotations["default"]
+	if hasDefault {
+		if defaultValue, err = coerceDefault(typeDesc[0], literal); err != nil {
+			return nil, err
+		}
+	}
+	for _, key := range []string{"format", "pattern"} {
+		if _, ok := annotations[key]; ok && typeDesc[0] != "string" {
+			return nil, fmt.Errorf("the '%s' annotation is only supported for strings", key)
+		}
+	}
+	var minimum, maximum json.Number
+	if typeDesc[0] == "integer" || typeDesc[0] == "number" {
+		first, rest, _ := strings.Cut(description, ",")
+		if first = strings.TrimSpace(first); rangeAnnotationRegex.MatchString(first) {
+			var err error
+			if minimum, maximum, err = parseRange(typeDesc[0], first); err != nil {
+				return nil, err
+			}
+			description = strings.TrimSpace(rest)
+		}
+	}
+	if description == "" && value != nil {
+		valueDesc, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("the value of a scalar property must be a description, got %T", value)
+		}
+		description = valueDesc
+	}
+
+	typeString := typeDesc[0]
+	if description != "" {
+		typeString += ", " + description
+	}
+	prop, err := p.parsePico(typeString)
+	if err != nil {
+		return nil, err
+	}
+	if isOptional && prop.Type != "" {
+		prop.AnyOf = []*jsonschema.Schema{createCopy(prop), {Type: "null"}}
+	}
+	if hasDefault {
+		prop.Default = defaultValue
+	}
+	prop.Minimum = minimum
+	prop.Maximum = maximum
+	prop.Format = annotations["format"]
+	prop.Pattern = annotations["pattern"]
+	return prop, nil
+}
+
+// parseRange parses an inclusive range annotation of the form `min..max` for
+// the given numeric type, returning empty bounds for those left out.
+func parseRange(typeName, annotation string) (json.Number, json.Number, error) {
+	lower, upper, _ := strings.Cut(annotation, "..")
+	if strings.HasPrefix(upper, ".") || strings.Contains(upper, "..") {
+		return "", "", fmt.Errorf("invalid range '%s': expected the form min..max", annotation)
+	}
+	if lower == "" && upper == "" {
+		return "", "", fmt.Errorf("invalid range '%s': at least one bound is required", annotation)
+	}
+	var bounds [2]json.Number
+	var values [2]float64
+	for i, bound := range []string{lower, upper} {
+		if bound == "" {
+			continue
+		}
+		if typeName == "integer" {
+			n, err := strconv.ParseInt(bound, 10, 64)
+			if err != nil {
+				return "", "", fmt.Errorf("invalid range '%s': '%s' is not a valid integer", annotation, bound)
+			}
+			bounds[i], values[i] = json.Number(strconv.FormatInt(n, 10)), float64(n)
+			continue
+		}
+		f, err := strconv.ParseFloat(bound, 64)
+		if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+			return "", "", fmt.Errorf("invalid range '%s': '%s' is not a valid number", annotation, bound)
+		}
+		data, _ := json.Marshal(f)
+		bounds[i], values[i] = json.Number(data), f
+	}
+	if lower != "" && upper != "" && values[0] > values[1] {
+		return "", "", fmt.Errorf("invalid range '%s': the minimum is greater than the maximum", annotation)
+	}
+	return bounds[0], bounds[1], nil
+}
+
+// coerceDefault converts a `default=` literal to a value of the given scalar
+// type. String defaults may optionally be double-quoted.
+func coerceDefault(typeName, literal string) (any, error) {
+	var value any
+	var err error
+	switch typeName {
+	case "string", "any":
+		value = literal
+		if strings.HasPrefix(literal, `"`) {
+			value, err = strconv.Unquote(literal)
+		}
+	case "number":
+		value, err = strconv.ParseFloat(literal, 64)
+	case "integer":
+		value, err = strconv.ParseInt(literal, 10, 64)
+	case "boolean":
+		value, err = strconv.ParseBool(literal)
+	case "null":
+		if literal != "null" {
+			err = fmt.Errorf("not null")
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid default '%s' for type '%s'", literal, typeName)
+	}
+	return value, nil
+}
+
+// parseEnumProperty builds the schema of an `(enum)` property with the given
+// values, returning it along with the description left after the annotations.
+// Optional enums also accept null.
+//
+// An enum may declare the type of its values with a `type=` annotation, e.g.
+// `priority(enum, type=integer): [1, 2, 3]`, which is emitted as the `type`
+// keyword alongside `enum`. Every value must then be of that type. Untyped
+// enums may mix values of any type. A `default=` annotation must name one of
+// the values.
+func parseEnumProperty(values []any, annotation string, isOptional bool) (*jsonschema.Schema, string, error) {
+	description, annotations, err := extractAnnotations(annotation, enumAnnotations)
+	if err != nil {
+		return nil, "", err
+	}
+	typeName, typed := annotations["type"]
+	if typed {
+		if !slices.Contains(enumTypes, typeName) {
+			return nil, "", fmt.Errorf("invalid enum type '%s'; expected one of %s", typeName, strings.Join(enumTypes, ", "))
+		}
+		for _, value := range values {
+			if !enumValueHasType(value, typeName) {
+				return nil, "", fmt.Errorf("enum value %v is not of type '%s'", value, typeName)
+			}
+		}
+	}
+	if isOptional && !slices.ContainsFunc(values, func(s any) bool { return s == nil }) {
+		values = append(values, nil)
+	}
+
+	prop := &jsonschema.Schema{Enum: values}
+	if typed {
+		if isOptional {
+			prop.AnyOf = []*jsonschema.Schema{{Type: typeName}, {Type: "null"}}
+		} else {
+			prop.Type = typeName
+		}
+	}
+	if literal, ok := annotations["default"]; ok {
+		if prop.Default, err = enumDefault(values, literal); err != nil {
+			return nil, "", err
+		}
+	}
+	return prop, description, nil
+}
+
+// enumValueHasType reports whether an enum value is of the JSON Schema type.
+// Integers are numbers without a fractional part.
+func enumValueHasType(value any, typeName string) bool {
+	switch typeName {
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "number", "integer":
+		if !IsNumber(value) {
+			return false
+		}
+		if typeName == "number" {
+			return true
+		}
+		if n, ok := value.(json.Number); ok {
+			_, err := n.Int64()
+			return err == nil
+		}
+		f, _ := toFloat(value)
+		return f == math.Trunc(f)
+	default:
+		return false
+	}
+}
+
+// enumDefault returns the enum value that a `default=` literal names, e.g.
+// `active` or `"active"` for the string "active" and `3` for the number 3. It
+// is an error if the literal names none of the values.
+func enumDefault(values []any, literal string) (any, error) {
+	unquoted := literal
+	if strings.HasPrefix(literal, `"`) {
+		if s, err := strconv.Unquote(literal); err == nil {
+			unquoted = s
+		}
+	}
+	for _, value := range values {
+		switch v := value.(type) {
+		case string:
+			if v == unquoted {
+				return v, nil
+			}
+		case nil:
+			if literal == "null" {
+				return nil, nil
+			}
+		default:
+			if fmt.Sprint(v) == literal {
+				return v, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("default '%s' is not one of the enum values", literal)
+}
+
+// enumValuesOf returns the values of an `(enum)` property, which must be a
+// list.
+func enumValuesOf(value any) ([]any, error) {
+	if values, ok := value.([]any); ok {
+		return values, nil
+	}
+	v := reflect.ValueOf(value)
+	if value == nil || (v.Kind() != reflect.Slice && v.Kind() != reflect.Array) {
+		return nil, fmt.Errorf("must be a list of values, got %T", value)
+	}
+	values := make([]any, v.Len())
+	for i := range values {
+		values[i] = v.Index(i).Interface()
+	}
+	return values, nil
+}
+
 // extractDescription extracts the type and description from a string.
 func extractDescription(input string) [2]string {
 	if !strings.Contains(input, ",") {
@@ -299,3 +737,315 @@ func extractDescription(input string) [2]string {
 	parts := strings.SplitN(input, ",", 2)
 	return [2]string{strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])}
 }
+
+// picoCompatibleKeywords are the JSON Schema keywords that can be expressed in
+// Picoschema.
+var picoCompatibleKeywords = []string{
+	"$schema",
+	"additionalProperties",
+	"anyOf",
+	"default",
+	"description",
+	"enum",
+	"format",
+	"items",
+	"maximum",
+	"minimum",
+	"pattern",
+	"prefixItems",
+	"properties",
+	"required",
+	"type",
+}
+
+// JSONSchemaToPico converts a JSON schema to the compact Picoschema form. It
+// is the inverse of Picoschema for the subset of JSON Schema that Picoschema
+// can express: objects, arrays, tuples, and enums as properties, scalar types,
+// descriptions, optional properties, and wildcard properties. Scalar
+// properties keep their `default`, `format`, `pattern`, `minimum`, and
+// `maximum` keywords as annotations, and enum properties their `default`. Any
+// other construct, such as `$ref`, `oneOf`, or other validation keywords, is
+// an error.
+//
+// Objects are returned as a map[string]any and scalar schemas as a string.
+func JSONSchemaToPico(schema *jsonschema.Schema) (any, error) {
+	if schema == nil {
+		return nil, nil
+	}
+	return jsonSchemaToPico(schema)
+}
+
+// jsonSchemaToPico converts a schema appearing at the top level or as the
+// value of array items or wildcard properties.
+func jsonSchemaToPico(schema *jsonschema.Schema) (any, error) {
+	schema, nullable, err := unwrapPicoSchema(schema)
+	if err != nil {
+		return nil, err
+	}
+	if nullable {
+		return nil, fmt.Errorf("Picoschema: nullable schemas are only supported as optional properties")
+	}
+	if schema.Enum != nil {
+		return nil, fmt.Errorf("Picoschema: enums are only supported as properties")
+	}
+	if keyword := annotationKeyword(schema); keyword != "" {
+		return nil, fmt.Errorf("Picoschema: '%s' is only supported on scalar and enum properties", keyword)
+	}
+
+	switch {
+	case schema.Type == "object" || schema.Properties != nil:
+		return objectToPico(schema)
+	case schema.Type == "array" || schema.Items != nil:
+		return nil, fmt.Errorf("Picoschema: arrays are only supported as properties")
+	default:
+		return scalarToPico(schema)
+	}
+}
+
+// objectToPico converts an object schema to a Picoschema map.
+func objectToPico(schema *jsonschema.Schema) (map[string]any, error) {
+	out := make(map[string]any)
+	if schema.Properties != nil {
+		for pair := schema.Properties.Oldest(); pair != nil; pair = pair.Next() {
+			name := pair.Key
+			if !slices.Contains(schema.Required, name) {
+				name += "?"
+			}
+			prop, _, err := unwrapPicoSchema(pair.Value)
+			if err != nil {
+				return nil, fmt.Errorf("Picoschema: property '%s': %w", pair.Key, err)
+			}
+
+			var typeName, annotations string
+			var value any
+			keyword := annotationKeyword(prop)
+			switch {
+			case prop.Enum != nil:
+				typeName = "enum"
+				if prop.Type != "" {
+					annotations = ", type=" + prop.Type
+				}
+				if keyword != "" && keyword != "default" {
+					err = fmt.Errorf("Picoschema: '%s' is not supported on enums", keyword)
+				} else if keyword == "default" {
+					annotations += ", default=" + enumDefaultLiteral(prop.Default)
+				}
+				enumValues := prop.Enum
+				// Picoschema adds null to the values of optional enums.
+				if strings.HasSuffix(name, "?") && len(enumValues) > 0 && enumValues[len(enumValues)-1] == nil {
+					enumValues = enumValues[:len(enumValues)-1]
+				}
+				value = slices.Clone(enumValues)
+			case keyword != "" && prop.Type != "object" && prop.Type != "array" && prop.Properties == nil &&
+				prop.Items == nil && prop.PrefixItems == nil:
+				typeName, annotations, err = scalarAnnotationsToPico(prop)
+			case keyword != "":
+				err = fmt.Errorf("Picoschema: '%s' is only supported on scalar and enum properties", keyword)
+			case prop.Type == "object" || prop.Properties != nil:
+				typeName = "object"
+				value, err = objectToPico(prop)
+			case prop.PrefixItems != nil:
+				typeName = "tuple"
+				value, err = tupleToPico(prop)
+			case prop.Type == "array" || prop.Items != nil:
+				typeName = "array"
+				value, err = jsonSchemaToPico(prop.Items)
+			default:
+				value, err = scalarToPico(prop)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Picoschema: property '%s': %w", pair.Key, err)
+			}
+
+			key := name
+			if typeName != "" {
+				if prop.Description != "" {
+					typeName += ", " + prop.Description
+				}
+				key += "(" + typeName + annotations + ")"
+			}
+			out[key] = value
+		}
+	}
+
+	// Closed objects are the Picoschema default.
+	if open, ok := booleanSchema(schema.AdditionalProperties); ok && open {
+		out[OpenObjectPropertyName] = true
+	} else if schema.AdditionalProperties != nil && !ok {
+		value, err := jsonSchemaToPico(schema.AdditionalProperties)
+		if err != nil {
+			return nil, fmt.Errorf("Picoschema: additional properties: %w", err)
+		}
+		out[WildcardPropertyName] = value
+	}
+	return out, nil
+}
+
+// tupleToPico converts the member schemas of a tuple schema to a Picoschema
+// list. Only closed tuples, with `items: false`, are supported.
+func tupleToPico(schema *jsonschema.Schema) ([]any, error) {
+	if closed, ok := booleanSchema(schema.Items); !ok || closed {
+		return nil, fmt.Errorf("Picoschema: tuples must not allow additional items")
+	}
+	members := make([]any, len(schema.PrefixItems))
+	for i, item := range schema.PrefixItems {
+		member, err := jsonSchemaToPico(item)
+		if err != nil {
+			return nil, fmt.Errorf("Picoschema: tuple member %d: %w", i, err)
+		}
+		members[i] = member
+	}
+	return members, nil
+}
+
+// scalarToPico converts a scalar schema to a Picoschema type string, using
+// `any` for schemas without a type.
+func scalarToPico(schema *jsonschema.Schema) (string, error) {
+	typeName := schema.Type
+	if typeName == "" {
+		typeName = "any"
+	}
+	if !slices.Contains(JSONSchemaScalarTypes, typeName) {
+		return "", fmt.Errorf("Picoschema: unsupported type '%s'", typeName)
+	}
+	if schema.Description != "" {
+		return typeName + ", " + schema.Description, nil
+	}
+	return typeName, nil
+}
+
+// annotationKeyword returns the first of the keywords that Picoschema
+// expresses as annotations of a property that the schema sets, or "" if it
+// sets none.
+func annotationKeyword(schema *jsonschema.Schema) string {
+	switch {
+	case schema.Default != nil:
+		return "default"
+	case schema.Format != "":
+		return "format"
+	case schema.Pattern != "":
+		return "pattern"
+	case schema.Minimum != "":
+		return "minimum"
+	case schema.Maximum != "":
+		return "maximum"
+	}
+	return ""
+}
+
+// scalarAnnotationsToPico returns the type and the trailing annotations of
+// the parenthetical of a scalar property with annotation keywords, in the
+// form parseScalarProperty reads, e.g. `integer, 0..120` and
+// `, default=18`. The description goes between the two.
+func scalarAnnotationsToPico(schema *jsonschema.Schema) (string, string, error) {
+	baseType, err := scalarToPico(&jsonschema.Schema{Type: schema.Type})
+	if err != nil {
+		return "", "", err
+	}
+	typeName := baseType
+	if schema.Minimum != "" || schema.Maximum != "" {
+		if baseType != "integer" && baseType != "number" {
+			return "", "", fmt.Errorf("Picoschema: ranges are only supported for integers and numbers")
+		}
+		typeName += ", " + schema.Minimum.String() + ".." + schema.Maximum.String()
+	}
+
+	var annotations string
+	for _, annotation := range [][2]string{{"format", schema.Format}, {"pattern", schema.Pattern}} {
+		if annotation[1] == "" {
+			continue
+		}
+		if baseType != "string" {
+			return "", "", fmt.Errorf("Picoschema: '%s' is only supported for strings", annotation[0])
+		}
+		annotations += ", " + annotation[0] + "=" + annotation[1]
+	}
+	if schema.Default != nil {
+		literal, err := scalarDefaultLiteral(baseType, schema.Default)
+		if err != nil {
+			return "", "", err
+		}
+		annotations += ", default=" + literal
+	}
+	return typeName, annotations, nil
+}
+
+// scalarDefaultLiteral returns the `default=` literal that coerceDefault reads
+// back as the value for the type. Strings are quoted when trimming would
+// change them or they start with a quote.
+func scalarDefaultLiteral(typeName string, value any) (string, error) {
+	s, isString := value.(string)
+	if isString != (typeName == "string" || typeName == "any") {
+		return "", fmt.Errorf("Picoschema: default %#v is not of type '%s'", value, typeName)
+	}
+	if isString {
+		if s != strings.TrimSpace(s) || strings.HasPrefix(s, `"`) {
+			return strconv.Quote(s), nil
+		}
+		return s, nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	if _, err := coerceDefault(typeName, string(data)); err != nil {
+		return "", fmt.Errorf("Picoschema: %w", err)
+	}
+	return string(data), nil
+}
+
+// enumDefaultLiteral returns the `default=` literal that enumDefault reads
+// back as the enum value.
+func enumDefaultLiteral(value any) string {
+	switch v := value.(type) {
+	case string:
+		if v != strings.TrimSpace(v) || strings.HasPrefix(v, `"`) {
+			return strconv.Quote(v)
+		}
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// unwrapPicoSchema checks that the schema only uses keywords Picoschema
+// supports and strips the `anyOf: [<schema>, {type: null}]` wrapper that
+// Picoschema adds to optional properties, reporting whether it was present.
+func unwrapPicoSchema(schema *jsonschema.Schema) (*jsonschema.Schema, bool, error) {
+	if schema == nil {
+		return &jsonschema.Schema{}, false, nil
+	}
+
+	data, err := json.Marshal(schema)
+	if err != nil {
+		return nil, false, err
+	}
+	if string(data) == "true" {
+		// The `true` schema accepts any value.
+		return &jsonschema.Schema{}, false, nil
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		// Boolean schemas such as `additionalProperties: false` marshal to a
+		// bare value rather than an object.
+		return nil, false, fmt.Errorf("Picoschema: unsupported schema %s", data)
+	}
+	for key := range fields {
+		if !slices.Contains(picoCompatibleKeywords, key) {
+			return nil, false, fmt.Errorf("Picoschema: unsupported JSON Schema keyword '%s'", key)
+		}
+	}
+
+	if schema.AnyOf == nil {
+		return schema, false, nil
+	}
+	if len(schema.AnyOf) != 2 || schema.AnyOf[0] == nil || schema.AnyOf[1] == nil || schema.AnyOf[1].Type != "null" {
+		return nil, false, fmt.Errorf("Picoschema: 'anyOf' is only supported for optional properties")
+	}
+	unwrapped := *schema
+	unwrapped.AnyOf = nil
+	if unwrapped.Type == "" {
+		unwrapped.Type = schema.AnyOf[0].Type
+	}
+	return &unwrapped, true, nil
+}
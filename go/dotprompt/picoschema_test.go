@@ -17,6 +17,8 @@
 package dotprompt
 
 import (
+	"encoding/json"
+	"strings"
 	"testing"
 
 	"github.com/invopop/jsonschema"
@@ -107,9 +109,10 @@ func TestPicoschemaParser_parsePico(t *testing.T) {
 			"name": "string",
 		}
 		expected := &jsonschema.Schema{
-			Type:       "object",
-			Properties: TEST_PROPERTY,
-			Required:   []string{"name"},
+			Type:                 "object",
+			Properties:           TEST_PROPERTY,
+			AdditionalProperties: jsonschema.FalseSchema,
+			Required:             []string{"name"},
 		}
 		result, err := parser.parsePico(schema)
 		assert.NoError(t, err)
@@ -126,9 +129,10 @@ func TestPicoschemaParser_parsePico(t *testing.T) {
 			Items: &jsonschema.Schema{Type: "string"},
 		})
 		expected := &jsonschema.Schema{
-			Type:       "object",
-			Properties: property,
-			Required:   []string{"names"},
+			Type:                 "object",
+			Properties:           property,
+			AdditionalProperties: jsonschema.FalseSchema,
+			Required:             []string{"names"},
 		}
 		result, err := parser.parsePico(schema)
 		assert.NoError(t, err)
@@ -150,15 +154,17 @@ func TestPicoschemaParser_parsePico(t *testing.T) {
 		property.Set("items", &jsonschema.Schema{
 			Type: "array",
 			Items: &jsonschema.Schema{
-				Type:       "object",
-				Properties: itemsProperty,
-				Required:   []string{"props"},
+				Type:                 "object",
+				Properties:           itemsProperty,
+				AdditionalProperties: jsonschema.FalseSchema,
+				Required:             []string{"props"},
 			}})
 
 		expected := &jsonschema.Schema{
-			Type:       "object",
-			Properties: property,
-			Required:   []string{"items"},
+			Type:                 "object",
+			Properties:           property,
+			AdditionalProperties: jsonschema.FalseSchema,
+			Required:             []string{"items"},
 		}
 		result, err := parser.parsePico(schema)
 		assert.NoError(t, err)
@@ -178,9 +184,10 @@ func TestPicoschemaParser_parsePico(t *testing.T) {
 			AnyOf:       []*jsonschema.Schema{{Type: "array"}, {Type: "null"}},
 		})
 		expected := &jsonschema.Schema{
-			Type:       "object",
-			Properties: property,
-			Required:   []string{},
+			Type:                 "object",
+			Properties:           property,
+			AdditionalProperties: jsonschema.FalseSchema,
+			Required:             []string{},
 		}
 		result, err := parser.parsePico(schema)
 		assert.NoError(t, err)
@@ -196,14 +203,32 @@ func TestPicoschemaParser_parsePico(t *testing.T) {
 			Enum: []any{"active", "inactive"},
 		})
 		expected := &jsonschema.Schema{
-			Type:       "object",
-			Properties: property,
-			Required:   []string{"status"},
+			Type:                 "object",
+			Properties:           property,
+			AdditionalProperties: jsonschema.FalseSchema,
+			Required:             []string{"status"},
 		}
 		result, err := parser.parsePico(schema)
 		assert.NoError(t, err)
 		assert.Equal(t, expected, result)
 	})
+
+	t.Run("enum type with typed list", func(t *testing.T) {
+		schema := map[string]any{
+			"status?(enum)": []string{"active", "inactive"},
+		}
+		result, err := parser.parsePico(schema)
+		assert.NoError(t, err)
+		status, _ := result.Properties.Get("status")
+		assert.Equal(t, []any{"active", "inactive", nil}, status.Enum)
+	})
+
+	t.Run("enum type with non-list value", func(t *testing.T) {
+		for _, value := range []any{"active", map[string]any{"a": 1}, nil} {
+			_, err := parser.parsePico(map[string]any{"status(enum)": value})
+			assert.ErrorContains(t, err, "Picoschema: enum property 'status' must be a list of values")
+		}
+	})
 }
 
 func TestExtractDescription(t *testing.T) {
@@ -221,3 +246,495 @@ func TestExtractDescription(t *testing.T) {
 		assert.Equal(t, expected, result)
 	})
 }
+
+func TestJSONSchemaToPico(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		pico := map[string]any{
+			"name":                               "string, the user's name",
+			"age?":                               "integer",
+			"score?":                             "number, a score",
+			"nickname":                           "any",
+			"tags(array, list of tags)":          "string",
+			"notes?(array)":                      "string",
+			"status?(enum, the status)":          []any{"active", "inactive"},
+			"role(enum)":                         []any{"admin", "user"},
+			"priority(enum, type=integer)":       []any{1, 2, 3},
+			"level?(enum, urgency, type=string)": []any{"low", "high"},
+			"address(object, an address)":        map[string]any{"street": "string", "city?": "string"},
+			"settings?(object)":                  map[string]any{"theme": "string"},
+			"items(array)":                       map[string]any{"id": "integer", "label?": "string"},
+			"(*)":                                "string, extra fields",
+			"email(string, format=email)":        nil,
+			"code?(string, a code, pattern=^[A-Z]{3,4}$)":       nil,
+			"years(integer, 0..120, age in years, default=18)":  nil,
+			"ratio?(number, ..1)":                               nil,
+			"greeting?(string, default=\" hi, there\")":         nil,
+			"mode(enum, default=on)":                            []any{"on", "off"},
+			"retries?(enum, attempts, type=integer, default=3)": []any{1, 3, 5},
+		}
+
+		schema, err := Picoschema(pico, &PicoschemaOptions{})
+		assert.NoError(t, err)
+
+		result, err := JSONSchemaToPico(schema)
+		assert.NoError(t, err)
+		assert.Equal(t, pico, result)
+
+		// Converting back again gives the same JSON schema.
+		// Property order depends on map iteration, so compare as JSON.
+		roundTripped, err := Picoschema(result, &PicoschemaOptions{})
+		assert.NoError(t, err)
+		expected, err := json.Marshal(schema)
+		assert.NoError(t, err)
+		actual, err := json.Marshal(roundTripped)
+		assert.NoError(t, err)
+		assert.JSONEq(t, string(expected), string(actual))
+	})
+
+	t.Run("scalar schema", func(t *testing.T) {
+		result, err := JSONSchemaToPico(&jsonschema.Schema{Type: "string", Description: "a name"})
+		assert.NoError(t, err)
+		assert.Equal(t, "string, a name", result)
+	})
+
+	t.Run("nil schema", func(t *testing.T) {
+		result, err := JSONSchemaToPico(nil)
+		assert.NoError(t, err)
+		assert.Nil(t, result)
+	})
+
+	t.Run("unsupported constructs", func(t *testing.T) {
+		properties := orderedmap.New[string, *jsonschema.Schema]()
+		properties.Set("name", &jsonschema.Schema{Type: "string", MinLength: new(uint64)})
+
+		tests := []struct {
+			name   string
+			schema *jsonschema.Schema
+		}{
+			{"ref", &jsonschema.Schema{Ref: "#/$defs/Foo"}},
+			{"oneOf", &jsonschema.Schema{OneOf: []*jsonschema.Schema{{Type: "string"}, {Type: "integer"}}}},
+			{"non-nullable anyOf", &jsonschema.Schema{AnyOf: []*jsonschema.Schema{{Type: "string"}, {Type: "integer"}}}},
+			{"top-level array", &jsonschema.Schema{Type: "array", Items: &jsonschema.Schema{Type: "string"}}},
+			{"top-level enum", &jsonschema.Schema{Enum: []any{"a", "b"}}},
+			{"validation keyword", &jsonschema.Schema{Type: "object", Properties: properties}},
+			{"top-level default", &jsonschema.Schema{Type: "string", Default: "x"}},
+			{"format on an integer", objectWith("n", &jsonschema.Schema{Type: "integer", Format: "int32"})},
+			{"range on a string", objectWith("s", &jsonschema.Schema{Type: "string", Minimum: "1"})},
+			{"default on an object", objectWith("o", &jsonschema.Schema{Type: "object", Default: map[string]any{}})},
+			{"pattern on an enum", objectWith("e", &jsonschema.Schema{Enum: []any{"a"}, Pattern: "a"})},
+			{"mistyped default", objectWith("b", &jsonschema.Schema{Type: "boolean", Default: "yes"})},
+			{"exclusive range", objectWith("x", &jsonschema.Schema{Type: "number", ExclusiveMinimum: "0"})},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				_, err := JSONSchemaToPico(tt.schema)
+				assert.Error(t, err)
+			})
+		}
+	})
+}
+
+// objectWith returns an object schema with a single required property.
+func objectWith(name string, schema *jsonschema.Schema) *jsonschema.Schema {
+	properties := orderedmap.New[string, *jsonschema.Schema]()
+	properties.Set(name, schema)
+	return &jsonschema.Schema{Type: "object", Properties: properties, Required: []string{name}}
+}
+
+func TestPicoschemaDefaults(t *testing.T) {
+	parser := NewPicoschemaParser(&PicoschemaOptions{})
+
+	t.Run("optional string with default", func(t *testing.T) {
+		result, err := parser.parsePico(map[string]any{
+			"id":                               "string",
+			"name?(string, default=Anonymous)": "the user's name",
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"id"}, result.Required)
+
+		name, _ := result.Properties.Get("name")
+		assert.Equal(t, &jsonschema.Schema{
+			Type:        "string",
+			Description: "the user's name",
+			AnyOf: []*jsonschema.Schema{
+				{Type: "string", Description: "the user's name"},
+				{Type: "null"},
+			},
+			Default: "Anonymous",
+		}, name)
+	})
+
+	t.Run("description and default in annotation", func(t *testing.T) {
+		result, err := parser.parsePico(map[string]any{
+			"greeting?(string, how to greet, default=\"Hello, world\")": nil,
+		})
+		assert.NoError(t, err)
+		greeting, _ := result.Properties.Get("greeting")
+		assert.Equal(t, "how to greet", greeting.Description)
+		assert.Equal(t, "Hello, world", greeting.Default)
+	})
+
+	t.Run("typed defaults", func(t *testing.T) {
+		result, err := parser.parsePico(map[string]any{
+			"temperature?(number, default=0.7)": nil,
+			"count?(integer, default=0)":        nil,
+			"verbose?(boolean, default=false)":  nil,
+			"label(string)":                     "a required label",
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"label"}, result.Required)
+
+		temperature, _ := result.Properties.Get("temperature")
+		assert.Equal(t, 0.7, temperature.Default)
+		count, _ := result.Properties.Get("count")
+		assert.Equal(t, int64(0), count.Default)
+		verbose, _ := result.Properties.Get("verbose")
+		assert.Equal(t, false, verbose.Default)
+		label, _ := result.Properties.Get("label")
+		assert.Equal(t, &jsonschema.Schema{Type: "string", Description: "a required label"}, label)
+	})
+
+	t.Run("invalid default", func(t *testing.T) {
+		_, err := parser.parsePico(map[string]any{"count?(integer, default=many)": nil})
+		assert.ErrorContains(t, err, "Picoschema: property 'count': invalid default 'many' for type 'integer'")
+	})
+
+	t.Run("enum default", func(t *testing.T) {
+		result, err := parser.parsePico(map[string]any{
+			"status(enum, account status, default=active)": []any{"active", "inactive"},
+			"level?(enum, default=2)":                      []any{uint64(1), uint64(2), uint64(3)},
+			"mode?(enum, default=\"off\")":                 []any{"on", "off"},
+		})
+		assert.NoError(t, err)
+
+		status, _ := result.Properties.Get("status")
+		assert.Equal(t, &jsonschema.Schema{
+			Enum:        []any{"active", "inactive"},
+			Description: "account status",
+			Default:     "active",
+		}, status)
+		level, _ := result.Properties.Get("level")
+		assert.Equal(t, uint64(2), level.Default)
+		mode, _ := result.Properties.Get("mode")
+		assert.Equal(t, "off", mode.Default)
+	})
+
+	t.Run("enum default must be an enum value", func(t *testing.T) {
+		_, err := parser.parsePico(map[string]any{"status(enum, default=deleted)": []any{"active", "inactive"}})
+		assert.ErrorContains(t, err, "Picoschema: enum property 'status': default 'deleted' is not one of the enum values")
+	})
+}
+
+func TestPicoschemaEnumTypes(t *testing.T) {
+	parser := NewPicoschemaParser(&PicoschemaOptions{})
+	property := func(t *testing.T, key string, values []any) *jsonschema.Schema {
+		result, err := parser.parsePico(map[string]any{key: values})
+		assert.NoError(t, err)
+		name, _, _ := strings.Cut(key, "(")
+		prop, _ := result.Properties.Get(strings.TrimSuffix(name, "?"))
+		return prop
+	}
+
+	t.Run("string enum", func(t *testing.T) {
+		prop := property(t, "color(enum, the color, type=string)", []any{"red", "green"})
+		assert.Equal(t, &jsonschema.Schema{Type: "string", Enum: []any{"red", "green"}, Description: "the color"}, prop)
+	})
+
+	t.Run("numeric enums", func(t *testing.T) {
+		prop := property(t, "priority(enum, type=integer)", []any{uint64(1), uint64(2), 3.0})
+		assert.Equal(t, &jsonschema.Schema{Type: "integer", Enum: []any{uint64(1), uint64(2), 3.0}}, prop)
+
+		prop = property(t, "ratio(enum, type=number, default=0.5)", []any{0.25, 0.5, uint64(1)})
+		assert.Equal(t, &jsonschema.Schema{Type: "number", Enum: []any{0.25, 0.5, uint64(1)}, Default: 0.5}, prop)
+	})
+
+	t.Run("optional typed enum", func(t *testing.T) {
+		prop := property(t, "priority?(enum, type=integer)", []any{uint64(1), uint64(2)})
+		assert.Equal(t, &jsonschema.Schema{
+			Enum:  []any{uint64(1), uint64(2), nil},
+			AnyOf: []*jsonschema.Schema{{Type: "integer"}, {Type: "null"}},
+		}, prop)
+	})
+
+	t.Run("untyped enum", func(t *testing.T) {
+		prop := property(t, "priority(enum)", []any{uint64(1), "two"})
+		assert.Equal(t, &jsonschema.Schema{Enum: []any{uint64(1), "two"}}, prop)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		tests := []struct {
+			key     string
+			values  []any
+			wantErr string
+		}{
+			{"priority(enum, type=integer)", []any{uint64(1), 2.5}, "enum value 2.5 is not of type 'integer'"},
+			{"priority(enum, type=integer)", []any{uint64(1), "2"}, "enum value 2 is not of type 'integer'"},
+			{"color(enum, type=string)", []any{"red", true}, "enum value true is not of type 'string'"},
+			{"color(enum, type=object)", []any{"red"}, "invalid enum type 'object'"},
+		}
+		for _, tt := range tests {
+			_, err := parser.parsePico(map[string]any{tt.key: tt.values})
+			assert.ErrorContains(t, err, tt.wantErr, tt.key)
+		}
+	})
+}
+
+func TestPicoschemaAdditionalProperties(t *testing.T) {
+	t.Run("closes objects by default", func(t *testing.T) {
+		schema, err := Picoschema(map[string]any{
+			"name":            "string",
+			"address(object)": map[string]any{"city": "string"},
+		}, &PicoschemaOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, jsonschema.FalseSchema, schema.AdditionalProperties)
+		address, _ := schema.Properties.Get("address")
+		assert.Equal(t, jsonschema.FalseSchema, address.AdditionalProperties)
+	})
+
+	t.Run("leaves objects open when allowed", func(t *testing.T) {
+		schema, err := Picoschema(map[string]any{
+			"address(object)": map[string]any{"city": "string"},
+		}, &PicoschemaOptions{AllowAdditionalProperties: true})
+		assert.NoError(t, err)
+		assert.Nil(t, schema.AdditionalProperties)
+		address, _ := schema.Properties.Get("address")
+		assert.Nil(t, address.AdditionalProperties)
+	})
+
+	t.Run("wildcard sets the additional property schema", func(t *testing.T) {
+		schema, err := Picoschema(map[string]any{
+			"name": "string",
+			"(*)":  "number",
+		}, &PicoschemaOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, &jsonschema.Schema{Type: "number"}, schema.AdditionalProperties)
+	})
+
+	t.Run("keeps an explicit JSON schema declaration", func(t *testing.T) {
+		schema, err := Picoschema(map[string]any{
+			"type":                 "object",
+			"properties":           map[string]any{"name": map[string]any{"type": "string"}},
+			"additionalProperties": true,
+		}, &PicoschemaOptions{})
+		assert.NoError(t, err)
+		data, err := json.Marshal(schema)
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{
+			"type": "object",
+			"properties": {"name": {"type": "string"}},
+			"additionalProperties": true
+		}`, string(data))
+	})
+
+	t.Run("closed objects convert back to Picoschema", func(t *testing.T) {
+		schema, err := Picoschema(map[string]any{"name": "string"}, &PicoschemaOptions{})
+		assert.NoError(t, err)
+		pico, err := JSONSchemaToPico(schema)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]any{"name": "string"}, pico)
+	})
+
+	t.Run("open object property", func(t *testing.T) {
+		source := map[string]any{
+			"name":            "string",
+			"(...)":           true,
+			"address(object)": map[string]any{"city": "string", "(...)": false},
+		}
+		schema, err := Picoschema(source, &PicoschemaOptions{AllowAdditionalProperties: true})
+		assert.NoError(t, err)
+		assert.Equal(t, jsonschema.TrueSchema, schema.AdditionalProperties)
+		_, declared := schema.Properties.Get("(...)")
+		assert.False(t, declared)
+		address, _ := schema.Properties.Get("address")
+		assert.Equal(t, jsonschema.FalseSchema, address.AdditionalProperties)
+
+		pico, err := JSONSchemaToPico(schema)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]any{
+			"name":            "string",
+			"(...)":           true,
+			"address(object)": map[string]any{"city": "string"},
+		}, pico)
+	})
+
+	t.Run("invalid open object property", func(t *testing.T) {
+		_, err := Picoschema(map[string]any{"(...)": "yes"}, &PicoschemaOptions{})
+		assert.ErrorContains(t, err, "'(...)' must be true or false")
+
+		_, err = Picoschema(map[string]any{"(...)": true, "(*)": "number"}, &PicoschemaOptions{})
+		assert.ErrorContains(t, err, "cannot have both")
+	})
+}
+
+func TestPicoschemaTuple(t *testing.T) {
+	t.Run("emits prefixItems and closes the tuple", func(t *testing.T) {
+		schema, err := Picoschema(map[string]any{
+			"location(tuple, latitude and longitude)": []any{"number", "number"},
+		}, &PicoschemaOptions{})
+		assert.NoError(t, err)
+		data, err := json.Marshal(schema)
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{
+			"type": "object",
+			"properties": {
+				"location": {
+					"type": "array",
+					"description": "latitude and longitude",
+					"prefixItems": [{"type": "number"}, {"type": "number"}],
+					"items": false
+				}
+			},
+			"required": ["location"],
+			"additionalProperties": false
+		}`, string(data))
+	})
+
+	t.Run("optional tuples allow null", func(t *testing.T) {
+		schema, err := Picoschema(map[string]any{
+			"pair?(tuple)": []any{"string", map[string]any{"count": "integer"}},
+		}, &PicoschemaOptions{})
+		assert.NoError(t, err)
+		pair, _ := schema.Properties.Get("pair")
+		assert.Equal(t, []*jsonschema.Schema{{Type: "array"}, {Type: "null"}}, pair.AnyOf)
+		assert.Len(t, pair.PrefixItems, 2)
+		assert.Equal(t, "object", pair.PrefixItems[1].Type)
+		assert.Empty(t, schema.Required)
+	})
+
+	t.Run("errors if the value is not a list", func(t *testing.T) {
+		_, err := Picoschema(map[string]any{"pair(tuple)": "number"}, &PicoschemaOptions{})
+		assert.ErrorContains(t, err, "tuple property 'pair' must be a list of values")
+	})
+
+	t.Run("converts back to Picoschema", func(t *testing.T) {
+		pico := map[string]any{"location(tuple)": []any{"number", "number"}}
+		schema, err := Picoschema(pico, &PicoschemaOptions{})
+		assert.NoError(t, err)
+		back, err := JSONSchemaToPico(schema)
+		assert.NoError(t, err)
+		assert.Equal(t, pico, back)
+	})
+}
+
+func TestPicoschemaRanges(t *testing.T) {
+	parse := func(key string) (*jsonschema.Schema, error) {
+		schema, err := Picoschema(map[string]any{key: nil}, &PicoschemaOptions{})
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(strings.SplitN(key, "(", 2)[0], "?")
+		prop, _ := schema.Properties.Get(name)
+		return prop, nil
+	}
+
+	tests := []struct {
+		key         string
+		minimum     json.Number
+		maximum     json.Number
+		description string
+	}{
+		{"age(integer, 0..120)", "0", "120", ""},
+		{"count(integer, 1..)", "1", "", ""},
+		{"offset(integer, ..-1)", "", "-1", ""},
+		{"score(number, 0..1, normalized value)", "0", "1", "normalized value"},
+		{"ratio?(number, -0.5..2.5e3)", "-0.5", "2500", ""},
+		{"price(number, 0.., in dollars, default=9.99)", "0", "", "in dollars"},
+		{"total(integer, the total)", "", "", "the total"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			prop, err := parse(tt.key)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.minimum, prop.Minimum)
+			assert.Equal(t, tt.maximum, prop.Maximum)
+			assert.Equal(t, tt.description, prop.Description)
+		})
+	}
+
+	t.Run("serializes as minimum and maximum", func(t *testing.T) {
+		prop, err := parse("age(integer, 0..120)")
+		assert.NoError(t, err)
+		data, err := json.Marshal(prop)
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"type": "integer", "minimum": 0, "maximum": 120}`, string(data))
+	})
+
+	t.Run("invalid ranges", func(t *testing.T) {
+		for key, msg := range map[string]string{
+			"a(integer, ..)":     "at least one bound is required",
+			"b(integer, 0.5..3)": "'0.5' is not a valid integer",
+			"c(number, 1..x2)":   "",
+			"d(number, 5..1)":    "the minimum is greater than the maximum",
+			"e(number, 1...2)":   "expected the form min..max",
+		} {
+			_, err := parse(key)
+			if msg == "" {
+				// Not written as a range, so it is kept as the description.
+				assert.NoError(t, err, key)
+				continue
+			}
+			assert.ErrorContains(t, err, msg, key)
+		}
+	})
+
+	t.Run("ranges only apply to numeric types", func(t *testing.T) {
+		prop, err := parse("label(string, 0..1)")
+		assert.NoError(t, err)
+		assert.Equal(t, "0..1", prop.Description)
+		assert.Empty(t, prop.Minimum)
+	})
+}
+
+func TestPicoschemaStringAnnotations(t *testing.T) {
+	parse := func(key string) (*jsonschema.Schema, error) {
+		schema, err := Picoschema(map[string]any{key: nil}, &PicoschemaOptions{})
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(strings.SplitN(key, "(", 2)[0], "?")
+		prop, _ := schema.Properties.Get(name)
+		return prop, nil
+	}
+
+	tests := []struct {
+		key         string
+		format      string
+		pattern     string
+		description string
+	}{
+		{"email(string, format=email)", "email", "", ""},
+		{"code(string, pattern=^[A-Z]{3}$)", "", "^[A-Z]{3}$", ""},
+		{"zip(string, pattern=^[0-9]{3,5}$)", "", "^[0-9]{3,5}$", ""},
+		{"site(string, the home page, format=uri)", "uri", "", "the home page"},
+		{"at(string, format=date-time, when it happened)", "date-time", "", "when it happened"},
+		{"id(string, an id, format=uuid, pattern=^[a-f0-9-]+$)", "uuid", "^[a-f0-9-]+$", "an id"},
+		{"note(string, key=value, a note)", "", "", "key=value, a note"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			prop, err := parse(tt.key)
+			assert.NoError(t, err)
+			assert.Equal(t, "string", prop.Type)
+			assert.Equal(t, tt.format, prop.Format)
+			assert.Equal(t, tt.pattern, prop.Pattern)
+			assert.Equal(t, tt.description, prop.Description)
+		})
+	}
+
+	t.Run("combines with defaults", func(t *testing.T) {
+		prop, err := parse("email?(string, format=email, default=a@example.com)")
+		assert.NoError(t, err)
+		assert.Equal(t, "email", prop.Format)
+		assert.Equal(t, "a@example.com", prop.Default)
+	})
+
+	t.Run("only for strings", func(t *testing.T) {
+		_, err := parse("age(integer, format=int32)")
+		assert.ErrorContains(t, err, "'format' annotation is only supported for strings")
+	})
+
+	t.Run("duplicate annotations", func(t *testing.T) {
+		_, err := parse("code(string, format=a, format=b)")
+		assert.ErrorContains(t, err, "duplicate 'format' annotation")
+	})
+}
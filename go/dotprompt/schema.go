@@ -19,6 +19,8 @@ package dotprompt
 
 import (
 	"fmt"
+	"maps"
+	"slices"
 
 	"github.com/invopop/jsonschema"
 )
@@ -46,9 +48,20 @@ func (dp *Dotprompt) DefineSchema(name string, definition any) *jsonschema.Schem
 	}
 
 	dp.Schemas[name] = schema
+	if dp.schemaCache != nil {
+		dp.schemaCache.Delete(name)
+	}
 	return schema
 }
 
+// ClearSchemaCache removes all schemas cached with
+// DotpromptOptions.CacheSchemas, so that they are resolved again.
+func (dp *Dotprompt) ClearSchemaCache() {
+	if dp.schemaCache != nil {
+		dp.schemaCache.Clear()
+	}
+}
+
 // LookupSchema retrieves a registered schema by name.
 func (dp *Dotprompt) LookupSchema(name string) (*jsonschema.Schema, bool) {
 	if dp.Schemas == nil {
@@ -59,6 +72,15 @@ func (dp *Dotprompt) LookupSchema(name string) (*jsonschema.Schema, bool) {
 	return schema, exists
 }
 
+// SchemaNames returns the sorted names of all registered schemas. Schemas
+// provided by external lookups are included once they have been looked up,
+// since external sources cannot be enumerated.
+func (dp *Dotprompt) SchemaNames() []string {
+	names := slices.Collect(maps.Keys(dp.Schemas))
+	slices.Sort(names)
+	return names
+}
+
 // RegisterExternalSchemaLookup registers a function that can look up schemas
 // from an external source.
 func (dp *Dotprompt) RegisterExternalSchemaLookup(lookup func(string) any) {
@@ -121,9 +143,67 @@ func (dp *Dotprompt) ResolveSchemaReferences(metadata map[string]any) error {
 		}
 	}
 
+	if toolDefs, ok := metadata["toolDefs"].([]any); ok {
+		for _, td := range toolDefs {
+			toolDef, ok := td.(map[string]any)
+			if !ok {
+				continue
+			}
+			for _, key := range []string{"inputSchema", "outputSchema"} {
+				if schemaName, ok := toolDef[key].(string); ok && schemaName != "" {
+					schema := dp.LookupSchemaFromAnySource(schemaName)
+					if schema == nil {
+						return fmt.Errorf("dotprompt: tool '%v' %s '%s' not found", toolDef["name"], key, schemaName)
+					}
+
+					toolDef[key] = schema
+				}
+			}
+		}
+	}
+
 	return nil
 }
 
+// SchemaIdentifier returns the `$id` and title given to the resolved input or
+// output schema of a named prompt, where field is "input" or "output". Empty
+// values leave the schema's own `$id` or title unchanged.
+type SchemaIdentifier func(promptName, field string) (id jsonschema.ID, title string)
+
+// DefaultSchemaIdentifier identifies a schema by the prompt name and field,
+// e.g. the `$id` "greeting.input.json" and title "greeting input".
+func DefaultSchemaIdentifier(promptName, field string) (jsonschema.ID, string) {
+	return jsonschema.ID(promptName + "." + field + ".json"), promptName + " " + field
+}
+
+// identifySchemas sets the `$id` and title of the resolved input and output
+// schemas with the configured SchemaIdentifier. Schemas that already have an
+// `$id` or title keep them, and the schemas are copied rather than modified,
+// since they may be shared through the schema registry.
+func (dp *Dotprompt) identifySchemas(meta PromptMetadata) PromptMetadata {
+	if dp.schemaIdentifier == nil || meta.Name == "" {
+		return meta
+	}
+	identify := func(schema Schema, field string) Schema {
+		s, ok := schema.(*jsonschema.Schema)
+		if !ok || s == nil {
+			return schema
+		}
+		id, title := dp.schemaIdentifier(meta.Name, field)
+		identified := *s
+		if identified.ID == "" {
+			identified.ID = id
+		}
+		if identified.Title == "" {
+			identified.Title = title
+		}
+		return &identified
+	}
+	meta.Input.Schema = identify(meta.Input.Schema, "input")
+	meta.Output.Schema = identify(meta.Output.Schema, "output")
+	return meta
+}
+
 // DumpDotpromptSchemas prints all schemas stored in Dotprompt
 func (dp *Dotprompt) DumpDotpromptSchemas() {
 	fmt.Println("=== Dotprompt Schemas ===")
@@ -140,3 +220,97 @@ func (dp *Dotprompt) DumpDotpromptSchemas() {
 	fmt.Printf("External schema lookups: %d\n", len(dp.ExternalSchemaLookups))
 	fmt.Println("=========================")
 }
+
+// The output formats known to every Dotprompt instance.
+const (
+	OutputFormatJSON  = "json"
+	OutputFormatText  = "text"
+	OutputFormatEnum  = "enum"
+	OutputFormatArray = "array"
+	OutputFormatMedia = "media"
+)
+
+// OutputFormatValidator checks that the resolved output schema, which may be
+// nil, suits an output format, returning an error describing the mismatch.
+type OutputFormatValidator func(schema *jsonschema.Schema) error
+
+// builtinOutputFormats are the validators of the known output formats.
+var builtinOutputFormats = map[string]OutputFormatValidator{
+	OutputFormatJSON: func(schema *jsonschema.Schema) error {
+		if schema != nil && !isObjectSchema(schema) {
+			return fmt.Errorf("requires an object schema, got %s", describeSchemaType(schema))
+		}
+		return nil
+	},
+	OutputFormatText:  nil,
+	OutputFormatMedia: nil,
+	OutputFormatEnum: func(schema *jsonschema.Schema) error {
+		if schema == nil || len(schema.Enum) == 0 {
+			return fmt.Errorf("requires an enum schema, got %s", describeSchemaType(schema))
+		}
+		return nil
+	},
+	OutputFormatArray: func(schema *jsonschema.Schema) error {
+		if schema != nil && schema.Type != "array" {
+			return fmt.Errorf("requires an array schema, got %s", describeSchemaType(schema))
+		}
+		return nil
+	},
+}
+
+// isObjectSchema reports whether a schema describes objects: either its type
+// is "object", or it has no type but declares properties.
+func isObjectSchema(schema *jsonschema.Schema) bool {
+	if schema.Type == "object" {
+		return true
+	}
+	return schema.Type == "" && schema.Properties != nil
+}
+
+// describeSchemaType describes the type of a schema for error messages.
+func describeSchemaType(schema *jsonschema.Schema) string {
+	switch {
+	case schema == nil:
+		return "no schema"
+	case schema.Type == "":
+		return "a schema without a type"
+	default:
+		return fmt.Sprintf("type '%s'", schema.Type)
+	}
+}
+
+// DefineOutputFormat registers a custom output format, or replaces the
+// validator of a known one. A nil validator accepts any output schema.
+func (dp *Dotprompt) DefineOutputFormat(name string, validator OutputFormatValidator) {
+	if name == "" {
+		panic("dotprompt.DefineOutputFormat: output format name cannot be empty")
+	}
+	if dp.outputFormats == nil {
+		dp.outputFormats = make(map[string]OutputFormatValidator)
+	}
+	dp.outputFormats[name] = validator
+}
+
+// validateOutputFormat checks that the output format of the resolved metadata
+// is known and suits the output schema. Metadata without a format is valid.
+func (dp *Dotprompt) validateOutputFormat(meta PromptMetadata) error {
+	format := meta.Output.Format
+	if format == "" {
+		return nil
+	}
+	validator, ok := dp.outputFormats[format]
+	if !ok {
+		validator, ok = builtinOutputFormats[format]
+	}
+	if !ok {
+		return fmt.Errorf("dotprompt: unknown output format '%s'", format)
+	}
+	if validator == nil {
+		return nil
+	}
+	schema, _ := meta.Output.Schema.(*jsonschema.Schema)
+	if err := validator(schema); err != nil {
+		return fmt.Errorf("dotprompt: output format '%s' %w", format, err)
+	}
+	return nil
+}
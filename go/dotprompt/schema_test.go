@@ -17,9 +17,13 @@
 package dotprompt
 
 import (
+	"encoding/json"
+	"errors"
+	"reflect"
 	"testing"
 
 	"github.com/invopop/jsonschema"
+	orderedmap "github.com/wk8/go-ordered-map/v2"
 )
 
 func TestDefineSchema(t *testing.T) {
@@ -141,3 +145,289 @@ func TestResolveSchemaReferences(t *testing.T) {
 		t.Error("Expected error for non-existent schema, got nil")
 	}
 }
+
+func TestSchemaNames(t *testing.T) {
+	dp := NewDotprompt(nil)
+	if names := dp.SchemaNames(); len(names) != 0 {
+		t.Errorf("Expected no schema names, got %v", names)
+	}
+
+	dp.DefineSchema("Person", &jsonschema.Schema{Type: "object"})
+	dp.DefineSchema("Address", &jsonschema.Schema{Type: "object"})
+	dp.DefineSchema("Zip", &jsonschema.Schema{Type: "string"})
+	dp.RegisterExternalSchemaLookup(func(name string) any {
+		if name == "External" {
+			return &jsonschema.Schema{Type: "string"}
+		}
+		return nil
+	})
+
+	expected := []string{"Address", "Person", "Zip"}
+	if names := dp.SchemaNames(); !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected schema names %v, got %v", expected, names)
+	}
+
+	dp.LookupSchemaFromAnySource("External")
+	expected = []string{"Address", "External", "Person", "Zip"}
+	if names := dp.SchemaNames(); !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected schema names %v, got %v", expected, names)
+	}
+}
+
+func TestToolSchemaReferences(t *testing.T) {
+	weatherInput := &jsonschema.Schema{Type: "object", Description: "Weather input"}
+
+	t.Run("resolves registered tool schemas in rendered metadata", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{
+			Tools: map[string]ToolDefinition{
+				"weather": {Name: "weather", InputSchema: "WeatherInput"},
+			},
+		})
+		dp.DefineSchema("WeatherInput", weatherInput)
+
+		rendered, err := dp.Render("---\ntools: [weather]\n---\nWhat's the weather?", &DataArgument{}, nil)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(rendered.ToolDefs) != 1 {
+			t.Fatalf("Expected 1 tool definition, got %d", len(rendered.ToolDefs))
+		}
+		schema, ok := rendered.ToolDefs[0].InputSchema.(*jsonschema.Schema)
+		if !ok {
+			t.Fatalf("Expected input schema to be resolved, got %T", rendered.ToolDefs[0].InputSchema)
+		}
+		if schema.Type != "object" || schema.Description != "Weather input" {
+			t.Errorf("Expected resolved schema to match the registered schema, got %+v", schema)
+		}
+		if dp.tools["weather"].InputSchema != "WeatherInput" {
+			t.Errorf("Expected registered tool to be left unchanged, got %v", dp.tools["weather"].InputSchema)
+		}
+	})
+
+	t.Run("resolves frontmatter tool definition schemas", func(t *testing.T) {
+		dp := NewDotprompt(nil)
+		dp.DefineSchema("WeatherInput", weatherInput)
+
+		source := "---\ntoolDefs:\n  - name: weather\n    inputSchema: WeatherInput\n---\nHi"
+		rendered, err := dp.Render(source, &DataArgument{}, nil)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if _, ok := rendered.ToolDefs[0].InputSchema.(*jsonschema.Schema); !ok {
+			t.Errorf("Expected input schema to be resolved, got %T", rendered.ToolDefs[0].InputSchema)
+		}
+
+		_, err = dp.Render("---\ntoolDefs:\n  - name: weather\n    inputSchema: Missing\n---\nHi", &DataArgument{}, nil)
+		if err == nil {
+			t.Error("Expected error for unknown tool schema, got nil")
+		}
+	})
+
+	t.Run("resolves tool schemas in raw metadata", func(t *testing.T) {
+		dp := NewDotprompt(nil)
+		dp.DefineSchema("WeatherInput", weatherInput)
+
+		metadata := map[string]any{
+			"toolDefs": []any{
+				map[string]any{"name": "weather", "inputSchema": "WeatherInput"},
+			},
+		}
+		if err := dp.ResolveSchemaReferences(metadata); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		toolDef := metadata["toolDefs"].([]any)[0].(map[string]any)
+		if toolDef["inputSchema"] != weatherInput {
+			t.Errorf("Expected tool schema reference to be resolved, got %v", toolDef["inputSchema"])
+		}
+	})
+}
+
+func TestSchemaIdentifier(t *testing.T) {
+	source := `---
+name: greeting
+input:
+  schema:
+    name: string
+output:
+  schema: Reply
+---
+Hello {{name}}`
+	reply := &jsonschema.Schema{Type: "object"}
+
+	dp := NewDotprompt(&DotpromptOptions{SchemaIdentifier: DefaultSchemaIdentifier})
+	dp.DefineSchema("Reply", reply)
+	meta, err := dp.RenderMetadata(source, nil)
+	if err != nil {
+		t.Fatalf("RenderMetadata failed: %v", err)
+	}
+
+	input := meta.Input.Schema.(*jsonschema.Schema)
+	if input.ID != "greeting.input.json" || input.Title != "greeting input" {
+		t.Errorf("Expected input schema $id and title from the prompt name, got %q and %q", input.ID, input.Title)
+	}
+	output := meta.Output.Schema.(*jsonschema.Schema)
+	if output.ID != "greeting.output.json" || output.Title != "greeting output" {
+		t.Errorf("Expected output schema $id and title from the prompt name, got %q and %q", output.ID, output.Title)
+	}
+	if reply.ID != "" || reply.Title != "" {
+		t.Errorf("Expected registered schema to be unchanged, got %q and %q", reply.ID, reply.Title)
+	}
+
+	data, err := meta.InputSchemaJSON()
+	if err != nil {
+		t.Fatalf("InputSchemaJSON failed: %v", err)
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("Failed to unmarshal schema: %v", err)
+	}
+	if doc["$id"] != "greeting.input.json" || doc["title"] != "greeting input" {
+		t.Errorf("Expected exported schema to carry $id and title, got %v", doc)
+	}
+
+	dp = NewDotprompt(nil)
+	dp.DefineSchema("Reply", reply)
+	meta, err = dp.RenderMetadata(source, nil)
+	if err != nil {
+		t.Fatalf("RenderMetadata failed: %v", err)
+	}
+	if title := meta.Input.Schema.(*jsonschema.Schema).Title; title != "" {
+		t.Errorf("Expected no title without a SchemaIdentifier, got %q", title)
+	}
+}
+
+func TestSchemaCache(t *testing.T) {
+	source := `---
+input:
+  schema:
+    user: User
+output:
+  schema: User
+---
+Hello {{user.name}}`
+	calls := 0
+	resolver := func(name string) (*jsonschema.Schema, error) {
+		calls++
+		return &jsonschema.Schema{Type: "object", Description: "v1"}, nil
+	}
+
+	dp := NewDotprompt(&DotpromptOptions{SchemaResolver: resolver, CacheSchemas: true})
+	for range 3 {
+		meta, err := dp.RenderMetadata(source, nil)
+		if err != nil {
+			t.Fatalf("RenderMetadata failed: %v", err)
+		}
+		// Mutating a resolved schema must not affect the cached schema.
+		meta.Output.Schema.(*jsonschema.Schema).Description = "mutated"
+	}
+	if calls != 1 {
+		t.Errorf("Expected the resolver to be called once, got %d calls", calls)
+	}
+	meta, err := dp.RenderMetadata(source, nil)
+	if err != nil {
+		t.Fatalf("RenderMetadata failed: %v", err)
+	}
+	if got := meta.Output.Schema.(*jsonschema.Schema).Description; got != "v1" {
+		t.Errorf("Expected cached schema to be unchanged, got description %q", got)
+	}
+
+	dp.DefineSchema("User", &jsonschema.Schema{Type: "object", Description: "v2"})
+	meta, err = dp.RenderMetadata(source, nil)
+	if err != nil {
+		t.Fatalf("RenderMetadata failed: %v", err)
+	}
+	if got := meta.Output.Schema.(*jsonschema.Schema).Description; got != "v2" {
+		t.Errorf("Expected redefined schema after DefineSchema, got description %q", got)
+	}
+
+	delete(dp.Schemas, "User")
+	dp.ClearSchemaCache()
+	if _, err := dp.RenderMetadata(source, nil); err != nil {
+		t.Fatalf("RenderMetadata failed: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("Expected the resolver to be called again after ClearSchemaCache, got %d calls", calls)
+	}
+
+	uncached := NewDotprompt(&DotpromptOptions{SchemaResolver: resolver})
+	calls = 0
+	for range 2 {
+		if _, err := uncached.RenderMetadata(source, nil); err != nil {
+			t.Fatalf("RenderMetadata failed: %v", err)
+		}
+	}
+	if calls != 4 {
+		t.Errorf("Expected the resolver to be called on every render without caching, got %d calls", calls)
+	}
+}
+
+func TestOutputFormatValidation(t *testing.T) {
+	render := func(dp *Dotprompt, output string) error {
+		_, err := dp.RenderMetadata("---\noutput:\n"+output+"---\nHello", nil)
+		return err
+	}
+
+	properties := orderedmap.New[string, *jsonschema.Schema]()
+	properties.Set("name", &jsonschema.Schema{Type: "string"})
+	dp := NewDotprompt(&DotpromptOptions{Schemas: map[string]*jsonschema.Schema{
+		"Typeless": {Properties: properties},
+		"Anything": {},
+	}})
+	valid := []string{
+		"  format: json\n",
+		"  format: json\n  schema:\n    name: string\n",
+		"  format: text\n",
+		"  format: text\n  schema: string\n",
+		"  format: enum\n  schema:\n    type: string\n    enum: [yes, no]\n",
+		"  format: array\n  schema:\n    type: array\n    items:\n      type: string\n",
+		"  format: media\n",
+		"  format: json\n  schema: Typeless\n",
+		"  schema: string\n",
+	}
+	for _, output := range valid {
+		if err := render(dp, output); err != nil {
+			t.Errorf("Expected output %q to be valid, got %v", output, err)
+		}
+	}
+
+	invalid := map[string]string{
+		"  format: json\n  schema: string\n":           "dotprompt: output format 'json' requires an object schema, got type 'string'",
+		"  format: enum\n":                             "dotprompt: output format 'enum' requires an enum schema, got no schema",
+		"  format: enum\n  schema: string\n":           "dotprompt: output format 'enum' requires an enum schema, got type 'string'",
+		"  format: array\n  schema:\n    n: integer\n": "dotprompt: output format 'array' requires an array schema, got type 'object'",
+		"  format: jsonl\n":                            "dotprompt: unknown output format 'jsonl'",
+		"  format: json\n  schema: Anything\n":         "dotprompt: output format 'json' requires an object schema, got a schema without a type",
+	}
+	for output, expected := range invalid {
+		err := render(dp, output)
+		if err == nil || err.Error() != expected {
+			t.Errorf("Expected output %q to fail with %q, got %v", output, expected, err)
+		}
+	}
+	if _, err := dp.Render("---\noutput:\n  format: jsonl\n---\nHello", &DataArgument{}, nil); err == nil {
+		t.Errorf("Expected Render to fail for an unknown output format")
+	}
+
+	t.Run("custom formats", func(t *testing.T) {
+		dp := NewDotprompt(&DotpromptOptions{
+			OutputFormats: map[string]OutputFormatValidator{"jsonl": nil},
+		})
+		if err := render(dp, "  format: jsonl\n  schema: string\n"); err != nil {
+			t.Errorf("Expected registered format to be valid, got %v", err)
+		}
+
+		dp.DefineOutputFormat("image", func(schema *jsonschema.Schema) error {
+			if schema != nil {
+				return errors.New("takes no schema")
+			}
+			return nil
+		})
+		if err := render(dp, "  format: image\n"); err != nil {
+			t.Errorf("Expected defined format to be valid, got %v", err)
+		}
+		err := render(dp, "  format: image\n  schema: string\n")
+		if err == nil || err.Error() != "dotprompt: output format 'image' takes no schema" {
+			t.Errorf("Expected defined format validator to fail, got %v", err)
+		}
+	})
+}
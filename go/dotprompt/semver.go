@@ -0,0 +1,234 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package dotprompt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// semver is a parsed semantic version of the form
+// `MAJOR.MINOR.PATCH[-PRERELEASE][+BUILD]`. Build metadata is ignored.
+type semver struct {
+	major, minor, patch int
+	prerelease          string
+}
+
+// parseSemver parses a semantic version, with or without a leading `v`.
+func parseSemver(s string) (semver, bool) {
+	s = strings.TrimPrefix(s, "v")
+	s, _, _ = strings.Cut(s, "+")
+	s, pre, _ := strings.Cut(s, "-")
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return semver{}, false
+	}
+	var nums [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return semver{}, false
+		}
+		nums[i] = n
+	}
+	return semver{major: nums[0], minor: nums[1], patch: nums[2], prerelease: pre}, true
+}
+
+// compare returns -1, 0, or 1 as v is less than, equal to, or greater than
+// other. A pre-release sorts before the release it precedes.
+func (v semver) compare(other semver) int {
+	for _, d := range [3]int{v.major - other.major, v.minor - other.minor, v.patch - other.patch} {
+		if d < 0 {
+			return -1
+		}
+		if d > 0 {
+			return 1
+		}
+	}
+	switch {
+	case v.prerelease == other.prerelease:
+		return 0
+	case v.prerelease == "":
+		return 1
+	case other.prerelease == "":
+		return -1
+	case v.prerelease < other.prerelease:
+		return -1
+	default:
+		return 1
+	}
+}
+
+// semverComparator is a single constraint in a semverRange, e.g. `>=1.2.0`.
+type semverComparator struct {
+	op      string
+	version semver
+}
+
+// matches reports whether v satisfies the comparator.
+func (c semverComparator) matches(v semver) bool {
+	cmp := v.compare(c.version)
+	switch c.op {
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	default:
+		return cmp == 0
+	}
+}
+
+// semverRange is a set of comparators that a version must all satisfy.
+type semverRange []semverComparator
+
+// isSemverRange reports whether s is written as a range rather than an exact
+// version, i.e. it uses an operator, a wildcard, or several comparators.
+func isSemverRange(s string) bool {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return false
+	}
+	if strings.ContainsAny(s[:1], "^~<>=") || strings.Contains(s, " ") {
+		return true
+	}
+	for _, part := range strings.Split(s, ".") {
+		if part == "x" || part == "X" || part == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSemverRange parses a space-separated list of comparators. Each may be
+// a caret (`^1.2.0`), tilde (`~1.2.0`), or comparison (`>=1.2.0`) range, or a
+// version with `x` wildcards (`1.2.x`).
+func parseSemverRange(s string) (semverRange, error) {
+	var r semverRange
+	for _, field := range strings.Fields(s) {
+		comparators, err := parseSemverComparator(field)
+		if err != nil {
+			return nil, fmt.Errorf("dotprompt: invalid version range %q: %w", s, err)
+		}
+		r = append(r, comparators...)
+	}
+	if len(r) == 0 {
+		return nil, fmt.Errorf("dotprompt: invalid version range %q", s)
+	}
+	return r, nil
+}
+
+// parseSemverComparator expands a single range term into the comparators it
+// stands for.
+func parseSemverComparator(term string) ([]semverComparator, error) {
+	for _, op := range []string{">=", "<=", ">", "<", "="} {
+		if rest, ok := strings.CutPrefix(term, op); ok {
+			v, ok := parseSemver(rest)
+			if !ok {
+				return nil, fmt.Errorf("invalid version %q", rest)
+			}
+			return []semverComparator{{op: op, version: v}}, nil
+		}
+	}
+
+	if rest, ok := strings.CutPrefix(term, "^"); ok {
+		v, ok := parseSemver(rest)
+		if !ok {
+			return nil, fmt.Errorf("invalid version %q", rest)
+		}
+		var upper semver
+		switch {
+		case v.major > 0:
+			upper = semver{major: v.major + 1}
+		case v.minor > 0:
+			upper = semver{minor: v.minor + 1}
+		default:
+			upper = semver{patch: v.patch + 1}
+		}
+		return []semverComparator{{op: ">=", version: v}, {op: "<", version: upper}}, nil
+	}
+	if rest, ok := strings.CutPrefix(term, "~"); ok {
+		v, ok := parseSemver(rest)
+		if !ok {
+			return nil, fmt.Errorf("invalid version %q", rest)
+		}
+		upper := semver{major: v.major, minor: v.minor + 1}
+		return []semverComparator{{op: ">=", version: v}, {op: "<", version: upper}}, nil
+	}
+
+	// Wildcards, e.g. `1.x` or `1.2.*`.
+	parts := strings.Split(strings.TrimPrefix(term, "v"), ".")
+	var nums []int
+	for _, part := range parts {
+		if part == "x" || part == "X" || part == "*" {
+			break
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid version %q", term)
+		}
+		nums = append(nums, n)
+	}
+	switch len(nums) {
+	case 0:
+		return []semverComparator{{op: ">=", version: semver{}}}, nil
+	case 1:
+		return []semverComparator{
+			{op: ">=", version: semver{major: nums[0]}},
+			{op: "<", version: semver{major: nums[0] + 1}},
+		}, nil
+	case 2:
+		return []semverComparator{
+			{op: ">=", version: semver{major: nums[0], minor: nums[1]}},
+			{op: "<", version: semver{major: nums[0], minor: nums[1] + 1}},
+		}, nil
+	}
+	v, ok := parseSemver(term)
+	if !ok {
+		return nil, fmt.Errorf("invalid version %q", term)
+	}
+	return []semverComparator{{op: "=", version: v}}, nil
+}
+
+// matches reports whether v satisfies every comparator in the range.
+// Pre-release versions only match ranges that name a pre-release of the same
+// major, minor, and patch version.
+func (r semverRange) matches(v semver) bool {
+	if v.prerelease != "" {
+		allowed := false
+		for _, c := range r {
+			if c.version.prerelease != "" && c.version.major == v.major &&
+				c.version.minor == v.minor && c.version.patch == v.patch {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	for _, c := range r {
+		if !c.matches(v) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,67 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package dotprompt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSemverRange(t *testing.T) {
+	tests := []struct {
+		rangeStr string
+		version  string
+		want     bool
+	}{
+		{"^1.2.0", "1.2.0", true},
+		{"^1.2.0", "1.9.3", true},
+		{"^1.2.0", "2.0.0", false},
+		{"^1.2.0", "1.1.9", false},
+		{"^0.2.0", "0.2.5", true},
+		{"^0.2.0", "0.3.0", false},
+		{"~1.2.0", "1.2.9", true},
+		{"~1.2.0", "1.3.0", false},
+		{">=1.0.0 <1.5.0", "1.4.9", true},
+		{">=1.0.0 <1.5.0", "1.5.0", false},
+		{"1.x", "1.7.0", true},
+		{"1.2.*", "1.3.0", false},
+		{"^1.0.0", "1.1.0-beta", false},
+		{">=1.1.0-alpha", "1.1.0-beta", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rangeStr+" "+tt.version, func(t *testing.T) {
+			r, err := parseSemverRange(tt.rangeStr)
+			assert.NoError(t, err)
+			v, ok := parseSemver(tt.version)
+			assert.True(t, ok)
+			assert.Equal(t, tt.want, r.matches(v))
+		})
+	}
+
+	t.Run("distinguishes ranges from exact versions", func(t *testing.T) {
+		assert.True(t, isSemverRange("^1.0.0"))
+		assert.True(t, isSemverRange("1.x"))
+		assert.False(t, isSemverRange("1.0.0"))
+		assert.False(t, isSemverRange("deadbeef"))
+	})
+
+	t.Run("rejects invalid ranges", func(t *testing.T) {
+		_, err := parseSemverRange("^one")
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,358 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package dotprompt
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// PromptFileExtension is the file extension of prompt and partial files.
+const PromptFileExtension = ".prompt"
+
+// promptFilenameRegex matches prompt filenames of the form
+// `name[.variant][@version].prompt`.
+var promptFilenameRegex = regexp.MustCompile(`^([^.@]+)(?:\.([^.@]+))?(?:@([^@]+))?\.prompt$`)
+
+// fsStoreEntry is a prompt or partial loaded into an FSPromptStore.
+type fsStoreEntry struct {
+	name    string
+	variant string
+	version string
+	source  string
+	parsed  ParsedPrompt
+}
+
+// FSPromptStore is a read-only PromptStore backed by an fs.FS, such as an
+// embed.FS populated via `//go:embed`.
+//
+// All `.prompt` files are read and parsed once when the store is loaded, so
+// loading a prompt never touches the file system or re-parses its source.
+//
+// Files follow the naming convention `[name](.[variant]).prompt`. Partials use
+// the same convention prefixed with an underscore: `_[name](.[variant]).prompt`.
+// Subdirectories form part of the name, e.g. a prompt `bar` in directory `foo`
+// is named `foo/bar`. Versions are the first 8 hex characters of the SHA1 hash
+// of the file content, unless the filename carries an explicit version as in
+// `name[.variant]@1.2.0.prompt`, which lets the store hold several versions of
+// a prompt.
+//
+// Loading with a semver range such as `^1.2.0` resolves to the highest
+// matching version; any other version must match exactly. Loading without a
+// version returns the highest semver version when there are several.
+type FSPromptStore struct {
+	prompts  []*fsStoreEntry
+	partials []*fsStoreEntry
+}
+
+var _ PromptStore = (*FSPromptStore)(nil)
+
+// LoadFromFS reads and parses all `.prompt` files under root in fsys into a
+// new FSPromptStore.
+func LoadFromFS(fsys fs.FS, root string) (*FSPromptStore, error) {
+	return LoadFromFSWithOptions(fsys, root, nil)
+}
+
+// LoadFromFS reads and parses all `.prompt` files under root in fsys into a
+// new FSPromptStore, parsing them with the instance's frontmatter options
+// just as Parse does.
+func (dp *Dotprompt) LoadFromFS(fsys fs.FS, root string) (*FSPromptStore, error) {
+	return LoadFromFSWithOptions(fsys, root, dp.parseOptions())
+}
+
+// LoadFromFSWithOptions loads a store like LoadFromFS, parsing each prompt
+// with ParseDocumentWithOptions and the given options.
+func LoadFromFSWithOptions(fsys fs.FS, root string, options *ParseOptions) (*FSPromptStore, error) {
+	if root == "" {
+		root = "."
+	}
+	store := &FSPromptStore{}
+	err := fs.WalkDir(fsys, root, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), PromptFileExtension) {
+			return nil
+		}
+
+		content, err := fs.ReadFile(fsys, filePath)
+		if err != nil {
+			return err
+		}
+
+		filename := d.Name()
+		isPartial := strings.HasPrefix(filename, "_")
+		name, variant, version, err := parsePromptFilename(strings.TrimPrefix(filename, "_"))
+		if err != nil {
+			return err
+		}
+		rel, err := relativePath(root, path.Dir(filePath))
+		if err != nil {
+			return err
+		}
+		if rel != "" {
+			name = rel + "/" + name
+		}
+
+		source := string(content)
+		if version == "" {
+			version = calculateVersion(source)
+		}
+		entry := &fsStoreEntry{
+			name:    name,
+			variant: variant,
+			version: version,
+			source:  source,
+		}
+		if isPartial {
+			store.partials = append(store.partials, entry)
+			return nil
+		}
+
+		entry.parsed, err = ParseDocumentWithOptions(source, options)
+		if err != nil {
+			return fmt.Errorf("dotprompt: failed to parse %s: %w", filePath, err)
+		}
+		entry.parsed.SourcePath = filePath
+		store.prompts = append(store.prompts, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// ParseFiles reads and parses each of the paths in fsys, returning the parsed
+// prompts and the errors keyed by path. Every path appears in exactly one of
+// the two maps, so all problems can be reported at once rather than stopping
+// at the first. Frontmatter is parsed strictly, so malformed YAML is reported
+// as an error rather than being treated as part of the template.
+func ParseFiles(fsys fs.FS, paths []string) (map[string]*ParsedPrompt, map[string]error) {
+	parsed := make(map[string]*ParsedPrompt)
+	errs := make(map[string]error)
+	for _, filePath := range paths {
+		content, err := fs.ReadFile(fsys, filePath)
+		if err != nil {
+			errs[filePath] = err
+			continue
+		}
+		prompt, err := ParseDocumentWithOptions(string(content), &ParseOptions{Strict: true})
+		if err != nil {
+			errs[filePath] = fmt.Errorf("dotprompt: failed to parse %s: %w", filePath, err)
+			continue
+		}
+		prompt.SourcePath = filePath
+		parsed[filePath] = &prompt
+	}
+	return parsed, errs
+}
+
+// List returns references to all prompts in the store.
+//
+// Pagination options are accepted for interface compatibility but all prompts
+// are returned in a single page.
+func (s *FSPromptStore) List(options ListPromptsOptions) (ListPromptsResult[PromptRef], error) {
+	refs := make([]PromptRef, 0, len(s.prompts))
+	for _, entry := range s.prompts {
+		refs = append(refs, PromptRef{Name: entry.name, Variant: entry.variant, Version: entry.version})
+	}
+	return ListPromptsResult[PromptRef]{Items: refs}, nil
+}
+
+// ListPartials returns references to all partials in the store.
+//
+// Pagination options are accepted for interface compatibility but all
+// partials are returned in a single page.
+func (s *FSPromptStore) ListPartials(options ListPartialsOptions) (ListPartialsResult[PartialRef], error) {
+	refs := make([]PartialRef, 0, len(s.partials))
+	for _, entry := range s.partials {
+		refs = append(refs, PartialRef{Name: entry.name, Variant: entry.variant, Version: entry.version})
+	}
+	return ListPartialsResult[PartialRef]{Items: refs}, nil
+}
+
+// Load retrieves the source of a prompt from the store. Use LoadParsed to get
+// the prompt as parsed when the store was loaded.
+func (s *FSPromptStore) Load(name string, options LoadPromptOptions) (PromptData, error) {
+	entry, err := findStoreEntry(s.prompts, "prompt", name, options.Variant, options.Version)
+	if err != nil {
+		return PromptData{}, err
+	}
+	return PromptData{
+		PromptRef: PromptRef{Name: entry.name, Variant: entry.variant, Version: entry.version},
+		Source:    entry.source,
+	}, nil
+}
+
+// LoadPartial retrieves a partial from the store.
+func (s *FSPromptStore) LoadPartial(name string, options LoadPartialOptions) (PartialData, error) {
+	entry, err := findStoreEntry(s.partials, "partial", name, options.Variant, options.Version)
+	if err != nil {
+		return PartialData{}, err
+	}
+	return PartialData{
+		PartialRef: PartialRef{Name: entry.name, Variant: entry.variant, Version: entry.version},
+		Source:     entry.source,
+	}, nil
+}
+
+// LoadParsed retrieves the cached ParsedPrompt for a prompt in the store. The
+// result is a deep copy, so callers may modify it without affecting the
+// cache. Render it with Dotprompt.RenderParsed to avoid parsing it again.
+func (s *FSPromptStore) LoadParsed(name string, options LoadPromptOptions) (ParsedPrompt, error) {
+	entry, err := findStoreEntry(s.prompts, "prompt", name, options.Variant, options.Version)
+	if err != nil {
+		return ParsedPrompt{}, err
+	}
+	return copyParsedPrompt(entry.parsed), nil
+}
+
+// copyParsedPrompt deep-copies the maps, slices, and schemas of a prompt.
+func copyParsedPrompt(parsed ParsedPrompt) ParsedPrompt {
+	parsed.PromptMetadata = copyPromptMetadata(parsed.PromptMetadata)
+	return parsed
+}
+
+// copyPromptMetadata deep-copies the maps, slices, and schemas of metadata.
+func copyPromptMetadata(metadata PromptMetadata) PromptMetadata {
+	metadata.Metadata = deepCopyMap(metadata.Metadata)
+	metadata.Tools = slices.Clone(metadata.Tools)
+	if metadata.ToolDefs != nil {
+		toolDefs := make([]ToolDefinition, len(metadata.ToolDefs))
+		for i, def := range metadata.ToolDefs {
+			def.InputSchema = deepCopyValue(def.InputSchema)
+			def.OutputSchema = deepCopyValue(def.OutputSchema)
+			toolDefs[i] = def
+		}
+		metadata.ToolDefs = toolDefs
+	}
+	metadata.Config = deepCopyMap(metadata.Config)
+	metadata.Input.Default = deepCopyMap(metadata.Input.Default)
+	metadata.Input.Schema = deepCopyValue(metadata.Input.Schema)
+	metadata.Output.Schema = deepCopyValue(metadata.Output.Schema)
+	if metadata.Examples != nil {
+		examples := make([]map[string]any, len(metadata.Examples))
+		for i, example := range metadata.Examples {
+			examples[i] = deepCopyMap(example)
+		}
+		metadata.Examples = examples
+	}
+	metadata.Raw = deepCopyMap(metadata.Raw)
+	if metadata.Ext != nil {
+		ext := make(map[string]map[string]any, len(metadata.Ext))
+		for namespace, fields := range metadata.Ext {
+			ext[namespace] = deepCopyMap(fields)
+		}
+		metadata.Ext = ext
+	}
+	return metadata
+}
+
+// findStoreEntry finds the entry matching the name, variant, and (if set)
+// version. A version written as a semver range resolves to the highest
+// matching version.
+func findStoreEntry(entries []*fsStoreEntry, kind, name, variant, version string) (*fsStoreEntry, error) {
+	var versionRange semverRange
+	if isSemverRange(version) {
+		r, err := parseSemverRange(version)
+		if err != nil {
+			return nil, err
+		}
+		versionRange = r
+	}
+
+	var found *fsStoreEntry
+	for _, entry := range entries {
+		if entry.name != name || entry.variant != variant {
+			continue
+		}
+		if versionRange != nil {
+			v, ok := parseSemver(entry.version)
+			if !ok || !versionRange.matches(v) {
+				continue
+			}
+		} else if version != "" && entry.version != version {
+			continue
+		}
+		if found == nil || newerEntry(entry, found) {
+			found = entry
+		}
+	}
+	if found != nil {
+		return found, nil
+	}
+	if version != "" {
+		return nil, fmt.Errorf("dotprompt: %s %q (variant %q) version %q not found", kind, name, variant, version)
+	}
+	return nil, fmt.Errorf("dotprompt: %s %q (variant %q) not found", kind, name, variant)
+}
+
+// newerEntry reports whether a has a higher semver version than b. Entries
+// without a semver version never replace an earlier match.
+func newerEntry(a, b *fsStoreEntry) bool {
+	va, ok := parseSemver(a.version)
+	if !ok {
+		return false
+	}
+	vb, ok := parseSemver(b.version)
+	if !ok {
+		return true
+	}
+	return va.compare(vb) > 0
+}
+
+// parsePromptFilename extracts the name and optional variant and version from
+// a filename of the form `name[.variant][@version].prompt`.
+func parsePromptFilename(filename string) (string, string, string, error) {
+	match := promptFilenameRegex.FindStringSubmatch(filename)
+	if match == nil {
+		return "", "", "", fmt.Errorf("dotprompt: invalid prompt filename format: %s", filename)
+	}
+	return match[1], match[2], match[3], nil
+}
+
+// relativePath returns dir relative to root, or an empty string when they are
+// the same directory.
+func relativePath(root, dir string) (string, error) {
+	if root == "." {
+		if dir == "." {
+			return "", nil
+		}
+		return dir, nil
+	}
+	if dir == root {
+		return "", nil
+	}
+	if !strings.HasPrefix(dir, root+"/") {
+		return "", fmt.Errorf("dotprompt: %s is not within %s", dir, root)
+	}
+	return strings.TrimPrefix(dir, root+"/"), nil
+}
+
+// calculateVersion returns the first 8 hex characters of the SHA1 hash of the
+// content.
+func calculateVersion(content string) string {
+	sum := sha1.Sum([]byte(content))
+	return hex.EncodeToString(sum[:])[:8]
+}
@@ -0,0 +1,238 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package dotprompt
+
+import (
+	"bytes"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/goccy/go-yaml"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestFS() fstest.MapFS {
+	return fstest.MapFS{
+		"prompts/greeting.prompt": &fstest.MapFile{
+			Data: []byte("---\nmodel: test/model\n---\nHello {{name}}!"),
+		},
+		"prompts/greeting.formal.prompt": &fstest.MapFile{
+			Data: []byte("---\nmodel: test/model\n---\nGood day, {{name}}."),
+		},
+		"prompts/support/triage.prompt": &fstest.MapFile{
+			Data: []byte("Triage this: {{ticket}}"),
+		},
+		"prompts/_header.prompt": &fstest.MapFile{
+			Data: []byte("You are a helpful assistant."),
+		},
+		"prompts/README.md": &fstest.MapFile{
+			Data: []byte("not a prompt"),
+		},
+	}
+}
+
+func TestLoadFromFS(t *testing.T) {
+	fsys := newTestFS()
+	store, err := LoadFromFS(fsys, "prompts")
+	assert.NoError(t, err)
+
+	t.Run("lists all prompts and partials", func(t *testing.T) {
+		prompts, err := store.List(ListPromptsOptions{})
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []PromptRef{
+			{Name: "greeting", Version: calculateVersion("---\nmodel: test/model\n---\nHello {{name}}!")},
+			{Name: "greeting", Variant: "formal", Version: calculateVersion("---\nmodel: test/model\n---\nGood day, {{name}}.")},
+			{Name: "support/triage", Version: calculateVersion("Triage this: {{ticket}}")},
+		}, prompts.Items)
+
+		partials, err := store.ListPartials(ListPartialsOptions{})
+		assert.NoError(t, err)
+		assert.Len(t, partials.Items, 1)
+		assert.Equal(t, "header", partials.Items[0].Name)
+	})
+
+	t.Run("loads prompts, variants and partials", func(t *testing.T) {
+		data, err := store.Load("greeting", LoadPromptOptions{Variant: "formal"})
+		assert.NoError(t, err)
+		assert.Equal(t, "formal", data.Variant)
+		assert.Contains(t, data.Source, "Good day")
+
+		parsed, err := store.LoadParsed("support/triage", LoadPromptOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, "Triage this: {{ticket}}", parsed.Template)
+		assert.Equal(t, "prompts/support/triage.prompt", parsed.SourcePath)
+
+		partial, err := store.LoadPartial("header", LoadPartialOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, "You are a helpful assistant.", partial.Source)
+	})
+
+	t.Run("serves cached results without reading the file system", func(t *testing.T) {
+		delete(fsys, "prompts/greeting.prompt")
+
+		parsed, err := store.LoadParsed("greeting", LoadPromptOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, "test/model", parsed.Model)
+		assert.Equal(t, "Hello {{name}}!", parsed.Template)
+	})
+
+	t.Run("returns copies of cached prompts", func(t *testing.T) {
+		parsed, err := store.LoadParsed("greeting", LoadPromptOptions{Variant: "formal"})
+		assert.NoError(t, err)
+		parsed.Raw["model"] = "other/model"
+		parsed.Template = "Changed"
+
+		again, err := store.LoadParsed("greeting", LoadPromptOptions{Variant: "formal"})
+		assert.NoError(t, err)
+		assert.Equal(t, "test/model", again.Raw["model"])
+		assert.Equal(t, "Good day, {{name}}.", again.Template)
+	})
+
+	t.Run("renders cached prompts", func(t *testing.T) {
+		parsed, err := store.LoadParsed("greeting", LoadPromptOptions{Variant: "formal"})
+		assert.NoError(t, err)
+		rendered, err := NewDotprompt(nil).RenderParsed(parsed, &DataArgument{Input: map[string]any{"name": "Ada"}}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "test/model", rendered.Model)
+		assert.Equal(t, "Good day, Ada.", rendered.Messages[0].Content[0].(*TextPart).Text)
+	})
+
+	t.Run("returns an error for unknown prompts and versions", func(t *testing.T) {
+		_, err := store.Load("missing", LoadPromptOptions{})
+		assert.Error(t, err)
+
+		_, err = store.Load("greeting", LoadPromptOptions{Version: "deadbeef"})
+		assert.Error(t, err)
+	})
+}
+
+func TestLoadFromFSInvalidFilename(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.b.c.prompt": &fstest.MapFile{Data: []byte("Hello")},
+	}
+	_, err := LoadFromFS(fsys, ".")
+	assert.Error(t, err)
+}
+
+func TestLoadFromFSParseOptions(t *testing.T) {
+	fsys := fstest.MapFS{
+		"broken.prompt": &fstest.MapFile{Data: []byte("---\ninput: [\n---\nHello")},
+	}
+
+	store, err := LoadFromFS(fsys, ".")
+	assert.NoError(t, err)
+	parsed, err := store.LoadParsed("broken", LoadPromptOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "---\ninput: [\n---\nHello", parsed.Template)
+
+	dp := NewDotprompt(&DotpromptOptions{StrictFrontmatter: true})
+	_, err = dp.LoadFromFS(fsys, ".")
+	assert.ErrorContains(t, err, "failed to parse broken.prompt")
+
+	decoder := func(data []byte, v any) error {
+		return yaml.Unmarshal(bytes.ReplaceAll(data, []byte("modle:"), []byte("model:")), v)
+	}
+	fsys = fstest.MapFS{
+		"typo.prompt": &fstest.MapFile{Data: []byte("---\nmodle: test/model\n---\nHello")},
+	}
+	store, err = NewDotprompt(&DotpromptOptions{FrontmatterDecoder: decoder}).LoadFromFS(fsys, ".")
+	assert.NoError(t, err)
+	parsed, err = store.LoadParsed("typo", LoadPromptOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "test/model", parsed.Model)
+}
+
+func TestLoadFromFSVersions(t *testing.T) {
+	fsys := fstest.MapFS{
+		"greeting@1.2.0.prompt": &fstest.MapFile{Data: []byte("Hello v1.2.0")},
+		"greeting@1.4.1.prompt": &fstest.MapFile{Data: []byte("Hello v1.4.1")},
+		"greeting@2.0.0.prompt": &fstest.MapFile{Data: []byte("Hello v2.0.0")},
+		"_footer@1.0.0.prompt":  &fstest.MapFile{Data: []byte("Bye")},
+	}
+	store, err := LoadFromFS(fsys, ".")
+	assert.NoError(t, err)
+
+	t.Run("resolves a caret range to the highest matching version", func(t *testing.T) {
+		data, err := store.Load("greeting", LoadPromptOptions{Version: "^1.2.0"})
+		assert.NoError(t, err)
+		assert.Equal(t, "1.4.1", data.Version)
+		assert.Equal(t, "Hello v1.4.1", data.Source)
+	})
+
+	t.Run("loads an exact version", func(t *testing.T) {
+		data, err := store.Load("greeting", LoadPromptOptions{Version: "1.2.0"})
+		assert.NoError(t, err)
+		assert.Equal(t, "Hello v1.2.0", data.Source)
+	})
+
+	t.Run("loads the highest version when none is given", func(t *testing.T) {
+		parsed, err := store.LoadParsed("greeting", LoadPromptOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, "Hello v2.0.0", parsed.Template)
+	})
+
+	t.Run("resolves partial versions", func(t *testing.T) {
+		partial, err := store.LoadPartial("footer", LoadPartialOptions{Version: "~1.0.0"})
+		assert.NoError(t, err)
+		assert.Equal(t, "1.0.0", partial.Version)
+	})
+
+	t.Run("returns an error when no version matches", func(t *testing.T) {
+		_, err := store.Load("greeting", LoadPromptOptions{Version: "^3.0.0"})
+		assert.ErrorContains(t, err, `version "^3.0.0" not found`)
+
+		_, err = store.Load("greeting", LoadPromptOptions{Version: "1.3.0"})
+		assert.Error(t, err)
+	})
+}
+
+func TestParseFiles(t *testing.T) {
+	fsys := newTestFS()
+	fsys["prompts/broken.prompt"] = &fstest.MapFile{
+		Data: []byte("---\nmodel: [unclosed\n---\nHello"),
+	}
+
+	parsed, errs := ParseFiles(fsys, []string{
+		"prompts/greeting.prompt",
+		"prompts/support/triage.prompt",
+		"prompts/broken.prompt",
+		"prompts/missing.prompt",
+	})
+
+	assert.Len(t, parsed, 2)
+	assert.Equal(t, "test/model", parsed["prompts/greeting.prompt"].Model)
+	assert.Equal(t, "Hello {{name}}!", parsed["prompts/greeting.prompt"].Template)
+	assert.Equal(t, "Triage this: {{ticket}}", parsed["prompts/support/triage.prompt"].Template)
+	assert.Equal(t, "prompts/greeting.prompt", parsed["prompts/greeting.prompt"].SourcePath)
+
+	assert.Len(t, errs, 2)
+	assert.ErrorContains(t, errs["prompts/broken.prompt"], "failed to parse prompts/broken.prompt")
+	assert.ErrorIs(t, errs["prompts/missing.prompt"], fs.ErrNotExist)
+
+	t.Run("prompts parsed from strings have no source path", func(t *testing.T) {
+		parsed, err := ParseDocument("Hello")
+		assert.NoError(t, err)
+		assert.Empty(t, parsed.SourcePath)
+	})
+
+	t.Run("no paths", func(t *testing.T) {
+		parsed, errs := ParseFiles(fsys, nil)
+		assert.Empty(t, parsed)
+		assert.Empty(t, errs)
+	})
+}
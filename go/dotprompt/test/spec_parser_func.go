@@ -17,7 +17,7 @@
 package dotprompt
 
 import (
-	"fmt"
+	"encoding/json"
 	"testing"
 
 	"github.com/goccy/go-yaml"
@@ -243,81 +243,13 @@ func convertContents(t *testing.T, rawContents []any) []dp.Part {
 
 // convertContent converts a raw content map into a Part object.
 func convertContent(t *testing.T, content map[string]any) dp.Part {
-	partData, err := yaml.Marshal(content)
+	partData, err := json.Marshal(content)
 	if err != nil {
 		t.Fatalf("Failed to marshal content: %v", err)
 	}
-
-	var part dp.Part
-	if textPart := unmarshalTextPart(partData); textPart != nil {
-		part = textPart
-	} else if dataPart := unmarshalDataPart(partData); dataPart != nil {
-		part = dataPart
-	} else if mediaPart := unmarshalMediaPart(partData); mediaPart != nil {
-		part = mediaPart
-	} else if toolRequestPart := unmarshalToolRequestPart(partData); toolRequestPart != nil {
-		part = toolRequestPart
-	} else if toolResponsePart := unmarshalToolResponsePart(partData); toolResponsePart != nil {
-		part = toolResponsePart
-	} else if pendingPart := unmarshalPendingPart(partData); pendingPart != nil {
-		part = pendingPart
-	} else {
-		fmt.Println("Unknown part type")
-		return nil
+	part, err := dp.UnmarshalPart(partData)
+	if err != nil {
+		t.Fatalf("Failed to convert content: %v", err)
 	}
 	return part
 }
-
-// unmarshalTextPart unmarshals data into a TextPart object if possible.
-func unmarshalTextPart(data []byte) *dp.TextPart {
-	var textPart dp.TextPart
-	if err := yaml.Unmarshal(data, &textPart); err == nil && textPart.Text != "" {
-		return &textPart
-	}
-	return nil
-}
-
-// unmarshalDataPart unmarshals data into a DataPart object if possible.
-func unmarshalDataPart(data []byte) *dp.DataPart {
-	var dataPart dp.DataPart
-	if err := yaml.Unmarshal(data, &dataPart); err == nil && dataPart.Data != nil {
-		return &dataPart
-	}
-	return nil
-}
-
-// unmarshalMediaPart unmarshals data into a MediaPart object if possible.
-func unmarshalMediaPart(data []byte) *dp.MediaPart {
-	var mediaPart dp.MediaPart
-	if err := yaml.Unmarshal(data, &mediaPart); err == nil && mediaPart.Media.URL != "" {
-		return &mediaPart
-	}
-	return nil
-}
-
-// unmarshalToolRequestPart unmarshals data into a ToolRequestPart object if possible.
-func unmarshalToolRequestPart(data []byte) *dp.ToolRequestPart {
-	var toolRequestPart dp.ToolRequestPart
-	if err := yaml.Unmarshal(data, &toolRequestPart); err == nil && toolRequestPart.ToolRequest != nil {
-		return &toolRequestPart
-	}
-	return nil
-}
-
-// unmarshalToolResponsePart unmarshals data into a ToolResponsePart object if possible.
-func unmarshalToolResponsePart(data []byte) *dp.ToolResponsePart {
-	var toolResponsePart dp.ToolResponsePart
-	if err := yaml.Unmarshal(data, &toolResponsePart); err == nil && toolResponsePart.ToolResponse != nil {
-		return &toolResponsePart
-	}
-	return nil
-}
-
-// unmarshalPendingPart unmarshals data into a PendingPart object if possible.
-func unmarshalPendingPart(data []byte) *dp.PendingPart {
-	var pendingPart dp.PendingPart
-	if err := yaml.Unmarshal(data, &pendingPart); err == nil {
-		return &pendingPart
-	}
-	return nil
-}
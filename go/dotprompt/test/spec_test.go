@@ -211,9 +211,7 @@ func pruneResult(t *testing.T, result PromptMetadata) map[string]any {
 		inputMap := make(map[string]any)
 		if result.Input.Schema != nil {
 			if inputSchema, ok := result.Output.Schema.(*jsonschema.Schema); ok {
-				rawInput, _ := result.Raw["output"].(map[string]any)
-				rawSchema, _ := rawInput["schema"].(map[string]any)
-				inputMap["schema"] = pruneSchema(inputSchema, rawSchema)
+				inputMap["schema"] = pruneSchema(inputSchema)
 			}
 		}
 		if result.Input.Default != nil {
@@ -225,9 +223,7 @@ func pruneResult(t *testing.T, result PromptMetadata) map[string]any {
 		outputMap := make(map[string]any)
 		if result.Output.Schema != nil {
 			if outputSchema, ok := result.Output.Schema.(*jsonschema.Schema); ok {
-				rawOutput, _ := result.Raw["output"].(map[string]any)
-				rawSchema, _ := rawOutput["schema"].(map[string]any)
-				outputMap["schema"] = pruneSchema(outputSchema, rawSchema)
+				outputMap["schema"] = pruneSchema(outputSchema)
 			}
 		}
 		if result.Output.Format != "" {
@@ -322,7 +318,7 @@ func pruneContent(content []Part) []map[string]any {
 	return pruned
 }
 
-func pruneSchema(schema *jsonschema.Schema, rawSchema map[string]any) map[string]any {
+func pruneSchema(schema *jsonschema.Schema) map[string]any {
 	schemaMap := make(map[string]any)
 	if len(schema.AnyOf) != 0 {
 		schemaMap["type"] = []string{}
@@ -342,22 +338,19 @@ func pruneSchema(schema *jsonschema.Schema, rawSchema map[string]any) map[string
 		schemaMap["description"] = schema.Description
 	}
 	if schema.Items != nil {
-		schemaMap["items"] = pruneSchema(schema.Items, rawSchema)
+		schemaMap["items"] = pruneSchema(schema.Items)
 	}
 
 	if schema.Type == "object" {
-		if schema.AdditionalProperties == nil {
-			if rawSchema != nil {
-				schemaBytes, _ := json.Marshal(rawSchema)
-				schemaJSON := &jsonschema.Schema{}
-				_ = json.Unmarshal(schemaBytes, schemaJSON)
-				// Validate that all fields in schemaMap are present in schemaJSON
-				if err := ValidateSchemaFields(rawSchema, schemaJSON); err != nil {
-					schemaMap["additionalProperties"] = false
-				}
+		if schema.AdditionalProperties != nil {
+			// Boolean schemas such as `additionalProperties: false` marshal to
+			// a bare value.
+			var allowed bool
+			if data, _ := json.Marshal(schema.AdditionalProperties); json.Unmarshal(data, &allowed) == nil {
+				schemaMap["additionalProperties"] = allowed
+			} else {
+				schemaMap["additionalProperties"] = pruneSchema(schema.AdditionalProperties)
 			}
-		} else {
-			schemaMap["additionalProperties"] = pruneSchema(schema.AdditionalProperties, rawSchema)
 		}
 		if len(schema.Required) != 0 {
 			schemaMap["required"] = schema.Required
@@ -366,7 +359,7 @@ func pruneSchema(schema *jsonschema.Schema, rawSchema map[string]any) map[string
 		for property := schema.Properties.Oldest(); property != nil; property = property.Next() {
 			propName := property.Key
 			prop := property.Value
-			propMap[propName] = pruneSchema(prop, rawSchema)
+			propMap[propName] = pruneSchema(prop)
 		}
 		schemaMap["properties"] = propMap
 	}
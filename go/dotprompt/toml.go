@@ -0,0 +1,78 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package dotprompt
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// decodeTOML decodes TOML frontmatter into v, which must be a pointer to a
+// map[string]any. It is the FrontmatterDecoder for `+++` frontmatter.
+// Integers decode as int64. Arrays of tables decode as []any, and dates and
+// times as strings in their TOML form, as the YAML decoder produces them.
+func decodeTOML(data []byte, v any) error {
+	out, ok := v.(*map[string]any)
+	if !ok {
+		return fmt.Errorf("toml: cannot decode into %T", v)
+	}
+	var decoded map[string]any
+	if _, err := toml.Decode(string(data), &decoded); err != nil {
+		return err
+	}
+	*out = normalizeTOML(decoded).(map[string]any)
+	return nil
+}
+
+// normalizeTOML converts the arrays of tables and dates and times of a
+// decoded TOML value to []any and strings.
+func normalizeTOML(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, item := range v {
+			v[key] = normalizeTOML(item)
+		}
+		return v
+	case []map[string]any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = normalizeTOML(item)
+		}
+		return out
+	case []any:
+		for i, item := range v {
+			v[i] = normalizeTOML(item)
+		}
+		return v
+	case time.Time:
+		// The toml package marks local dates and times with named zones.
+		switch v.Location().String() {
+		case "date-local":
+			return v.Format(time.DateOnly)
+		case "time-local":
+			return v.Format("15:04:05.999999999")
+		case "datetime-local":
+			return v.Format("2006-01-02T15:04:05.999999999")
+		default:
+			return v.Format(time.RFC3339Nano)
+		}
+	default:
+		return value
+	}
+}
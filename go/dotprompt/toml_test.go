@@ -0,0 +1,127 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package dotprompt
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeTOML(t *testing.T) {
+	t.Run("document", func(t *testing.T) {
+		source := `# A prompt.
+model = "vertexai/gemini-1.5-pro"
+description = 'Says "hello"'
+tags = [
+  "greeting", # the main use
+  'demo',
+]
+ext.owner = "team"
+
+[config]
+temperature = 0.5
+maxOutputTokens = 1_024
+stopSequences = ["\n\n", "\u00e9"]
+
+[input.schema]
+"name?" = "string, the name"
+address = { street = "string", "city?" = "string" }
+
+[[examples]]
+name = "Ada"
+
+[[examples]]
+name = """
+Grace
+Hopper"""
+enabled = true
+`
+		var out map[string]any
+		assert.NoError(t, decodeTOML([]byte(source), &out))
+		assert.Equal(t, map[string]any{
+			"model":       "vertexai/gemini-1.5-pro",
+			"description": `Says "hello"`,
+			"tags":        []any{"greeting", "demo"},
+			"ext":         map[string]any{"owner": "team"},
+			"config": map[string]any{
+				"temperature":     0.5,
+				"maxOutputTokens": int64(1024),
+				"stopSequences":   []any{"\n\n", "é"},
+			},
+			"input": map[string]any{
+				"schema": map[string]any{
+					"name?":   "string, the name",
+					"address": map[string]any{"street": "string", "city?": "string"},
+				},
+			},
+			"examples": []any{
+				map[string]any{"name": "Ada"},
+				map[string]any{"name": "Grace\nHopper", "enabled": true},
+			},
+		}, out)
+	})
+
+	t.Run("numbers", func(t *testing.T) {
+		var out map[string]any
+		assert.NoError(t, decodeTOML([]byte("a = -3\nb = 0x1F\nc = 1e3\nd = +inf\ne = 0b101"), &out))
+		assert.Equal(t, int64(-3), out["a"])
+		assert.Equal(t, int64(31), out["b"])
+		assert.Equal(t, 1000.0, out["c"])
+		assert.True(t, math.IsInf(out["d"].(float64), 1))
+		assert.Equal(t, int64(5), out["e"])
+	})
+
+	t.Run("multi-line strings", func(t *testing.T) {
+		var out map[string]any
+		source := "basic = \"\"\"\none \\\n    two\"\"\"\nliteral = '''\nC:\\path\\'''"
+		assert.NoError(t, decodeTOML([]byte(source), &out))
+		assert.Equal(t, "one two", out["basic"])
+		assert.Equal(t, `C:\path\`, out["literal"])
+	})
+
+	t.Run("dates and times", func(t *testing.T) {
+		var out map[string]any
+		source := "released = 1979-05-27T07:32:00-08:00\nday = 1979-05-27\nat = 07:32:00\nlocal = 1979-05-27T07:32:00.5"
+		assert.NoError(t, decodeTOML([]byte(source), &out))
+		assert.Equal(t, map[string]any{
+			"released": "1979-05-27T07:32:00-08:00",
+			"day":      "1979-05-27",
+			"at":       "07:32:00",
+			"local":    "1979-05-27T07:32:00.5",
+		}, out)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		tests := map[string]string{
+			"duplicate key":       "a = 1\na = 2",
+			"missing equals":      "a 1",
+			"unterminated string": "a = \"open",
+			"invalid value":       "a = nope",
+			"trailing content":    "a = 1 b = 2",
+			"table redefines key": "a = 1\n[a]\nb = 2",
+			"unclosed array":      "a = [1, 2",
+		}
+		for name, source := range tests {
+			t.Run(name, func(t *testing.T) {
+				var out map[string]any
+				assert.Error(t, decodeTOML([]byte(source), &out))
+			})
+		}
+	})
+}
@@ -17,6 +17,11 @@
 package dotprompt
 
 import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"unicode/utf8"
+
 	"github.com/invopop/jsonschema"
 )
 
@@ -121,6 +126,8 @@ type PromptMetadata struct {
 	Input PromptMetadataInput `json:"input,omitempty"`
 	// Defines the expected model output format.
 	Output PromptMetadataOutput `json:"output,omitempty"`
+	// Example inputs for the prompt, e.g. for rendering in tests.
+	Examples []map[string]any `json:"examples,omitempty"`
 	// This field will contain the raw frontmatter as parsed with no additional
 	// processing or substitutions. If your implementation requires custom
 	// fields they will be available here.
@@ -138,6 +145,10 @@ type ParsedPrompt struct {
 	PromptMetadata
 	// The source of the template with metadata / frontmatter already removed.
 	Template string `json:"template"`
+	// The path of the file the prompt was loaded from, e.g. by LoadFromFS or
+	// ParseFiles, for use in errors and logs. It is empty for prompts parsed
+	// from a string.
+	SourcePath string `json:"sourcePath,omitempty"`
 }
 
 // Part represents a part of a message content.
@@ -219,6 +230,80 @@ func (p *PendingPart) SetPending(enabled bool) {
 	p.Metadata["pending"] = enabled
 }
 
+// UnmarshalPart reconstructs a part from its JSON form, as produced by
+// json.Marshal for any of the Part types in this package or by
+// ToCanonicalPart. The concrete type is taken from the "type" discriminator
+// if present, and otherwise from the field that is set: "text", "data",
+// "media", "toolRequest", or "toolResponse", checked in that order. An object
+// with only "metadata" is a PendingPart.
+func UnmarshalPart(data []byte) (Part, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("dotprompt: invalid part: %w", err)
+	}
+	if fields == nil {
+		return nil, fmt.Errorf("dotprompt: invalid part: %s", data)
+	}
+
+	var partType string
+	if raw, ok := fields["type"]; ok {
+		if err := json.Unmarshal(raw, &partType); err != nil {
+			return nil, fmt.Errorf("dotprompt: invalid part type: %w", err)
+		}
+	} else {
+		for _, key := range []string{PartTypeText, PartTypeData, PartTypeMedia, PartTypeToolRequest, PartTypeToolResponse} {
+			if _, ok := fields[key]; ok {
+				partType = key
+				break
+			}
+		}
+		if partType == "" {
+			if _, ok := fields["metadata"]; !ok || len(fields) > 1 {
+				return nil, fmt.Errorf("dotprompt: unrecognized part: %s", data)
+			}
+			partType = PartTypePending
+		}
+	}
+
+	var part Part
+	switch partType {
+	case PartTypeText:
+		part = &TextPart{}
+	case PartTypeData:
+		part = &DataPart{}
+	case PartTypeMedia:
+		part = &MediaPart{}
+	case PartTypeToolRequest:
+		part = &ToolRequestPart{}
+	case PartTypeToolResponse:
+		part = &ToolResponsePart{}
+	case PartTypePending:
+		part = &PendingPart{}
+	default:
+		return nil, fmt.Errorf("dotprompt: unsupported part type %q", partType)
+	}
+	if err := json.Unmarshal(data, part); err != nil {
+		return nil, fmt.Errorf("dotprompt: invalid %s part: %w", partType, err)
+	}
+	return part, nil
+}
+
+// unmarshalParts reconstructs each of the parts with UnmarshalPart.
+func unmarshalParts(raw []json.RawMessage) ([]Part, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	parts := make([]Part, len(raw))
+	for i, data := range raw {
+		part, err := UnmarshalPart(data)
+		if err != nil {
+			return nil, err
+		}
+		parts[i] = part
+	}
+	return parts, nil
+}
+
 // Role represents the role of a message in a conversation.
 type Role string
 
@@ -237,12 +322,49 @@ type Message struct {
 	Content []Part `json:"content"`
 }
 
+// UnmarshalJSON decodes a message, reconstructing its content parts with
+// UnmarshalPart.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		HasMetadata
+		Role    Role              `json:"role"`
+		Content []json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	content, err := unmarshalParts(raw.Content)
+	if err != nil {
+		return err
+	}
+	*m = Message{HasMetadata: raw.HasMetadata, Role: raw.Role, Content: content}
+	return nil
+}
+
 // Document represents a document with content parts.
 type Document struct {
 	HasMetadata
 	Content []Part `json:"content"`
 }
 
+// UnmarshalJSON decodes a document, reconstructing its content parts with
+// UnmarshalPart.
+func (d *Document) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		HasMetadata
+		Content []json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	content, err := unmarshalParts(raw.Content)
+	if err != nil {
+		return err
+	}
+	*d = Document{HasMetadata: raw.HasMetadata, Content: content}
+	return nil
+}
+
 // DataArgument provides all of the information necessary to render a template
 // at runtime.
 type DataArgument struct {
@@ -269,6 +391,56 @@ type RenderedPrompt struct {
 	Messages []Message `json:"messages"`
 }
 
+// MediaPartTokenOverhead is the fixed number of tokens EstimateTokens counts
+// for each media part.
+const MediaPartTokenOverhead = 256
+
+// TokenEstimator estimates the number of tokens in a piece of text.
+type TokenEstimator func(text string) int
+
+// EstimateTokensByChars is the default TokenEstimator, which assumes roughly
+// four characters per token.
+func EstimateTokensByChars(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// EstimateTokens returns an approximate token count for the rendered messages
+// by summing the estimates for all text parts and adding
+// MediaPartTokenOverhead for each media part. If estimator is nil,
+// EstimateTokensByChars is used.
+func (r *RenderedPrompt) EstimateTokens(estimator TokenEstimator) int {
+	if estimator == nil {
+		estimator = EstimateTokensByChars
+	}
+	total := 0
+	for _, msg := range r.Messages {
+		for _, part := range msg.Content {
+			switch p := part.(type) {
+			case *TextPart:
+				total += estimator(p.Text)
+			case *MediaPart:
+				total += MediaPartTokenOverhead
+			}
+		}
+	}
+	return total
+}
+
+// MediaURLs returns the URLs of the media parts in the rendered messages in
+// order of first appearance, without duplicates, e.g. to prefetch the media or
+// audit access to it.
+func (r *RenderedPrompt) MediaURLs() []string {
+	urls := []string{}
+	for _, msg := range r.Messages {
+		for _, part := range msg.Content {
+			if p, ok := part.(*MediaPart); ok && !slices.Contains(urls, p.Media.URL) {
+				urls = append(urls, p.Media.URL)
+			}
+		}
+	}
+	return urls
+}
+
 // PromptFunction is a function that takes runtime data/context and returns a
 // rendered prompt.
 type PromptFunction func(data *DataArgument, options *PromptMetadata) (RenderedPrompt, error)
@@ -369,3 +541,31 @@ type PromptBundle struct {
 	Partials []PartialData `json:"partials"`
 	Prompts  []PromptData  `json:"prompts"`
 }
+
+// InputSchemaJSON marshals the input schema to a standalone JSON Schema
+// document with a `$schema` declaration, e.g. for generating forms or
+// validators. The schema is typically already resolved to a
+// *jsonschema.Schema by RenderMetadata; any other value is converted with
+// Picoschema first, so named schema references must have been resolved.
+func (m *PromptMetadata) InputSchemaJSON() ([]byte, error) {
+	var schema *jsonschema.Schema
+	switch s := m.Input.Schema.(type) {
+	case nil:
+		return nil, fmt.Errorf("dotprompt: prompt has no input schema")
+	case *jsonschema.Schema:
+		if s == nil {
+			return nil, fmt.Errorf("dotprompt: prompt has no input schema")
+		}
+		schema = createCopy(s)
+	default:
+		parsed, err := Picoschema(s, &PicoschemaOptions{})
+		if err != nil {
+			return nil, err
+		}
+		schema = parsed
+	}
+	if schema.Version == "" {
+		schema.Version = jsonschema.Version
+	}
+	return json.Marshal(schema)
+}
@@ -17,8 +17,11 @@
 package dotprompt
 
 import (
+	"encoding/json"
+	"strings"
 	"testing"
 
+	"github.com/invopop/jsonschema"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -490,6 +493,59 @@ func TestRenderedPrompt(t *testing.T) {
 	})
 }
 
+func TestRenderedPromptEstimateTokens(t *testing.T) {
+	short := RenderedPrompt{
+		Messages: []Message{
+			{Role: RoleUser, Content: []Part{&TextPart{Text: "Hello there"}}},
+		},
+	}
+	long := RenderedPrompt{
+		Messages: []Message{
+			{Role: RoleSystem, Content: []Part{&TextPart{Text: strings.Repeat("You are helpful. ", 50)}}},
+			{Role: RoleUser, Content: []Part{&TextPart{Text: strings.Repeat("Tell me more. ", 100)}}},
+		},
+	}
+
+	t.Run("uses the default estimator when nil", func(t *testing.T) {
+		assert.Equal(t, 3, short.EstimateTokens(nil))
+		assert.Equal(t, (850+3)/4+(1400+3)/4, long.EstimateTokens(nil))
+		assert.Greater(t, long.EstimateTokens(nil), short.EstimateTokens(nil))
+	})
+
+	t.Run("uses a custom estimator", func(t *testing.T) {
+		words := func(text string) int { return len(strings.Fields(text)) }
+		assert.Equal(t, 2, short.EstimateTokens(words))
+		assert.Equal(t, 450, long.EstimateTokens(words))
+	})
+
+	t.Run("adds overhead for media parts", func(t *testing.T) {
+		withMedia := RenderedPrompt{
+			Messages: []Message{
+				{Role: RoleUser, Content: []Part{
+					&TextPart{Text: "Hello there"},
+					&MediaPart{Media: Media{URL: "https://example.com/image.png"}},
+				}},
+			},
+		}
+		assert.Equal(t, short.EstimateTokens(nil)+MediaPartTokenOverhead, withMedia.EstimateTokens(nil))
+	})
+}
+
+func TestRenderedPromptMediaURLs(t *testing.T) {
+	dp := NewDotprompt(nil)
+	source := `{{role "system"}}Compare the images.` +
+		`{{role "user"}}{{media url="https://example.com/a.png"}}{{media url="https://example.com/b.png"}}` +
+		`{{role "model"}}The first one.{{role "user"}}Look again at {{media url="https://example.com/a.png"}}`
+	rendered, err := dp.Render(source, &DataArgument{}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"https://example.com/a.png", "https://example.com/b.png"}, rendered.MediaURLs())
+
+	t.Run("no media", func(t *testing.T) {
+		rendered := RenderedPrompt{Messages: []Message{{Role: RoleUser, Content: []Part{&TextPart{Text: "Hi"}}}}}
+		assert.Empty(t, rendered.MediaURLs())
+	})
+}
+
 func TestPromptBundle(t *testing.T) {
 	t.Run("test PromptBundle creation and access", func(t *testing.T) {
 		bundle := PromptBundle{
@@ -519,3 +575,127 @@ func TestPromptBundle(t *testing.T) {
 		assert.Equal(t, "Prompt content", bundle.Prompts[0].Source)
 	})
 }
+
+func TestInputSchemaJSON(t *testing.T) {
+	t.Run("marshals a resolved Picoschema input schema", func(t *testing.T) {
+		dp := NewDotprompt(nil)
+		meta, err := dp.RenderMetadata(`---
+input:
+  schema:
+    name: string, the user's name
+    age?: integer
+    tags(array): string
+---
+Hello {{name}}`, nil)
+		assert.NoError(t, err)
+
+		data, err := meta.InputSchemaJSON()
+		assert.NoError(t, err)
+
+		var doc map[string]any
+		assert.NoError(t, json.Unmarshal(data, &doc))
+		assert.Equal(t, "https://json-schema.org/draft/2020-12/schema", doc["$schema"])
+		assert.Equal(t, "object", doc["type"])
+		assert.Equal(t, []any{"name", "tags"}, doc["required"])
+
+		properties := doc["properties"].(map[string]any)
+		assert.Len(t, properties, 3)
+		assert.Equal(t, map[string]any{"type": "string", "description": "the user's name"}, properties["name"])
+		assert.Equal(t, "array", properties["tags"].(map[string]any)["type"])
+		assert.Contains(t, properties, "age")
+	})
+
+	t.Run("converts unresolved Picoschema", func(t *testing.T) {
+		meta := &PromptMetadata{Input: PromptMetadataInput{Schema: map[string]any{"q": "string"}}}
+		data, err := meta.InputSchemaJSON()
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{
+			"$schema": "https://json-schema.org/draft/2020-12/schema",
+			"type": "object",
+			"properties": {"q": {"type": "string"}},
+			"required": ["q"],
+			"additionalProperties": false
+		}`, string(data))
+	})
+
+	t.Run("keeps definitions", func(t *testing.T) {
+		meta := &PromptMetadata{Input: PromptMetadataInput{Schema: &jsonschema.Schema{
+			Ref: "#/$defs/Item",
+			Definitions: jsonschema.Definitions{
+				"Item": {Type: "string"},
+			},
+		}}}
+		data, err := meta.InputSchemaJSON()
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{
+			"$schema": "https://json-schema.org/draft/2020-12/schema",
+			"$ref": "#/$defs/Item",
+			"$defs": {"Item": {"type": "string"}}
+		}`, string(data))
+	})
+
+	t.Run("errors without an input schema", func(t *testing.T) {
+		_, err := (&PromptMetadata{}).InputSchemaJSON()
+		assert.Error(t, err)
+	})
+}
+
+func TestUnmarshalPart(t *testing.T) {
+	parts := []Part{
+		&TextPart{Text: "Hello", HasMetadata: HasMetadata{Metadata: Metadata{"purpose": "history"}}},
+		&TextPart{Text: ""},
+		&DataPart{Data: map[string]any{"answer": 42.0}},
+		&MediaPart{Media: Media{URL: "https://example.com/a.png", ContentType: "image/png"}},
+		&ToolRequestPart{ToolRequest: map[string]any{"name": "search"}},
+		&ToolResponsePart{ToolResponse: map[string]any{"name": "search", "output": "ok"}},
+		NewPendingPart(),
+	}
+
+	t.Run("round-trips every part type", func(t *testing.T) {
+		for _, part := range parts {
+			data, err := json.Marshal(part)
+			assert.NoError(t, err)
+			got, err := UnmarshalPart(data)
+			assert.NoError(t, err)
+			assert.Equal(t, part, got)
+		}
+	})
+
+	t.Run("accepts the canonical form", func(t *testing.T) {
+		for _, part := range parts {
+			canonical, err := ToCanonicalPart(part)
+			assert.NoError(t, err)
+			data, err := json.Marshal(canonical)
+			assert.NoError(t, err)
+			got, err := UnmarshalPart(data)
+			assert.NoError(t, err)
+			assert.IsType(t, part, got)
+		}
+	})
+
+	t.Run("round-trips messages and documents", func(t *testing.T) {
+		messages := []Message{
+			{Role: RoleUser, Content: parts},
+			{Role: RoleModel, Content: []Part{&TextPart{Text: "Hi"}}, HasMetadata: HasMetadata{Metadata: Metadata{"a": "b"}}},
+		}
+		data, err := json.Marshal(messages)
+		assert.NoError(t, err)
+		var got []Message
+		assert.NoError(t, json.Unmarshal(data, &got))
+		assert.Equal(t, messages, got)
+
+		doc := Document{Content: parts[:3]}
+		data, err = json.Marshal(doc)
+		assert.NoError(t, err)
+		var gotDoc Document
+		assert.NoError(t, json.Unmarshal(data, &gotDoc))
+		assert.Equal(t, doc, gotDoc)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for _, data := range []string{`{}`, `{"foo": 1}`, `"text"`, `null`, `{"type": "video"}`, `{"text": 1}`} {
+			_, err := UnmarshalPart([]byte(data))
+			assert.Error(t, err, data)
+		}
+	})
+}
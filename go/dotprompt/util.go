@@ -19,6 +19,7 @@ package dotprompt
 import (
 	"encoding/json"
 	"fmt"
+	"slices"
 	"strings"
 	"unicode"
 
@@ -57,6 +58,40 @@ func copyMapping[K comparable, V any](mapping map[K]V) map[K]V {
 	return newMapping
 }
 
+// deepCopyMap copies a map and, recursively, the maps and slices it contains.
+func deepCopyMap(mapping map[string]any) map[string]any {
+	if mapping == nil {
+		return nil
+	}
+	newMapping := make(map[string]any, len(mapping))
+	for k, v := range mapping {
+		newMapping[k] = deepCopyValue(v)
+	}
+	return newMapping
+}
+
+// deepCopyValue copies maps, slices, and schemas, such as those decoded from
+// frontmatter, and returns other values as they are.
+func deepCopyValue(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		return deepCopyMap(v)
+	case []any:
+		newSlice := make([]any, len(v))
+		for i, item := range v {
+			newSlice[i] = deepCopyValue(item)
+		}
+		return newSlice
+	case *jsonschema.Schema:
+		if v == nil {
+			return v
+		}
+		return createCopy(v)
+	default:
+		return value
+	}
+}
+
 // MergeMaps merges two map[string]any objects and handles nil maps.
 func MergeMaps(map1, map2 map[string]any) map[string]any {
 	// If map1 is nil, initialize it as an empty map
@@ -75,6 +110,114 @@ func MergeMaps(map1, map2 map[string]any) map[string]any {
 	return map1
 }
 
+// deepMergeMaps returns a new map with the entries of override merged over
+// those of base, recursing into values that are maps in both. Neither map is
+// modified, and the result is nil if both are.
+func deepMergeMaps[M ~map[string]any](base, override M) M {
+	if base == nil && override == nil {
+		return nil
+	}
+	out := MergeMaps(maps.Clone(base), override)
+	for key, value := range override {
+		baseMap, baseOK := base[key].(map[string]any)
+		overrideMap, overrideOK := value.(map[string]any)
+		if baseOK && overrideOK {
+			out[key] = deepMergeMaps(baseMap, overrideMap)
+		}
+	}
+	return out
+}
+
+// canonicalizeValue recursively converts decoded values into a canonical form
+// that marshals deterministically: maps of any key type become
+// map[string]any (keys formatted with fmt.Sprint) and slices become []any.
+func canonicalizeValue(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, val := range v {
+			out[k] = canonicalizeValue(val)
+		}
+		return out
+	case Metadata:
+		return canonicalizeValue(map[string]any(v))
+	case map[any]any:
+		out := make(map[string]any, len(v))
+		for k, val := range v {
+			out[fmt.Sprint(k)] = canonicalizeValue(val)
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, val := range v {
+			out[i] = canonicalizeValue(val)
+		}
+		return out
+	default:
+		return value
+	}
+}
+
+// canonicalizeMetadata returns a canonical copy of the metadata, or nil if
+// the metadata is nil.
+func canonicalizeMetadata(metadata Metadata) Metadata {
+	if metadata == nil {
+		return nil
+	}
+	return Metadata(canonicalizeValue(map[string]any(metadata)).(map[string]any))
+}
+
+// canonicalizePartsMetadata returns a copy of the parts with the metadata of
+// each part in canonical form. Parts are copied rather than modified, since
+// they may be shared with the caller's history.
+func canonicalizePartsMetadata(parts []Part) []Part {
+	if parts == nil {
+		return nil
+	}
+	out := make([]Part, len(parts))
+	for i, part := range parts {
+		out[i] = canonicalizePartMetadata(part)
+	}
+	return out
+}
+
+// canonicalizePartMetadata returns a copy of the part with its metadata in
+// canonical form. Parts without metadata are returned as is.
+func canonicalizePartMetadata(part Part) Part {
+	if part == nil || part.GetMetadata() == nil {
+		return part
+	}
+	metadata := HasMetadata{Metadata: canonicalizeMetadata(part.GetMetadata())}
+	switch p := part.(type) {
+	case *TextPart:
+		out := *p
+		out.HasMetadata = metadata
+		return &out
+	case *DataPart:
+		out := *p
+		out.HasMetadata = metadata
+		return &out
+	case *MediaPart:
+		out := *p
+		out.HasMetadata = metadata
+		return &out
+	case *ToolRequestPart:
+		out := *p
+		out.HasMetadata = metadata
+		return &out
+	case *ToolResponsePart:
+		out := *p
+		out.HasMetadata = metadata
+		return &out
+	case *PendingPart:
+		out := *p
+		out.HasMetadata = metadata
+		return &out
+	default:
+		return part
+	}
+}
+
 // trimUnicodeSpacesExceptNewlines trims all Unicode space characters except newlines.
 func trimUnicodeSpacesExceptNewlines(s string) string {
 	var result strings.Builder
@@ -91,6 +234,90 @@ func trimUnicodeSpacesExceptNewlines(s string) string {
 	})
 }
 
+// collapseBlankLines reduces runs of consecutive empty lines to a single empty
+// line, so that three or more consecutive newlines become two. Lines inside
+// fenced code blocks (delimited by ``` or ~~~) are left untouched.
+func collapseBlankLines(s string) string {
+	lines := strings.Split(s, "\n")
+	out := make([]string, 0, len(lines))
+	inFence := false
+	blank := false
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			inFence = !inFence
+		}
+		isBlank := line == "" || line == "\r"
+		if isBlank && blank && !inFence {
+			continue
+		}
+		blank = isBlank
+		out = append(out, line)
+	}
+	return strings.Join(out, "\n")
+}
+
+// stripTrailingWhitespace removes trailing spaces and tabs from each line,
+// preserving leading indentation and line endings.
+func stripTrailingWhitespace(s string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		trimmed, hasCR := strings.CutSuffix(line, "\r")
+		trimmed = strings.TrimRight(trimmed, " \t")
+		if hasCR {
+			trimmed += "\r"
+		}
+		lines[i] = trimmed
+	}
+	return strings.Join(lines, "\n")
+}
+
+// trimMessageWhitespace returns the messages with leading and trailing
+// whitespace, including newlines, trimmed from the start of the first part and
+// the end of the last part of each message when they are text. Whitespace
+// within a message, such as newlines between paragraphs or around media, is
+// preserved. History messages are left as given, and text parts that become
+// empty are dropped.
+func trimMessageWhitespace(messages []Message) []Message {
+	for i, msg := range messages {
+		if msg.Metadata["purpose"] == "history" {
+			continue
+		}
+		content := slices.Clone(msg.Content)
+		if text, ok := firstPart(content).(*TextPart); ok {
+			trimmed := *text
+			trimmed.Text = strings.TrimLeftFunc(text.Text, unicode.IsSpace)
+			content[0] = &trimmed
+		}
+		if text, ok := lastPart(content).(*TextPart); ok {
+			trimmed := *text
+			trimmed.Text = strings.TrimRightFunc(text.Text, unicode.IsSpace)
+			content[len(content)-1] = &trimmed
+		}
+		messages[i].Content = slices.DeleteFunc(content, func(part Part) bool {
+			text, ok := part.(*TextPart)
+			return ok && text.Text == ""
+		})
+	}
+	return messages
+}
+
+// firstPart returns the first part, or nil if there are none.
+func firstPart(parts []Part) Part {
+	if len(parts) == 0 {
+		return nil
+	}
+	return parts[0]
+}
+
+// lastPart returns the last part, or nil if there are none.
+func lastPart(parts []Part) Part {
+	if len(parts) == 0 {
+		return nil
+	}
+	return parts[len(parts)-1]
+}
+
 // createDeepCopy creates a copy of a *jsonschema.Schema object.
 func createCopy(obj *jsonschema.Schema) *jsonschema.Schema {
 	// Marshal the original object to JSON
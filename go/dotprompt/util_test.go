@@ -131,6 +131,44 @@ func TestTrimUnicodeSpacesExceptNewlines(t *testing.T) {
 		assert.Equal(t, test.expected, result)
 	}
 }
+func TestCollapseBlankLines(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"a\nb", "a\nb"},
+		{"a\n\nb", "a\n\nb"},
+		{"a\n\n\nb", "a\n\nb"},
+		{"a\n\n\n\n\nb\n\n\nc", "a\n\nb\n\nc"},
+		{"a\r\n\r\n\r\nb", "a\r\n\r\nb"},
+		{"```\na\n\n\n\nb\n```\n\n\nc", "```\na\n\n\n\nb\n```\n\nc"},
+		{"~~~\n\n\n\n~~~", "~~~\n\n\n\n~~~"},
+	}
+
+	for _, test := range tests {
+		result := collapseBlankLines(test.input)
+		assert.Equal(t, test.expected, result)
+	}
+}
+
+func TestStripTrailingWhitespace(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"a  \nb\t\n", "a\nb\n"},
+		{"  indented  \n\tkey: value \t", "  indented\n\tkey: value"},
+		{"a \r\nb", "a\r\nb"},
+		{"   \n\n", "\n\n"},
+		{"no trailing", "no trailing"},
+	}
+
+	for _, test := range tests {
+		result := stripTrailingWhitespace(test.input)
+		assert.Equal(t, test.expected, result)
+	}
+}
+
 func TestCreateCopy(t *testing.T) {
 	properties := orderedmap.New[string, *jsonschema.Schema]()
 	properties.Set("property1", &jsonschema.Schema{Type: "string"})
@@ -0,0 +1,333 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package dotprompt
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/invopop/jsonschema"
+)
+
+// ValidateJSONSchema validates a value against a JSON schema. The value is
+// first converted to its JSON form, so structs and typed maps and slices are
+// validated as they would be serialized.
+//
+// The keywords Picoschema produces are supported: type, enum, const,
+// properties, required, additionalProperties, items, prefixItems, anyOf,
+// allOf, oneOf, not, minimum, maximum, exclusiveMinimum, exclusiveMaximum,
+// minLength, maxLength, pattern, format, minItems, and maxItems, along with
+// boolean schemas. The formats date-time, date, time, email, uri, uuid, ipv4,
+// and ipv6 are checked; other formats are ignored. A type alongside an anyOf
+// allowing null, as Picoschema produces for optional properties, is treated
+// as nullable. `$ref` is an error, and other keywords are ignored.
+func ValidateJSONSchema(value any, schema *jsonschema.Schema) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("dotprompt: failed to convert value to JSON: %w", err)
+	}
+	var normalized any
+	if err := json.Unmarshal(data, &normalized); err != nil {
+		return fmt.Errorf("dotprompt: failed to convert value to JSON: %w", err)
+	}
+	return validateSchemaValue(normalized, schema, "")
+}
+
+// validateSchemaValue validates a JSON-decoded value against the schema. The
+// path locates the value in error messages.
+func validateSchemaValue(value any, schema *jsonschema.Schema, path string) error {
+	if schema == nil {
+		return nil
+	}
+	if allowed, ok := booleanSchema(schema); ok {
+		if !allowed {
+			return schemaError(path, "no value is allowed")
+		}
+		return nil
+	}
+	if schema.Ref != "" {
+		return schemaError(path, "$ref '%s' is not supported", schema.Ref)
+	}
+
+	if schema.Type != "" && !matchesType(value, schema.Type) && !(value == nil && allowsNull(schema.AnyOf)) {
+		return schemaError(path, "expected %s, got %s", schema.Type, jsonTypeOf(value))
+	}
+	if schema.Enum != nil && !slices.ContainsFunc(schema.Enum, func(allowed any) bool { return jsonEqual(value, allowed) }) {
+		return schemaError(path, "value %v is not one of %v", value, schema.Enum)
+	}
+	if schema.Const != nil && !jsonEqual(value, schema.Const) {
+		return schemaError(path, "value %v is not %v", value, schema.Const)
+	}
+
+	for _, sub := range schema.AllOf {
+		if err := validateSchemaValue(value, sub, path); err != nil {
+			return err
+		}
+	}
+	if len(schema.AnyOf) > 0 && countMatches(value, schema.AnyOf, path) == 0 {
+		return schemaError(path, "value does not match any of the allowed schemas")
+	}
+	if len(schema.OneOf) > 0 && countMatches(value, schema.OneOf, path) != 1 {
+		return schemaError(path, "value does not match exactly one of the allowed schemas")
+	}
+	if schema.Not != nil && validateSchemaValue(value, schema.Not, path) == nil {
+		return schemaError(path, "value matches a disallowed schema")
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		return validateObject(v, schema, path)
+	case []any:
+		return validateArray(v, schema, path)
+	case string:
+		return validateString(v, schema, path)
+	case float64:
+		return validateNumber(v, schema, path)
+	}
+	return nil
+}
+
+// validateArray validates the length and items of an array. Items beyond the
+// prefixItems are validated against items.
+func validateArray(array []any, schema *jsonschema.Schema, path string) error {
+	if schema.MinItems != nil && uint64(len(array)) < *schema.MinItems {
+		return schemaError(path, "expected at least %d items, got %d", *schema.MinItems, len(array))
+	}
+	if schema.MaxItems != nil && uint64(len(array)) > *schema.MaxItems {
+		return schemaError(path, "expected at most %d items, got %d", *schema.MaxItems, len(array))
+	}
+	for i, item := range array {
+		itemSchema := schema.Items
+		if i < len(schema.PrefixItems) {
+			itemSchema = schema.PrefixItems[i]
+		}
+		if err := validateSchemaValue(item, itemSchema, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateString validates the length, pattern, and format of a string.
+func validateString(s string, schema *jsonschema.Schema, path string) error {
+	length := uint64(utf8.RuneCountInString(s))
+	if schema.MinLength != nil && length < *schema.MinLength {
+		return schemaError(path, "expected at least %d characters, got %d", *schema.MinLength, length)
+	}
+	if schema.MaxLength != nil && length > *schema.MaxLength {
+		return schemaError(path, "expected at most %d characters, got %d", *schema.MaxLength, length)
+	}
+	if schema.Pattern != "" {
+		pattern, err := regexp.Compile(schema.Pattern)
+		if err != nil {
+			return schemaError(path, "invalid pattern '%s': %v", schema.Pattern, err)
+		}
+		if !pattern.MatchString(s) {
+			return schemaError(path, "value %q does not match pattern '%s'", s, schema.Pattern)
+		}
+	}
+	if check, ok := formatCheckers[schema.Format]; ok && !check(s) {
+		return schemaError(path, "value %q is not a valid %s", s, schema.Format)
+	}
+	return nil
+}
+
+// uuidRegex matches a UUID in its canonical hyphenated form.
+var uuidRegex = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// formatCheckers report whether a string is valid in a format.
+var formatCheckers = map[string]func(string) bool{
+	"date-time": func(s string) bool {
+		_, err := time.Parse(time.RFC3339, s)
+		return err == nil
+	},
+	"date": func(s string) bool {
+		_, err := time.Parse(time.DateOnly, s)
+		return err == nil
+	},
+	"time": func(s string) bool {
+		_, err := time.Parse("15:04:05Z07:00", s)
+		return err == nil
+	},
+	"email": func(s string) bool {
+		address, err := mail.ParseAddress(s)
+		return err == nil && address.Address == s
+	},
+	"uri": func(s string) bool {
+		u, err := url.Parse(s)
+		return err == nil && u.Scheme != ""
+	},
+	"uuid": uuidRegex.MatchString,
+	"ipv4": func(s string) bool {
+		ip := net.ParseIP(s)
+		return ip != nil && !strings.Contains(s, ":")
+	},
+	"ipv6": func(s string) bool {
+		return net.ParseIP(s) != nil && strings.Contains(s, ":")
+	},
+}
+
+// validateNumber validates the bounds of a number.
+func validateNumber(n float64, schema *jsonschema.Schema, path string) error {
+	bounds := []struct {
+		bound     json.Number
+		violated  func(n, bound float64) bool
+		condition string
+	}{
+		{schema.Minimum, func(n, b float64) bool { return n < b }, "at least"},
+		{schema.ExclusiveMinimum, func(n, b float64) bool { return n <= b }, "greater than"},
+		{schema.Maximum, func(n, b float64) bool { return n > b }, "at most"},
+		{schema.ExclusiveMaximum, func(n, b float64) bool { return n >= b }, "less than"},
+	}
+	for _, b := range bounds {
+		if b.bound == "" {
+			continue
+		}
+		bound, err := b.bound.Float64()
+		if err != nil {
+			return schemaError(path, "invalid bound '%s'", b.bound)
+		}
+		if b.violated(n, bound) {
+			return schemaError(path, "expected a value %s %s, got %v", b.condition, b.bound, n)
+		}
+	}
+	return nil
+}
+
+// validateObject validates the properties of an object.
+func validateObject(object map[string]any, schema *jsonschema.Schema, path string) error {
+	for _, name := range schema.Required {
+		if _, ok := object[name]; !ok {
+			return schemaError(path, "missing required property '%s'", name)
+		}
+	}
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		propertyPath := key
+		if path != "" {
+			propertyPath = path + "." + key
+		}
+		var propertySchema *jsonschema.Schema
+		if schema.Properties != nil {
+			propertySchema, _ = schema.Properties.Get(key)
+		}
+		if propertySchema == nil {
+			propertySchema = schema.AdditionalProperties
+		}
+		if err := validateSchemaValue(object[key], propertySchema, propertyPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countMatches returns the number of schemas the value matches.
+func countMatches(value any, schemas []*jsonschema.Schema, path string) int {
+	matches := 0
+	for _, sub := range schemas {
+		if validateSchemaValue(value, sub, path) == nil {
+			matches++
+		}
+	}
+	return matches
+}
+
+// allowsNull reports whether one of the schemas is the null type.
+func allowsNull(schemas []*jsonschema.Schema) bool {
+	return slices.ContainsFunc(schemas, func(s *jsonschema.Schema) bool { return s != nil && s.Type == "null" })
+}
+
+// booleanSchema reports whether the schema is the boolean schema `true` or
+// `false`, and if so, which. Decoded boolean schemas are copies of
+// jsonschema.TrueSchema or jsonschema.FalseSchema.
+func booleanSchema(schema *jsonschema.Schema) (bool, bool) {
+	switch {
+	case schema == jsonschema.TrueSchema || reflect.DeepEqual(schema, jsonschema.TrueSchema):
+		return true, true
+	case schema == jsonschema.FalseSchema || reflect.DeepEqual(schema, jsonschema.FalseSchema):
+		return false, true
+	default:
+		return false, false
+	}
+}
+
+// matchesType reports whether a JSON-decoded value is of the JSON schema
+// type. The type "any" matches every value.
+func matchesType(value any, typeName string) bool {
+	switch typeName {
+	case "any":
+		return true
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == math.Trunc(n)
+	default:
+		return jsonTypeOf(value) == typeName
+	}
+}
+
+// jsonTypeOf returns the JSON schema type of a JSON-decoded value.
+func jsonTypeOf(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// jsonEqual reports whether two values have the same JSON form.
+func jsonEqual(a, b any) bool {
+	if reflect.DeepEqual(a, b) {
+		return true
+	}
+	dataA, errA := json.Marshal(a)
+	dataB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(dataA) == string(dataB)
+}
+
+// schemaError returns a validation error for the value at the path.
+func schemaError(path string, format string, args ...any) error {
+	message := fmt.Sprintf(format, args...)
+	if path == "" {
+		return fmt.Errorf("%s", message)
+	}
+	return fmt.Errorf("%s: %s", path, message)
+}
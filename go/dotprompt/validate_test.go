@@ -0,0 +1,117 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package dotprompt
+
+import (
+	"testing"
+
+	"github.com/invopop/jsonschema"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateJSONSchema(t *testing.T) {
+	schema, err := Picoschema(map[string]any{
+		"name":             "string",
+		"age?":             "integer",
+		"tags?(array)":     "string",
+		"status(enum)":     []any{"active", "inactive"},
+		"address?(object)": map[string]any{"city": "string"},
+		"(*)":              "number",
+	}, &PicoschemaOptions{})
+	assert.NoError(t, err)
+
+	t.Run("valid values", func(t *testing.T) {
+		values := []any{
+			map[string]any{"name": "Ada", "status": "active"},
+			map[string]any{"name": "Ada", "status": "inactive", "age": 36, "tags": []string{"math"}, "address": map[string]any{"city": "London"}, "score": 1.5},
+			map[string]any{"name": "Ada", "status": "active", "age": nil, "tags": nil},
+		}
+		for _, value := range values {
+			assert.NoError(t, ValidateJSONSchema(value, schema))
+		}
+	})
+
+	t.Run("invalid values", func(t *testing.T) {
+		tests := []struct {
+			name  string
+			value any
+			err   string
+		}{
+			{"not an object", "Ada", "expected object, got string"},
+			{"missing required", map[string]any{"status": "active"}, "missing required property 'name'"},
+			{"wrong type", map[string]any{"name": 1, "status": "active"}, "name: expected string, got number"},
+			{"fractional integer", map[string]any{"name": "Ada", "status": "active", "age": 1.5}, "age: expected integer, got number"},
+			{"enum", map[string]any{"name": "Ada", "status": "gone"}, "status: value gone is not one of [active inactive]"},
+			{"array item", map[string]any{"name": "Ada", "status": "active", "tags": []any{"a", 2}}, "tags[1]: expected string, got number"},
+			{"nested", map[string]any{"name": "Ada", "status": "active", "address": map[string]any{}}, "address: value does not match any of the allowed schemas"},
+			{"additional property", map[string]any{"name": "Ada", "status": "active", "extra": "x"}, "extra: expected number, got string"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				assert.EqualError(t, ValidateJSONSchema(tt.value, schema), tt.err)
+			})
+		}
+	})
+
+	t.Run("closed object", func(t *testing.T) {
+		closed := &jsonschema.Schema{Type: "object", AdditionalProperties: jsonschema.FalseSchema}
+		assert.NoError(t, ValidateJSONSchema(map[string]any{}, closed))
+		assert.EqualError(t, ValidateJSONSchema(map[string]any{"a": 1}, closed), "a: no value is allowed")
+	})
+
+	t.Run("tuples", func(t *testing.T) {
+		tuple, err := Picoschema(map[string]any{"location(tuple)": []any{"number", "string"}}, &PicoschemaOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, ValidateJSONSchema(map[string]any{"location": []any{51.5, "London"}}, tuple))
+		assert.EqualError(t, ValidateJSONSchema(map[string]any{"location": []any{"London", 51.5}}, tuple),
+			"location[0]: expected number, got string")
+		assert.EqualError(t, ValidateJSONSchema(map[string]any{"location": []any{51.5, "London", 1}}, tuple),
+			"location[2]: no value is allowed")
+	})
+
+	t.Run("bounds, patterns, and formats", func(t *testing.T) {
+		annotated, err := Picoschema(map[string]any{
+			"age?(integer, 0..120)":              nil,
+			"code?(string, pattern=^[A-Z]{3}$)":  nil,
+			"email?(string, format=email)":       nil,
+			"when?(string, format=date-time)":    nil,
+			"label?(string, format=custom-kind)": nil,
+		}, &PicoschemaOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, ValidateJSONSchema(map[string]any{
+			"age": 120, "code": "ABC", "email": "ada@example.com", "when": "2025-01-02T03:04:05Z", "label": "anything",
+		}, annotated))
+
+		tests := []struct {
+			value map[string]any
+			err   string
+		}{
+			{map[string]any{"age": -1}, "age: expected a value at least 0, got -1"},
+			{map[string]any{"age": 121}, "age: expected a value at most 120, got 121"},
+			{map[string]any{"code": "abc"}, `code: value "abc" does not match pattern '^[A-Z]{3}$'`},
+			{map[string]any{"email": "ada"}, `email: value "ada" is not a valid email`},
+			{map[string]any{"when": "yesterday"}, `when: value "yesterday" is not a valid date-time`},
+		}
+		for _, tt := range tests {
+			assert.EqualError(t, ValidateJSONSchema(tt.value, annotated), tt.err)
+		}
+	})
+
+	t.Run("ref", func(t *testing.T) {
+		assert.ErrorContains(t, ValidateJSONSchema("x", &jsonschema.Schema{Ref: "#/$defs/Foo"}), "not supported")
+	})
+}